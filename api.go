@@ -0,0 +1,303 @@
+/* LimitServer配额管理JSON API，供自动化脚本使用:
+** 1. GET    /api/v1/buckets                          列出所有桶配额
+** 2. GET    /api/v1/buckets/{name}/quota/{warn|limit} 获取桶配额
+** 3. PUT    /api/v1/buckets/{name}/quota/{warn|limit} 设置桶配额
+** 4. POST   /api/v1/buckets/{name}/quota/{warn|limit} 新建桶配额，已存在时失败
+** 5. DELETE /api/v1/buckets/{name}/quota/{warn|limit} 删除桶配额
+** 6. DELETE /api/v1/buckets/{name}                    删除桶的全部配额
+** 7. GET    /api/v1/buckets/{name}/history            获取桶配额修改历史
+** 8. POST   /api/v1/buckets/{name}/history/{rev}/rollback 回滚桶配额至版本rev
+** 9. GET|PUT|DELETE /api/v1/buckets/{name}/boost      查看、设置、取消临时提额
+** 10. POST  /api/v1/buckets/{name}/simulate           在历史数据上模拟拟设置的限速配额
+** 11. GET|PUT|DELETE /api/v1/buckets/{name}/block      查看封禁状态、封禁、解除封禁，立即生效不需要审批
+** 大幅降低或删除限速配额需要审批时返回202和待审批变更，审批接口见/api/v1/approvals
+** 请求需通过HTTP Basic Auth携带管理员账号，出错时返回ApiError
+*/
+
+package main
+
+import (
+    "fmt"
+    "strings"
+    "net/url"
+    "net/http"
+    "encoding/json"
+)
+
+
+// API出错时返回的结构化错误信息
+type ApiError struct {
+    Code     string
+    Message  string
+}
+
+
+// 桶的全部配额，Warn为报警配额，Limit为限速配额
+type BucketQuotaInfo struct {
+    BucketName  string
+    Warn        *BucketQuota
+    Limit       *BucketQuota
+}
+
+
+// 将@v以json格式写回客户端
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+    b, err := json.Marshal(v)
+    if err != nil {
+        GErrorLogger.Error("json Marshal api response failed: [%s]", err)
+        status = http.StatusInternalServerError
+        b = []byte(`{"Code":"InternalError","Message":"marshal response failed"}`)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(b)
+}
+
+
+func writeApiError(w http.ResponseWriter, status int, code string, msg string) {
+    writeJson(w, status, ApiError{Code: code, Message: msg})
+}
+
+
+// 配额写入存储失败，修改已撤销
+func writeSaveError(w http.ResponseWriter, err error) {
+    writeApiError(w, http.StatusInternalServerError, "SaveQuotaFailed", saveErrMsg(err))
+}
+
+
+// 提交待审批变更@p的响应，成功时返回202和待审批变更，@err为保存待审批变更失败的原因
+func writePending(w http.ResponseWriter, p *PendingChange, err error) {
+    if err != nil {
+        writeSaveError(w, err)
+        return
+    }
+    writeJson(w, http.StatusAccepted, p)
+}
+
+
+// 管理员身份检查，返回管理员用户名，检查失败时已经写回错误信息
+func apiAuth(w http.ResponseWriter, r *http.Request) (string, bool) {
+    user, passwd, ok := r.BasicAuth()
+    if !ok || user == "" || passwd == "" {
+        writeApiError(w, http.StatusUnauthorized, "Unauthorized", "用户名或密码不能为空")
+        return "", false
+    }
+
+    value, find := admins[user]
+    if !find || value != passwd {
+        writeApiError(w, http.StatusForbidden, "Forbidden", "非管理员登陆")
+        return "", false
+    }
+    return user, true
+}
+
+
+/* 将json请求体转换为与WEB表单相同的参数，以便复用getParFromForm的检查逻辑
+** 引用模板时，填写的配额项作为对模板的覆盖，如{"Template": "standard", "QPS": 200}
+** 请求体形如: {"Rate": 1024, "Connection": 10, "QPS": 100, "RatePerConn": 0, "QPSGet": 50, "Reason": "...",
+**            "Schedules": [{"Name": "night", "Start": "00:00", "End": "06:00", "RateQuota": 2048, ...}]}
+*/
+func getFormFromBody(r *http.Request) (url.Values, string) {
+    body := make(map[string]interface{})
+    d := json.NewDecoder(r.Body)
+    d.UseNumber()
+    err := d.Decode(&body)
+    if err != nil {
+        return nil, fmt.Sprintf("请求体不是合法的json: %s", err)
+    }
+
+    form := url.Values{}
+    keys := []string{"Reason", "Template", "Duration", "Expire", "Source", "Hours"}
+    for _, f := range quotaFields {
+        keys = append(keys, f.Key)
+    }
+    for _, key := range keys {
+        v, ok := body[key]
+        if ok && v != nil {
+            form.Set(key, fmt.Sprint(v))
+        }
+    }
+    // 结构化字段保持json格式，与WEB表单一致
+    if v, ok := body["Schedules"]; ok && v != nil {
+        b, _ := json.Marshal(v)
+        form.Set("Schedules", string(b))
+    }
+    return form, ""
+}
+
+
+// GET /api/v1/buckets
+func apiListQuota(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET is allowed")
+        return
+    }
+    if _, ok := apiAuth(w, r); !ok {
+        return
+    }
+
+    list := make([]BucketQuotaInfo, 0)
+    for key, value := range quotaRegistry.Snapshot() {
+        list = append(list, BucketQuotaInfo{BucketName: key, Warn: value[0], Limit: value[1]})
+    }
+    writeJson(w, http.StatusOK, list)
+}
+
+
+// /api/v1/buckets/{name}/quota/{warn|limit}
+func apiBucketQuota(w http.ResponseWriter, r *http.Request) {
+    // 解析出桶名和配额类型
+    path := strings.TrimPrefix(r.URL.Path, "/api/v1/buckets/")
+    parts := strings.Split(path, "/")
+    if len(parts) == 1 && parts[0] != "" {
+        apiBucket(w, r, parts[0])
+        return
+    }
+    if len(parts) >= 2 && parts[0] != "" && parts[1] == "history" {
+        apiBucketHistory(w, r, parts[0], parts[2:])
+        return
+    }
+    if len(parts) == 2 && parts[0] != "" && parts[1] == "simulate" {
+        apiBucketSimulate(w, r, parts[0])
+        return
+    }
+    if len(parts) == 2 && parts[0] != "" && parts[1] == "boost" {
+        apiBucketBoost(w, r, parts[0])
+        return
+    }
+    if len(parts) == 2 && parts[0] != "" && parts[1] == "block" {
+        apiBucketBlock(w, r, parts[0])
+        return
+    }
+    if len(parts) != 3 || parts[0] == "" || parts[1] != "quota" {
+        writeApiError(w, http.StatusNotFound, "NotFound", "unknown api path " + r.URL.Path)
+        return
+    }
+    bucket := parts[0]
+    if errMsg := checkBucketName(bucket); errMsg != "" {
+        writeApiError(w, http.StatusBadRequest, "InvalidBucketName", errMsg)
+        return
+    }
+
+    var quotaType int
+    switch parts[2] {
+    case "warn":
+        quotaType = 0
+    case "limit":
+        quotaType = 1
+    default:
+        writeApiError(w, http.StatusNotFound, "NotFound", "quota type should be warn or limit")
+        return
+    }
+
+    admin, ok := apiAuth(w, r)
+    if !ok {
+        return
+    }
+
+    switch r.Method {
+    case "GET":
+        value, ok := quotaRegistry.Snapshot()[bucket]
+        if !ok || value[quotaType] == nil {
+            writeApiError(w, http.StatusNotFound, "NoSuchQuota", "no " + parts[2] + " quota for bucket " + bucket)
+            return
+        }
+        writeJson(w, http.StatusOK, value[quotaType])
+
+    case "PUT", "POST":
+        form, errMsg := getFormFromBody(r)
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "MalformedJson", errMsg)
+            return
+        }
+        if quotaType == 0 {
+            form.Set("Warn", "true")
+        }
+        quota, errMsg := getParFromForm(form)
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "InvalidArgument", errMsg)
+            return
+        }
+        var err error
+        if r.Method == "POST" {
+            var p *PendingChange
+            errMsg, p, err = addQuota(bucket, quotaType, quota, admin, form.Get("Reason"))
+            if errMsg != "" {
+                writeApiError(w, http.StatusConflict, "QuotaAlreadyExists", errMsg)
+                return
+            }
+            if p != nil {
+                writePending(w, p, err)
+                return
+            }
+        } else {
+            if why := needApproval(bucket, quotaType, quota); why != "" {
+                p, err := submitApproval(RESET, bucket, quotaType, quota, admin, form.Get("Reason"), why)
+                writePending(w, p, err)
+                return
+            }
+            err = setQuota(bucket, quotaType, quota, admin, form.Get("Reason"))
+        }
+        if err != nil {
+            writeSaveError(w, err)
+            return
+        }
+
+        // 限速配额全0时已被删除
+        value, ok := quotaRegistry.Snapshot()[bucket]
+        if !ok || value[quotaType] == nil {
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+        writeJson(w, http.StatusOK, value[quotaType])
+
+    case "DELETE":
+        if why := needApproval(bucket, quotaType, nil); why != "" {
+            p, err := submitApproval(DEL, bucket, quotaType, nil, admin, r.URL.Query().Get("reason"), why)
+            writePending(w, p, err)
+            return
+        }
+        found, err := delQuota(bucket, quotaType, admin, r.URL.Query().Get("reason"))
+        if !found {
+            writeApiError(w, http.StatusNotFound, "NoSuchQuota", "no " + parts[2] + " quota for bucket " + bucket)
+            return
+        }
+        if err != nil {
+            writeSaveError(w, err)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET, PUT, POST and DELETE are allowed")
+    }
+}
+
+
+// /api/v1/buckets/{name}
+func apiBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+    if r.Method != "DELETE" {
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only DELETE is allowed")
+        return
+    }
+    admin, ok := apiAuth(w, r)
+    if !ok {
+        return
+    }
+
+    if why := needBucketApproval(bucket); why != "" {
+        p, err := submitApproval(DEL, bucket, -1, nil, admin, r.URL.Query().Get("reason"), why)
+        writePending(w, p, err)
+        return
+    }
+    found, err := delBucket(bucket, admin, r.URL.Query().Get("reason"))
+    if !found {
+        writeApiError(w, http.StatusNotFound, "NoSuchBucket", "no quota for bucket " + bucket)
+        return
+    }
+    if err != nil {
+        writeSaveError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
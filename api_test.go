@@ -0,0 +1,134 @@
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+
+// 以管理员@user身份调用@handler，返回响应
+func callApi(handler http.HandlerFunc, user string, method string, path string, body string) (*httptest.ResponseRecorder) {
+    r := httptest.NewRequest(method, path, strings.NewReader(body))
+    if user != "" {
+        r.SetBasicAuth(user, admins[user])
+    }
+    w := httptest.NewRecorder()
+    handler(w, r)
+    return w
+}
+
+
+func TestApiAuth(t *testing.T) {
+    w := callApi(apiListQuota, "", "GET", "/api/v1/buckets", "")
+    if w.Code != http.StatusUnauthorized {
+        t.Fatalf("no auth: got %d, want 401", w.Code)
+    }
+
+    r := httptest.NewRequest("GET", "/api/v1/buckets", nil)
+    r.SetBasicAuth("alice", "wrong")
+    w = httptest.NewRecorder()
+    apiListQuota(w, r)
+    if w.Code != http.StatusForbidden {
+        t.Fatalf("wrong password: got %d, want 403", w.Code)
+    }
+}
+
+
+func TestApiQuotaCrud(t *testing.T) {
+    defer clearBucket("api-crud")
+    path := "/api/v1/buckets/api-crud/quota/limit"
+
+    w := callApi(apiBucketQuota, "alice", "PUT", path, `{"Rate": 2048, "Connection": 10, "QPS": 100, "RatePerConn": 0}`)
+    if w.Code != http.StatusOK {
+        t.Fatalf("PUT: got %d %s", w.Code, w.Body.String())
+    }
+    var q BucketQuota
+    if err := json.Unmarshal(w.Body.Bytes(), &q); err != nil {
+        t.Fatal(err)
+    }
+    if q.BucketName != "api-crud" || q.QuotaType != 1 || q.RateQuota != 2048 || q.ConnQuota != 10 || q.QpsQuota != 100 {
+        t.Fatalf("PUT returned %+v", q)
+    }
+
+    w = callApi(apiBucketQuota, "bob", "GET", path, "")
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"RateQuota":2048`) {
+        t.Fatalf("GET: got %d %s", w.Code, w.Body.String())
+    }
+
+    w = callApi(apiListQuota, "alice", "GET", "/api/v1/buckets", "")
+    var list []BucketQuotaInfo
+    if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+        t.Fatal(err)
+    }
+    found := false
+    for _, v := range list {
+        if v.BucketName == "api-crud" && v.Limit != nil && v.Limit.RateQuota == 2048 {
+            found = true
+        }
+    }
+    if !found {
+        t.Fatalf("bucket missing from list: %s", w.Body.String())
+    }
+
+    // 配额已经持久化
+    b, err := ioutil.ReadFile("./conf/quota")
+    if err != nil || !strings.Contains(string(b), `"BucketName":"api-crud"`) {
+        t.Fatalf("quota not persisted: %v %s", err, b)
+    }
+
+    w = callApi(apiBucketQuota, "alice", "DELETE", path, "")
+    if w.Code != http.StatusNoContent {
+        t.Fatalf("DELETE: got %d %s", w.Code, w.Body.String())
+    }
+    w = callApi(apiBucketQuota, "alice", "GET", path, "")
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("GET after DELETE: got %d", w.Code)
+    }
+    w = callApi(apiBucketQuota, "alice", "DELETE", path, "")
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("second DELETE: got %d", w.Code)
+    }
+}
+
+
+// 限速配额全0等同于删除
+func TestApiZeroLimit(t *testing.T) {
+    defer clearBucket("api-zero")
+    path := "/api/v1/buckets/api-zero/quota/limit"
+
+    callApi(apiBucketQuota, "alice", "PUT", path, `{"Rate": 100, "Connection": 0, "QPS": 0, "RatePerConn": 0}`)
+    w := callApi(apiBucketQuota, "alice", "PUT", path, `{"Rate": 0, "Connection": 0, "QPS": 0, "RatePerConn": 0}`)
+    if w.Code != http.StatusNoContent {
+        t.Fatalf("zero PUT: got %d %s", w.Code, w.Body.String())
+    }
+    w = callApi(apiBucketQuota, "alice", "GET", path, "")
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("GET after zero PUT: got %d", w.Code)
+    }
+}
+
+
+func TestApiBadRequest(t *testing.T) {
+    cases := []struct {
+        method string
+        path   string
+        body   string
+        code   int
+    }{
+        {"GET", "/api/v1/buckets/b/limit", "", http.StatusNotFound},
+        {"GET", "/api/v1/buckets/b/quota/other", "", http.StatusNotFound},
+        {"PUT", "/api/v1/buckets/TotalStatistic/quota/limit", `{"Rate": 1}`, http.StatusBadRequest},
+        {"PUT", "/api/v1/buckets/b/quota/limit", `not json`, http.StatusBadRequest},
+        {"PATCH", "/api/v1/buckets/b/quota/limit", "", http.StatusMethodNotAllowed},
+    }
+    for _, c := range cases {
+        w := callApi(apiBucketQuota, "alice", c.method, c.path, c.body)
+        if w.Code != c.code {
+            t.Errorf("%s %s: got %d, want %d (%s)", c.method, c.path, w.Code, c.code, w.Body.String())
+        }
+    }
+}
@@ -0,0 +1,586 @@
+/* LimitServer大幅配额变更双人审批，避免单个管理员的误操作造成故障:
+** 1. 将限速配额降低超过ApprovalThreshold%或删除限速配额的变更进入待审批状态，不立即生效，
+**    包括新建低于继承通配配额的精确配额、修改配额、回滚历史版本、降低被限速桶引用的配额模板，
+**    以及降低组限速配额；批量导入中有这类变更时整体拒绝
+** 2. 另一位管理员在/approvals页面或API中批准后才持久化并同步至前端Nginx，也可以拒绝
+** 3. 待审批变更超过ApprovalExpire分钟未处理自动过期
+** 4. 变更提交、批准、拒绝、过期时通过SendWarn通知审批人
+** ApprovalThreshold为0时不需要审批
+** 待审批变更以json格式保存在./conf/approvals，每个变更一行
+*/
+
+package main
+
+import (
+    "io"
+    "bytes"
+    "os"
+    "fmt"
+    "html"
+    "sort"
+    "time"
+    "bufio"
+    "strconv"
+    "sync"
+    "strings"
+    "net/http"
+    "encoding/json"
+)
+
+
+const approvalFile = "./conf/approvals"
+
+
+/* 待审批的配额变更
+** Op为ADD/DEL/RESET，Op为DEL且QuotaType为-1时表示删除桶的全部配额
+** Template或Group不为空时为配额模板或组的修改，此时BucketName为空
+*/
+type PendingChange struct {
+    ID          int64
+    Op          int
+    BucketName  string
+    QuotaType   int
+    Quota       *BucketQuota
+    Template    *QuotaTemplate  `json:",omitempty"`
+    Group       *QuotaGroup     `json:",omitempty"`
+    Admin       string
+    Reason      string
+    // 需要审批的原因
+    Why         string
+    Created     int64
+    Expire      int64
+}
+
+
+// 待审批变更，key为变更编号，pendingApprovals和lastApprovalID由approvalLock保护
+var pendingApprovals map[int64]*PendingChange
+var lastApprovalID int64
+var approvalLock sync.Mutex
+
+
+// 加载磁盘上的待审批变更
+func loadApprovals() {
+    approvalLock.Lock()
+    defer approvalLock.Unlock()
+    pendingApprovals = make(map[int64]*PendingChange)
+    lastApprovalID = 0
+
+    f, err := os.Open(approvalFile)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            GErrorLogger.Error("open approval file[%s] failed: [%s]", approvalFile, err)
+        }
+        return
+    }
+    defer f.Close()
+
+    r := bufio.NewReader(f)
+    for {
+        buf, err := r.ReadBytes('\n')
+        if len(trimLine(buf)) > 0 {
+            p := new(PendingChange)
+            if jerr := json.Unmarshal(buf, p); jerr != nil {
+                GErrorLogger.Error("Unmarshal approval [%s] failed: [%s]", buf, jerr)
+            } else {
+                pendingApprovals[p.ID] = p
+                if p.ID > lastApprovalID {
+                    lastApprovalID = p.ID
+                }
+            }
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            GErrorLogger.Error("read approval file [%s] failed: [%s]", approvalFile, err)
+            break
+        }
+    }
+    GLogger.Info("read approval file [%s] done, %d pending changes", approvalFile, len(pendingApprovals))
+}
+
+
+/* 持久化待审批变更，先写入approvals.new并fsync再重命名，调用者必须持有approvalLock
+** 返回值：持久化失败的原因
+*/
+func updateDiskApprovals() (error) {
+    var data bytes.Buffer
+    for id, p := range pendingApprovals {
+        b, err := json.Marshal(p)
+        if err != nil {
+            GErrorLogger.Error("json Marshal approval[%d]failed: [%s]", id, err)
+            return err
+        }
+        data.Write(append(b, '\n'))
+    }
+
+    newfile := approvalFile + ".new"
+    err := writeFileSync(newfile, data.Bytes())
+    if err == nil {
+        err = os.Rename(newfile, approvalFile)
+    }
+    if err != nil {
+        GErrorLogger.Error("save approval file [%s] failed: [%s]", approvalFile, err)
+    }
+    return err
+}
+
+
+/* 判断将桶@bucket的@qt类型配额改为@quota(nil表示删除)是否需要审批
+** 只检查限速配额：删除精确限速配额，或任一配额项降低超过ApprovalThreshold%
+** 返回值：需要审批的原因，""表示不需要
+*/
+func needApproval(bucket string, qt int, quota *BucketQuota) (string) {
+    if ApprovalThreshold <= 0 || qt != 1 {
+        return ""
+    }
+    if quota == nil || isUnlimited(quota) {
+        if value, ok := quotaRegistry.Snapshot()[bucket]; ok && value[1] != nil {
+            return "删除限速配额"
+        }
+        return ""
+    }
+
+    current := resolveQuota(bucket, 1)
+    if current == nil {
+        return ""
+    }
+    o, n := *current, *quota
+    applyTemplate(&o)
+    applyTemplate(&n)
+    return quotaReduction(&o, &n)
+}
+
+
+/* 比较展开模板后的配额@o和@n，任一配额项降低超过ApprovalThreshold%时返回原因
+** 返回值：""表示没有大幅降低
+*/
+func quotaReduction(o *BucketQuota, n *BucketQuota) (string) {
+    for _, f := range quotaFields {
+        if f.Optional && f.LimitOnly {
+            continue
+        }
+        ov, nv := *quotaFieldPtr(o, f.Field), *quotaFieldPtr(n, f.Field)
+        // 0表示不限制，改为0是放宽
+        if ov <= 0 || nv <= 0 {
+            continue
+        }
+        if float64(nv) < float64(ov) * float64(100 - ApprovalThreshold) / 100 {
+            return fmt.Sprintf("%s从%d降低至%d，超过%d%%", f.Name, ov, nv, ApprovalThreshold)
+        }
+    }
+    return ""
+}
+
+
+// 删除桶@bucket的全部配额是否需要审批
+func needBucketApproval(bucket string) (string) {
+    return needApproval(bucket, 1, nil)
+}
+
+
+/* 判断将模板修改为@t是否需要审批：模板被限速配额引用，且任一配额项降低超过ApprovalThreshold%
+** 返回值：需要审批的原因，""表示不需要
+*/
+func needTemplateApproval(t *QuotaTemplate) (string) {
+    if ApprovalThreshold <= 0 {
+        return ""
+    }
+    old, ok := getTemplate(t.Name)
+    if !ok {
+        return ""
+    }
+    for _, b := range templateBuckets(t.Name, 1) {
+        current := quotaRegistry.Get(b, 1)
+        if current == nil {
+            continue
+        }
+        o, n := *current, *current
+        old.applyTo(&o)
+        t.applyTo(&n)
+        if why := quotaReduction(&o, &n); why != "" {
+            return "引用模板的桶" + b + "的" + why
+        }
+    }
+    return ""
+}
+
+
+/* 保存待审批变更@p并通知审批人
+** 返回值：持久化失败的原因，此时变更没有提交
+*/
+func addApproval(p *PendingChange) (error) {
+    now := time.Now().Unix()
+    p.Created = now
+    p.Expire  = now + int64(ApprovalExpire) * 60
+    approvalLock.Lock()
+    lastApprovalID++
+    p.ID = lastApprovalID
+    pendingApprovals[p.ID] = p
+    if err := updateDiskApprovals(); err != nil {
+        delete(pendingApprovals, p.ID)
+        approvalLock.Unlock()
+        return err
+    }
+    approvalLock.Unlock()
+
+    msg := fmt.Sprintf("Quota change #%d on %s by %s needs approval: %s, %s. Approve at http://%s:%s/approvals",
+                       p.ID, pendingTarget(p), p.Admin, describePending(p), p.Why, Host, HttpPort)
+    GLogger.Info(msg)
+    SendWarn(msg)
+    return nil
+}
+
+
+/* 提交一个待审批变更并通知审批人
+** 返回值：提交的变更；持久化失败的原因，此时变更没有提交
+*/
+func submitApproval(op int, bucket string, qt int, quota *BucketQuota, admin string, reason string, why string) (*PendingChange, error) {
+    p := &PendingChange{Op: op, BucketName: bucket, QuotaType: qt, Quota: quota,
+                        Admin: admin, Reason: reason, Why: why}
+    if quota != nil {
+        quota.BucketName = bucket
+        quota.QuotaType  = int64(qt)
+    }
+    return p, addApproval(p)
+}
+
+
+// 提交一个待审批的模板修改@t并通知审批人
+func submitTemplateApproval(t *QuotaTemplate, admin string, reason string, why string) (*PendingChange, error) {
+    p := &PendingChange{Op: RESET, QuotaType: 1, Template: t, Admin: admin, Reason: reason, Why: why}
+    return p, addApproval(p)
+}
+
+
+// 提交一个待审批的组修改@g并通知审批人
+func submitGroupApproval(g *QuotaGroup, admin string, reason string, why string) (*PendingChange, error) {
+    p := &PendingChange{Op: RESET, QuotaType: 1, Group: g, Admin: admin, Reason: reason, Why: why}
+    return p, addApproval(p)
+}
+
+
+// 提交待审批变更@p后展示给管理员的信息，@err为保存待审批变更失败的原因
+func pendingMsg(p *PendingChange, err error) (string) {
+    if err != nil {
+        return saveErrMsg(err)
+    }
+    return fmt.Sprintf("变更需要另一位管理员审批，审批编号%d: %s", p.ID, p.Why)
+}
+
+
+// 变更的对象，用于通知信息
+func pendingTarget(p *PendingChange) (string) {
+    switch {
+    case p.Template != nil:
+        return "template " + p.Template.Name
+    case p.Group != nil:
+        return "group " + p.Group.Name
+    }
+    return "bucket " + p.BucketName
+}
+
+
+func describePending(p *PendingChange) (string) {
+    switch {
+    case p.Template != nil:
+        t := p.Template
+        return fmt.Sprintf("set template %s to Rate:%d Conn:%d QPS:%d RatePerConn:%d", t.Name,
+                           t.RateQuota, t.ConnQuota, t.QpsQuota, t.RatePerConn)
+    case p.Group != nil:
+        return fmt.Sprintf("set group %s limit to %s", p.Group.Name, describeQuota(p.Group.Limit))
+    case p.Op == DEL && p.QuotaType == -1:
+        return "delete bucket"
+    case p.Op == DEL:
+        return "delete " + []string{"warn", "limit"}[p.QuotaType] + " quota"
+    }
+    return "set " + []string{"warn", "limit"}[p.QuotaType] + " quota to " + describeQuota(p.Quota)
+}
+
+
+/* 从待审批变更中取出变更@id
+** 返回值：变更，不存在时返回nil；持久化失败的原因，此时变更保留在待审批中
+*/
+func takeApproval(id int64) (*PendingChange, error) {
+    approvalLock.Lock()
+    defer approvalLock.Unlock()
+    p, ok := pendingApprovals[id]
+    if !ok {
+        return nil, nil
+    }
+    delete(pendingApprovals, id)
+    if err := updateDiskApprovals(); err != nil {
+        pendingApprovals[id] = p
+        return nil, err
+    }
+    return p, nil
+}
+
+
+// 获取待审批变更@id，不存在时返回nil
+func getApproval(id int64) (*PendingChange) {
+    approvalLock.Lock()
+    defer approvalLock.Unlock()
+    return pendingApprovals[id]
+}
+
+
+// 待审批变更数量
+func approvalCount() (int) {
+    approvalLock.Lock()
+    defer approvalLock.Unlock()
+    return len(pendingApprovals)
+}
+
+
+// 变更@p生效失败时放回待审批变更，便于重新审批
+func restoreApproval(p *PendingChange) {
+    approvalLock.Lock()
+    defer approvalLock.Unlock()
+    pendingApprovals[p.ID] = p
+    if err := updateDiskApprovals(); err != nil {
+        GErrorLogger.Error("restore approval %d failed: [%s]", p.ID, err)
+    }
+}
+
+
+/* 管理员@approver批准待审批变更@id，变更立即生效，已过期的变更不能批准
+** 取出变更后再修改配额，不在持有approvalLock时获取注册表写锁
+** 返回值：""代表成功，否则为出错原因；配额持久化失败的原因，此时变更放回待审批
+*/
+func approveChange(id int64, approver string) (string, error) {
+    p := getApproval(id)
+    if p == nil {
+        return fmt.Sprintf("待审批变更%d不存在", id), nil
+    }
+    if p.Admin == approver {
+        return "不能审批自己提交的变更", nil
+    }
+    if p.Expire <= time.Now().Unix() {
+        return fmt.Sprintf("待审批变更%d已过期", id), nil
+    }
+    p, err := takeApproval(id)
+    if err != nil {
+        return "", err
+    }
+    if p == nil {
+        return fmt.Sprintf("待审批变更%d不存在", id), nil
+    }
+
+    reason := fmt.Sprintf("%s (approved by %s)", p.Reason, approver)
+    errMsg := ""
+    found := true
+    switch {
+    case p.Template != nil:
+        _, err = putTemplate(p.Template, p.Admin, reason)
+    case p.Group != nil:
+        err = putGroup(p.Group, p.Admin, reason)
+    case p.Op == DEL && p.QuotaType == -1:
+        found, err = delBucket(p.BucketName, p.Admin, reason)
+    case p.Op == DEL:
+        found, err = delQuota(p.BucketName, p.QuotaType, p.Admin, reason)
+    default:
+        q := *p.Quota
+        err = setQuota(p.BucketName, p.QuotaType, &q, p.Admin, reason)
+    }
+    if !found {
+        errMsg = "桶配额不存在"
+    }
+    if err != nil {
+        restoreApproval(p)
+    }
+
+    msg := fmt.Sprintf("Quota change #%d on %s approved by %s", id, pendingTarget(p), approver)
+    if errMsg != "" {
+        msg += ", apply failed: " + errMsg
+    } else if err != nil {
+        msg += ", save failed: " + err.Error()
+    }
+    GLogger.Info(msg)
+    SendWarn(msg)
+    return errMsg, err
+}
+
+
+/* 管理员@approver拒绝待审批变更@id
+** 返回值：""代表成功，否则为出错原因；持久化失败的原因
+*/
+func rejectChange(id int64, approver string, why string) (string, error) {
+    p, err := takeApproval(id)
+    if err != nil {
+        return "", err
+    }
+    if p == nil {
+        return fmt.Sprintf("待审批变更%d不存在", id), nil
+    }
+
+    msg := fmt.Sprintf("Quota change #%d on %s by %s rejected by %s: %s", id, pendingTarget(p), p.Admin, approver, why)
+    GLogger.Info(msg)
+    SendWarn(msg)
+    return "", nil
+}
+
+
+// 每分钟清理一次过期的待审批变更
+func approvalWatcher() {
+    GLogger.Info("Start approval watcher")
+    for {
+        now := time.Now().Unix()
+        expired := make([]*PendingChange, 0)
+        approvalLock.Lock()
+        for id, p := range pendingApprovals {
+            if p.Expire > now {
+                continue
+            }
+            delete(pendingApprovals, id)
+            expired = append(expired, p)
+        }
+        if len(expired) > 0 {
+            // 保存失败时重启后重新加载，再次过期
+            updateDiskApprovals()
+        }
+        approvalLock.Unlock()
+
+        for _, p := range expired {
+            msg := fmt.Sprintf("Quota change #%d on %s by %s expired without approval", p.ID, pendingTarget(p), p.Admin)
+            GLogger.Info(msg)
+            SendWarn(msg)
+        }
+        time.Sleep(60 * time.Second)
+    }
+}
+
+
+func sortedApprovals() ([]*PendingChange) {
+    approvalLock.Lock()
+    list := make([]*PendingChange, 0, len(pendingApprovals))
+    for _, p := range pendingApprovals {
+        list = append(list, p)
+    }
+    approvalLock.Unlock()
+    sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+    return list
+}
+
+
+// 待审批变更WEB页面，GET展示所有待审批变更，POST批准或拒绝
+func handlerApprovals(w http.ResponseWriter, r *http.Request) {
+    if r.Method == "POST" {
+        user := r.FormValue("Admin")
+        passwd := r.FormValue("Password")
+        value, find := admins[user]
+        errMsg := ""
+        id, err := strconv.ParseInt(r.FormValue("ID"), 10, 64)
+        if user == "" || passwd == "" {
+            errMsg = "用户名或密码不能为空"
+        } else if !find || value != passwd {
+            errMsg = "非管理员登陆"
+        } else if err != nil {
+            errMsg = "变更编号错误"
+        } else if r.FormValue("Op") == "Reject" {
+            var serr error
+            if errMsg, serr = rejectChange(id, user, r.FormValue("Reason")); serr != nil {
+                errMsg = saveErrMsg(serr)
+            }
+        } else {
+            var serr error
+            if errMsg, serr = approveChange(id, user); serr != nil {
+                errMsg = saveErrMsg(serr)
+            }
+        }
+        if errMsg == "" {
+            errMsg = "OK!"
+        }
+        fmt.Fprintf(w, `<html><head><meta charset=utf-8><meta http-equiv="refresh" content="2; url=http://%s:%s/approvals" /></head><body>%s</body></html>`, Host, HttpPort, html.EscapeString(errMsg))
+        return
+    }
+
+    lines := ""
+    for _, p := range sortedApprovals() {
+        lines += fmt.Sprintf(`<tr><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td>
+            <td><form action="/approvals" method="post">
+            <input type="hidden" name="ID" value="%d"></input>
+            Admin<input type="text" name="Admin"></input>
+            Password<input type="password" name="Password"></input>
+            Reason<input type="text" name="Reason"></input>
+            <input type="submit" name="Op" value="Approve"></input>
+            <input type="submit" name="Op" value="Reject"></input>
+            </form></td></tr>`, p.ID, html.EscapeString(pendingTarget(p)), html.EscapeString(describePending(p)),
+            html.EscapeString(p.Why), html.EscapeString(p.Admin), html.EscapeString(p.Reason),
+            time.Unix(p.Expire, 0).Format("2006-01-02 15:04:05"), p.ID)
+    }
+    fmt.Fprintf(w, `<html><head><meta charset=utf-8></head><body>
+        <p><b>待审批配额变更</b></p>
+        <table border=1>
+        <tr><td>ID</td><td>Target</td><td>Change</td><td>Why</td><td>Admin</td><td>Reason</td><td>Expire</td><td></td></tr>
+        %s
+        </table></body></html>`, lines)
+}
+
+
+/* 待审批变更API:
+** GET  /api/v1/approvals               列出所有待审批变更
+** POST /api/v1/approvals/{id}/approve  批准变更
+** POST /api/v1/approvals/{id}/reject   拒绝变更，请求体可以携带{"Reason": "..."}
+*/
+func apiApprovals(w http.ResponseWriter, r *http.Request) {
+    admin, ok := apiAuth(w, r)
+    if !ok {
+        return
+    }
+
+    path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/approvals"), "/")
+    if path == "" {
+        if r.Method != "GET" {
+            writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET is allowed")
+            return
+        }
+        writeJson(w, http.StatusOK, sortedApprovals())
+        return
+    }
+
+    parts := strings.Split(path, "/")
+    if len(parts) != 2 || (parts[1] != "approve" && parts[1] != "reject") {
+        writeApiError(w, http.StatusNotFound, "NotFound", "unknown api path " + r.URL.Path)
+        return
+    }
+    if r.Method != "POST" {
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only POST is allowed")
+        return
+    }
+    id, err := strconv.ParseInt(parts[0], 10, 64)
+    if err != nil {
+        writeApiError(w, http.StatusBadRequest, "InvalidArgument", "id should be a number")
+        return
+    }
+    if getApproval(id) == nil {
+        writeApiError(w, http.StatusNotFound, "NoSuchApproval", fmt.Sprintf("no pending change %d", id))
+        return
+    }
+
+    errMsg := ""
+    if parts[1] == "approve" {
+        var serr error
+        if errMsg, serr = approveChange(id, admin); serr != nil {
+            writeSaveError(w, serr)
+            return
+        }
+    } else {
+        reason := ""
+        body := make(map[string]string)
+        if err = json.NewDecoder(r.Body).Decode(&body); err == nil {
+            reason = strings.TrimSpace(body["Reason"])
+        }
+        var serr error
+        if errMsg, serr = rejectChange(id, admin, reason); serr != nil {
+            writeSaveError(w, serr)
+            return
+        }
+    }
+    if errMsg != "" {
+        writeApiError(w, http.StatusConflict, "ApprovalFailed", errMsg)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
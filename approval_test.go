@@ -0,0 +1,216 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+
+// 开启审批，降低超过50%需要审批
+func enableApproval(t *testing.T) {
+    ApprovalThreshold, ApprovalExpire = 50, 60
+    t.Cleanup(func() { ApprovalThreshold = 0 })
+}
+
+
+func decodePending(t *testing.T, body []byte) (*PendingChange) {
+    p := new(PendingChange)
+    if err := json.Unmarshal(body, p); err != nil || p.ID == 0 {
+        t.Fatalf("response is not a pending change: %s", body)
+    }
+    return p
+}
+
+
+func TestApprovalReduceLimit(t *testing.T) {
+    enableApproval(t)
+    defer clearBucket("appr")
+    path := "/api/v1/buckets/appr/quota/limit"
+    setQuota("appr", 1, testQuota(1000, 100, 0, 0), "alice", "")
+
+    // 小幅降低直接生效
+    w := callApi(apiBucketQuota, "alice", "PUT", path, `{"Rate": 600, "Connection": 100, "QPS": 0, "RatePerConn": 0}`)
+    if w.Code != http.StatusOK || quotaRegistry.Get("appr", 1).RateQuota != 600 {
+        t.Fatalf("small reduction: got %d %s", w.Code, w.Body.String())
+    }
+
+    w = callApi(apiBucketQuota, "alice", "PUT", path, `{"Rate": 100, "Connection": 100, "QPS": 0, "RatePerConn": 0, "Reason": "cut"}`)
+    if w.Code != http.StatusAccepted {
+        t.Fatalf("large reduction: got %d %s", w.Code, w.Body.String())
+    }
+    p := decodePending(t, w.Body.Bytes())
+    if quotaRegistry.Get("appr", 1).RateQuota != 600 {
+        t.Fatal("pending change applied before approval")
+    }
+
+    // 待审批变更重启后仍然存在
+    loadApprovals()
+    if getApproval(p.ID) == nil {
+        t.Fatal("pending change lost after reload")
+    }
+
+    if errMsg, _ := approveChange(p.ID, "alice"); errMsg == "" {
+        t.Fatal("admin approved own change")
+    }
+    if errMsg, err := approveChange(p.ID, "bob"); errMsg != "" || err != nil {
+        t.Fatalf("approve: %q %v", errMsg, err)
+    }
+    if quotaRegistry.Get("appr", 1).RateQuota != 100 || getApproval(p.ID) != nil {
+        t.Fatal("approved change not applied")
+    }
+    if rev := getBucketHistory("appr")[0]; rev.Admin != "alice" || rev.Reason != "cut (approved by bob)" {
+        t.Fatalf("approved revision is %+v", rev)
+    }
+    if errMsg, _ := approveChange(p.ID, "bob"); errMsg == "" {
+        t.Fatal("change approved twice")
+    }
+}
+
+
+func TestApprovalRejectDelete(t *testing.T) {
+    enableApproval(t)
+    defer clearBucket("appr-del")
+    setQuota("appr-del", 1, testQuota(1000, 0, 0, 0), "alice", "")
+
+    w := callApi(apiBucketQuota, "alice", "DELETE", "/api/v1/buckets/appr-del/quota/limit", "")
+    if w.Code != http.StatusAccepted {
+        t.Fatalf("DELETE limit: got %d %s", w.Code, w.Body.String())
+    }
+    p := decodePending(t, w.Body.Bytes())
+
+    w = callApi(apiApprovals, "bob", "POST", "/api/v1/approvals/" + strconv.FormatInt(p.ID, 10) + "/reject", `{"Reason": "no"}`)
+    if w.Code != http.StatusNoContent {
+        t.Fatalf("reject: got %d %s", w.Code, w.Body.String())
+    }
+    if quotaRegistry.Get("appr-del", 1) == nil || getApproval(p.ID) != nil {
+        t.Fatal("rejected change applied or still pending")
+    }
+
+    w = callApi(apiBucketQuota, "alice", "DELETE", "/api/v1/buckets/appr-del", "")
+    if w.Code != http.StatusAccepted {
+        t.Fatalf("DELETE bucket: got %d %s", w.Code, w.Body.String())
+    }
+    p = decodePending(t, w.Body.Bytes())
+    w = callApi(apiApprovals, "bob", "POST", "/api/v1/approvals/" + strconv.FormatInt(p.ID, 10) + "/approve", "")
+    if w.Code != http.StatusNoContent {
+        t.Fatalf("approve: got %d %s", w.Code, w.Body.String())
+    }
+    if _, ok := quotaRegistry.Snapshot()["appr-del"]; ok {
+        t.Fatal("bucket not deleted after approval")
+    }
+}
+
+
+// 新建的精确限速配额大幅低于继承的通配配额时需要审批
+func TestApprovalAddBelowPattern(t *testing.T) {
+    enableApproval(t)
+    defer func() {
+        clearBucket("appr-add-*")
+        clearBucket("appr-add-x")
+    }()
+    setQuota("appr-add-*", 1, testQuota(1000, 0, 0, 0), "alice", "")
+
+    body := `{"Rate": 10, "Connection": 0, "QPS": 0, "RatePerConn": 0}`
+    w := callApi(apiBucketQuota, "alice", "POST", "/api/v1/buckets/appr-add-x/quota/limit", body)
+    if w.Code != http.StatusAccepted {
+        t.Fatalf("POST: got %d %s", w.Code, w.Body.String())
+    }
+    p := decodePending(t, w.Body.Bytes())
+    if p.Op != ADD || p.Quota.BucketName != "appr-add-x" {
+        t.Fatalf("pending change is %+v", p)
+    }
+    if _, ok := quotaRegistry.Snapshot()["appr-add-x"]; ok {
+        t.Fatal("quota added before approval")
+    }
+    approveChange(p.ID, "bob")
+    if quotaRegistry.Snapshot()["appr-add-x"] == nil || quotaRegistry.Get("appr-add-x", 1).RateQuota != 10 {
+        t.Fatal("approved add not applied")
+    }
+
+    // 没有继承配额时直接新建
+    errMsg, p, err := addQuota("appr-new", 1, testQuota(1, 0, 0, 0), "alice", "")
+    defer clearBucket("appr-new")
+    if errMsg != "" || p != nil || err != nil {
+        t.Fatalf("add without inherited quota: %q %v %v", errMsg, p, err)
+    }
+}
+
+
+// 大幅降低被限速桶引用的模板需要审批，批准后模板生效并记录历史
+func TestApprovalTemplate(t *testing.T) {
+    enableApproval(t)
+    defer func() {
+        clearBucket("appr-tpl")
+        delTemplate("appr-std", "alice", "")
+    }()
+    setTemplate(&QuotaTemplate{Name: "appr-std", RateQuota: 1000}, "alice", "")
+    setQuota("appr-tpl", 1, &BucketQuota{Template: "appr-std"}, "alice", "")
+
+    p, _, err := setTemplate(&QuotaTemplate{Name: "appr-std", RateQuota: 10}, "alice", "shrink")
+    if p == nil || err != nil {
+        t.Fatalf("template reduction: %v %v", p, err)
+    }
+    if tpl, _ := getTemplate("appr-std"); tpl.RateQuota != 1000 {
+        t.Fatal("template changed before approval")
+    }
+    w := callApi(apiTemplates, "alice", "PUT", "/api/v1/templates/appr-std", `{"Rate": 20, "Connection": 0, "QPS": 0, "RatePerConn": 0}`)
+    if w.Code != http.StatusAccepted {
+        t.Fatalf("PUT template: got %d %s", w.Code, w.Body.String())
+    }
+
+    if errMsg, err := approveChange(p.ID, "bob"); errMsg != "" || err != nil {
+        t.Fatalf("approve: %q %v", errMsg, err)
+    }
+    if tpl, _ := getTemplate("appr-std"); tpl.RateQuota != 10 {
+        t.Fatal("approved template not applied")
+    }
+    if rev := getTemplateHistory("appr-std")[0]; rev.Reason != "shrink (approved by bob)" {
+        t.Fatalf("template revision is %+v", rev)
+    }
+}
+
+
+func TestApprovalExpired(t *testing.T) {
+    enableApproval(t)
+    defer clearBucket("appr-exp")
+    setQuota("appr-exp", 1, testQuota(1000, 0, 0, 0), "alice", "")
+
+    p, err := submitApproval(DEL, "appr-exp", 1, nil, "alice", "", "test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    p.Expire = time.Now().Unix() - 1
+    if errMsg, _ := approveChange(p.ID, "bob"); !strings.Contains(errMsg, "过期") {
+        t.Fatalf("approve expired: %q", errMsg)
+    }
+    if quotaRegistry.Get("appr-exp", 1) == nil {
+        t.Fatal("expired change applied")
+    }
+    rejectChange(p.ID, "bob", "")
+}
+
+
+// 待审批变更保存失败时不提交，并向管理员报告错误
+func TestApprovalSaveFailure(t *testing.T) {
+    enableApproval(t)
+    defer clearBucket("appr-fail")
+    setQuota("appr-fail", 1, testQuota(1000, 0, 0, 0), "alice", "")
+    before := approvalCount()
+
+    restore := breakFile(t, approvalFile + ".new")
+    defer restore()
+    if _, err := submitApproval(DEL, "appr-fail", 1, nil, "alice", "", "test"); err == nil {
+        t.Fatal("submitApproval should fail")
+    }
+    w := callApi(apiBucketQuota, "alice", "DELETE", "/api/v1/buckets/appr-fail/quota/limit", "")
+    if w.Code != http.StatusInternalServerError {
+        t.Fatalf("DELETE: got %d %s", w.Code, w.Body.String())
+    }
+    if approvalCount() != before || quotaRegistry.Get("appr-fail", 1) == nil {
+        t.Fatal("failed approval was submitted or applied")
+    }
+}
@@ -0,0 +1,357 @@
+/* LimitServer桶封禁模块，提供以下功能:
+** 1. 封禁被滥用的桶，限速配额上记录封禁标记，不需要审批，立即同步至所有前端Nginx，Nginx拒绝该桶的全部请求
+** 2. 一键解除封禁，恢复封禁前的限速配额
+** 3. 封禁、解除封禁都记录在配额修改历史中，/blocks页面展示封禁中的桶和封禁记录
+** 封禁期间修改、回滚限速配额不改变封禁状态，只能通过解除封禁恢复
+*/
+
+package main
+
+import (
+    "fmt"
+    "html"
+    "sort"
+    "time"
+    "strings"
+    "net/http"
+)
+
+
+/* 封禁桶@bucket，@reason不能为空
+** 返回值：""代表成功，否则为出错原因；配额持久化失败的原因
+*/
+func blockBucket(bucket string, admin string, reason string) (string, error) {
+    if bucket == "" {
+        return "桶名不能为空", nil
+    }
+    if bucket == "TotalStatistic" || isPattern(bucket) {
+        return "只能封禁单个桶", nil
+    }
+    if errMsg := checkBucketName(bucket); errMsg != "" {
+        return errMsg, nil
+    }
+    if reason == "" {
+        return "封禁原因不能为空", nil
+    }
+
+    quotaRegistry.Lock()
+    defer quotaRegistry.Unlock()
+    q := &BucketQuota{BucketName: bucket, QuotaType: 1}
+    if old := quotaRegistry.Get(bucket, 1); old != nil {
+        if old.Blocked {
+            return "桶" + bucket + "已经被封禁", nil
+        }
+        c := *old
+        q = &c
+    }
+    q.Blocked = true
+    if err := putQuotaLocked(bucket, 1, q, admin, "block: " + reason); err != nil {
+        return "", err
+    }
+
+    msg := fmt.Sprintf("Bucket %s blocked by %s: %s", bucket, admin, reason)
+    GLogger.Info(msg)
+    SendWarn(msg)
+    return "", nil
+}
+
+
+/* 解除桶@bucket的封禁，恢复封禁前的限速配额，封禁前不限速时删除限速配额
+** 返回值：""代表成功，否则为出错原因；配额持久化失败的原因
+*/
+func unblockBucket(bucket string, admin string, reason string) (string, error) {
+    quotaRegistry.Lock()
+    defer quotaRegistry.Unlock()
+    old := quotaRegistry.Get(bucket, 1)
+    if old == nil || !old.Blocked {
+        return "桶" + bucket + "没有被封禁", nil
+    }
+    // 封禁前没有精确限速配额且封禁期间没有设置时，删除只有封禁标记的配额，恢复继承的通配配额
+    q := unblockedQuota(old)
+    if reason == "" {
+        reason = "manual"
+    }
+    if err := putQuotaLocked(bucket, 1, q, admin, "unblock: " + reason); err != nil {
+        return "", err
+    }
+
+    msg := fmt.Sprintf("Bucket %s unblocked by %s: %s", bucket, admin, reason)
+    GLogger.Info(msg)
+    SendWarn(msg)
+    return "", nil
+}
+
+
+/* 桶@bucket封禁中时，修改后的限速配额@quota保持封禁，@quota为nil时改为只有封禁标记的限速配额
+** 调用者必须持有注册表写锁
+*/
+func keepBlocked(bucket string, quota *BucketQuota) (*BucketQuota) {
+    if !isBlocked(bucket) {
+        return quota
+    }
+    if quota == nil {
+        quota = &BucketQuota{BucketName: bucket, QuotaType: 1}
+    }
+    quota.Blocked = true
+    return quota
+}
+
+
+// 去掉封禁标记后的限速配额@q，只有封禁标记时返回nil
+func unblockedQuota(q *BucketQuota) (*BucketQuota) {
+    if q == nil || !q.Blocked {
+        return q
+    }
+    c := *q
+    c.Blocked = false
+    if isUnlimited(&c) {
+        return nil
+    }
+    return &c
+}
+
+
+// 桶@bucket是否被封禁
+func isBlocked(bucket string) (bool) {
+    q := quotaRegistry.Get(bucket, 1)
+    return q != nil && q.Blocked
+}
+
+
+// 封禁中的桶及封禁时的修改记录，按桶名排序
+func blockedBuckets() ([]string, map[string]*QuotaRevision) {
+    buckets := make([]string, 0)
+    for key, value := range quotaRegistry.Snapshot() {
+        if value[1] != nil && value[1].Blocked {
+            buckets = append(buckets, key)
+        }
+    }
+    sort.Strings(buckets)
+
+    since := make(map[string]*QuotaRevision)
+    for _, rev := range blockEvents(0) {
+        if _, ok := since[rev.BucketName]; !ok && rev.New != nil && rev.New.Blocked {
+            since[rev.BucketName] = rev
+        }
+    }
+    return buckets, since
+}
+
+
+// 封禁状态发生变化的修改记录，最新的在前，@n为0表示全部
+func blockEvents(n int) ([]*QuotaRevision) {
+    historyLock.RLock()
+    defer historyLock.RUnlock()
+    revs := make([]*QuotaRevision, 0)
+    for i := len(quotaHistory) - 1; i >= 0; i-- {
+        rev := quotaHistory[i]
+        if rev.QuotaType != 1 {
+            continue
+        }
+        oldBlocked := rev.Old != nil && rev.Old.Blocked
+        newBlocked := rev.New != nil && rev.New.Blocked
+        if oldBlocked == newBlocked {
+            continue
+        }
+        revs = append(revs, rev)
+        if n > 0 && len(revs) >= n {
+            break
+        }
+    }
+    return revs
+}
+
+
+// /all页面展示的封禁中的桶
+func blockSummary() (string) {
+    buckets, since := blockedBuckets()
+    if len(buckets) == 0 {
+        return ""
+    }
+    url := "http://" + Host + ":" + HttpPort
+    out := fmt.Sprintf(`<p><b style="color:red">封禁中的桶 %d</b> <a href=%s/blocks>Manage</a></p>`, len(buckets), url)
+    for _, key := range buckets {
+        out += fmt.Sprintf(`<p style="color:red">%s`, html.EscapeString(key))
+        if rev, ok := since[key]; ok {
+            out += fmt.Sprintf(`: since %s, by %s %s`, time.Unix(rev.Time, 0).Format("2006-01-02 15:04:05"),
+                               html.EscapeString(rev.Admin), html.EscapeString(rev.Reason))
+        }
+        out += "</p>"
+    }
+    return out
+}
+
+
+// 解除封禁的表单
+func unblockForm(bucket string) (string) {
+    return fmt.Sprintf(`<form action="/blocks" method="post">
+            <input type="hidden" name="Bucket" value="%s"></input>
+            Admin<input type="text" name="Admin"></input>
+            Password<input type="password" name="Password"></input>
+            <input type="submit" name="Op" value="Unblock"></input>
+            </form>`, html.EscapeString(bucket))
+}
+
+
+// /bucket页面展示的封禁状态
+func blockNotice(bucket string) (string) {
+    if !isBlocked(bucket) {
+        return ""
+    }
+    return fmt.Sprintf(`<p><b style="color:red">桶%s已被封禁，前端Nginx拒绝该桶的全部请求</b></p>%s`, html.EscapeString(bucket), unblockForm(bucket))
+}
+
+
+// 桶封禁WEB页面，GET展示封禁中的桶和封禁记录，POST封禁或解除封禁
+func handlerBlocks(w http.ResponseWriter, r *http.Request) {
+    if r.Method == "POST" {
+        r.ParseForm()
+        user := r.Form.Get("Admin")
+        passwd := r.Form.Get("Password")
+        value, find := admins[user]
+        bucket := strings.TrimSpace(r.Form.Get("Bucket"))
+        errMsg := ""
+        if user == "" || passwd == "" {
+            errMsg = "用户名或密码不能为空"
+        } else if !find || value != passwd {
+            errMsg = "非管理员登陆"
+        } else {
+            var err error
+            if r.Form.Get("Op") == "Unblock" {
+                errMsg, err = unblockBucket(bucket, user, r.Form.Get("Reason"))
+            } else {
+                errMsg, err = blockBucket(bucket, user, r.Form.Get("Reason"))
+            }
+            if err != nil {
+                errMsg = saveErrMsg(err)
+            }
+        }
+        if errMsg == "" {
+            errMsg = "OK!"
+        }
+        fmt.Fprintf(w, `<html><head><meta charset=utf-8><meta http-equiv="refresh" content="2; url=http://%s:%s/blocks" /></head><body>%s</body></html>`, Host, HttpPort, html.EscapeString(errMsg))
+        return
+    }
+
+    buckets, since := blockedBuckets()
+    lines := ""
+    for _, key := range buckets {
+        start, admin, reason := "-", "-", "-"
+        if rev, ok := since[key]; ok {
+            start, admin, reason = time.Unix(rev.Time, 0).Format("2006-01-02 15:04:05"), rev.Admin, rev.Reason
+        }
+        lines += fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>`,
+            html.EscapeString(key), html.EscapeString(describeQuota(quotaRegistry.Get(key, 1))), start,
+            html.EscapeString(admin), html.EscapeString(reason), unblockForm(key))
+    }
+
+    events := ""
+    for _, rev := range blockEvents(50) {
+        op := "Unblock"
+        if rev.New != nil && rev.New.Blocked {
+            op = "Block"
+        }
+        events += fmt.Sprintf(`<tr><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>`,
+            rev.Revision, time.Unix(rev.Time, 0).Format("2006-01-02 15:04:05"), html.EscapeString(rev.BucketName), op,
+            html.EscapeString(rev.Admin), html.EscapeString(rev.Reason))
+    }
+
+    fmt.Fprintf(w, `<html><head><meta charset=utf-8></head><body>
+        <p><b>封禁中的桶</b></p>
+        <table border=1>
+        <tr><td>Bucket</td><td>LimitQuota</td><td>Since</td><td>Admin</td><td>Reason</td><td></td></tr>
+        %s
+        </table>
+        <p><b>封禁桶</b>(立即生效，不需要审批)</p>
+        <form action="/blocks" method="post">
+        <table border=0>
+        <tr><td>Bucket</td><td><input type="text" name="Bucket"></input></td></tr>
+        <tr><td>Admin</td><td><input type="text" name="Admin"></input></td></tr>
+        <tr><td>Password</td><td><input type="password" name="Password"></input></td></tr>
+        <tr><td>Reason</td><td><input type="text" name="Reason"></input></td></tr>
+        <tr><td><input type="submit" name="Op" value="Block"></input></td></tr>
+        </table>
+        </form>
+        <p><b>封禁记录</b></p>
+        <table border=1>
+        <tr><td>Revision</td><td>Time</td><td>Bucket</td><td>Op</td><td>Admin</td><td>Reason</td></tr>
+        %s
+        </table>
+        </body></html>`, lines, events)
+}
+
+
+// 封禁状态及封禁时的修改记录
+type BlockStatus struct {
+    BucketName  string
+    Blocked     bool
+    Since       *QuotaRevision `json:",omitempty"`
+}
+
+
+/* 桶封禁API:
+** GET    /api/v1/buckets/{name}/block  获取桶的封禁状态
+** PUT    /api/v1/buckets/{name}/block  封禁桶，请求体为{"Reason": "..."}，Reason不能为空
+** DELETE /api/v1/buckets/{name}/block  解除封禁
+*/
+func apiBucketBlock(w http.ResponseWriter, r *http.Request, bucket string) {
+    admin, ok := apiAuth(w, r)
+    if !ok {
+        return
+    }
+
+    status := func() (*BlockStatus) {
+        s := &BlockStatus{BucketName: bucket, Blocked: isBlocked(bucket)}
+        if s.Blocked {
+            _, since := blockedBuckets()
+            s.Since = since[bucket]
+        }
+        return s
+    }
+
+    switch r.Method {
+    case "GET":
+        writeJson(w, http.StatusOK, status())
+
+    case "PUT":
+        form, errMsg := getFormFromBody(r)
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "MalformedJson", errMsg)
+            return
+        }
+        errMsg, err := blockBucket(bucket, admin, form.Get("Reason"))
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "InvalidArgument", errMsg)
+            return
+        }
+        if err != nil {
+            writeSaveError(w, err)
+            return
+        }
+        writeJson(w, http.StatusOK, status())
+
+    case "DELETE":
+        reason := ""
+        if r.ContentLength > 0 {
+            form, errMsg := getFormFromBody(r)
+            if errMsg != "" {
+                writeApiError(w, http.StatusBadRequest, "MalformedJson", errMsg)
+                return
+            }
+            reason = form.Get("Reason")
+        }
+        errMsg, err := unblockBucket(bucket, admin, reason)
+        if errMsg != "" {
+            writeApiError(w, http.StatusNotFound, "NotBlocked", errMsg)
+            return
+        }
+        if err != nil {
+            writeSaveError(w, err)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET, PUT and DELETE are allowed")
+    }
+}
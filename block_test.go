@@ -0,0 +1,177 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+    "time"
+)
+
+
+func TestBlockBucket(t *testing.T) {
+    defer clearBucket("blk")
+    setQuota("blk", 1, testQuota(100, 10, 0, 0), "alice", "")
+
+    if errMsg, err := blockBucket("blk", "alice", "abuse"); errMsg != "" || err != nil {
+        t.Fatalf("block: %q %v", errMsg, err)
+    }
+    if q := quotaRegistry.Get("blk", 1); !q.Blocked || q.RateQuota != 100 {
+        t.Fatalf("blocked quota is %+v", q)
+    }
+    if errMsg, _ := blockBucket("blk", "alice", "again"); errMsg == "" {
+        t.Fatal("blocked twice")
+    }
+
+    // 封禁期间修改、删除限速配额都保持封禁
+    setQuota("blk", 1, testQuota(300, 10, 0, 0), "bob", "")
+    if q := quotaRegistry.Get("blk", 1); !q.Blocked || q.RateQuota != 300 {
+        t.Fatalf("modified quota is %+v", q)
+    }
+    delQuota("blk", 1, "bob", "")
+    if !isBlocked("blk") {
+        t.Fatal("block lost after delete")
+    }
+    setQuota("blk", 1, testQuota(200, 0, 0, 0), "bob", "")
+
+    buckets, since := blockedBuckets()
+    if len(buckets) != 1 || buckets[0] != "blk" || since["blk"] == nil || since["blk"].Reason != "block: abuse" {
+        t.Fatalf("blocked buckets are %v %v", buckets, since)
+    }
+    l := nginxLimitData("127.0.0.1:80", effectiveQuota("blk", 1))
+    if !l.LimitBlock || l.LimitRate != 1 || l.LimitConn != 1 || l.LimitQps != 1 {
+        t.Fatalf("blocked limit data is %+v", l)
+    }
+
+    if errMsg, err := unblockBucket("blk", "alice", ""); errMsg != "" || err != nil {
+        t.Fatalf("unblock: %q %v", errMsg, err)
+    }
+    if q := quotaRegistry.Get("blk", 1); q == nil || q.Blocked || q.RateQuota != 200 {
+        t.Fatalf("unblocked quota is %+v", q)
+    }
+    if errMsg, _ := unblockBucket("blk", "alice", ""); errMsg == "" {
+        t.Fatal("unblocked twice")
+    }
+    if revs := blockEvents(2); len(revs) != 2 || revs[0].Reason != "unblock: manual" || revs[1].Reason != "block: abuse" {
+        t.Fatalf("block events are %+v", revs)
+    }
+}
+
+
+func TestBlockInvalid(t *testing.T) {
+    for _, bucket := range []string{"", "TotalStatistic", "blk-*", "a*b"} {
+        if errMsg, _ := blockBucket(bucket, "alice", "abuse"); errMsg == "" {
+            t.Errorf("block %q accepted", bucket)
+        }
+    }
+    if errMsg, _ := blockBucket("blk", "alice", ""); errMsg == "" {
+        t.Error("block without reason accepted")
+    }
+    if errMsg, _ := unblockBucket("never-blocked", "alice", ""); errMsg == "" {
+        t.Error("unblock of unblocked bucket accepted")
+    }
+}
+
+
+// 封禁前只有通配配额的桶，解除封禁后删除精确配额，重新继承通配配额
+func TestUnblockRestoresPattern(t *testing.T) {
+    emptyQuotas(t)
+    setQuota("shadow-*", 1, testQuota(50, 0, 0, 0), "alice", "")
+
+    blockBucket("shadow-a", "alice", "abuse")
+    if q := effectiveQuota("shadow-a", 1); q == nil || !q.Blocked {
+        t.Fatalf("effective quota while blocked is %+v", q)
+    }
+    if q := effectiveQuota("shadow-b", 1); q == nil || q.Blocked {
+        t.Fatalf("block leaked to other buckets: %+v", q)
+    }
+
+    unblockBucket("shadow-a", "alice", "")
+    if q := quotaRegistry.Get("shadow-a", 1); q != nil {
+        t.Fatalf("exact quota left after unblock: %+v", q)
+    }
+    if q := effectiveQuota("shadow-a", 1); q == nil || q.Blocked || q.RateQuota != 50 {
+        t.Fatalf("effective quota after unblock is %+v", q)
+    }
+}
+
+
+// 提额期间被封禁的桶，提额结束恢复原配额并保持封禁；封禁中的桶不能提额
+func TestBoostBlocked(t *testing.T) {
+    defer clearBucket("blk-boost")
+    setQuota("blk-boost", 1, testQuota(100, 0, 0, 0), "alice", "")
+    expire := time.Now().Add(time.Hour).Unix()
+    if errMsg, _ := setBoost("blk-boost", testQuota(1000, 0, 0, 0), expire, "alice", ""); errMsg != "" {
+        t.Fatal(errMsg)
+    }
+    blockBucket("blk-boost", "alice", "abuse")
+
+    if ok, err := endBoost("blk-boost", "system", "expired"); !ok || err != nil {
+        t.Fatalf("endBoost: %v %v", ok, err)
+    }
+    if q := quotaRegistry.Get("blk-boost", 1); q == nil || !q.Blocked || q.RateQuota != 100 {
+        t.Fatalf("quota after boost ended is %+v", q)
+    }
+    if errMsg, _ := setBoost("blk-boost", testQuota(1000, 0, 0, 0), expire, "alice", ""); errMsg == "" {
+        t.Fatal("blocked bucket boosted")
+    }
+
+    unblockBucket("blk-boost", "alice", "")
+    if q := quotaRegistry.Get("blk-boost", 1); q == nil || q.Blocked || q.RateQuota != 100 {
+        t.Fatalf("quota after unblock is %+v", q)
+    }
+}
+
+
+// 提额前不限速的桶被封禁后提额结束，只保留封禁标记，解除封禁后删除限速配额
+func TestBoostBlockedWithoutPrevious(t *testing.T) {
+    defer clearBucket("blk-boost-new")
+    setBoost("blk-boost-new", testQuota(1000, 0, 0, 0), time.Now().Add(time.Hour).Unix(), "alice", "")
+    blockBucket("blk-boost-new", "alice", "abuse")
+
+    endBoost("blk-boost-new", "system", "expired")
+    if q := quotaRegistry.Get("blk-boost-new", 1); q == nil || !q.Blocked || q.RateQuota != 0 {
+        t.Fatalf("quota after boost ended is %+v", q)
+    }
+    unblockBucket("blk-boost-new", "alice", "")
+    if q := quotaRegistry.Get("blk-boost-new", 1); q != nil {
+        t.Fatalf("quota after unblock is %+v", q)
+    }
+}
+
+
+func TestRollbackBlocked(t *testing.T) {
+    defer clearBucket("blk-rb")
+    setQuota("blk-rb", 1, testQuota(100, 0, 0, 0), "alice", "")
+    rev := getBucketHistory("blk-rb")[0].Revision
+    blockBucket("blk-rb", "alice", "abuse")
+    setQuota("blk-rb", 1, testQuota(90, 0, 0, 0), "alice", "")
+
+    if _, errMsg, err := rollbackQuota("blk-rb", rev, "bob", ""); errMsg != "" || err != nil {
+        t.Fatalf("rollback: %q %v", errMsg, err)
+    }
+    if q := quotaRegistry.Get("blk-rb", 1); q == nil || !q.Blocked || q.RateQuota != 100 {
+        t.Fatalf("rolled back quota is %+v", q)
+    }
+}
+
+
+func TestApiBlock(t *testing.T) {
+    defer clearBucket("api-blk")
+    path := "/api/v1/buckets/api-blk/block"
+
+    if w := callApi(apiBucketQuota, "alice", "PUT", path, `{}`); w.Code != http.StatusBadRequest {
+        t.Fatalf("PUT without reason: got %d", w.Code)
+    }
+    if w := callApi(apiBucketQuota, "alice", "PUT", path, `{"Reason": "abuse"}`); w.Code != http.StatusOK {
+        t.Fatalf("PUT: got %d %s", w.Code, w.Body.String())
+    }
+    w := callApi(apiBucketQuota, "bob", "GET", path, "")
+    if w.Code != http.StatusOK || !isBlocked("api-blk") {
+        t.Fatalf("GET: got %d %s", w.Code, w.Body.String())
+    }
+    if w = callApi(apiBucketQuota, "bob", "DELETE", path, `{"Reason": "fixed"}`); w.Code != http.StatusNoContent {
+        t.Fatalf("DELETE: got %d %s", w.Code, w.Body.String())
+    }
+    if w = callApi(apiBucketQuota, "bob", "DELETE", path, ""); w.Code != http.StatusNotFound {
+        t.Fatalf("DELETE unblocked: got %d", w.Code)
+    }
+}
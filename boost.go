@@ -0,0 +1,469 @@
+/* LimitServer临时提额模块，提供以下功能:
+** 1. 为桶的限速配额设置一个带过期时间的临时配额，例如数据迁移期间放宽几个小时带宽
+** 2. 到期后自动恢复提额前的限速配额，持久化并同步至所有前端Nginx，并发送通知
+** 3. 通过WEB页面、API查看和取消临时提额，活跃的提额在/all页面展示
+** 临时提额以json格式保存在./conf/boosts，每个提额一行
+*/
+
+package main
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "bytes"
+    "html"
+    "sort"
+    "time"
+    "bufio"
+    "sync"
+    "strings"
+    "strconv"
+    "net/url"
+    "net/http"
+    "encoding/json"
+)
+
+
+const boostFile = "./conf/boosts"
+
+
+// 桶的一次临时提额，Previous为提额前的限速配额，nil表示提额前不限速
+type QuotaBoost struct {
+    BucketName  string
+    Admin       string
+    Reason      string
+    Start       int64
+    Expire      int64
+    Previous    *BucketQuota
+    Boost       *BucketQuota
+}
+
+
+/* 当前生效的临时提额，key为桶名，由boostLock保护
+** 修改提额时整体替换为新的QuotaBoost，取出的提额只读
+** 需要同时修改配额时先获取boostLock，再获取注册表写锁
+*/
+var quotaBoosts map[string]*QuotaBoost
+var boostLock sync.Mutex
+
+
+// 加载磁盘上的临时提额
+func loadBoosts() {
+    boostLock.Lock()
+    defer boostLock.Unlock()
+    quotaBoosts = make(map[string]*QuotaBoost)
+
+    f, err := os.Open(boostFile)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            GErrorLogger.Error("open boost file[%s] failed: [%s]", boostFile, err)
+        }
+        return
+    }
+    defer f.Close()
+
+    r := bufio.NewReader(f)
+    for {
+        buf, err := r.ReadBytes('\n')
+        if len(trimLine(buf)) > 0 {
+            b := new(QuotaBoost)
+            if jerr := json.Unmarshal(buf, b); jerr != nil {
+                GErrorLogger.Error("Unmarshal boost [%s] failed: [%s]", buf, jerr)
+            } else {
+                quotaBoosts[b.BucketName] = b
+            }
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            GErrorLogger.Error("read boost file [%s] failed: [%s]", boostFile, err)
+            break
+        }
+    }
+    GLogger.Info("read boost file [%s] done, %d active boosts", boostFile, len(quotaBoosts))
+}
+
+
+/* 持久化临时提额，先写入boosts.new并fsync再重命名，调用者必须持有boostLock
+** 返回值：持久化失败的原因
+*/
+func updateDiskBoosts() (error) {
+    var data bytes.Buffer
+    for key, b := range quotaBoosts {
+        buf, err := json.Marshal(b)
+        if err != nil {
+            GErrorLogger.Error("json Marshal boost[%s]failed: [%s]", key, err)
+            return err
+        }
+        data.Write(append(buf, '\n'))
+    }
+
+    newfile := boostFile + ".new"
+    err := writeFileSync(newfile, data.Bytes())
+    if err == nil {
+        err = os.Rename(newfile, boostFile)
+    }
+    if err != nil {
+        GErrorLogger.Error("save boost file [%s] failed: [%s]", boostFile, err)
+    }
+    return err
+}
+
+
+// 两个配额是否相同，用于判断提额期间限速配额是否被手工修改过
+func sameQuota(a *BucketQuota, b *BucketQuota) (bool) {
+    if a == nil || b == nil {
+        return a == b
+    }
+    ja, _ := json.Marshal(a)
+    jb, _ := json.Marshal(b)
+    return string(ja) == string(jb)
+}
+
+
+/* 为桶@bucket设置临时提额@quota，@expire时刻到期
+** 桶已经在提额中时只更新提额配额和到期时间，到期后仍恢复最初的配额
+** 返回值：""代表成功，否则为出错原因；配额持久化失败的原因
+*/
+func setBoost(bucket string, quota *BucketQuota, expire int64, admin string, reason string) (string, error) {
+    if bucket == "TotalStatistic" {
+        return "TotalStatistic不支持临时提额", nil
+    }
+    if errMsg := checkBucketName(bucket); errMsg != "" {
+        return errMsg, nil
+    }
+    if expire <= time.Now().Unix() {
+        return "到期时间必须晚于当前时间", nil
+    }
+
+    boostLock.Lock()
+    defer boostLock.Unlock()
+    quotaRegistry.Lock()
+    defer quotaRegistry.Unlock()
+    if isBlocked(bucket) {
+        return "桶" + bucket + "已被封禁，请先解除封禁", nil
+    }
+    // 提额不能绕过审批大幅降低限速配额，全0的提额配额表示不限速，总是放宽
+    quota.QuotaType = 1
+    if !isUnlimited(quota) {
+        if why := needApproval(bucket, 1, quota); why != "" {
+            return "提额配额低于当前限速配额(" + why + ")，请通过修改配额提交审批", nil
+        }
+    }
+
+    b := &QuotaBoost{BucketName: bucket}
+    old, boosting := quotaBoosts[bucket]
+    if boosting {
+        b.Previous = old.Previous
+    } else if current := quotaRegistry.Get(bucket, 1); current != nil {
+        p := *current
+        b.Previous = &p
+    }
+    b.Admin  = admin
+    b.Reason = reason
+    b.Start  = time.Now().Unix()
+    b.Expire = expire
+
+    if reason == "" {
+        reason = "temporary boost"
+    }
+    reason = fmt.Sprintf("%s (expire at %s)", reason, time.Unix(expire, 0).Format("2006-01-02 15:04:05"))
+    before := quotaRegistry.Get(bucket, 1)
+    if err := setQuotaLocked(bucket, 1, quota, admin, reason); err != nil {
+        return "", err
+    }
+
+    // 全0的提额配额表示提额期间不限速
+    if current := quotaRegistry.Get(bucket, 1); current != nil {
+        q := *current
+        b.Boost = &q
+    }
+    quotaBoosts[bucket] = b
+    if err := updateDiskBoosts(); err != nil {
+        // 提额记录没有保存，撤销提额，避免重启后提额不再到期
+        if boosting {
+            quotaBoosts[bucket] = old
+        } else {
+            delete(quotaBoosts, bucket)
+        }
+        if rerr := putQuotaLocked(bucket, 1, before, admin, "revert boost: save boosts failed"); rerr != nil {
+            GErrorLogger.Error("revert boost of bucket %s failed: [%s]", bucket, rerr)
+        }
+        return "", err
+    }
+    GLogger.Info("Admin %s boost bucket %s limit quota until %d", admin, bucket, expire)
+    return "", nil
+}
+
+
+/* 结束桶@bucket的临时提额，恢复提额前的限速配额并通知
+** 提额期间限速配额被手工修改过时，保留修改后的配额，只结束提额；封禁不算作修改，恢复后保持封禁
+** 比较和恢复在同一次注册表写锁内完成，避免覆盖并发的修改
+** 返回值：桶不在提额中时返回false；持久化失败的原因，此时保留提额，到期检查时重试
+*/
+func endBoost(bucket string, admin string, reason string) (bool, error) {
+    boostLock.Lock()
+    defer boostLock.Unlock()
+    b, ok := quotaBoosts[bucket]
+    if !ok {
+        return false, nil
+    }
+
+    quotaRegistry.Lock()
+    defer quotaRegistry.Unlock()
+    msg := fmt.Sprintf("Bucket %s boost ended (%s), limit quota was modified during boost, keep current quota", bucket, reason)
+    if sameQuota(unblockedQuota(quotaRegistry.Get(bucket, 1)), b.Boost) {
+        // 提额期间被封禁的桶恢复配额后保持封禁
+        var previous *BucketQuota
+        if b.Previous != nil {
+            p := *b.Previous
+            previous = &p
+        }
+        previous = keepBlocked(bucket, previous)
+        if err := putQuotaLocked(bucket, 1, previous, admin, "boost " + reason); err != nil {
+            return true, err
+        }
+        msg = fmt.Sprintf("Bucket %s boost ended (%s), limit quota restored to %s", bucket, reason, describeQuota(previous))
+    }
+    delete(quotaBoosts, bucket)
+    if err := updateDiskBoosts(); err != nil {
+        // 保留提额记录，到期检查时重试
+        quotaBoosts[bucket] = b
+        return true, err
+    }
+    GLogger.Info(msg)
+    SendWarn(msg)
+    return true, nil
+}
+
+
+// 每30秒检查一次临时提额是否到期，到期后恢复提额前的配额
+func boostWatcher() {
+    GLogger.Info("Start quota boost watcher")
+    for {
+        now := time.Now().Unix()
+        for _, b := range sortedBoosts() {
+            if b.Expire <= now {
+                if _, err := endBoost(b.BucketName, "system", "expired"); err != nil {
+                    GErrorLogger.Error("end boost of bucket %s failed: [%s]", b.BucketName, err)
+                }
+            }
+        }
+        time.Sleep(30 * time.Second)
+    }
+}
+
+
+// 获取桶@bucket的临时提额，不在提额中时返回nil
+func getBoost(bucket string) (*QuotaBoost) {
+    boostLock.Lock()
+    defer boostLock.Unlock()
+    return quotaBoosts[bucket]
+}
+
+
+// 按到期时间排序的临时提额
+func sortedBoosts() ([]*QuotaBoost) {
+    boostLock.Lock()
+    boosts := make([]*QuotaBoost, 0, len(quotaBoosts))
+    for _, b := range quotaBoosts {
+        boosts = append(boosts, b)
+    }
+    boostLock.Unlock()
+    sort.Slice(boosts, func(i, j int) bool { return boosts[i].Expire < boosts[j].Expire })
+    return boosts
+}
+
+
+/* 从@form中解析临时提额的到期时间
+** Duration为时长，如"4h"、"90m"；Expire为到期时刻，格式"2006-01-02 15:04"或unix时间戳
+*/
+func getBoostExpire(form url.Values) (int64, string) {
+    duration := strings.TrimSpace(form.Get("Duration"))
+    if duration != "" {
+        d, err := time.ParseDuration(duration)
+        if err != nil || d <= 0 {
+            return 0, "Duration格式错误，如4h、90m"
+        }
+        return time.Now().Add(d).Unix(), ""
+    }
+
+    expire := strings.TrimSpace(form.Get("Expire"))
+    if expire == "" {
+        return 0, "Duration和Expire不能都为空"
+    }
+    if ts, err := strconv.ParseInt(expire, 10, 64); err == nil {
+        return ts, ""
+    }
+    t, err := time.ParseInLocation("2006-01-02 15:04", expire, time.Local)
+    if err != nil {
+        return 0, "Expire格式应为2006-01-02 15:04"
+    }
+    return t.Unix(), ""
+}
+
+
+// /all页面中活跃提额的展示
+func boostSummary() (string) {
+    boosts := sortedBoosts()
+    if len(boosts) == 0 {
+        return ""
+    }
+    url := "http://" + Host + ":" + HttpPort
+    out := fmt.Sprintf(`<p><b>临时提额 %d</b> <a href=%s/boosts>Manage</a></p>`, len(boosts), url)
+    for _, b := range boosts {
+        out += fmt.Sprintf(`<p>%s: %s, expire at %s, by %s %s</p>`, html.EscapeString(b.BucketName), html.EscapeString(describeQuota(b.Boost)),
+                           time.Unix(b.Expire, 0).Format("2006-01-02 15:04:05"), html.EscapeString(b.Admin), html.EscapeString(b.Reason))
+    }
+    return out
+}
+
+
+// 临时提额WEB页面，GET展示所有提额，POST设置或取消提额
+func handlerBoosts(w http.ResponseWriter, r *http.Request) {
+    if r.Method == "POST" {
+        r.ParseForm()
+        user := r.Form.Get("Admin")
+        passwd := r.Form.Get("Password")
+        value, find := admins[user]
+        bucket := strings.TrimSpace(r.Form.Get("Bucket"))
+        errMsg := ""
+        if user == "" || passwd == "" {
+            errMsg = "用户名或密码不能为空"
+        } else if !find || value != passwd {
+            errMsg = "非管理员登陆"
+        } else if r.Form.Get("Op") == "Cancel" {
+            found, serr := endBoost(bucket, user, "cancelled")
+            if !found {
+                errMsg = "桶" + bucket + "没有临时提额"
+            } else if serr != nil {
+                errMsg = saveErrMsg(serr)
+            }
+        } else {
+            expire, err := getBoostExpire(r.Form)
+            if err != "" {
+                errMsg = err
+            } else {
+                r.Form.Del("Warn")
+                quota, err := getParFromForm(r.Form)
+                if err != "" {
+                    errMsg = err
+                } else {
+                    var serr error
+                    if errMsg, serr = setBoost(bucket, quota, expire, user, r.Form.Get("Reason")); serr != nil {
+                        errMsg = saveErrMsg(serr)
+                    }
+                }
+            }
+        }
+        if errMsg == "" {
+            errMsg = "OK!"
+        }
+        fmt.Fprintf(w, `<html><head><meta charset=utf-8><meta http-equiv="refresh" content="2; url=http://%s:%s/boosts" /></head><body>%s</body></html>`, Host, HttpPort, html.EscapeString(errMsg))
+        return
+    }
+
+    lines := ""
+    for _, b := range sortedBoosts() {
+        lines += fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td>
+            <td><form action="/boosts" method="post">
+            <input type="hidden" name="Bucket" value="%s"></input>
+            Admin<input type="text" name="Admin"></input>
+            Password<input type="password" name="Password"></input>
+            <input type="submit" name="Op" value="Cancel"></input>
+            </form></td></tr>`, html.EscapeString(b.BucketName), html.EscapeString(describeQuota(b.Previous)),
+            html.EscapeString(describeQuota(b.Boost)),
+            time.Unix(b.Start, 0).Format("2006-01-02 15:04:05"), time.Unix(b.Expire, 0).Format("2006-01-02 15:04:05"),
+            html.EscapeString(b.Admin), html.EscapeString(b.Reason), html.EscapeString(b.BucketName))
+    }
+    fmt.Fprintf(w, `<html><head><meta charset=utf-8></head><body>
+        <p><b>临时提额</b></p>
+        <table border=1>
+        <tr><td>Bucket</td><td>Previous</td><td>Boost</td><td>Start</td><td>Expire</td><td>Admin</td><td>Reason</td><td></td></tr>
+        %s
+        </table>
+        <form action="/boosts" method="post">
+        <table border=0>
+        <tr><td>Bucket</td><td><input type="text" name="Bucket"></input></td></tr>
+        <tr><td>Rate(B/s)</td><td><input type="text" name="Rate"></input></td></tr>
+        <tr><td>QPS</td><td><input type="text" name="QPS"></input></td></tr>
+        <tr><td>Connection</td><td><input type="text" name="Connection"></input></td></tr>
+        <tr><td>RatePerConn(B/s)</td><td><input type="text" name="RatePerConn"></input></td></tr>
+        %s
+        <tr><td>Template</td><td><input type="text" name="Template"></input></td></tr>
+        <tr><td>Duration(如4h)</td><td><input type="text" name="Duration"></input></td></tr>
+        <tr><td>Expire(2006-01-02 15:04)</td><td><input type="text" name="Expire"></input></td></tr>
+        <tr><td>Admin</td><td><input type="text" name="Admin"></input></td></tr>
+        <tr><td>Password</td><td><input type="password" name="Password"></input></td></tr>
+        <tr><td>Reason</td><td><input type="text" name="Reason"></input></td></tr>
+        <tr><td><input type="submit" value="Boost"></input></td></tr>
+        </table>
+        </form></body></html>`, lines, optionalInputs("", 1))
+}
+
+
+/* 临时提额API:
+** GET    /api/v1/buckets/{name}/boost  获取桶的临时提额
+** PUT    /api/v1/buckets/{name}/boost  设置临时提额，请求体为限速配额加Duration或Expire
+** DELETE /api/v1/buckets/{name}/boost  提前结束临时提额，恢复提额前的配额
+*/
+func apiBucketBoost(w http.ResponseWriter, r *http.Request, bucket string) {
+    admin, ok := apiAuth(w, r)
+    if !ok {
+        return
+    }
+
+    switch r.Method {
+    case "GET":
+        b := getBoost(bucket)
+        if b == nil {
+            writeApiError(w, http.StatusNotFound, "NoSuchBoost", "no boost for bucket " + bucket)
+            return
+        }
+        writeJson(w, http.StatusOK, b)
+
+    case "PUT":
+        form, errMsg := getFormFromBody(r)
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "MalformedJson", errMsg)
+            return
+        }
+        expire, errMsg := getBoostExpire(form)
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "InvalidArgument", errMsg)
+            return
+        }
+        quota, errMsg := getParFromForm(form)
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "InvalidArgument", errMsg)
+            return
+        }
+        errMsg, err := setBoost(bucket, quota, expire, admin, form.Get("Reason"))
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "InvalidArgument", errMsg)
+            return
+        }
+        if err != nil {
+            writeSaveError(w, err)
+            return
+        }
+        writeJson(w, http.StatusOK, getBoost(bucket))
+
+    case "DELETE":
+        found, err := endBoost(bucket, admin, "cancelled")
+        if !found {
+            writeApiError(w, http.StatusNotFound, "NoSuchBoost", "no boost for bucket " + bucket)
+            return
+        }
+        if err != nil {
+            writeSaveError(w, err)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET, PUT and DELETE are allowed")
+    }
+}
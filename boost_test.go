@@ -0,0 +1,140 @@
+package main
+
+import (
+    "net/http"
+    "net/url"
+    "testing"
+    "time"
+)
+
+
+func TestBoostRestore(t *testing.T) {
+    defer clearBucket("boost")
+    setQuota("boost", 1, testQuota(100, 10, 0, 0), "alice", "")
+    expire := time.Now().Add(time.Hour).Unix()
+
+    if errMsg, _ := setBoost("boost", testQuota(1000, 10, 0, 0), expire, "alice", "migration"); errMsg != "" {
+        t.Fatal(errMsg)
+    }
+    if quotaRegistry.Get("boost", 1).RateQuota != 1000 {
+        t.Fatal("boost not applied")
+    }
+    // 再次提额只更新提额配额，到期后仍恢复最初的配额
+    if errMsg, _ := setBoost("boost", testQuota(5000, 10, 0, 0), expire + 60, "bob", "more"); errMsg != "" {
+        t.Fatal(errMsg)
+    }
+    b := getBoost("boost")
+    if b.Previous.RateQuota != 100 || b.Boost.RateQuota != 5000 || b.Admin != "bob" || b.Expire != expire + 60 {
+        t.Fatalf("boost is %+v", b)
+    }
+
+    // 磁盘上的提额在重启后仍然生效
+    loadBoosts()
+    if b = getBoost("boost"); b == nil || b.Previous.RateQuota != 100 {
+        t.Fatalf("reloaded boost is %+v", b)
+    }
+
+    if ok, _ := endBoost("boost", "system", "expired"); !ok {
+        t.Fatal("endBoost returned false")
+    }
+    if quotaRegistry.Get("boost", 1).RateQuota != 100 || getBoost("boost") != nil {
+        t.Fatalf("quota not restored: %+v", quotaRegistry.Get("boost", 1))
+    }
+    if ok, _ := endBoost("boost", "system", "expired"); ok {
+        t.Fatal("second endBoost should return false")
+    }
+    if revs := getBucketHistory("boost"); revs[0].Reason != "boost expired" || revs[0].Admin != "system" {
+        t.Fatalf("restore revision is %+v", revs[0])
+    }
+}
+
+
+// 提额前不限速的桶，提额结束后删除限速配额
+func TestBoostWithoutPrevious(t *testing.T) {
+    defer clearBucket("boost-new")
+    setBoost("boost-new", testQuota(100, 0, 0, 0), time.Now().Add(time.Hour).Unix(), "alice", "")
+    if b := getBoost("boost-new"); b == nil || b.Previous != nil {
+        t.Fatalf("boost is %+v", b)
+    }
+    endBoost("boost-new", "alice", "cancelled")
+    if _, ok := quotaRegistry.Snapshot()["boost-new"]; ok {
+        t.Fatal("limit quota should be deleted after boost")
+    }
+}
+
+
+// 提额期间手工修改过的配额在提额结束后保留
+func TestBoostModifiedDuringBoost(t *testing.T) {
+    defer clearBucket("boost-mod")
+    setQuota("boost-mod", 1, testQuota(100, 0, 0, 0), "alice", "")
+    setBoost("boost-mod", testQuota(1000, 0, 0, 0), time.Now().Add(time.Hour).Unix(), "alice", "")
+    setQuota("boost-mod", 1, testQuota(300, 0, 0, 0), "bob", "manual")
+
+    if ok, _ := endBoost("boost-mod", "system", "expired"); !ok {
+        t.Fatal("endBoost returned false")
+    }
+    if quotaRegistry.Get("boost-mod", 1).RateQuota != 300 || getBoost("boost-mod") != nil {
+        t.Fatalf("manual quota lost: %+v", quotaRegistry.Get("boost-mod", 1))
+    }
+}
+
+
+func TestBoostInvalid(t *testing.T) {
+    future := time.Now().Add(time.Hour).Unix()
+    if errMsg, _ := setBoost("TotalStatistic", testQuota(1, 0, 0, 0), future, "alice", ""); errMsg == "" {
+        t.Error("TotalStatistic should not be boosted")
+    }
+    if errMsg, _ := setBoost("a*b", testQuota(1, 0, 0, 0), future, "alice", ""); errMsg == "" {
+        t.Error("invalid bucket name should fail")
+    }
+    if errMsg, _ := setBoost("past", testQuota(1, 0, 0, 0), time.Now().Unix() - 1, "alice", ""); errMsg == "" {
+        t.Error("expire in the past should fail")
+    }
+
+    cases := []struct {
+        form url.Values
+        ok   bool
+    }{
+        {url.Values{"Duration": {"4h"}}, true},
+        {url.Values{"Duration": {"-1h"}}, false},
+        {url.Values{"Duration": {"soon"}}, false},
+        {url.Values{"Expire": {"2030-01-02 15:04"}}, true},
+        {url.Values{"Expire": {"1900000000"}}, true},
+        {url.Values{"Expire": {"tomorrow"}}, false},
+        {url.Values{}, false},
+    }
+    for _, c := range cases {
+        _, errMsg := getBoostExpire(c.form)
+        if (errMsg == "") != c.ok {
+            t.Errorf("getBoostExpire(%v): %q", c.form, errMsg)
+        }
+    }
+}
+
+
+func TestApiBoost(t *testing.T) {
+    defer clearBucket("api-boost")
+    path := "/api/v1/buckets/api-boost/boost"
+    setQuota("api-boost", 1, testQuota(100, 0, 0, 0), "alice", "")
+
+    w := callApi(apiBucketQuota, "alice", "PUT", path, `{"Rate": 900, "Connection": 0, "QPS": 0, "RatePerConn": 0, "Duration": "2h"}`)
+    if w.Code != http.StatusOK {
+        t.Fatalf("PUT: got %d %s", w.Code, w.Body.String())
+    }
+    w = callApi(apiBucketQuota, "bob", "GET", path, "")
+    if w.Code != http.StatusOK || getBoost("api-boost").Boost.RateQuota != 900 {
+        t.Fatalf("GET: got %d %s", w.Code, w.Body.String())
+    }
+    w = callApi(apiBucketQuota, "bob", "DELETE", path, "")
+    if w.Code != http.StatusNoContent || quotaRegistry.Get("api-boost", 1).RateQuota != 100 {
+        t.Fatalf("DELETE: got %d %s", w.Code, w.Body.String())
+    }
+    w = callApi(apiBucketQuota, "bob", "GET", path, "")
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("GET after DELETE: got %d", w.Code)
+    }
+    w = callApi(apiBucketQuota, "bob", "PUT", path, `{"Rate": 900, "Connection": 0, "QPS": 0, "RatePerConn": 0}`)
+    if w.Code != http.StatusBadRequest {
+        t.Fatalf("PUT without expire: got %d", w.Code)
+    }
+}
@@ -0,0 +1,355 @@
+/* LimitServer配额批量导入导出，用于在不同环境之间迁移配额:
+** 1. GET  /api/v1/quotas?format=jsonl|csv            导出全部配额
+** 2. POST /api/v1/quotas?format=jsonl|csv&mode=merge  导入配额，覆盖同名桶的同类配额
+** 3. POST /api/v1/quotas?format=jsonl|csv&mode=replace 导入配额，并删除导入数据中不存在的配额
+** jsonl格式与./conf/quota文件去掉首行校验头后相同，每行一个BucketQuota，以#开头的行被忽略
+** csv格式首行为表头: BucketName,QuotaType,RateQuota,ConnQuota,QpsQuota,RatePerConn,Schedules,Template,Overrides,
+** QpsGetQuota,QpsPutQuota,QpsDeleteQuota,QpsListQuota,QpsImageQuota,QpsVideoQuota,RateBurst,QpsBurst,RefillInterval,
+** Weight,Priority
+** 其中Schedules、Overrides为json格式，Schedules、Template、Overrides以及Overrides之后的各列可以为空
+** csv没有Blocked列，封禁状态不随csv导出导入，导入时保持桶当前的封禁状态
+*/
+
+package main
+
+import (
+    "io"
+    "fmt"
+    "bufio"
+    "sort"
+    "strconv"
+    "strings"
+    "net/http"
+    "encoding/csv"
+    "encoding/json"
+)
+
+
+var csvHeader = []string{"BucketName", "QuotaType", "RateQuota", "ConnQuota", "QpsQuota", "RatePerConn",
+                         "Schedules", "Template", "Overrides", "QpsGetQuota", "QpsPutQuota", "QpsDeleteQuota",
+                         "QpsListQuota", "QpsImageQuota", "QpsVideoQuota", "RateBurst", "QpsBurst", "RefillInterval",
+                         "Weight", "Priority"}
+
+
+// 导出全部配额，jsonl格式每个配额一行
+func exportQuota(w io.Writer, format string) {
+    if format == "csv" {
+        cw := csv.NewWriter(w)
+        cw.Write(csvHeader)
+        for _, value := range quotaRegistry.Snapshot() {
+            for _, v := range value {
+                if v == nil {
+                    continue
+                }
+                schedules, overrides := "", ""
+                if len(v.Schedules) > 0 {
+                    b, _ := json.Marshal(v.Schedules)
+                    schedules = string(b)
+                }
+                if len(v.Overrides) > 0 {
+                    b, _ := json.Marshal(v.Overrides)
+                    overrides = string(b)
+                }
+                rec := []string{v.BucketName, strconv.FormatInt(v.QuotaType, 10),
+                                strconv.FormatInt(v.RateQuota, 10), strconv.FormatInt(v.ConnQuota, 10),
+                                strconv.FormatInt(v.QpsQuota, 10), strconv.FormatInt(v.RatePerConn, 10),
+                                schedules, v.Template, overrides}
+                for _, field := range csvHeader[9:] {
+                    rec = append(rec, strconv.FormatInt(*quotaFieldPtr(v, field), 10))
+                }
+                cw.Write(rec)
+            }
+        }
+        cw.Flush()
+        return
+    }
+
+    for key, value := range quotaRegistry.Snapshot() {
+        for _, v := range value {
+            if v == nil {
+                continue
+            }
+            b, err := json.Marshal(v)
+            if err != nil {
+                GErrorLogger.Error("json Marshal[%s]failed: [%s]", key, err)
+                continue
+            }
+            w.Write(b)
+            w.Write([]byte("\n"))
+        }
+    }
+}
+
+
+// 检查导入的单个配额是否合法
+func checkImportQuota(q *BucketQuota) (string) {
+    if q.BucketName == "" {
+        return "BucketName is empty"
+    }
+    if errMsg := checkBucketName(q.BucketName); errMsg != "" {
+        return errMsg
+    }
+    if q.QuotaType != 0 && q.QuotaType != 1 {
+        return fmt.Sprintf("unknown QuotaType %d", q.QuotaType)
+    }
+    for _, f := range quotaFields {
+        if *quotaFieldPtr(q, f.Field) < 0 {
+            return f.Field + " should be in [0, +inf)"
+        }
+        if q.QuotaType == 0 && f.Optional && f.LimitOnly && *quotaFieldPtr(q, f.Field) != 0 {
+            return f.Field + " is only for limit quota"
+        }
+    }
+    if q.Template != "" {
+        if _, ok := getTemplate(q.Template); !ok {
+            return "unknown template " + q.Template
+        }
+    }
+    if len(q.Schedules) > 0 {
+        b, _ := json.Marshal(q.Schedules)
+        if _, errMsg := parseSchedules(string(b)); errMsg != "" {
+            return errMsg
+        }
+    }
+    return ""
+}
+
+
+/* 解析导入数据，任意一行出错则整体失败
+** 返回值：解析出的配额和出错原因，""代表成功
+*/
+func parseImportQuota(r io.Reader, format string) ([]*BucketQuota, string) {
+    quotas := make([]*BucketQuota, 0)
+
+    if format == "csv" {
+        records, err := csv.NewReader(r).ReadAll()
+        if err != nil {
+            return nil, fmt.Sprintf("parse csv failed: %s", err)
+        }
+        for i, rec := range records {
+            if i == 0 && len(rec) > 0 && rec[0] == csvHeader[0] {
+                continue
+            }
+            // 兼容缺少后面几列的旧格式
+            for len(rec) >= 6 && len(rec) < len(csvHeader) {
+                rec = append(rec, "")
+            }
+            if len(rec) != len(csvHeader) {
+                return nil, fmt.Sprintf("line %d: expect %d fields, got %d", i + 1, len(csvHeader), len(rec))
+            }
+            var nums [5]int64
+            for j := 0; j < 5; j++ {
+                nums[j], err = strconv.ParseInt(rec[j + 1], 10, 64)
+                if err != nil {
+                    return nil, fmt.Sprintf("line %d: %s is not a number", i + 1, csvHeader[j + 1])
+                }
+            }
+            q := &BucketQuota{BucketName: rec[0], QuotaType: nums[0], RateQuota: nums[1],
+                              ConnQuota: nums[2], QpsQuota: nums[3], RatePerConn: nums[4]}
+            var errMsg string
+            q.Schedules, errMsg = parseSchedules(rec[6])
+            if errMsg != "" {
+                return nil, fmt.Sprintf("line %d: %s", i + 1, errMsg)
+            }
+            q.Template = rec[7]
+            for j, field := range csvHeader[9:] {
+                if rec[9 + j] == "" {
+                    continue
+                }
+                if *quotaFieldPtr(q, field), err = strconv.ParseInt(rec[9 + j], 10, 64); err != nil {
+                    return nil, fmt.Sprintf("line %d: %s is not a number", i + 1, field)
+                }
+            }
+            if rec[8] != "" {
+                if err = json.Unmarshal([]byte(rec[8]), &q.Overrides); err != nil {
+                    return nil, fmt.Sprintf("line %d: Overrides is not a json object", i + 1)
+                }
+            }
+            if errMsg := checkImportQuota(q); errMsg != "" {
+                return nil, fmt.Sprintf("line %d: %s", i + 1, errMsg)
+            }
+            quotas = append(quotas, q)
+        }
+        return quotas, ""
+    }
+
+    br := bufio.NewReader(r)
+    for line := 1; ; line++ {
+        buf, err := br.ReadBytes('\n')
+        if len(trimLine(buf)) > 0 && buf[0] != '#' {
+            q := new(BucketQuota)
+            if jerr := json.Unmarshal(buf, q); jerr != nil {
+                return nil, fmt.Sprintf("line %d: %s", line, jerr)
+            }
+            if errMsg := checkImportQuota(q); errMsg != "" {
+                return nil, fmt.Sprintf("line %d: %s", line, errMsg)
+            }
+            quotas = append(quotas, q)
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Sprintf("read body failed: %s", err)
+        }
+    }
+    return quotas, ""
+}
+
+
+// 去掉行尾的空白字符
+func trimLine(buf []byte) ([]byte) {
+    for len(buf) > 0 {
+        c := buf[len(buf) - 1]
+        if c != '\n' && c != '\r' && c != ' ' && c != '\t' {
+            break
+        }
+        buf = buf[:len(buf) - 1]
+    }
+    return buf
+}
+
+
+/* 导入配额，@replace为true时删除导入数据中不存在的配额
+** 每个配额的变化都记录在修改历史中，导入在一次写锁内完成并持久化，
+** 解锁后发生变化的桶统一同步至所有前端Nginx
+** 导入不改变桶的封禁状态，封禁中的桶被删除限速配额时保留只有封禁标记的限速配额
+** 导入会删除或大幅降低限速配额时需要审批，整体拒绝，请逐个修改配额提交审批
+** 返回值：导入的配额数；""代表成功，否则为出错原因；持久化失败的原因，此时导入整体撤销
+*/
+func importQuota(quotas []*BucketQuota, replace bool, admin string) (int, string, error) {
+    reason := "bulk import"
+
+    quotaRegistry.Lock()
+    defer quotaRegistry.Unlock()
+
+    imported := make(map[string]bool)
+    for _, q := range quotas {
+        imported[q.BucketName + "/" + strconv.FormatInt(q.QuotaType, 10)] = true
+    }
+
+    // 需要审批的变更
+    denied := make([]string, 0)
+    if replace {
+        for key, value := range quotaRegistry.Snapshot() {
+            if value[1] != nil && !imported[key + "/1"] {
+                if why := needApproval(key, 1, nil); why != "" {
+                    denied = append(denied, key + ": " + why)
+                }
+            }
+        }
+    }
+    for _, q := range quotas {
+        if q.QuotaType == 1 {
+            if why := needApproval(q.BucketName, 1, q); why != "" {
+                denied = append(denied, q.BucketName + ": " + why)
+            }
+        }
+    }
+    if len(denied) > 0 {
+        sort.Strings(denied)
+        return 0, "以下变更需要审批，请逐个修改配额: " + strings.Join(denied, "; "), nil
+    }
+
+    if replace {
+        for key, value := range quotaRegistry.Snapshot() {
+            for qt, v := range value {
+                if v == nil || imported[key + "/" + strconv.Itoa(qt)] {
+                    continue
+                }
+                // 封禁中的桶保留只有封禁标记的限速配额
+                var q *BucketQuota
+                if qt == 1 {
+                    q = keepBlocked(key, nil)
+                }
+                if !sameQuota(v, q) {
+                    replaceQuota(key, qt, q, admin, reason)
+                }
+            }
+        }
+    }
+
+    count := 0
+    for _, q := range quotas {
+        // 导入不改变桶的封禁状态，封禁和解除封禁见block.go
+        if q.QuotaType == 1 {
+            q.Blocked = false
+        }
+        // 全0的限速配额相当于不限速
+        if isUnlimited(q) {
+            if old := quotaRegistry.Get(q.BucketName, 1); old != nil {
+                if nq := keepBlocked(q.BucketName, nil); !sameQuota(old, nq) {
+                    replaceQuota(q.BucketName, 1, nq, admin, reason)
+                }
+            }
+        } else {
+            if q.QuotaType == 1 {
+                q = keepBlocked(q.BucketName, q)
+            }
+            replaceQuota(q.BucketName, int(q.QuotaType), q, admin, reason)
+        }
+        count++
+    }
+    if err := updateDiskQuota(); err != nil {
+        return 0, "", err
+    }
+    return count, "", nil
+}
+
+
+// /api/v1/quotas
+func apiBulkQuota(w http.ResponseWriter, r *http.Request) {
+    format := r.URL.Query().Get("format")
+    if format == "" {
+        format = "jsonl"
+    }
+    if format != "jsonl" && format != "csv" {
+        writeApiError(w, http.StatusBadRequest, "InvalidArgument", "format should be jsonl or csv")
+        return
+    }
+
+    admin, ok := apiAuth(w, r)
+    if !ok {
+        return
+    }
+
+    switch r.Method {
+    case "GET":
+        if format == "csv" {
+            w.Header().Set("Content-Type", "text/csv")
+        } else {
+            w.Header().Set("Content-Type", "application/x-ndjson")
+        }
+        exportQuota(w, format)
+
+    case "POST":
+        mode := r.URL.Query().Get("mode")
+        if mode == "" {
+            mode = "merge"
+        }
+        if mode != "merge" && mode != "replace" {
+            writeApiError(w, http.StatusBadRequest, "InvalidArgument", "mode should be merge or replace")
+            return
+        }
+
+        quotas, errMsg := parseImportQuota(r.Body, format)
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "InvalidArgument", errMsg)
+            return
+        }
+        count, errMsg, err := importQuota(quotas, mode == "replace", admin)
+        if errMsg != "" {
+            writeApiError(w, http.StatusConflict, "ApprovalRequired", errMsg)
+            return
+        }
+        if err != nil {
+            writeSaveError(w, err)
+            return
+        }
+        GLogger.Info("Admin %s imported %d quotas, format %s, mode %s", admin, count, format, mode)
+        writeJson(w, http.StatusOK, map[string]int{"Imported": count})
+
+    default:
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET and POST are allowed")
+    }
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+    "bytes"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+
+func TestParseImportQuota(t *testing.T) {
+    jsonl := `{"BucketName":"a","QuotaType":1,"RateQuota":100,"ConnQuota":2,"QpsQuota":3,"RatePerConn":4}
+
+{"BucketName":"b","QuotaType":0,"RateQuota":5}
+`
+    quotas, errMsg := parseImportQuota(strings.NewReader(jsonl), "jsonl")
+    if errMsg != "" {
+        t.Fatal(errMsg)
+    }
+    if len(quotas) != 2 || quotas[0].BucketName != "a" || quotas[0].RatePerConn != 4 || quotas[1].RateQuota != 5 {
+        t.Fatalf("jsonl parsed %+v", quotas)
+    }
+
+    csvData := "BucketName,QuotaType,RateQuota,ConnQuota,QpsQuota,RatePerConn\na,1,100,2,3,4\nb,0,5,0,0,0\n"
+    quotas, errMsg = parseImportQuota(strings.NewReader(csvData), "csv")
+    if errMsg != "" {
+        t.Fatal(errMsg)
+    }
+    if len(quotas) != 2 || quotas[0].QpsQuota != 3 || quotas[1].BucketName != "b" {
+        t.Fatalf("csv parsed %+v", quotas)
+    }
+
+    bad := []struct {
+        format string
+        data   string
+    }{
+        {"jsonl", `{"BucketName":"","QuotaType":1}`},
+        {"jsonl", `{"BucketName":"a","QuotaType":2}`},
+        {"jsonl", `{"BucketName":"a","QuotaType":1,"Weight":-1}`},
+        {"jsonl", `{"BucketName":"a","QuotaType":1,"RateQuota":-1}`},
+        {"jsonl", "{\"BucketName\":\"a\"}\nnot json\n"},
+        {"csv", "a,1,100\n"},
+        {"csv", "a,1,x,0,0,0\n"},
+    }
+    for _, c := range bad {
+        if _, errMsg := parseImportQuota(strings.NewReader(c.data), c.format); errMsg == "" {
+            t.Errorf("%s %q should fail", c.format, c.data)
+        }
+    }
+}
+
+
+// 导出再以replace方式导入，配额保持不变
+func TestExportImportRoundTrip(t *testing.T) {
+    emptyQuotas(t)
+
+    setQuota("rt-a", 1, testQuota(1000, 10, 100, 5), "alice", "")
+    setQuota("rt-a", 0, testQuota(2000, 0, 0, 0), "alice", "")
+    setQuota("rt-b", 1, testQuota(300, 0, 0, 0), "alice", "")
+
+    for _, format := range []string{"jsonl", "csv"} {
+        var buf bytes.Buffer
+        exportQuota(&buf, format)
+        quotas, errMsg := parseImportQuota(&buf, format)
+        if errMsg != "" {
+            t.Fatalf("%s: %s", format, errMsg)
+        }
+        if len(quotas) != 3 {
+            t.Fatalf("%s: exported %d quotas, want 3", format, len(quotas))
+        }
+
+        importQuota(quotas, true, "alice")
+        if len(quotaRegistry.Snapshot()) != 2 || quotaRegistry.Get("rt-a", 1).RatePerConn != 5 || quotaRegistry.Get("rt-a", 0).RateQuota != 2000 ||
+           quotaRegistry.Get("rt-b", 1).RateQuota != 300 {
+            t.Fatalf("%s: quotas changed after round trip", format)
+        }
+    }
+}
+
+
+func TestImportMergeAndReplace(t *testing.T) {
+    emptyQuotas(t)
+
+    setQuota("keep", 1, testQuota(100, 0, 0, 0), "alice", "")
+    setQuota("over", 1, testQuota(100, 0, 0, 0), "alice", "")
+
+    body := `{"BucketName":"over","QuotaType":1,"RateQuota":999}
+{"BucketName":"new","QuotaType":0,"RateQuota":7}
+`
+    w := callApi(apiBulkQuota, "alice", "POST", "/api/v1/quotas", body)
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Imported":2`) {
+        t.Fatalf("merge: got %d %s", w.Code, w.Body.String())
+    }
+    if quotaRegistry.Snapshot()["keep"] == nil || quotaRegistry.Get("over", 1).RateQuota != 999 || quotaRegistry.Get("new", 0).RateQuota != 7 {
+        t.Fatal("merge import result is wrong")
+    }
+
+    // 全0限速配额在导入时等同于删除
+    body = "BucketName,QuotaType,RateQuota,ConnQuota,QpsQuota,RatePerConn\nover,1,0,0,0,0\nnew,1,50,0,0,0\n"
+    w = callApi(apiBulkQuota, "alice", "POST", "/api/v1/quotas?format=csv&mode=replace", body)
+    if w.Code != http.StatusOK {
+        t.Fatalf("replace: got %d %s", w.Code, w.Body.String())
+    }
+    if len(quotaRegistry.Snapshot()) != 1 || quotaRegistry.Get("new", 1).RateQuota != 50 || quotaRegistry.Get("new", 0) != nil {
+        t.Fatalf("replace import result is wrong: %v", quotaRegistry.Snapshot())
+    }
+
+    // 出错时不修改任何配额
+    w = callApi(apiBulkQuota, "alice", "POST", "/api/v1/quotas?mode=replace", `{"BucketName":""}`)
+    if w.Code != http.StatusBadRequest || len(quotaRegistry.Snapshot()) != 1 {
+        t.Fatalf("bad import: got %d, %d buckets left", w.Code, len(quotaRegistry.Snapshot()))
+    }
+
+    w = callApi(apiBulkQuota, "alice", "GET", "/api/v1/quotas?format=csv", "")
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "new,1,50,0,0,0") {
+        t.Fatalf("export: got %d %s", w.Code, w.Body.String())
+    }
+
+    for _, path := range []string{"/api/v1/quotas?format=xml", "/api/v1/quotas?mode=append"} {
+        w = callApi(apiBulkQuota, "alice", "POST", path, "")
+        if w.Code != http.StatusBadRequest {
+            t.Errorf("POST %s: got %d, want 400", path, w.Code)
+        }
+    }
+}
+
+
+func TestApiAddAndDeleteBucket(t *testing.T) {
+    defer clearBucket("api-add")
+    path := "/api/v1/buckets/api-add/quota/limit"
+    body := `{"Rate": 100, "Connection": 0, "QPS": 0, "RatePerConn": 0}`
+
+    w := callApi(apiBucketQuota, "alice", "POST", path, body)
+    if w.Code != http.StatusOK {
+        t.Fatalf("first POST: got %d %s", w.Code, w.Body.String())
+    }
+    w = callApi(apiBucketQuota, "alice", "POST", path, body)
+    if w.Code != http.StatusConflict {
+        t.Fatalf("second POST: got %d, want 409", w.Code)
+    }
+    callApi(apiBucketQuota, "alice", "PUT", "/api/v1/buckets/api-add/quota/warn", body)
+
+    w = callApi(apiBucketQuota, "alice", "DELETE", "/api/v1/buckets/api-add", "")
+    if w.Code != http.StatusNoContent {
+        t.Fatalf("DELETE bucket: got %d %s", w.Code, w.Body.String())
+    }
+    if _, ok := quotaRegistry.Snapshot()["api-add"]; ok {
+        t.Fatal("bucket still has quotas")
+    }
+    w = callApi(apiBucketQuota, "alice", "DELETE", "/api/v1/buckets/api-add", "")
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("second DELETE bucket: got %d", w.Code)
+    }
+}
+
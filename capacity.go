@@ -0,0 +1,306 @@
+/* LimitServer集群容量限速模块:
+** 1. TotalStatistic的限速配额即集群容量(流量、连接数、QPS)
+** 2. 总体用量(TotalStatisticRing最近一分钟的平均值)达到容量的CapacityTrigger%时，
+**    按带权重和优先级的max-min公平算法为活跃桶计算限速配额，使总体用量不超过该水位
+** 3. 计算出的配额与桶自身的限速配额取较小值后同步至所有前端Nginx，
+**    总体用量低于容量的CapacityRelease%时自动解除
+** 桶的权重和优先级由其限速配额中的Weight、Priority设置，默认权重1、优先级0
+*/
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "container/ring"
+)
+
+
+// 计算用量时取最近一分钟的统计数据
+const capacityWindow = 60
+
+
+// 以下变量由capacityLock保护
+var capacityLock sync.Mutex
+// 各维度是否处于容量限速中，顺序同shareDims
+var capacityEnforced [3]bool
+// 最近一次计算时的总体用量
+var capacityUsage [3]float64
+// 容量限速中各桶分得的限速配额，key为桶名
+var capacityShares = make(map[string]*BucketQuota)
+
+
+// 一个桶在某个维度上的需求
+type fairDemand struct {
+    Bucket    string
+    Demand    float64
+    Weight    float64
+    Priority  int64
+}
+
+
+/* 环@r中最近capacityWindow秒统计数据的平均值，顺序同shareDims
+** 最新一个窗口可能仍在聚合中，不计入；调用者必须持有rwLocker读锁
+** 返回值：实际用量；Nginx上报的未限速时的期望用量
+*/
+func recentUsage(r *ring.Ring) ([3]float64, [3]float64) {
+    var sum, expected [3]float64
+    if r == nil {
+        return sum, expected
+    }
+    now := time.Now().Unix()
+    num := 0
+    r.Do(func(p interface{}) {
+        if p == nil {
+            return
+        }
+        bs := p.(*BucketStatistic)
+        if bs.TimeStamp <= now - capacityWindow || bs.TimeStamp > now - DURATION {
+            return
+        }
+        sum[0] += bs.StatisticBucketRate
+        sum[1] += bs.StatisticBucketConn
+        sum[2] += bs.StatisticBucketQps.QPSTotal
+        expected[0] += bs.ExpectedBucketRate
+        expected[1] += bs.ExpectedBucketConn
+        expected[2] += bs.ExpectedBucketQps
+        num++
+    })
+    if num > 0 {
+        for i := range sum {
+            sum[i] /= float64(num)
+            expected[i] /= float64(num)
+        }
+    }
+    return sum, expected
+}
+
+
+/* 带权重和优先级的max-min公平分配，按优先级从高到低依次分配剩余容量@capacity
+** 同一优先级内使用注水法求水位level，需求低于weight*level的桶得到满足，其余桶分得weight*level
+** 返回值：每个桶的上限weight*level；需求全部得到满足的优先级没有上限，不出现在返回值中
+** 上限取水位而不是需求，未用满份额的桶仍可以增长至水位
+*/
+func maxMinFair(capacity float64, demands []fairDemand) (map[string]float64) {
+    caps := make(map[string]float64)
+    tiers := make(map[int64][]fairDemand)
+    priorities := make([]int64, 0)
+    for _, d := range demands {
+        if _, ok := tiers[d.Priority]; !ok {
+            priorities = append(priorities, d.Priority)
+        }
+        tiers[d.Priority] = append(tiers[d.Priority], d)
+    }
+    sort.Slice(priorities, func(i, j int) bool { return priorities[i] > priorities[j] })
+
+    remaining := capacity
+    for _, p := range priorities {
+        tier := tiers[p]
+        sum, wsum := 0.0, 0.0
+        for _, d := range tier {
+            sum += d.Demand
+            wsum += d.Weight
+        }
+        if sum <= remaining {
+            remaining -= sum
+            continue
+        }
+
+        // 按单位权重需求从小到大注水
+        sort.Slice(tier, func(i, j int) bool { return tier[i].Demand / tier[i].Weight < tier[j].Demand / tier[j].Weight })
+        left, level := remaining, 0.0
+        for _, d := range tier {
+            level = left / wsum
+            if d.Demand / d.Weight > level {
+                break
+            }
+            left -= d.Demand
+            wsum -= d.Weight
+        }
+        for _, d := range tier {
+            caps[d.Bucket] = d.Weight * level
+        }
+        remaining = 0
+    }
+    return caps
+}
+
+
+// 桶@bucket的公平份额权重和优先级
+func bucketWeight(bucket string) (float64, int64) {
+    q := effectiveQuota(bucket, 1)
+    if q == nil {
+        return 1, 0
+    }
+    if q.Weight <= 0 {
+        return 1, q.Priority
+    }
+    return float64(q.Weight), q.Priority
+}
+
+
+/* 根据总体用量重新计算容量限速中各桶的限速配额
+** 份额发生变化的桶通知前端Nginx同步协程，容量限速开始或解除时报警
+** 容量限速中桶的实际用量已被限制，需求取实际用量与期望用量的较大值；
+** 重新计算后不再受限的桶保留上一轮的份额，只有总体用量低于CapacityRelease%时才统一解除，避免反复限速
+*/
+func updateCapacityShares() {
+    capacity := effectiveQuota("TotalStatistic", 1)
+
+    rwLocker.RLock()
+    total, _ := recentUsage(TotalStatisticRing)
+    usage := make(map[string][3]float64)
+    for key, value := range ringmap {
+        u, e := recentUsage(value)
+        for i := range u {
+            if e[i] > u[i] {
+                u[i] = e[i]
+            }
+        }
+        if u != [3]float64{} {
+            usage[key] = u
+        }
+    }
+    rwLocker.RUnlock()
+
+    msgs := make([]string, 0)
+    shares := make(map[string]*BucketQuota)
+    weights := make(map[string]float64)
+    priorities := make(map[string]int64)
+    for key, _ := range usage {
+        weights[key], priorities[key] = bucketWeight(key)
+    }
+
+    capacityLock.Lock()
+    capacityUsage = total
+    old := capacityShares
+    for i, d := range shareDims {
+        limit := 0.0
+        if capacity != nil {
+            limit = float64(*quotaFieldPtr(capacity, d.Field))
+        }
+        target := limit * float64(CapacityTrigger) / 100
+        was := capacityEnforced[i]
+        if limit <= 0 || total[i] < limit * float64(CapacityRelease) / 100 {
+            capacityEnforced[i] = false
+        } else if total[i] >= target {
+            capacityEnforced[i] = true
+        }
+        if capacityEnforced[i] != was {
+            state := "released"
+            if capacityEnforced[i] {
+                state = "reached"
+            }
+            msgs = append(msgs, fmt.Sprintf("Cluster %s capacity %s, usage<%.1f>, capacity<%d>", d.Key, state, total[i], int64(limit)))
+        }
+        if !capacityEnforced[i] {
+            continue
+        }
+
+        demands := make([]fairDemand, 0)
+        for key, u := range usage {
+            if u[i] > 0 {
+                demands = append(demands, fairDemand{Bucket: key, Demand: u[i], Weight: weights[key], Priority: priorities[key]})
+            }
+        }
+        caps := maxMinFair(target, demands)
+        if was {
+            for _, dm := range demands {
+                if _, ok := caps[dm.Bucket]; ok {
+                    continue
+                }
+                if o, ok := old[dm.Bucket]; ok && *quotaFieldPtr(o, d.Field) > 0 {
+                    caps[dm.Bucket] = float64(*quotaFieldPtr(o, d.Field))
+                }
+            }
+        }
+        for key, c := range caps {
+            q, ok := shares[key]
+            if !ok {
+                q = &BucketQuota{BucketName: key, QuotaType: 1}
+                shares[key] = q
+            }
+            v := int64(c)
+            if v < 1 {
+                v = 1
+            }
+            *quotaFieldPtr(q, d.Field) = v
+        }
+    }
+    capacityShares = shares
+    capacityLock.Unlock()
+
+    for b, q := range shares {
+        if !sameQuota(old[b], q) {
+            quotaRegistry.Notify(b)
+        }
+    }
+    for b, _ := range old {
+        if _, ok := shares[b]; !ok {
+            quotaRegistry.Notify(b)
+        }
+    }
+    for _, msg := range msgs {
+        GLogger.Info(msg)
+        SendWarn(msg)
+    }
+}
+
+
+// 每10秒检查一次总体用量并重新分配容量
+func capacityWatcher() {
+    GLogger.Info("Start cluster capacity watcher")
+    for {
+        updateCapacityShares()
+        time.Sleep(10 * time.Second)
+    }
+}
+
+
+// 容量限速中桶@bucket分得的限速配额，没有时返回nil
+func capacityShare(bucket string) (*BucketQuota) {
+    capacityLock.Lock()
+    defer capacityLock.Unlock()
+    s, ok := capacityShares[bucket]
+    if !ok {
+        return nil
+    }
+    q := *s
+    return &q
+}
+
+
+// 组限速和集群容量限速中桶@bucket分得的限速配额合并后的结果，没有时返回nil
+func sharedLimit(bucket string) (*BucketQuota) {
+    var q *BucketQuota
+    for _, s := range []*BucketQuota{groupShare(bucket), capacityShare(bucket)} {
+        if s == nil {
+            continue
+        }
+        if q == nil {
+            q = &BucketQuota{BucketName: bucket, QuotaType: 1}
+        }
+        mergeShare(q, s)
+    }
+    return q
+}
+
+
+// /all页面中集群容量限速的展示
+func capacitySummary() (string) {
+    capacityLock.Lock()
+    defer capacityLock.Unlock()
+    limiting := ""
+    for i, d := range shareDims {
+        if capacityEnforced[i] {
+            limiting += " " + d.Key
+        }
+    }
+    if limiting == "" {
+        return ""
+    }
+    return fmt.Sprintf(`<p><b>集群容量限速中:%s</b> Usage Rate:%.1f Conn:%.1f QPS:%.1f, %d个桶受限</p>`, limiting,
+                       capacityUsage[0], capacityUsage[1], capacityUsage[2], len(capacityShares))
+}
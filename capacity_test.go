@@ -0,0 +1,79 @@
+package main
+
+import (
+    "math"
+    "testing"
+)
+
+
+func almostEqual(a float64, b float64) (bool) {
+    return math.Abs(a - b) < 1e-6
+}
+
+
+func TestMaxMinFairUnderCapacity(t *testing.T) {
+    caps := maxMinFair(100, []fairDemand{
+        {Bucket: "a", Demand: 30, Weight: 1},
+        {Bucket: "b", Demand: 50, Weight: 1},
+    })
+    if len(caps) != 0 {
+        t.Fatalf("demands fit in capacity, want no caps, got %v", caps)
+    }
+}
+
+
+func TestMaxMinFairWaterFilling(t *testing.T) {
+    // a的需求低于水位得到满足，b、c平分剩余的90
+    caps := maxMinFair(100, []fairDemand{
+        {Bucket: "a", Demand: 10, Weight: 1},
+        {Bucket: "b", Demand: 50, Weight: 1},
+        {Bucket: "c", Demand: 100, Weight: 1},
+    })
+    for _, b := range []string{"a", "b", "c"} {
+        if !almostEqual(caps[b], 45) {
+            t.Errorf("bucket %s cap %v, want 45", b, caps[b])
+        }
+    }
+}
+
+
+func TestMaxMinFairWeights(t *testing.T) {
+    caps := maxMinFair(80, []fairDemand{
+        {Bucket: "a", Demand: 100, Weight: 1},
+        {Bucket: "b", Demand: 100, Weight: 3},
+    })
+    if !almostEqual(caps["a"], 20) || !almostEqual(caps["b"], 60) {
+        t.Fatalf("want caps a=20 b=60, got %v", caps)
+    }
+}
+
+
+func TestMaxMinFairPriorities(t *testing.T) {
+    // 高优先级的需求先满足，不受限；低优先级分剩余的40
+    caps := maxMinFair(100, []fairDemand{
+        {Bucket: "high", Demand: 60, Weight: 1, Priority: 1},
+        {Bucket: "low1", Demand: 50, Weight: 1},
+        {Bucket: "low2", Demand: 50, Weight: 1},
+    })
+    if _, ok := caps["high"]; ok {
+        t.Errorf("high priority bucket should not be capped, got %v", caps["high"])
+    }
+    if !almostEqual(caps["low1"], 20) || !almostEqual(caps["low2"], 20) {
+        t.Errorf("want low priority caps 20, got %v", caps)
+    }
+}
+
+
+func TestMaxMinFairExhaustedTier(t *testing.T) {
+    // 高优先级用完容量后，低优先级的上限为0
+    caps := maxMinFair(50, []fairDemand{
+        {Bucket: "high", Demand: 80, Weight: 1, Priority: 2},
+        {Bucket: "low", Demand: 10, Weight: 1},
+    })
+    if !almostEqual(caps["high"], 50) {
+        t.Errorf("high cap %v, want 50", caps["high"])
+    }
+    if c, ok := caps["low"]; !ok || c != 0 {
+        t.Errorf("low cap %v (present %v), want 0", c, ok)
+    }
+}
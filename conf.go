@@ -17,8 +17,27 @@ var LimitListWarnThreahold int
 var RateAlarmThreshold     int
 var ConnAlarmThreshold     int
 var QpsAlarmThreshold      int
+// 保留的配额文件备份数量
+var QuotaBackupNum         int
+// 配额存储类型file或postgres，以及postgres的连接串，使用postgres时必须配置连接串
+var QuotaStoreType         string
+var QuotaStoreDSN          string
+// 限速配额降低超过该百分比或被删除时需要另一位管理员审批，0表示不需要审批
+var ApprovalThreshold      int
+// 待审批变更的过期时间(分钟)
+var ApprovalExpire         int
+// 总体用量达到集群容量的该百分比时开始按公平份额限速，低于CapacityRelease时解除
+var CapacityTrigger        int
+var CapacityRelease        int
+// 按流量分配桶配额时，每个Nginx至少分得均分份额的该百分比
+var NodeShareFloor         int
+// 同步Nginx时只计算并记录同步计划，不实际下发
+var SyncDryRun             bool
+// 一次同步中删除Nginx上的桶配额超过该数量时需要管理员确认，0表示不限制
+var SyncMaxDeletes         int
 
 
+// limit.conf中的前端Nginx，只在./conf/nginxs不存在时作为初始节点列表
 var Nginxs []string
 
 /* 从原始字符串(可能包含" ")中提取出有效字符串
@@ -134,6 +153,67 @@ func parseConfig(line []byte)(bool) {
             return false
         }
         QpsAlarmThreshold , _ = strconv.Atoi(value)
+    } else if key == "QuotaStore"{
+        value := getValue(s, index, " ")
+        if value != "file" && value != "postgres" {
+            return false
+        }
+        QuotaStoreType = value
+    } else if key == "QuotaStoreDSN"{
+        // 连接串本身包含空格，取key之后的整行
+        value := strings.TrimSpace(s[index:])
+        if value == "" {
+            return false
+        }
+        QuotaStoreDSN = value
+    } else if key == "ApprovalThreshold"{
+        value := getValue(s, index, " ")
+        if value == "" {
+            return false
+        }
+        ApprovalThreshold, _ = strconv.Atoi(value)
+    } else if key == "ApprovalExpire"{
+        value := getValue(s, index, " ")
+        if value == "" {
+            return false
+        }
+        ApprovalExpire, _ = strconv.Atoi(value)
+    } else if key == "QuotaBackupNum"{
+        value := getValue(s, index, " ")
+        if value == "" {
+            return false
+        }
+        QuotaBackupNum, _ = strconv.Atoi(value)
+    } else if key == "CapacityTrigger"{
+        value := getValue(s, index, " ")
+        if value == "" {
+            return false
+        }
+        CapacityTrigger, _ = strconv.Atoi(value)
+    } else if key == "CapacityRelease"{
+        value := getValue(s, index, " ")
+        if value == "" {
+            return false
+        }
+        CapacityRelease, _ = strconv.Atoi(value)
+    } else if key == "NodeShareFloor"{
+        value := getValue(s, index, " ")
+        if value == "" {
+            return false
+        }
+        NodeShareFloor, _ = strconv.Atoi(value)
+    } else if key == "SyncDryRun"{
+        value := getValue(s, index, " ")
+        if value != "true" && value != "false" {
+            return false
+        }
+        SyncDryRun = value == "true"
+    } else if key == "SyncMaxDeletes"{
+        value := getValue(s, index, " ")
+        if value == "" {
+            return false
+        }
+        SyncMaxDeletes, _ = strconv.Atoi(value)
     }
     return true
 }
@@ -152,6 +232,16 @@ func LoadConfig() (bool) {
     RateAlarmThreshold = 52428800
     ConnAlarmThreshold = 50
     QpsAlarmThreshold  = 200
+    QuotaBackupNum     = 5
+    QuotaStoreType     = "file"
+    ApprovalThreshold  = 0
+    ApprovalExpire     = 60
+    CapacityTrigger    = 90
+    CapacityRelease    = 75
+    NodeShareFloor     = 20
+    SyncDryRun         = false
+    SyncMaxDeletes     = 20
+    QuotaStoreDSN      = ""
 
     f, err := os.Open("./conf/limit.conf")
     if err != nil {
@@ -0,0 +1,203 @@
+/* LimitServer向Nginx逐个桶下发限速配额的投递队列:
+** 1. 每个Nginx节点一个队列，由该节点的同步协程独占，每个桶只保留最新的一个操作(设置或删除)，
+**    操作是幂等的，重复投递没有副作用
+** 2. 投递失败后按指数退避重试(1秒起，最长60秒)，无法访问Nginx时本轮剩余操作一起退避
+** 3. 投递成功后重新获取Nginx上的配额列表核对，不一致的桶重新入队
+** 4. 一个操作连续失败deliveryWarnAttempts次时报警
+** 每次同步都按最新的差异重建队列，不再需要的操作直接丢弃
+*/
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "time"
+)
+
+
+// 第一次重试的间隔和最长重试间隔
+const deliveryBackoff = time.Second
+const deliveryMaxBackoff = 60 * time.Second
+
+// 连续失败该次数时报警
+const deliveryWarnAttempts = 5
+
+
+// 对一个桶的投递操作，Delete为false时设置为Data
+type deliveryOp struct {
+    Bucket     string
+    Delete     bool
+    Data       LimitData
+    Attempts   int
+    NextTry    time.Time
+    LastError  string
+}
+
+
+type deliveryQueue struct {
+    // key为桶名
+    ops  map[string]*deliveryOp
+}
+
+
+func newDeliveryQueue() (*deliveryQueue) {
+    return &deliveryQueue{ops: make(map[string]*deliveryOp)}
+}
+
+
+func (q *deliveryQueue) empty() (bool) {
+    return len(q.ops) == 0
+}
+
+
+// 第@attempts次失败后的重试间隔
+func deliveryDelay(attempts int) (time.Duration) {
+    d := deliveryBackoff
+    for i := 1; i < attempts && d < deliveryMaxBackoff; i++ {
+        d *= 2
+    }
+    if d > deliveryMaxBackoff {
+        d = deliveryMaxBackoff
+    }
+    return d
+}
+
+
+// 加入操作@op，已有相同的操作时保留其重试状态，返回值：队列中的操作
+func (q *deliveryQueue) put(op *deliveryOp) (*deliveryOp) {
+    if old, ok := q.ops[op.Bucket]; ok && old.Delete == op.Delete && old.Data == op.Data {
+        return old
+    }
+    op.NextTry = time.Now()
+    q.ops[op.Bucket] = op
+    return op
+}
+
+
+// 按本次同步的差异@set、@del重建队列
+func (q *deliveryQueue) reconcile(set []LimitData, del []string) {
+    want := make(map[string]bool)
+    for _, v := range set {
+        want[v.BucketName] = true
+        q.put(&deliveryOp{Bucket: v.BucketName, Data: v})
+    }
+    for _, key := range del {
+        want[key] = true
+        q.put(&deliveryOp{Bucket: key, Delete: true, Data: LimitData{BucketName: key}})
+    }
+    for key, _ := range q.ops {
+        if !want[key] {
+            delete(q.ops, key)
+        }
+    }
+}
+
+
+// 记录操作@op失败，按退避时间安排重试，连续失败过多时报警
+func (q *deliveryQueue) failed(server string, op *deliveryOp, reason string) {
+    op.Attempts++
+    op.LastError = reason
+    op.NextTry = time.Now().Add(deliveryDelay(op.Attempts))
+    if op.Attempts == deliveryWarnAttempts {
+        action := "set"
+        if op.Delete {
+            action = "delete"
+        }
+        SendWarn(fmt.Sprintf("%s bucket %s limit on %s failed %d times: %s", action, op.Bucket, server, op.Attempts, reason))
+    }
+}
+
+
+/* 距下一次重试的时间，队列为空或者超过@max时返回@max
+*/
+func (q *deliveryQueue) nextRetry(max time.Duration) (time.Duration) {
+    next := max
+    now := time.Now()
+    for _, op := range q.ops {
+        if d := op.NextTry.Sub(now); d < next {
+            next = d
+        }
+    }
+    if next < 0 {
+        next = 0
+    }
+    return next
+}
+
+
+/* 投递所有到期的操作，成功后读取Nginx上的配额核对并更新同步状态@st
+** 无法访问Nginx时本轮剩余的到期操作一起退避
+*/
+func (q *deliveryQueue) flush(server string, st *nodeSyncState) {
+    now := time.Now()
+    due := make([]*deliveryOp, 0)
+    for _, op := range q.ops {
+        if !op.NextTry.After(now) {
+            due = append(due, op)
+        }
+    }
+    sort.Slice(due, func(i, j int) bool { return due[i].Bucket < due[j].Bucket })
+
+    delivered := make([]*deliveryOp, 0)
+    for i, op := range due {
+        var status int
+        var err error
+        if op.Delete {
+            status, err = st.enforcer.Delete(op.Bucket)
+        } else {
+            status, err = st.enforcer.Set(op.Data)
+        }
+        if err == nil {
+            delivered = append(delivered, op)
+            continue
+        }
+        q.failed(server, op, err.Error())
+        if status == 0 {
+            for _, rest := range due[i + 1:] {
+                q.failed(server, rest, "nginx unreachable")
+            }
+            break
+        }
+    }
+    if len(delivered) > 0 {
+        q.verify(server, st, delivered)
+    }
+}
+
+
+/* 读取Nginx上的配额核对已投递的操作@delivered，一致的操作出队，不一致的重新安排重试
+** 同时用读取到的配额列表更新同步状态@st
+*/
+func (q *deliveryQueue) verify(server string, st *nodeSyncState, delivered []*deliveryOp) {
+    limitList, etag, _, ok := st.enforcer.List("")
+    if !ok {
+        // 无法核对时按投递成功处理，下次同步时重新对比
+        for _, op := range delivered {
+            if op.Delete {
+                delete(st.applied, op.Bucket)
+            } else {
+                st.applied[op.Bucket] = op.Data
+            }
+            delete(q.ops, op.Bucket)
+        }
+        st.etag = ""
+        return
+    }
+
+    st.applied = make(map[string]LimitData)
+    for _, v := range limitList {
+        st.applied[v.BucketName] = v
+    }
+    st.etag = etag
+    for _, op := range delivered {
+        v, find := st.applied[op.Bucket]
+        if (op.Delete && !find) || (!op.Delete && find && v == op.Data) {
+            delete(q.ops, op.Bucket)
+            continue
+        }
+        GErrorLogger.Error("Verify bucket %s limit on %s failed, delete %v, want %v, got %v", op.Bucket, server, op.Delete, op.Data, v)
+        recordSyncError(server, fmt.Sprintf("bucket %s limit read back mismatch", op.Bucket))
+        q.failed(server, op, "read back mismatch")
+    }
+}
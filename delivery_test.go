@@ -0,0 +1,81 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+
+func TestDeliveryDelay(t *testing.T) {
+    cases := []struct {
+        attempts  int
+        want      time.Duration
+    }{
+        {0, time.Second},
+        {1, time.Second},
+        {2, 2 * time.Second},
+        {3, 4 * time.Second},
+        {6, 32 * time.Second},
+        {7, 60 * time.Second},
+        {100, 60 * time.Second},
+    }
+    for _, c := range cases {
+        if got := deliveryDelay(c.attempts); got != c.want {
+            t.Errorf("deliveryDelay(%d) = %s, want %s", c.attempts, got, c.want)
+        }
+    }
+}
+
+
+func TestDeliveryReconcile(t *testing.T) {
+    q := newDeliveryQueue()
+    a := LimitData{BucketName: "a", LimitRate: 100}
+    b := LimitData{BucketName: "b", LimitRate: 200}
+    q.reconcile([]LimitData{a, b}, []string{"c"})
+    if len(q.ops) != 3 || !q.ops["c"].Delete {
+        t.Fatalf("want set a, b and delete c, got %v", q.ops)
+    }
+
+    q.failed("nginx", q.ops["a"], "timeout")
+    q.failed("nginx", q.ops["b"], "timeout")
+
+    // a不变，保留重试状态；b的配额变化，重新开始；c不再需要删除，丢弃；d新增
+    b.LimitRate = 300
+    q.reconcile([]LimitData{a, b}, []string{"d"})
+    if len(q.ops) != 3 {
+        t.Fatalf("want 3 ops, got %v", q.ops)
+    }
+    if op := q.ops["a"]; op.Attempts != 1 || op.LastError != "timeout" {
+        t.Errorf("unchanged op should keep retry state, got %+v", op)
+    }
+    if op := q.ops["b"]; op.Attempts != 0 || op.Data.LimitRate != 300 {
+        t.Errorf("changed op should be replaced, got %+v", op)
+    }
+    if _, ok := q.ops["c"]; ok {
+        t.Errorf("stale delete of c should be dropped")
+    }
+    if op, ok := q.ops["d"]; !ok || !op.Delete {
+        t.Errorf("want delete d, got %+v", op)
+    }
+
+    q.reconcile(nil, nil)
+    if !q.empty() {
+        t.Errorf("empty diff should clear the queue, got %v", q.ops)
+    }
+}
+
+
+func TestDeliveryNextRetry(t *testing.T) {
+    q := newDeliveryQueue()
+    if d := q.nextRetry(time.Minute); d != time.Minute {
+        t.Fatalf("empty queue should wait max, got %s", d)
+    }
+    q.reconcile([]LimitData{{BucketName: "a"}}, nil)
+    if d := q.nextRetry(time.Minute); d != 0 {
+        t.Errorf("new op should be due now, got %s", d)
+    }
+    q.failed("nginx", q.ops["a"], "timeout")
+    if d := q.nextRetry(time.Minute); d <= 0 || d > time.Second {
+        t.Errorf("failed op should retry within 1s, got %s", d)
+    }
+}
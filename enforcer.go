@@ -0,0 +1,132 @@
+/* LimitServer限速执行后端:
+** 每个节点的同步协程通过Enforcer读取和下发限速信息，同步协议见nginxsync.go，目前支持:
+** 1. nginx: 自研Nginx限速模块的HTTP接口，默认后端，节点地址即模块监听的ip:port
+** 2. file: 将限速信息渲染为Nginx limit_req/limit_conn配置文件并执行重载命令，见render.go
+** 3. webhook: 向HTTP地址推送限速信息，供其它代理接入，见webhook.go
+** 后端在./conf/nginxs中按节点配置(Backend、Endpoint、ReloadCmd)，同一份QuotaInfo可以管理混合的节点
+*/
+
+package main
+
+import (
+    "fmt"
+    "strings"
+    "encoding/json"
+)
+
+
+const (
+    BACKEND_NGINX   = "nginx"
+    BACKEND_FILE    = "file"
+    BACKEND_WEBHOOK = "webhook"
+)
+
+
+type Enforcer interface {
+    // 后端类型，展示用
+    Kind() string
+    /* 读取节点上的限速信息，@etag不为空时为条件读取
+    ** 返回值：限速信息、版本、是否没有变化、成功与否
+    */
+    List(etag string) ([]LimitData, string, bool, bool)
+    // 设置、删除一个桶的限速信息，返回值：HTTP状态码(无法访问时为0)、出错原因
+    Set(l LimitData) (int, error)
+    Delete(bucket string) (int, error)
+    /* 批量下发，不支持时返回404/405/501
+    ** 返回值：响应、HTTP状态码(请求失败时为0)、出错原因
+    */
+    Bulk(bulk *LimitBulk) (*LimitBulkResponse, int, error)
+}
+
+
+// 自研Nginx限速模块
+type nginxEnforcer struct {
+    server  string
+}
+
+
+func (e *nginxEnforcer) Kind() (string) {
+    return BACKEND_NGINX
+}
+
+
+func (e *nginxEnforcer) List(etag string) ([]LimitData, string, bool, bool) {
+    limitList, newEtag, notModified, ok := GetNginxLimit(e.server, etag)
+    if !ok || notModified {
+        return nil, newEtag, notModified, ok
+    }
+    GLogger.Info("[%s] LimitList: %s", e.server, limitList)
+    var blimits LimitList
+    if err := json.Unmarshal(limitList, &(blimits.BucketLimit)); err != nil {
+        GErrorLogger.Error("Json unmarshal %s failed: %s\n", limitList, err)
+        recordSyncError(e.server, fmt.Sprintf("unmarshal limit list failed: %s", err))
+        return nil, "", false, false
+    }
+    return blimits.BucketLimit, newEtag, false, true
+}
+
+
+func (e *nginxEnforcer) Set(l LimitData) (int, error) {
+    return SetNginxLimit(e.server, l)
+}
+
+
+func (e *nginxEnforcer) Delete(bucket string) (int, error) {
+    return DelNginxLimit(e.server, bucket)
+}
+
+
+func (e *nginxEnforcer) Bulk(bulk *LimitBulk) (*LimitBulkResponse, int, error) {
+    return postBulk(e.server, bulk)
+}
+
+
+/* 检查节点@n的后端配置
+** 返回值：""代表成功，否则为出错原因
+*/
+func checkBackend(n *NginxNode) (string) {
+    switch n.Backend {
+    case "", BACKEND_NGINX:
+        return ""
+    case BACKEND_FILE:
+        if n.Endpoint == "" {
+            return "file后端需要配置文件路径Endpoint"
+        }
+        return ""
+    case BACKEND_WEBHOOK:
+        if !strings.HasPrefix(n.Endpoint, "http://") && !strings.HasPrefix(n.Endpoint, "https://") {
+            return "webhook后端的Endpoint应为http地址"
+        }
+        return ""
+    }
+    return "未知的后端" + n.Backend
+}
+
+
+// 按节点@n的后端配置创建Enforcer，配置错误时使用nginx后端
+func newEnforcer(n NginxNode) (Enforcer) {
+    if errMsg := checkBackend(&n); errMsg != "" {
+        GErrorLogger.Error("nginx %s backend config error: %s, use nginx backend", n.Addr, errMsg)
+        return &nginxEnforcer{server: n.Addr}
+    }
+    switch n.Backend {
+    case BACKEND_FILE:
+        return &fileEnforcer{node: n.Addr, path: n.Endpoint, reloadCmd: n.ReloadCmd}
+    case BACKEND_WEBHOOK:
+        return &webhookEnforcer{node: n.Addr, url: n.Endpoint}
+    }
+    return &nginxEnforcer{server: n.Addr}
+}
+
+
+// 节点@addr当前配置的Enforcer，节点不存在时使用nginx后端
+func nodeEnforcer(addr string) (Enforcer) {
+    fleetLock.Lock()
+    n, ok := nginxNodes[addr]
+    node := NginxNode{Addr: addr}
+    if ok {
+        node = *n
+    }
+    fleetLock.Unlock()
+    return newEnforcer(node)
+}
@@ -0,0 +1,448 @@
+/* LimitServer前端Nginx节点管理，提供以下功能:
+** 1. 运行时添加、下线(drain)、恢复和删除Nginx节点，每个节点有独立的同步协程，删除节点时停止该协程
+** 2. 下线中的节点仍然同步限速配额，但只分得保底份额，配额集中分配给其它节点
+** 3. 节点变化后通知所有同步协程，按新的节点列表重新分配并下发每个桶的配额
+** 4. 删除节点只停止同步，节点上已下发的限速保留不变，需要时在节点上手工清除
+** 5. 单个节点可以设置为dry-run，只计算并记录同步计划，不实际下发，全局开关见limit.conf的SyncDryRun
+** 6. 节点的限速执行后端(Backend、Endpoint、ReloadCmd)只能在./conf/nginxs中配置，见enforcer.go，
+**    运行时添加的节点使用nginx后端，页面和接口修改节点状态时保留后端配置
+** 节点列表以json格式保存在./conf/nginxs，每个节点一行；文件不存在时使用limit.conf中的Nginxs
+*/
+
+package main
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "bytes"
+    "html"
+    "sort"
+    "sync"
+    "time"
+    "bufio"
+    "strings"
+    "net/http"
+    "encoding/json"
+)
+
+
+const fleetFile = "./conf/nginxs"
+
+const (
+    NODE_ACTIVE   = "active"
+    NODE_DRAINING = "draining"
+)
+
+
+type NginxNode struct {
+    // Nginx地址，形式为ip:port
+    Addr        string
+    State       string
+    DryRun      bool    `json:",omitempty"`
+    // 限速执行后端nginx、file或webhook，为空时为nginx
+    Backend     string  `json:",omitempty"`
+    // file后端为配置文件路径，webhook后端为推送地址
+    Endpoint    string  `json:",omitempty"`
+    // file后端渲染配置文件后执行的重载命令
+    ReloadCmd   string  `json:",omitempty"`
+    Admin       string
+    UpdateTime  int64
+}
+
+
+// 以下变量由fleetLock保护
+var fleetLock sync.Mutex
+var nginxNodes = make(map[string]*NginxNode)
+// 运行中的同步协程，关闭管道即停止
+var fleetStops = make(map[string]chan struct{})
+// 同步协程退出时关闭的管道，协程退出后删除
+var fleetDone = make(map[string]chan struct{})
+
+
+// 加载节点列表，文件不存在时使用limit.conf中的Nginxs
+func loadFleet() {
+    fleetLock.Lock()
+    defer fleetLock.Unlock()
+
+    f, err := os.Open(fleetFile)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            GErrorLogger.Error("open nginx file[%s] failed: [%s]", fleetFile, err)
+        }
+        for _, addr := range Nginxs {
+            nginxNodes[addr] = &NginxNode{Addr: addr, State: NODE_ACTIVE, Admin: "limit.conf"}
+        }
+        GLogger.Info("no nginx file [%s], use %d Nginxs in limit.conf", fleetFile, len(nginxNodes))
+        return
+    }
+    defer f.Close()
+
+    r := bufio.NewReader(f)
+    for {
+        buf, err := r.ReadBytes('\n')
+        if len(trimLine(buf)) > 0 {
+            n := new(NginxNode)
+            if jerr := json.Unmarshal(buf, n); jerr != nil {
+                GErrorLogger.Error("Unmarshal nginx [%s] failed: [%s]", buf, jerr)
+            } else {
+                nginxNodes[n.Addr] = n
+            }
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            GErrorLogger.Error("read nginx file [%s] failed: [%s]", fleetFile, err)
+            break
+        }
+    }
+    GLogger.Info("read nginx file [%s] done, %d nginxs", fleetFile, len(nginxNodes))
+}
+
+
+/* 持久化节点列表，先写入nginxs.new并fsync再重命名，调用者必须持有fleetLock
+** 返回值：持久化失败的原因
+*/
+func updateDiskFleet() (error) {
+    var buf bytes.Buffer
+    for key, n := range nginxNodes {
+        b, err := json.Marshal(n)
+        if err != nil {
+            GErrorLogger.Error("json Marshal nginx[%s]failed: [%s]", key, err)
+            return err
+        }
+        buf.Write(append(b, '\n'))
+    }
+
+    newfile := fleetFile + ".new"
+    err := writeFileSync(newfile, buf.Bytes())
+    if err == nil {
+        err = os.Rename(newfile, fleetFile)
+    }
+    if err != nil {
+        GErrorLogger.Error("save nginx file [%s] failed: [%s]", fleetFile, err)
+    }
+    return err
+}
+
+
+// 节点列表持久化失败时的出错信息
+func fleetErrMsg(err error) (string) {
+    return fmt.Sprintf("保存Nginx节点列表失败，修改已撤销: %s", err)
+}
+
+
+// 按地址排序的节点列表副本
+func fleetNodes() ([]NginxNode) {
+    fleetLock.Lock()
+    defer fleetLock.Unlock()
+    nodes := make([]NginxNode, 0, len(nginxNodes))
+    for _, n := range nginxNodes {
+        nodes = append(nodes, *n)
+    }
+    sort.Slice(nodes, func(i, j int) bool { return nodes[i].Addr < nodes[j].Addr })
+    return nodes
+}
+
+
+/* 启动节点@addr的同步协程，调用者必须持有fleetLock
+** 节点刚被删除时，等待之前的同步协程退出后再启动，避免两个协程同时向该节点下发
+** 同步状态在这里创建，在delNginxNode中删除，都持有fleetLock，退出中的协程不会再创建已删除节点的状态
+*/
+func startNodeSync(addr string) {
+    if _, ok := fleetStops[addr]; ok {
+        return
+    }
+    initSyncStatus(addr)
+    stop, done := make(chan struct{}), make(chan struct{})
+    prev := fleetDone[addr]
+    fleetStops[addr], fleetDone[addr] = stop, done
+    go func() {
+        if prev != nil {
+            <-prev
+        }
+        limitServer(addr, stop)
+
+        fleetLock.Lock()
+        if fleetDone[addr] == done {
+            delete(fleetDone, addr)
+        }
+        fleetLock.Unlock()
+        close(done)
+    }()
+}
+
+
+// 节点列表变化后通知所有同步协程重新分配并下发配额
+func fleetChanged() {
+    quotaRegistry.Notify("")
+}
+
+
+/* 添加节点@addr，或者将节点设置为@state
+** 返回值：""代表成功，否则为出错原因；持久化失败的原因，此时修改已撤销
+*/
+func setNginxNode(addr string, state string, admin string) (string, error) {
+    if addr == "" || strings.ContainsAny(addr, "/ ") {
+        return "Nginx地址应为ip:port", nil
+    }
+    if state != NODE_ACTIVE && state != NODE_DRAINING {
+        return "节点状态应为active或draining", nil
+    }
+
+    fleetLock.Lock()
+    old, ok := nginxNodes[addr]
+    if ok && old.State == state {
+        fleetLock.Unlock()
+        return "", nil
+    }
+    n := &NginxNode{Addr: addr}
+    if ok {
+        *n = *old
+    }
+    n.State, n.Admin, n.UpdateTime = state, admin, time.Now().Unix()
+    nginxNodes[addr] = n
+    if err := updateDiskFleet(); err != nil {
+        if ok {
+            nginxNodes[addr] = old
+        } else {
+            delete(nginxNodes, addr)
+        }
+        fleetLock.Unlock()
+        return "", err
+    }
+    startNodeSync(addr)
+    fleetLock.Unlock()
+
+    GLogger.Info("Admin %s set nginx %s %s", admin, addr, state)
+    fleetChanged()
+    return "", nil
+}
+
+
+/* 设置节点@addr是否为dry-run
+** 返回值：""代表成功，否则为出错原因；持久化失败的原因，此时修改已撤销
+*/
+func setNodeDryRun(addr string, dryRun bool, admin string) (string, error) {
+    fleetLock.Lock()
+    n, ok := nginxNodes[addr]
+    if !ok {
+        fleetLock.Unlock()
+        return "Nginx " + addr + "不存在", nil
+    }
+    if n.DryRun == dryRun {
+        fleetLock.Unlock()
+        return "", nil
+    }
+    updated := *n
+    updated.DryRun, updated.Admin, updated.UpdateTime = dryRun, admin, time.Now().Unix()
+    nginxNodes[addr] = &updated
+    if err := updateDiskFleet(); err != nil {
+        nginxNodes[addr] = n
+        fleetLock.Unlock()
+        return "", err
+    }
+    fleetLock.Unlock()
+
+    GLogger.Info("Admin %s set nginx %s dry-run %v", admin, addr, dryRun)
+    fleetChanged()
+    return "", nil
+}
+
+
+// 节点@addr的同步是否为dry-run
+func nodeDryRun(addr string) (bool) {
+    if SyncDryRun {
+        return true
+    }
+    fleetLock.Lock()
+    defer fleetLock.Unlock()
+    n, ok := nginxNodes[addr]
+    return ok && n.DryRun
+}
+
+
+/* 删除节点@addr并停止其同步协程
+** 返回值：节点不存在时返回false；持久化失败的原因，此时节点保留
+*/
+func delNginxNode(addr string, admin string) (bool, error) {
+    fleetLock.Lock()
+    n, ok := nginxNodes[addr]
+    if !ok {
+        fleetLock.Unlock()
+        return false, nil
+    }
+    delete(nginxNodes, addr)
+    if err := updateDiskFleet(); err != nil {
+        nginxNodes[addr] = n
+        fleetLock.Unlock()
+        return true, err
+    }
+    if stop, find := fleetStops[addr]; find {
+        close(stop)
+        delete(fleetStops, addr)
+    }
+    delSyncStatus(addr)
+    fleetLock.Unlock()
+
+    // 节点上已下发的限速不会被清除，也不再对账
+    GLogger.Info("Admin %s remove nginx %s, limits already pushed to it are kept and no longer reconciled", admin, addr)
+    delNodeDemands(addr)
+    fleetChanged()
+    return true, nil
+}
+
+
+// Nginx节点管理WEB页面，GET展示所有节点，POST添加、下线、恢复或删除节点
+func handlerNginxs(w http.ResponseWriter, r *http.Request) {
+    if r.Method == "POST" {
+        r.ParseForm()
+        user := r.Form.Get("Admin")
+        passwd := r.Form.Get("Password")
+        addr := strings.TrimSpace(r.Form.Get("Addr"))
+        value, find := admins[user]
+        errMsg := ""
+        if user == "" || passwd == "" {
+            errMsg = "用户名或密码不能为空"
+        } else if !find || value != passwd {
+            errMsg = "非管理员登陆"
+        } else {
+            var err error
+            switch r.Form.Get("Op") {
+            case "Add", "Activate":
+                errMsg, err = setNginxNode(addr, NODE_ACTIVE, user)
+            case "Drain":
+                errMsg, err = setNginxNode(addr, NODE_DRAINING, user)
+            case "DryRun":
+                errMsg, err = setNodeDryRun(addr, true, user)
+            case "Live":
+                errMsg, err = setNodeDryRun(addr, false, user)
+            case "Remove":
+                var found bool
+                if found, err = delNginxNode(addr, user); !found {
+                    errMsg = "Nginx " + addr + "不存在"
+                }
+            default:
+                errMsg = "未知操作"
+            }
+            if err != nil {
+                errMsg = fleetErrMsg(err)
+            }
+        }
+        if errMsg == "" {
+            errMsg = "OK!"
+        }
+        fmt.Fprintf(w, `<html><head><meta charset=utf-8><meta http-equiv="refresh" content="2; url=http://%s:%s/nginxs" /></head><body>%s</body></html>`, Host, HttpPort, html.EscapeString(errMsg))
+        return
+    }
+
+    lines := ""
+    for _, n := range fleetNodes() {
+        backend := n.Backend
+        if backend == "" {
+            backend = BACKEND_NGINX
+        }
+        lines += fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%v</td><td>%s %s</td><td>%s</td><td>%s</td></tr>`, html.EscapeString(n.Addr), n.State, n.DryRun || SyncDryRun,
+                             html.EscapeString(backend), html.EscapeString(n.Endpoint), html.EscapeString(n.Admin),
+                             time.Unix(n.UpdateTime, 0).Format("2006-01-02 15:04:05"))
+    }
+    fmt.Fprintf(w, `<html><head><meta charset=utf-8></head><body>
+        <p><b>Nginx节点</b></p>
+        <table border=1>
+        <tr><td>Addr</td><td>State</td><td>DryRun</td><td>Backend</td><td>Admin</td><td>Modified</td></tr>
+        %s
+        </table>
+        <form action="/nginxs" method="post">
+        <table border=0>
+        <tr><td>Addr(ip:port)</td><td><input type="text" name="Addr"></input></td></tr>
+        <tr><td>Admin</td><td><input type="text" name="Admin"></input></td></tr>
+        <tr><td>Password</td><td><input type="password" name="Password"></input></td></tr>
+        <tr><td><input type="submit" name="Op" value="Add"></input> <input type="submit" name="Op" value="Drain"></input>
+            <input type="submit" name="Op" value="Activate"></input> <input type="submit" name="Op" value="Remove"></input>
+            <input type="submit" name="Op" value="DryRun"></input> <input type="submit" name="Op" value="Live"></input></td></tr>
+        </table>
+        </form></body></html>`, lines)
+}
+
+
+/* Nginx节点管理API:
+** GET    /api/v1/nginxs         列出所有节点
+** PUT    /api/v1/nginxs/{addr}  添加节点或修改节点状态，请求体为{"State":"active|draining", "DryRun":true|false}
+**                               State为空且未设置DryRun时为active，只设置DryRun时不修改状态
+** DELETE /api/v1/nginxs/{addr}  删除节点
+*/
+func apiNginxs(w http.ResponseWriter, r *http.Request) {
+    addr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/nginxs"), "/")
+    if strings.Contains(addr, "/") {
+        writeApiError(w, http.StatusNotFound, "NotFound", "unknown api path " + r.URL.Path)
+        return
+    }
+
+    admin, ok := apiAuth(w, r)
+    if !ok {
+        return
+    }
+
+    if addr == "" {
+        if r.Method != "GET" {
+            writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET is allowed")
+            return
+        }
+        writeJson(w, http.StatusOK, fleetNodes())
+        return
+    }
+
+    switch r.Method {
+    case "PUT":
+        var body struct {
+            State   string
+            DryRun  *bool
+        }
+        if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+            writeApiError(w, http.StatusBadRequest, "MalformedJson", fmt.Sprintf("请求体不是合法的json: %s", err))
+            return
+        }
+        if body.State == "" && body.DryRun == nil {
+            body.State = NODE_ACTIVE
+        }
+        if body.State != "" {
+            errMsg, err := setNginxNode(addr, body.State, admin)
+            if errMsg != "" {
+                writeApiError(w, http.StatusBadRequest, "InvalidArgument", errMsg)
+                return
+            }
+            if err != nil {
+                writeApiError(w, http.StatusInternalServerError, "SaveFleetFailed", fleetErrMsg(err))
+                return
+            }
+        }
+        if body.DryRun != nil {
+            errMsg, err := setNodeDryRun(addr, *body.DryRun, admin)
+            if errMsg != "" {
+                writeApiError(w, http.StatusNotFound, "NoSuchNginx", errMsg)
+                return
+            }
+            if err != nil {
+                writeApiError(w, http.StatusInternalServerError, "SaveFleetFailed", fleetErrMsg(err))
+                return
+            }
+        }
+        writeJson(w, http.StatusOK, fleetNodes())
+
+    case "DELETE":
+        found, err := delNginxNode(addr, admin)
+        if !found {
+            writeApiError(w, http.StatusNotFound, "NoSuchNginx", "no nginx " + addr)
+            return
+        }
+        if err != nil {
+            writeApiError(w, http.StatusInternalServerError, "SaveFleetFailed", fleetErrMsg(err))
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only PUT and DELETE are allowed")
+    }
+}
@@ -0,0 +1,761 @@
+/* LimitServer组配额模块，提供以下功能:
+** 1. 定义账户或组，包含一组桶，为组设置报警配额和限速配额(流量、连接数、QPS)
+** 2. 组用量由每个统计窗口中成员桶的聚合数据累加得到，超过报警配额时通过SendWarn报警
+** 3. 组用量达到限速配额时，按成员桶最近的用量比例分配组配额，与桶自身限速配额取较小值后同步至Nginx
+** 4. 通过WEB页面和API管理组，大幅降低组限速配额需要另一位管理员审批，见approval.go
+** 组以json格式保存在./conf/groups，每个组一行
+*/
+
+package main
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "html"
+    "sort"
+    "sync"
+    "time"
+    "bufio"
+    "bytes"
+    "strings"
+    "strconv"
+    "net/url"
+    "net/http"
+    "encoding/json"
+)
+
+
+const groupFile = "./conf/groups"
+
+// 组用量低于限速配额的该比例时解除组限速，避免在阈值附近反复切换
+const groupReleaseRatio = 0.8
+
+// 成员用量的平滑系数，每个统计窗口更新一次
+const groupUsageAlpha = 0.1
+
+
+type QuotaGroup struct {
+    Name        string
+    Buckets     []string
+    // nil表示不报警/不限速，只使用RateQuota、ConnQuota、QpsQuota
+    Warn        *BucketQuota  `json:",omitempty"`
+    Limit       *BucketQuota  `json:",omitempty"`
+    Admin       string
+    UpdateTime  int64
+}
+
+
+// 组配额和集群容量支持的维度，Key为表单项名
+var shareDims = []struct {
+    Key    string
+    Field  string
+}{
+    {"Rate",       "RateQuota"},
+    {"Connection", "ConnQuota"},
+    {"QPS",        "QpsQuota"},
+}
+
+
+// 以下变量由groupLock保护，QuotaGroup整体替换，不在原地修改
+var groupLock sync.Mutex
+var quotaGroups = make(map[string]*QuotaGroup)
+// 成员桶最近的用量，顺序同shareDims，key为桶名
+var memberUsage = make(map[string]*[3]float64)
+// 组在各维度上是否处于限速中，key为组名
+var groupEnforced = make(map[string]*[3]bool)
+// 组限速中成员桶分得的限速配额，key为桶名
+var groupShares = make(map[string]*BucketQuota)
+
+
+// 加载磁盘上的组
+func loadGroups() {
+    f, err := os.Open(groupFile)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            GErrorLogger.Error("open group file[%s] failed: [%s]", groupFile, err)
+        }
+        return
+    }
+    defer f.Close()
+
+    groupLock.Lock()
+    defer groupLock.Unlock()
+    r := bufio.NewReader(f)
+    for {
+        buf, err := r.ReadBytes('\n')
+        if len(trimLine(buf)) > 0 {
+            g := new(QuotaGroup)
+            if jerr := json.Unmarshal(buf, g); jerr != nil {
+                GErrorLogger.Error("Unmarshal group [%s] failed: [%s]", buf, jerr)
+            } else {
+                quotaGroups[g.Name] = g
+            }
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            GErrorLogger.Error("read group file [%s] failed: [%s]", groupFile, err)
+            break
+        }
+    }
+    GLogger.Info("read group file [%s] done, %d groups", groupFile, len(quotaGroups))
+}
+
+
+/* 持久化组，先写入groups.new并fsync再重命名，调用者必须持有groupLock
+** 返回值：持久化失败的原因
+*/
+func updateDiskGroups() (error) {
+    var data bytes.Buffer
+    for key, g := range quotaGroups {
+        b, err := json.Marshal(g)
+        if err != nil {
+            GErrorLogger.Error("json Marshal group[%s]failed: [%s]", key, err)
+            return err
+        }
+        data.Write(append(b, '\n'))
+    }
+
+    newfile := groupFile + ".new"
+    err := writeFileSync(newfile, data.Bytes())
+    if err == nil {
+        err = os.Rename(newfile, groupFile)
+    }
+    if err != nil {
+        GErrorLogger.Error("save group file [%s] failed: [%s]", groupFile, err)
+    }
+    return err
+}
+
+
+// 一个统计窗口内各组的聚合用量
+type groupWindow struct {
+    groups  []*QuotaGroup
+    rate    map[string]float64
+    conn    map[string]float64
+    qps     map[string]*BucketQPS
+    // 成员桶在本窗口的用量
+    usage   map[string]*[3]float64
+}
+
+
+// 窗口开始聚合前获取组及成员关系
+func newGroupWindow() (*groupWindow) {
+    g := &groupWindow{rate: make(map[string]float64), conn: make(map[string]float64),
+                      qps: make(map[string]*BucketQPS), usage: make(map[string]*[3]float64)}
+    groupLock.Lock()
+    for _, group := range quotaGroups {
+        g.groups = append(g.groups, group)
+        for _, b := range group.Buckets {
+            g.usage[b] = new([3]float64)
+        }
+        g.qps[group.Name] = new(BucketQPS)
+    }
+    groupLock.Unlock()
+    return g
+}
+
+
+// 累加桶@bucket在本窗口的聚合数据@value
+func (g *groupWindow) add(bucket string, value *BucketState) {
+    u, ok := g.usage[bucket]
+    if !ok {
+        return
+    }
+    u[0] = value.StatisticBucketRate
+    u[1] = value.StatisticBucketConnMax
+    u[2] = value.StatisticBucketQps.QPSTotal
+    for _, group := range g.groups {
+        for _, b := range group.Buckets {
+            if b == bucket {
+                g.rate[group.Name] += value.StatisticBucketRate
+                g.conn[group.Name] += value.StatisticBucketConnMax
+                updateQps(g.qps[group.Name], &value.StatisticBucketQps)
+                break
+            }
+        }
+    }
+}
+
+
+/* 窗口聚合完成，更新成员最近用量，并检查组用量是否超过报警配额
+** 本窗口没有数据的成员按用量0计入
+*/
+func (g *groupWindow) finish() {
+    groupLock.Lock()
+    for bucket, cur := range g.usage {
+        u, ok := memberUsage[bucket]
+        if !ok {
+            u = new([3]float64)
+            memberUsage[bucket] = u
+        }
+        for i := range u {
+            u[i] = u[i] * (1 - groupUsageAlpha) + cur[i] * groupUsageAlpha
+        }
+    }
+    for bucket, _ := range memberUsage {
+        if _, ok := g.usage[bucket]; !ok {
+            delete(memberUsage, bucket)
+        }
+    }
+    groupLock.Unlock()
+
+    for _, group := range g.groups {
+        if group.Warn == nil {
+            continue
+        }
+        errMsg, over := quotaExceeded(group.Warn, g.rate[group.Name], g.conn[group.Name], *g.qps[group.Name])
+        if over {
+            SendWarn("Group: " + group.Name + errMsg)
+        }
+    }
+}
+
+
+/* 在@shares中按成员最近用量分配组@g第@i个维度的限速配额@limit，@total为组用量
+** 每个成员额外按平均份额的十分之一计权，避免空闲成员分得0而无法恢复
+** 桶属于多个限速中的组时取较小的份额
+*/
+func splitGroupQuota(g *QuotaGroup, i int, limit float64, total float64, shares map[string]*BucketQuota) {
+    weights := make([]float64, len(g.Buckets))
+    sum := 0.0
+    for j, b := range g.Buckets {
+        weights[j] = total / float64(10 * len(g.Buckets))
+        if u, ok := memberUsage[b]; ok {
+            weights[j] += u[i]
+        }
+        if total == 0 {
+            weights[j] = 1
+        }
+        sum += weights[j]
+    }
+
+    for j, b := range g.Buckets {
+        share := int64(limit * weights[j] / sum)
+        if share < 1 {
+            share = 1
+        }
+        q, ok := shares[b]
+        if !ok {
+            q = &BucketQuota{BucketName: b, QuotaType: 1}
+            shares[b] = q
+        }
+        p := quotaFieldPtr(q, shareDims[i].Field)
+        if *p == 0 || share < *p {
+            *p = share
+        }
+    }
+}
+
+
+// 组@g在各维度上的用量
+func groupTotal(g *QuotaGroup) ([3]float64) {
+    var total [3]float64
+    for _, b := range g.Buckets {
+        if u, ok := memberUsage[b]; ok {
+            for i := range total {
+                total[i] += u[i]
+            }
+        }
+    }
+    return total
+}
+
+
+/* 根据组用量重新计算成员桶分得的限速配额
+** 份额发生变化的桶通知前端Nginx同步协程，组限速开始或解除时报警
+*/
+func updateGroupShares() {
+    msgs := make([]string, 0)
+    shares := make(map[string]*BucketQuota)
+
+    groupLock.Lock()
+    for name, _ := range groupEnforced {
+        if g, ok := quotaGroups[name]; !ok || g.Limit == nil {
+            delete(groupEnforced, name)
+        }
+    }
+    for name, g := range quotaGroups {
+        if g.Limit == nil {
+            continue
+        }
+        enforced, ok := groupEnforced[name]
+        if !ok {
+            enforced = new([3]bool)
+            groupEnforced[name] = enforced
+        }
+        total := groupTotal(g)
+        for i, d := range shareDims {
+            limit := float64(*quotaFieldPtr(g.Limit, d.Field))
+            was := enforced[i]
+            if limit <= 0 || total[i] < limit * groupReleaseRatio {
+                enforced[i] = false
+            } else if total[i] >= limit {
+                enforced[i] = true
+            }
+            if enforced[i] != was {
+                state := "released"
+                if enforced[i] {
+                    state = "reached"
+                }
+                msgs = append(msgs, fmt.Sprintf("Group %s %s limit %s, usage<%.1f>, quota<%d>", name, d.Key, state, total[i], int64(limit)))
+            }
+            if enforced[i] {
+                splitGroupQuota(g, i, limit, total[i], shares)
+            }
+        }
+    }
+    old := groupShares
+    groupShares = shares
+    groupLock.Unlock()
+
+    for b, q := range shares {
+        if !sameQuota(old[b], q) {
+            quotaRegistry.Notify(b)
+        }
+    }
+    for b, _ := range old {
+        if _, ok := shares[b]; !ok {
+            quotaRegistry.Notify(b)
+        }
+    }
+    for _, msg := range msgs {
+        GLogger.Info(msg)
+        SendWarn(msg)
+    }
+}
+
+
+// 每30秒重新分配一次组限速配额
+func groupWatcher() {
+    GLogger.Info("Start quota group watcher")
+    for {
+        updateGroupShares()
+        time.Sleep(30 * time.Second)
+    }
+}
+
+
+// 组限速中桶@bucket分得的限速配额，没有时返回nil
+func groupShare(bucket string) (*BucketQuota) {
+    groupLock.Lock()
+    defer groupLock.Unlock()
+    s, ok := groupShares[bucket]
+    if !ok {
+        return nil
+    }
+    q := *s
+    return &q
+}
+
+
+// 将分得的限速配额@s合并至桶的限速配额@q，每个维度取较小值，0表示不限
+func mergeShare(q *BucketQuota, s *BucketQuota) {
+    for _, d := range shareDims {
+        p := quotaFieldPtr(q, d.Field)
+        v := *quotaFieldPtr(s, d.Field)
+        if v > 0 && (*p == 0 || v < *p) {
+            *p = v
+        }
+    }
+}
+
+
+// 解析组的@qt类型配额，表单项名以@prefix开头，全部为空或0时返回nil
+func getGroupQuota(form url.Values, prefix string, name string, qt int64) (*BucketQuota, string) {
+    q := &BucketQuota{BucketName: name, QuotaType: qt}
+    set := false
+    for _, d := range shareDims {
+        v, _, errMsg := getQuotaField(form, prefix + d.Key, prefix + d.Key, true)
+        if errMsg != "" {
+            return nil, errMsg
+        }
+        *quotaFieldPtr(q, d.Field) = v
+        if v > 0 {
+            set = true
+        }
+    }
+    if !set {
+        return nil, ""
+    }
+    return q, ""
+}
+
+
+/* 从@form中解析组@name，Buckets为空格或逗号分隔的桶名
+** 报警配额表单项为WarnRate、WarnConnection、WarnQPS，限速配额为Rate、Connection、QPS
+*/
+func getGroupFromForm(name string, form url.Values) (*QuotaGroup, string) {
+    if name == "" || strings.Contains(name, "/") {
+        return nil, "组名不能为空且不能包含/"
+    }
+
+    seen := make(map[string]bool)
+    buckets := make([]string, 0)
+    for _, b := range strings.FieldsFunc(form.Get("Buckets"), func(c rune) bool { return c == ',' || c == ' ' }) {
+        if b == "TotalStatistic" || isPattern(b) {
+            return nil, "组成员必须是具体的桶名: " + b
+        }
+        if !seen[b] {
+            seen[b] = true
+            buckets = append(buckets, b)
+        }
+    }
+    if len(buckets) == 0 {
+        return nil, "组成员不能为空"
+    }
+    sort.Strings(buckets)
+
+    g := &QuotaGroup{Name: name, Buckets: buckets}
+    errMsg := ""
+    if g.Warn, errMsg = getGroupQuota(form, "Warn", name, 0); errMsg != "" {
+        return nil, errMsg
+    }
+    if g.Limit, errMsg = getGroupQuota(form, "", name, 1); errMsg != "" {
+        return nil, errMsg
+    }
+    return g, ""
+}
+
+
+/* 判断将组修改为@g是否需要审批：组限速配额的任一维度降低超过ApprovalThreshold%
+** 该维度原来不限速时与组当前用量比较，新的组限速配额会立即压低全部成员桶
+** 返回值：需要审批的原因，""表示不需要
+*/
+func needGroupApproval(g *QuotaGroup) (string) {
+    if ApprovalThreshold <= 0 || g.Limit == nil {
+        return ""
+    }
+    groupLock.Lock()
+    old := quotaGroups[g.Name]
+    total := groupTotal(g)
+    groupLock.Unlock()
+
+    for i, d := range shareDims {
+        nv := *quotaFieldPtr(g.Limit, d.Field)
+        if nv <= 0 {
+            continue
+        }
+        limit := float64(nv) * 100 / float64(100 - ApprovalThreshold)
+        if old != nil && old.Limit != nil && *quotaFieldPtr(old.Limit, d.Field) > 0 {
+            if ov := *quotaFieldPtr(old.Limit, d.Field); float64(ov) > limit {
+                return fmt.Sprintf("组%s的%s限速配额从%d降低至%d，超过%d%%", g.Name, d.Key, ov, nv, ApprovalThreshold)
+            }
+        } else if total[i] > limit {
+            return fmt.Sprintf("组%s的%s限速配额%d低于当前用量%.1f超过%d%%", g.Name, d.Key, nv, total[i], ApprovalThreshold)
+        }
+    }
+    return ""
+}
+
+
+/* 新建或修改组@g，大幅降低组限速配额时提交待审批变更，否则立即生效
+** 返回值：待审批变更，nil表示已生效；持久化失败的原因
+*/
+func setGroup(g *QuotaGroup, admin string, reason string) (*PendingChange, error) {
+    if why := needGroupApproval(g); why != "" {
+        return submitGroupApproval(g, admin, reason, why)
+    }
+    return nil, putGroup(g, admin, reason)
+}
+
+
+/* 保存组@g，立即重新分配组限速配额
+** 返回值：持久化失败的原因，此时内存中的组已回滚
+*/
+func putGroup(g *QuotaGroup, admin string, reason string) (error) {
+    g.Admin = admin
+    g.UpdateTime = time.Now().Unix()
+    groupLock.Lock()
+    old, ok := quotaGroups[g.Name]
+    quotaGroups[g.Name] = g
+    if err := updateDiskGroups(); err != nil {
+        if ok {
+            quotaGroups[g.Name] = old
+        } else {
+            delete(quotaGroups, g.Name)
+        }
+        groupLock.Unlock()
+        return err
+    }
+    groupLock.Unlock()
+    GLogger.Info("Admin %s set group %s: Buckets:%s Warn:%s Limit:%s, reason: %s", admin, g.Name,
+                 strings.Join(g.Buckets, ","), describeQuota(g.Warn), describeQuota(g.Limit), reason)
+    updateGroupShares()
+    return nil
+}
+
+
+/* 删除组@name
+** 返回值：组不存在时返回false；持久化失败的原因，此时组未删除
+*/
+func delGroup(name string, admin string) (bool, error) {
+    groupLock.Lock()
+    old, ok := quotaGroups[name]
+    if ok {
+        delete(quotaGroups, name)
+        if err := updateDiskGroups(); err != nil {
+            quotaGroups[name] = old
+            groupLock.Unlock()
+            return true, err
+        }
+    }
+    groupLock.Unlock()
+    if !ok {
+        return false, nil
+    }
+    GLogger.Info("Admin %s delete group %s", admin, name)
+    updateGroupShares()
+    return true, nil
+}
+
+
+// 组的当前状态，Usage为组用量，Enforced为处于限速中的维度，Shares为成员分得的限速配额
+type QuotaGroupStatus struct {
+    Group     *QuotaGroup
+    Usage     map[string]float64
+    Enforced  []string
+    Shares    map[string]*BucketQuota
+}
+
+
+func getGroupStatus(name string) (*QuotaGroupStatus) {
+    groupLock.Lock()
+    defer groupLock.Unlock()
+    g, ok := quotaGroups[name]
+    if !ok {
+        return nil
+    }
+    s := &QuotaGroupStatus{Group: g, Usage: make(map[string]float64), Enforced: make([]string, 0),
+                           Shares: make(map[string]*BucketQuota)}
+    total := groupTotal(g)
+    for i, d := range shareDims {
+        s.Usage[d.Key] = total[i]
+        if e, ok := groupEnforced[name]; ok && e[i] {
+            s.Enforced = append(s.Enforced, d.Key)
+        }
+    }
+    for _, b := range g.Buckets {
+        if q, ok := groupShares[b]; ok {
+            c := *q
+            s.Shares[b] = &c
+        }
+    }
+    return s
+}
+
+
+// 按组名排序的组状态
+func sortedGroupStatus() ([]*QuotaGroupStatus) {
+    groupLock.Lock()
+    names := make([]string, 0)
+    for key, _ := range quotaGroups {
+        names = append(names, key)
+    }
+    groupLock.Unlock()
+    sort.Strings(names)
+
+    list := make([]*QuotaGroupStatus, 0)
+    for _, name := range names {
+        if s := getGroupStatus(name); s != nil {
+            list = append(list, s)
+        }
+    }
+    return list
+}
+
+
+// 组配额WEB页面，GET展示所有组及用量，POST新建、修改或删除组
+func handlerGroups(w http.ResponseWriter, r *http.Request) {
+    if r.Method == "POST" {
+        r.ParseForm()
+        user := r.Form.Get("Admin")
+        passwd := r.Form.Get("Password")
+        value, find := admins[user]
+        errMsg := ""
+        if user == "" || passwd == "" {
+            errMsg = "用户名或密码不能为空"
+        } else if !find || value != passwd {
+            errMsg = "非管理员登陆"
+        } else if r.Form.Get("Op") == "Delete" {
+            if found, serr := delGroup(r.Form.Get("Name"), user); !found {
+                errMsg = "组" + r.Form.Get("Name") + "不存在"
+            } else if serr != nil {
+                errMsg = saveErrMsg(serr)
+            }
+        } else {
+            g, err := getGroupFromForm(r.Form.Get("Name"), r.Form)
+            if err != "" {
+                errMsg = err
+            } else if p, serr := setGroup(g, user, r.Form.Get("Reason")); serr != nil {
+                errMsg = saveErrMsg(serr)
+            } else if p != nil {
+                // 大幅降低组限速配额需要另一位管理员审批
+                errMsg = pendingMsg(p, nil)
+            }
+        }
+        if errMsg == "" {
+            errMsg = "OK!"
+        }
+        fmt.Fprintf(w, `<html><head><meta charset=utf-8><meta http-equiv="refresh" content="2; url=http://%s:%s/groups" /></head><body>%s</body></html>`, Host, HttpPort, html.EscapeString(errMsg))
+        return
+    }
+
+    lines := ""
+    for _, s := range sortedGroupStatus() {
+        shares := ""
+        for _, b := range s.Group.Buckets {
+            if q, ok := s.Shares[b]; ok {
+                shares += fmt.Sprintf("%s: %s<br>", html.EscapeString(b), html.EscapeString(describeQuota(q)))
+            }
+        }
+        lines += fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%.1f/%.1f/%.1f</td><td>%s</td><td>%s</td><td>%s %s</td></tr>`,
+                             html.EscapeString(s.Group.Name), html.EscapeString(strings.Join(s.Group.Buckets, " ")),
+                             html.EscapeString(describeQuota(s.Group.Warn)), html.EscapeString(describeQuota(s.Group.Limit)),
+                             s.Usage["Rate"], s.Usage["Connection"], s.Usage["QPS"], strings.Join(s.Enforced, " "), shares,
+                             html.EscapeString(s.Group.Admin), time.Unix(s.Group.UpdateTime, 0).Format("2006-01-02 15:04:05"))
+    }
+    fmt.Fprintf(w, `<html><head><meta charset=utf-8></head><body>
+        <p><b>组配额</b></p>
+        <table border=1>
+        <tr><td>Name</td><td>Buckets</td><td>WarnQuota</td><td>LimitQuota</td><td>Usage Rate/Conn/QPS</td><td>Limiting</td><td>Shares</td><td>Modified</td></tr>
+        %s
+        </table>
+        <form action="/groups" method="post">
+        <table border=0>
+        <tr><td>Name</td><td><input type="text" name="Name"></input></td></tr>
+        <tr><td>Buckets</td><td><input type="text" name="Buckets" size=80></input></td></tr>
+        <tr><td>Warn Rate(B/s)</td><td><input type="text" name="WarnRate"></input></td></tr>
+        <tr><td>Warn Connection</td><td><input type="text" name="WarnConnection"></input></td></tr>
+        <tr><td>Warn QPS</td><td><input type="text" name="WarnQPS"></input></td></tr>
+        <tr><td>Limit Rate(B/s)</td><td><input type="text" name="Rate"></input></td></tr>
+        <tr><td>Limit Connection</td><td><input type="text" name="Connection"></input></td></tr>
+        <tr><td>Limit QPS</td><td><input type="text" name="QPS"></input></td></tr>
+        <tr><td>Admin</td><td><input type="text" name="Admin"></input></td></tr>
+        <tr><td>Password</td><td><input type="password" name="Password"></input></td></tr>
+        <tr><td>Reason</td><td><input type="text" name="Reason"></input></td></tr>
+        <tr><td><input type="submit" value="Set"></input></td><td><input type="submit" name="Op" value="Delete"></input></td></tr>
+        </table>
+        </form></body></html>`, lines)
+}
+
+
+// PUT /api/v1/groups/{name}的请求体
+type groupBody struct {
+    Buckets  []string
+    Warn     map[string]int64
+    Limit    map[string]int64
+    Reason   string
+}
+
+
+// 将请求体转换为与WEB表单相同的form
+func getGroupFormFromBody(r *http.Request) (url.Values, string) {
+    var body groupBody
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        return nil, fmt.Sprintf("请求体不是合法的json: %s", err)
+    }
+
+    form := url.Values{}
+    form.Set("Buckets", strings.Join(body.Buckets, " "))
+    form.Set("Reason", body.Reason)
+    quotas := []struct {
+        prefix  string
+        values  map[string]int64
+    }{
+        {"Warn", body.Warn},
+        {"",     body.Limit},
+    }
+    for _, q := range quotas {
+        for key, v := range q.values {
+            known := false
+            for _, d := range shareDims {
+                known = known || d.Key == key
+            }
+            if !known {
+                return nil, "组配额只支持Rate、Connection、QPS: " + key
+            }
+            form.Set(q.prefix + key, strconv.FormatInt(v, 10))
+        }
+    }
+    return form, ""
+}
+
+
+/* 组配额API:
+** GET    /api/v1/groups         列出所有组及状态
+** GET    /api/v1/groups/{name}  获取组及状态
+** PUT    /api/v1/groups/{name}  新建或修改组，请求体为{"Buckets":[...],"Warn":{"Rate":..},"Limit":{"QPS":..}}，
+**                               大幅降低组限速配额时返回202和待审批变更
+** DELETE /api/v1/groups/{name}  删除组
+*/
+func apiGroups(w http.ResponseWriter, r *http.Request) {
+    name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/groups"), "/")
+    if strings.Contains(name, "/") {
+        writeApiError(w, http.StatusNotFound, "NotFound", "unknown api path " + r.URL.Path)
+        return
+    }
+
+    admin, ok := apiAuth(w, r)
+    if !ok {
+        return
+    }
+
+    if name == "" {
+        if r.Method != "GET" {
+            writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET is allowed")
+            return
+        }
+        writeJson(w, http.StatusOK, sortedGroupStatus())
+        return
+    }
+
+    switch r.Method {
+    case "GET":
+        s := getGroupStatus(name)
+        if s == nil {
+            writeApiError(w, http.StatusNotFound, "NoSuchGroup", "no group " + name)
+            return
+        }
+        writeJson(w, http.StatusOK, s)
+
+    case "PUT":
+        form, errMsg := getGroupFormFromBody(r)
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "MalformedJson", errMsg)
+            return
+        }
+        g, errMsg := getGroupFromForm(name, form)
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "InvalidArgument", errMsg)
+            return
+        }
+        p, err := setGroup(g, admin, form.Get("Reason"))
+        if err != nil {
+            writeSaveError(w, err)
+            return
+        }
+        if p != nil {
+            writeJson(w, http.StatusAccepted, p)
+            return
+        }
+        writeJson(w, http.StatusOK, getGroupStatus(name))
+
+    case "DELETE":
+        found, err := delGroup(name, admin)
+        if !found {
+            writeApiError(w, http.StatusNotFound, "NoSuchGroup", "no group " + name)
+            return
+        }
+        if err != nil {
+            writeSaveError(w, err)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET, PUT and DELETE are allowed")
+    }
+}
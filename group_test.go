@@ -0,0 +1,186 @@
+package main
+
+import (
+    "net/http"
+    "net/url"
+    "testing"
+)
+
+
+// 设置成员桶最近的用量，测试结束后清空组及用量
+func setMemberUsage(t *testing.T, usage map[string][3]float64) {
+    groupLock.Lock()
+    for b, u := range usage {
+        v := u
+        memberUsage[b] = &v
+    }
+    groupLock.Unlock()
+    t.Cleanup(func() {
+        groupLock.Lock()
+        quotaGroups = make(map[string]*QuotaGroup)
+        memberUsage = make(map[string]*[3]float64)
+        groupLock.Unlock()
+        updateGroupShares()
+    })
+}
+
+
+func TestGroupFromForm(t *testing.T) {
+    form := url.Values{"Buckets": {"grp-b, grp-a grp-b"}, "WarnRate": {"800"}, "QPS": {"50"}}
+    g, errMsg := getGroupFromForm("team", form)
+    if errMsg != "" {
+        t.Fatal(errMsg)
+    }
+    if len(g.Buckets) != 2 || g.Buckets[0] != "grp-a" || g.Buckets[1] != "grp-b" {
+        t.Fatalf("buckets are %v", g.Buckets)
+    }
+    if g.Warn == nil || g.Warn.RateQuota != 800 || g.Limit == nil || g.Limit.QpsQuota != 50 || g.Limit.RateQuota != 0 {
+        t.Fatalf("quotas are warn %+v limit %+v", g.Warn, g.Limit)
+    }
+
+    bad := []url.Values{
+        {"Buckets": {""}},
+        {"Buckets": {"grp-*"}},
+        {"Buckets": {"TotalStatistic"}},
+        {"Buckets": {"grp-a"}, "Rate": {"-1"}},
+    }
+    for _, f := range bad {
+        if _, errMsg := getGroupFromForm("team", f); errMsg == "" {
+            t.Errorf("form %v accepted", f)
+        }
+    }
+    if _, errMsg := getGroupFromForm("a/b", form); errMsg == "" {
+        t.Error("group name with / accepted")
+    }
+}
+
+
+func TestGroupShareSplit(t *testing.T) {
+    defer clearBucket("grp-b")
+    setMemberUsage(t, map[string][3]float64{"grp-a": {900, 0, 0}, "grp-b": {100, 0, 0}})
+    setQuota("grp-b", 1, testQuota(300, 0, 0, 0), "alice", "")
+
+    g := &QuotaGroup{Name: "team", Buckets: []string{"grp-a", "grp-b"}, Limit: testQuota(500, 0, 0, 0)}
+    if p, err := setGroup(g, "alice", ""); p != nil || err != nil {
+        t.Fatalf("set group: %v %v", p, err)
+    }
+
+    // 按用量加平均份额的十分之一计权：900+50与100+50
+    if q := effectiveQuota("grp-a", 1); q == nil || q.RateQuota != 431 {
+        t.Fatalf("grp-a effective quota is %+v", q)
+    }
+    // 桶自身的限速配额与组份额取较小值
+    if q := effectiveQuota("grp-b", 1); q == nil || q.RateQuota != 68 {
+        t.Fatalf("grp-b effective quota is %+v", q)
+    }
+    s := getGroupStatus("team")
+    if len(s.Enforced) != 1 || s.Enforced[0] != "Rate" || s.Usage["Rate"] != 1000 {
+        t.Fatalf("group status is %+v", s)
+    }
+
+    // 用量低于限速配额的80%时解除组限速
+    setMemberUsage(t, map[string][3]float64{"grp-a": {200, 0, 0}, "grp-b": {100, 0, 0}})
+    updateGroupShares()
+    if q := effectiveQuota("grp-a", 1); q != nil {
+        t.Fatalf("grp-a still limited after release: %+v", q)
+    }
+    if q := effectiveQuota("grp-b", 1); q == nil || q.RateQuota != 300 {
+        t.Fatalf("grp-b effective quota after release is %+v", q)
+    }
+
+    if found, err := delGroup("team", "alice"); !found || err != nil {
+        t.Fatalf("delete group: %v %v", found, err)
+    }
+    if getGroupStatus("team") != nil {
+        t.Fatal("group not deleted")
+    }
+}
+
+
+func TestGroupReload(t *testing.T) {
+    setMemberUsage(t, nil)
+    g := &QuotaGroup{Name: "saved", Buckets: []string{"grp-a"}, Warn: testQuota(100, 0, 0, 0)}
+    g.Warn.QuotaType = 0
+    if _, err := setGroup(g, "alice", ""); err != nil {
+        t.Fatal(err)
+    }
+
+    groupLock.Lock()
+    quotaGroups = make(map[string]*QuotaGroup)
+    groupLock.Unlock()
+    loadGroups()
+    s := getGroupStatus("saved")
+    if s == nil || s.Group.Warn == nil || s.Group.Warn.RateQuota != 100 {
+        t.Fatalf("reloaded group is %+v", s)
+    }
+}
+
+
+func TestGroupSaveFailure(t *testing.T) {
+    setMemberUsage(t, nil)
+    g := &QuotaGroup{Name: "broken", Buckets: []string{"grp-a"}, Limit: testQuota(100, 0, 0, 0)}
+    restore := breakFile(t, groupFile + ".new")
+    _, err := setGroup(g, "alice", "")
+    restore()
+    if err == nil {
+        t.Fatal("save failure not reported")
+    }
+    if getGroupStatus("broken") != nil {
+        t.Fatal("group kept in memory after save failure")
+    }
+}
+
+
+func TestGroupApproval(t *testing.T) {
+    enableApproval(t)
+    setMemberUsage(t, map[string][3]float64{"grp-a": {0, 0, 400}})
+    path := "/api/v1/groups/team"
+
+    // 新建组时与组当前用量比较
+    w := callApi(apiGroups, "alice", "PUT", path, `{"Buckets": ["grp-a"], "Limit": {"QPS": 100}}`)
+    if w.Code != http.StatusAccepted {
+        t.Fatalf("limit far below usage: got %d %s", w.Code, w.Body.String())
+    }
+    p := decodePending(t, w.Body.Bytes())
+    if p.Group == nil || getGroupStatus("team") != nil {
+        t.Fatalf("pending group change is %+v", p)
+    }
+    if errMsg, err := approveChange(p.ID, "bob"); errMsg != "" || err != nil {
+        t.Fatalf("approve: %q %v", errMsg, err)
+    }
+    if s := getGroupStatus("team"); s == nil || s.Group.Limit.QpsQuota != 100 {
+        t.Fatalf("approved group is %+v", s)
+    }
+
+    // 小幅降低直接生效
+    w = callApi(apiGroups, "alice", "PUT", path, `{"Buckets": ["grp-a"], "Limit": {"QPS": 80}}`)
+    if w.Code != http.StatusOK || getGroupStatus("team").Group.Limit.QpsQuota != 80 {
+        t.Fatalf("small reduction: got %d %s", w.Code, w.Body.String())
+    }
+    w = callApi(apiGroups, "alice", "PUT", path, `{"Buckets": ["grp-a"], "Limit": {"QPS": 10}}`)
+    if w.Code != http.StatusAccepted {
+        t.Fatalf("large reduction: got %d %s", w.Code, w.Body.String())
+    }
+}
+
+
+func TestGroupApi(t *testing.T) {
+    setMemberUsage(t, nil)
+    path := "/api/v1/groups/api-team"
+
+    if w := callApi(apiGroups, "alice", "PUT", path, `{"Buckets": ["grp-a"], "Limit": {"Burst": 1}}`); w.Code != http.StatusBadRequest {
+        t.Fatalf("unknown dimension: got %d", w.Code)
+    }
+    if w := callApi(apiGroups, "alice", "PUT", path, `{"Buckets": ["grp-a", "grp-b"], "Warn": {"Rate": 10}}`); w.Code != http.StatusOK {
+        t.Fatalf("put: got %d %s", w.Code, w.Body.String())
+    }
+    if w := callApi(apiGroups, "alice", "GET", path, ""); w.Code != http.StatusOK {
+        t.Fatalf("get: got %d", w.Code)
+    }
+    if w := callApi(apiGroups, "alice", "DELETE", path, ""); w.Code != http.StatusNoContent {
+        t.Fatalf("delete: got %d", w.Code)
+    }
+    if w := callApi(apiGroups, "alice", "GET", path, ""); w.Code != http.StatusNotFound {
+        t.Fatalf("get deleted group: got %d", w.Code)
+    }
+}
@@ -0,0 +1,366 @@
+/* LimitServer配额修改历史模块，提供以下功能:
+** 1. 每次配额修改记录为一个版本(修改人、时间、修改前后的配额、原因)
+** 2. 通过WEB页面和API查看桶的修改历史
+** 3. 将桶配额回滚至任意历史版本，回滚本身也记录为一个新版本
+** 修改历史以json格式追加写入./conf/quota_history，每个版本一行
+*/
+
+package main
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "html"
+    "time"
+    "bufio"
+    "strings"
+    "sync"
+    "strconv"
+    "net/url"
+    "net/http"
+    "encoding/json"
+)
+
+
+const historyFile = "./conf/quota_history"
+
+
+/* 配额的一次修改，Old/New为nil表示修改前/后没有该配额
+** 配额模板的修改也记录为一个版本，此时BucketName为空，Template为模板名，
+** OldTemplate/NewTemplate为nil表示修改前/后没有该模板
+*/
+type QuotaRevision struct {
+    Revision    int64
+    BucketName  string
+    QuotaType   int64
+    Admin       string
+    Time        int64
+    Reason      string
+    Old         *BucketQuota
+    New         *BucketQuota
+    Template    string          `json:",omitempty"`
+    OldTemplate *QuotaTemplate  `json:",omitempty"`
+    NewTemplate *QuotaTemplate  `json:",omitempty"`
+}
+
+
+// 全部修改历史，按版本号递增排列，由historyLock保护；记录生成后不再修改
+var quotaHistory []*QuotaRevision
+var lastRevision int64
+var historyLock sync.RWMutex
+
+
+// 记录一次配额修改，并追加写入历史文件
+func recordRevision(bucket string, quotaType int, old *BucketQuota, new *BucketQuota, admin string, reason string) {
+    rev := &QuotaRevision{BucketName: bucket, QuotaType: int64(quotaType), Admin: admin, Reason: reason}
+    // 保存副本，避免之后内存配额的修改影响历史记录
+    if old != nil {
+        o := *old
+        rev.Old = &o
+    }
+    if new != nil {
+        n := *new
+        rev.New = &n
+    }
+    appendRevision(rev)
+}
+
+
+// 记录一次配额模板@name的修改，模板整体替换不在原地修改，不需要保存副本
+func recordTemplateRevision(name string, old *QuotaTemplate, new *QuotaTemplate, admin string, reason string) {
+    appendRevision(&QuotaRevision{Template: name, QuotaType: 1, Admin: admin, Reason: reason,
+                                  OldTemplate: old, NewTemplate: new})
+}
+
+
+// 为修改记录@rev分配版本号，并追加写入历史文件
+func appendRevision(rev *QuotaRevision) {
+    historyLock.Lock()
+    defer historyLock.Unlock()
+    lastRevision++
+    rev.Revision = lastRevision
+    rev.Time = time.Now().Unix()
+    quotaHistory = append(quotaHistory, rev)
+
+    b, err := json.Marshal(rev)
+    if err != nil {
+        GErrorLogger.Error("json Marshal revision %d failed: [%s]", rev.Revision, err)
+        return
+    }
+    f, err := os.OpenFile(historyFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+    if err != nil {
+        GErrorLogger.Error("open history file[%s] failed: [%s]", historyFile, err)
+        return
+    }
+    defer f.Close()
+    _, err = f.Write(append(b, '\n'))
+    if err != nil {
+        GErrorLogger.Error("write revision %d failed: [%s]", rev.Revision, err)
+    }
+}
+
+
+// 加载磁盘上的修改历史
+func loadHistory() {
+    historyLock.Lock()
+    defer historyLock.Unlock()
+    quotaHistory = make([]*QuotaRevision, 0)
+    lastRevision = 0
+
+    f, err := os.Open(historyFile)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            GErrorLogger.Error("open history file[%s] failed: [%s]", historyFile, err)
+        }
+        return
+    }
+    defer f.Close()
+
+    r := bufio.NewReader(f)
+    for {
+        buf, err := r.ReadBytes('\n')
+        if len(trimLine(buf)) > 0 {
+            rev := new(QuotaRevision)
+            if jerr := json.Unmarshal(buf, rev); jerr != nil {
+                GErrorLogger.Error("Unmarshal revision [%s] failed: [%s]", buf, jerr)
+            } else {
+                quotaHistory = append(quotaHistory, rev)
+                if rev.Revision > lastRevision {
+                    lastRevision = rev.Revision
+                }
+            }
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            GErrorLogger.Error("read history file [%s] failed: [%s]", historyFile, err)
+            break
+        }
+    }
+    GLogger.Info("read history file [%s] done, last revision %d", historyFile, lastRevision)
+}
+
+
+// 获取桶@bucket的修改历史，最新的版本在前
+func getBucketHistory(bucket string) ([]*QuotaRevision) {
+    historyLock.RLock()
+    defer historyLock.RUnlock()
+    revs := make([]*QuotaRevision, 0)
+    for i := len(quotaHistory) - 1; i >= 0; i-- {
+        if quotaHistory[i].BucketName == bucket && quotaHistory[i].Template == "" {
+            revs = append(revs, quotaHistory[i])
+        }
+    }
+    return revs
+}
+
+
+// 获取配额模板@name的修改历史，最新的版本在前
+func getTemplateHistory(name string) ([]*QuotaRevision) {
+    historyLock.RLock()
+    defer historyLock.RUnlock()
+    revs := make([]*QuotaRevision, 0)
+    for i := len(quotaHistory) - 1; i >= 0; i-- {
+        if quotaHistory[i].Template == name {
+            revs = append(revs, quotaHistory[i])
+        }
+    }
+    return revs
+}
+
+
+// 获取版本号为@revision的修改记录，没有时返回nil
+func getRevision(revision int64) (*QuotaRevision) {
+    historyLock.RLock()
+    defer historyLock.RUnlock()
+    for _, rev := range quotaHistory {
+        if rev.Revision == revision {
+            return rev
+        }
+    }
+    return nil
+}
+
+
+/* 将桶@bucket回滚至版本@revision之后的状态，并重新同步前端Nginx
+** 回滚导致限速配额被删除或大幅降低时，提交待审批变更而不立即生效
+** 返回值：待审批变更，nil表示已生效；""代表成功，否则为出错原因；配额持久化失败的原因
+*/
+func rollbackQuota(bucket string, revision int64, admin string, reason string) (*PendingChange, string, error) {
+    target := getRevision(revision)
+    if target == nil || target.Template != "" || target.BucketName != bucket {
+        return nil, fmt.Sprintf("桶%s没有版本%d", bucket, revision), nil
+    }
+
+    if reason == "" {
+        reason = fmt.Sprintf("rollback to revision %d", revision)
+    }
+
+    var quota *BucketQuota
+    if target.New != nil {
+        q := *target.New
+        q.Blocked = false
+        quota = &q
+    }
+    if target.QuotaType == 1 {
+        if why := needApproval(bucket, 1, quota); why != "" {
+            op := RESET
+            if quota == nil {
+                op = DEL
+            }
+            p, err := submitApproval(op, bucket, 1, quota, admin, reason, why)
+            if err != nil {
+                return nil, "", err
+            }
+            return p, "", nil
+        }
+    }
+
+    // 回滚不改变桶的封禁状态，封禁和解除封禁见block.go
+    quotaRegistry.Lock()
+    defer quotaRegistry.Unlock()
+    if target.QuotaType == 1 {
+        quota = keepBlocked(bucket, quota)
+    }
+    return nil, "", putQuotaLocked(bucket, int(target.QuotaType), quota, admin, reason)
+}
+
+
+func describeQuota(q *BucketQuota) (string) {
+    if q == nil {
+        return "-"
+    }
+    prefix := ""
+    if q.Blocked {
+        prefix = "BLOCKED "
+    }
+    if q.Template != "" {
+        return fmt.Sprintf("%sTemplate:%s Overrides:%v", prefix, q.Template, q.Overrides)
+    }
+    desc := prefix + fmt.Sprintf("Rate:%d Conn:%d QPS:%d RatePerConn:%d", q.RateQuota, q.ConnQuota, q.QpsQuota, q.RatePerConn)
+    for _, f := range quotaFields {
+        if v := *quotaFieldPtr(q, f.Field); f.Optional && v > 0 {
+            desc += fmt.Sprintf(" %s:%d", f.Key, v)
+        }
+    }
+    return desc
+}
+
+
+// 配额修改历史WEB页面，GET展示历史，POST执行回滚
+func handlerHistory(w http.ResponseWriter, r *http.Request) {
+    name := r.FormValue("name")
+
+    if r.Method == "POST" {
+        user := r.FormValue("Admin")
+        passwd := r.FormValue("Password")
+        value, find := admins[user]
+        errMsg := ""
+        if user == "" || passwd == "" {
+            errMsg = "用户名或密码不能为空"
+        } else if !find || value != passwd {
+            errMsg = "非管理员登陆"
+        } else {
+            revision, err := strconv.ParseInt(r.FormValue("Revision"), 10, 64)
+            if err != nil {
+                errMsg = "版本号错误"
+            } else {
+                p, msg, serr := rollbackQuota(name, revision, user, r.FormValue("Reason"))
+                if errMsg = msg; serr != nil {
+                    errMsg = saveErrMsg(serr)
+                } else if p != nil {
+                    errMsg = pendingMsg(p, nil)
+                }
+            }
+        }
+        if errMsg == "" {
+            errMsg = "OK!"
+        }
+        fmt.Fprintf(w, `<html><head><meta charset=utf-8><meta http-equiv="refresh" content="2; url=http://%s:%s/history?name=%s" /></head><body>%s</body></html>`,
+                    Host, HttpPort, url.QueryEscape(name), html.EscapeString(errMsg))
+        return
+    }
+
+    lines := ""
+    for _, rev := range getBucketHistory(name) {
+        qt := "Warn"
+        if rev.QuotaType == 1 {
+            qt = "Limit"
+        }
+        stime := time.Unix(rev.Time, 0).Format("2006-01-02 15:04:05")
+        lines += fmt.Sprintf(`<tr><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td>
+            <td><form action="/history" method="post">
+            <input type="hidden" name="name" value="%s"></input>
+            <input type="hidden" name="Revision" value="%d"></input>
+            Admin<input type="text" name="Admin"></input>
+            Password<input type="password" name="Password"></input>
+            Reason<input type="text" name="Reason"></input>
+            <input type="submit" value="Rollback"></input>
+            </form></td></tr>`, rev.Revision, stime, qt, html.EscapeString(rev.Admin),
+            html.EscapeString(describeQuota(rev.Old)), html.EscapeString(describeQuota(rev.New)),
+            html.EscapeString(rev.Reason), html.EscapeString(name), rev.Revision)
+    }
+    fmt.Fprintf(w, `<html><head><meta charset=utf-8></head><body>
+        <p><b>%s 配额修改历史</b></p>
+        <table border=1>
+        <tr><td>Revision</td><td>Time</td><td>Type</td><td>Admin</td><td>Old</td><td>New</td><td>Reason</td><td></td></tr>
+        %s
+        </table></body></html>`, html.EscapeString(name), lines)
+}
+
+
+/* 配额修改历史API:
+** GET  /api/v1/buckets/{name}/history                  获取桶的修改历史
+** POST /api/v1/buckets/{name}/history/{rev}/rollback   回滚至版本rev，需要审批时返回202和待审批变更
+*/
+func apiBucketHistory(w http.ResponseWriter, r *http.Request, bucket string, parts []string) {
+    admin, ok := apiAuth(w, r)
+    if !ok {
+        return
+    }
+
+    if len(parts) == 0 {
+        if r.Method != "GET" {
+            writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET is allowed")
+            return
+        }
+        writeJson(w, http.StatusOK, getBucketHistory(bucket))
+        return
+    }
+
+    if len(parts) != 2 || parts[1] != "rollback" {
+        writeApiError(w, http.StatusNotFound, "NotFound", "unknown api path " + r.URL.Path)
+        return
+    }
+    if r.Method != "POST" {
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only POST is allowed")
+        return
+    }
+    revision, err := strconv.ParseInt(parts[0], 10, 64)
+    if err != nil {
+        writeApiError(w, http.StatusBadRequest, "InvalidArgument", "revision should be a number")
+        return
+    }
+
+    reason := ""
+    body := make(map[string]string)
+    if err = json.NewDecoder(r.Body).Decode(&body); err == nil {
+        reason = strings.TrimSpace(body["Reason"])
+    }
+    p, errMsg, err := rollbackQuota(bucket, revision, admin, reason)
+    if errMsg != "" {
+        writeApiError(w, http.StatusNotFound, "NoSuchRevision", errMsg)
+        return
+    }
+    if err != nil {
+        writeSaveError(w, err)
+        return
+    }
+    if p != nil {
+        writeJson(w, http.StatusAccepted, p)
+        return
+    }
+    writeJson(w, http.StatusOK, getBucketHistory(bucket)[0])
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "testing"
+)
+
+
+func TestHistoryRecordAndRollback(t *testing.T) {
+    defer clearBucket("hist")
+
+    setQuota("hist", 1, testQuota(100, 0, 0, 0), "alice", "first")
+    first := lastRevision
+    setQuota("hist", 1, testQuota(200, 0, 0, 0), "bob", "second")
+    delQuota("hist", 1, "alice", "third")
+
+    revs := getBucketHistory("hist")
+    if len(revs) != 3 {
+        t.Fatalf("got %d revisions, want 3", len(revs))
+    }
+    // 最新的版本在前
+    if revs[0].Reason != "third" || revs[0].New != nil || revs[0].Old.RateQuota != 200 {
+        t.Fatalf("latest revision is %+v", revs[0])
+    }
+    if revs[1].Admin != "bob" || revs[1].Old.RateQuota != 100 || revs[1].New.RateQuota != 200 {
+        t.Fatalf("second revision is %+v", revs[1])
+    }
+    if revs[2].Revision != first || revs[2].Old != nil {
+        t.Fatalf("first revision is %+v", revs[2])
+    }
+
+    if _, errMsg, _ := rollbackQuota("hist", first, "bob", ""); errMsg != "" {
+        t.Fatal(errMsg)
+    }
+    if quotaRegistry.Snapshot()["hist"] == nil || quotaRegistry.Get("hist", 1).RateQuota != 100 {
+        t.Fatal("rollback did not restore the quota")
+    }
+    revs = getBucketHistory("hist")
+    if len(revs) != 4 || revs[0].Admin != "bob" || revs[0].Old != nil || revs[0].New.RateQuota != 100 {
+        t.Fatalf("rollback revision is %+v", revs[0])
+    }
+
+    // 回滚的结果不能影响历史中保存的配额
+    quotaRegistry.Get("hist", 1).RateQuota = 1
+    if revs[0].New.RateQuota != 100 {
+        t.Fatal("revision shares memory with the live quota")
+    }
+
+    if _, errMsg, _ := rollbackQuota("hist", first + 1000, "bob", ""); errMsg == "" {
+        t.Fatal("rollback to unknown revision should fail")
+    }
+    if _, errMsg, _ := rollbackQuota("other", first, "bob", ""); errMsg == "" {
+        t.Fatal("rollback to revision of another bucket should fail")
+    }
+}
+
+
+// 历史文件重新加载后与内存一致
+func TestHistoryReload(t *testing.T) {
+    defer clearBucket("reload")
+
+    setQuota("reload", 0, testQuota(10, 0, 0, 0), "alice", "r1")
+    setQuota("reload", 0, testQuota(20, 0, 0, 0), "alice", "r2")
+    before := getBucketHistory("reload")
+    last := lastRevision
+
+    loadHistory()
+    after := getBucketHistory("reload")
+    if lastRevision != last || len(after) != len(before) {
+        t.Fatalf("reloaded %d revisions up to %d, want %d up to %d", len(after), lastRevision, len(before), last)
+    }
+    for i := range before {
+        a, _ := json.Marshal(before[i])
+        b, _ := json.Marshal(after[i])
+        if string(a) != string(b) {
+            t.Fatalf("revision changed after reload: %s != %s", a, b)
+        }
+    }
+}
+
+
+func TestApiHistory(t *testing.T) {
+    defer clearBucket("api-hist")
+    path := "/api/v1/buckets/api-hist/quota/limit"
+
+    callApi(apiBucketQuota, "alice", "PUT", path, `{"Rate": 100, "Connection": 0, "QPS": 0, "RatePerConn": 0, "Reason": "init"}`)
+    first := lastRevision
+    callApi(apiBucketQuota, "alice", "PUT", path, `{"Rate": 300, "Connection": 0, "QPS": 0, "RatePerConn": 0}`)
+
+    w := callApi(apiBucketQuota, "bob", "GET", "/api/v1/buckets/api-hist/history", "")
+    var revs []*QuotaRevision
+    if err := json.Unmarshal(w.Body.Bytes(), &revs); err != nil {
+        t.Fatal(err)
+    }
+    if len(revs) != 2 || revs[1].Reason != "init" || revs[1].Admin != "alice" {
+        t.Fatalf("history is %s", w.Body.String())
+    }
+
+    w = callApi(apiBucketQuota, "bob", "POST", "/api/v1/buckets/api-hist/history/" + strconv.FormatInt(first, 10) + "/rollback", `{"Reason": "undo"}`)
+    if w.Code != http.StatusOK {
+        t.Fatalf("rollback: got %d %s", w.Code, w.Body.String())
+    }
+    var rev QuotaRevision
+    json.Unmarshal(w.Body.Bytes(), &rev)
+    if rev.Reason != "undo" || rev.Admin != "bob" || rev.New.RateQuota != 100 || quotaRegistry.Get("api-hist", 1).RateQuota != 100 {
+        t.Fatalf("rollback revision is %s", w.Body.String())
+    }
+
+    w = callApi(apiBucketQuota, "bob", "POST", "/api/v1/buckets/api-hist/history/x/rollback", "")
+    if w.Code != http.StatusBadRequest {
+        t.Fatalf("bad revision: got %d", w.Code)
+    }
+    w = callApi(apiBucketQuota, "bob", "POST", "/api/v1/buckets/api-hist/history/999999/rollback", "")
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("unknown revision: got %d", w.Code)
+    }
+}
+
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"io"
 	"fmt"
     "time"
-    "strings"
+    "bytes"
 	"net/http"
+	neturl "net/url"
 	"io/ioutil"
     "encoding/json"
 )
@@ -15,6 +17,19 @@ type LimitData struct {
     LimitConnRate int64    `json:"LimitConnRate"`
     LimitConn     int64    `json:"LimitBucketConn"`
     LimitQps      int64    `json:"LimitBucketQPS"`
+    // 分操作QPS限速，0表示不单独限制
+    LimitGetQps    int64   `json:"LimitBucketGetQPS,omitempty"`
+    LimitPutQps    int64   `json:"LimitBucketPutQPS,omitempty"`
+    LimitDeleteQps int64   `json:"LimitBucketDeleteQPS,omitempty"`
+    LimitListQps   int64   `json:"LimitBucketListQPS,omitempty"`
+    LimitImageQps  int64   `json:"LimitBucketImageQPS,omitempty"`
+    LimitVideoQps  int64   `json:"LimitBucketVideoQPS,omitempty"`
+    // 令牌桶参数：突发流量(B)、突发请求数、补充令牌的间隔(ms)，0表示不允许突发/连续补充
+    LimitBurstRate      int64  `json:"LimitBucketBurstRate,omitempty"`
+    LimitBurstQps       int64  `json:"LimitBucketBurstQPS,omitempty"`
+    LimitRefillInterval int64  `json:"LimitRefillInterval,omitempty"`
+    // 桶被封禁，Nginx拒绝该桶的全部请求
+    LimitBlock          bool   `json:"LimitBucketBlock,omitempty"`
 }
 
 // Nginx上的桶的限速信息
@@ -22,155 +37,256 @@ type LimitList struct {
 	BucketLimit []LimitData
 }
 
-/* 从@server上获取限速配额信息、
-** 返回值：限速配额信息和成功与否
+// 与Nginx交互的HTTP客户端，所有请求都有超时
+var nginxClient = &http.Client{Timeout: 10 * time.Second}
+
+
+/* 从@server上获取限速配额信息，@etag不为空时为条件请求，Nginx上的配额没有变化时返回304
+** 返回值：限速配额信息、Nginx返回的ETag、是否没有变化、成功与否
 */
-func GetNginxLimit(server string)([]byte, bool) {
-    var limitList []byte
-    ret := true
+func GetNginxLimit(server string, etag string)([]byte, string, bool, bool) {
     url := "http://" + server + "/?list"
     GLogger.Info("Get Nginx Limit, url is: %s", url)
-    res, err := http.Get(url)
+    req, err := http.NewRequest("GET", url, nil)
+    if err != nil {
+        GErrorLogger.Error("Get ListLimit failed from %s: %s", server, err)
+        recordSyncError(server, fmt.Sprintf("get limit list failed: %s", err))
+        return nil, "", false, false
+    }
+    if etag != "" {
+        req.Header.Set("If-None-Match", etag)
+    }
+    res, err := nginxClient.Do(req)
     if err != nil {
-        GErrorLogger.Error("Get ListLimit failed from %s", server)
-        ret = false
-        goto RET
-    } else {
-        defer res.Body.Close()
+        GErrorLogger.Error("Get ListLimit failed from %s: %s", server, err)
+        recordSyncError(server, fmt.Sprintf("get limit list failed: %s", err))
+        return nil, "", false, false
     }
+    defer res.Body.Close()
 
-    limitList, _ = ioutil.ReadAll(res.Body)
-RET:
-    return limitList, ret
+    if res.StatusCode == http.StatusNotModified {
+        return nil, etag, true, true
+    }
+    if res.StatusCode != http.StatusOK {
+        GErrorLogger.Error("Get ListLimit failed from %s, status %d", server, res.StatusCode)
+        recordSyncError(server, fmt.Sprintf("get limit list failed: status %d", res.StatusCode))
+        return nil, "", false, false
+    }
+    limitList, err := ioutil.ReadAll(res.Body)
+    if err != nil {
+        GErrorLogger.Error("Get ListLimit failed from %s: %s", server, err)
+        recordSyncError(server, fmt.Sprintf("get limit list failed: %s", err))
+        return nil, "", false, false
+    }
+    return limitList, res.Header.Get("ETag"), false, true
 }
 
 
 
-/* 从@server上删除@bucket的限速配额
+/* 检查Nginx限速模块的响应@res
+** 非2xx时错误中包含响应体；2xx时响应体为空或者不是json视为成功，
+** 为json时Status不为空且不为"ok"视为失败，格式同批量下发中每个桶的结果
+*/
+func checkNginxResponse(res *http.Response) (error) {
+    body, err := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+    if err != nil {
+        return fmt.Errorf("status %d, read body failed: %s", res.StatusCode, err)
+    }
+    if res.StatusCode / 100 != 2 {
+        return fmt.Errorf("status %d: %s", res.StatusCode, bytes.TrimSpace(body))
+    }
+    var result LimitBulkResult
+    if json.Unmarshal(body, &result) == nil && result.Status != "" && result.Status != "ok" {
+        return fmt.Errorf("status %d: %s", res.StatusCode, result.Status)
+    }
+    return nil
+}
+
+
+/* 从@server上删除@bucket的限速配额，失败时由投递队列重试并报警，见delivery.go
+** 返回值：HTTP状态码(无法访问Nginx时为0)、出错原因
 */
-func DelNginxLimit(server string, bucket string) {
+func DelNginxLimit(server string, bucket string) (int, error) {
     GLogger.Info("Del Nginx %s bucket %s limit quota", server, bucket)
-    url := "http://" + server + "/?LimitBucketName=" + bucket
+    url := "http://" + server + "/?LimitBucketName=" + neturl.QueryEscape(bucket)
     req, err := http.NewRequest("DELETE", url, nil)
-    res, err := http.DefaultClient.Do(req)
-    // 删除错误，记录日志并报警
     if err != nil {
-        GErrorLogger.Error("Delete %s from %s failed", bucket, server)
-        msg := fmt.Sprintf("Delete Bucket %s LimitQuota to %s failed", bucket, server)
-        SendWarn(msg)
-    } else {
-        defer res.Body.Close()
+        GErrorLogger.Error("Delete %s from %s failed: %s", bucket, server, err)
+        return 0, err
     }
+    res, err := nginxClient.Do(req)
+    if err != nil {
+        GErrorLogger.Error("Delete %s from %s failed: %s", bucket, server, err)
+        recordSyncError(server, fmt.Sprintf("delete bucket %s limit failed: %s", bucket, err))
+        return 0, err
+    }
+    defer res.Body.Close()
+    if err = checkNginxResponse(res); err != nil {
+        GErrorLogger.Error("Delete %s from %s failed: %s", bucket, server, err)
+        recordSyncError(server, fmt.Sprintf("delete bucket %s limit failed: %s", bucket, err))
+    }
+    return res.StatusCode, err
 }
 
 
 
-/* 更新@server上的@bucket限速配额
+/* 更新@server上的桶限速配额@pkg，失败时由投递队列重试并报警，见delivery.go
+** 返回值：HTTP状态码(无法访问Nginx时为0)、出错原因
 */
-func SetNginxLimit(server string, bucket string, rate int64, conn int64, qps int64, connrate int64){
-    var pkg LimitData
-    pkg.BucketName = bucket
-    pkg.LimitRate  = rate
-    pkg.LimitConn  = conn
-    pkg.LimitQps   = qps
-    pkg.LimitConnRate = connrate
-
+func SetNginxLimit(server string, pkg LimitData) (int, error) {
     // 封装成json格式
     buf, err := json.Marshal(pkg)
     if err != nil {
         GErrorLogger.Error("Marshal %s failed", pkg)
-        return
+        return 0, err
     }
     GLogger.Info("Set Nginx %s limit quota [%s]", server, string(buf))
 
     url := "http://" + server
-    s := string(buf[:len(buf)])
-    res, err := http.Post(url, "text/plain", strings.NewReader(s))
-    // 设置错误，记录日志并且报警
+    res, err := nginxClient.Post(url, "text/plain", bytes.NewReader(buf))
     if err != nil {
-        GErrorLogger.Error("Set %s failed, content: %s", url, buf)
-        msg := fmt.Sprintf("set Limit Data to %s failed", server)
-        SendWarn(msg)
-    } else {
-        defer res.Body.Close()
+        GErrorLogger.Error("Set %s failed: %s, content: %s", url, err, buf)
+        recordSyncError(server, fmt.Sprintf("set bucket %s limit failed: %s", pkg.BucketName, err))
+        return 0, err
     }
+    defer res.Body.Close()
+    if err = checkNginxResponse(res); err != nil {
+        GErrorLogger.Error("Set %s failed: %s, content: %s", url, err, buf)
+        recordSyncError(server, fmt.Sprintf("set bucket %s limit failed: %s", pkg.BucketName, err))
+    }
+    return res.StatusCode, err
 }
 
 
-// 启动LimitServer，server形式为ip:port
-func limitServer(server string) {
-    GLogger.Info("Start limitServer: %s", server)
-    contFailed := 0
-	for {
-        // 从前端Nginx获取
-        limitList, ok := GetNginxLimit(server)
-        if  !ok {
-            contFailed = contFailed + 1
-            if(LimitListWarnThreahold > 0 && contFailed >= LimitListWarnThreahold) {
-                warn := fmt.Sprintf("Get ListLimit failed %d times continuously from %s", contFailed, server)
-                SendWarn(warn)
-            }
-		    time.Sleep(60000 * time.Millisecond)
-			continue
-        }
-        contFailed = 0
+/* 根据桶的限速配额@q计算下发给Nginx @server的限速信息
+** 桶的流量、连接数、QPS(包括分操作QPS)配额按各Nginx最近的需求分配，单连接流量配额不需要分配
+*/
+func nginxLimitData(server string, q *BucketQuota) (LimitData) {
+    return splitLimitData(q, nodeRatio(server, q.BucketName))
+}
 
-		GLogger.Info("[%s] LimitList: %s", time.Now().Format("2006-01-02 15:04:05"), limitList)
 
-		var blimits LimitList
-        err := json.Unmarshal(limitList, &(blimits.BucketLimit))
-        if err != nil {
-            GErrorLogger.Error("Json unmarshal %s failed: %s\n", limitList, err)
+/* 按比例@ratio(流量、连接数、QPS，顺序同shareDims)计算限速信息
+** 令牌桶容量与补充速率按相同比例分配，补充间隔不需要分配
+** 封禁的桶下发封禁标记，同时将流量、连接数、QPS限制为1，不识别封禁标记的老版本模块也几乎不放行请求
+*/
+func splitLimitData(q *BucketQuota, ratio [3]float64) (LimitData) {
+    var d LimitData
+    if q.Blocked {
+        return LimitData{BucketName: q.BucketName, LimitBlock: true, LimitRate: 1, LimitConn: 1, LimitQps: 1}
+    }
+    d.BucketName    = q.BucketName
+    d.LimitRate     = splitQuota(q.RateQuota, ratio[0])
+    d.LimitConn     = splitQuota(q.ConnQuota, ratio[1])
+    d.LimitQps      = splitQuota(q.QpsQuota, ratio[2])
+    d.LimitConnRate = q.RatePerConn
+    d.LimitGetQps    = splitQuota(q.QpsGetQuota, ratio[2])
+    d.LimitPutQps    = splitQuota(q.QpsPutQuota, ratio[2])
+    d.LimitDeleteQps = splitQuota(q.QpsDeleteQuota, ratio[2])
+    d.LimitListQps   = splitQuota(q.QpsListQuota, ratio[2])
+    d.LimitImageQps  = splitQuota(q.QpsImageQuota, ratio[2])
+    d.LimitVideoQps  = splitQuota(q.QpsVideoQuota, ratio[2])
+    d.LimitBurstRate = splitQuota(q.RateBurst, ratio[0])
+    d.LimitBurstQps  = splitQuota(q.QpsBurst, ratio[2])
+    d.LimitRefillInterval = q.RefillInterval
+    return d
+}
+
+
+/* 计算所有需要下发至Nginx的桶限速配额，包括:
+** 1. 有精确限速配额的桶
+** 2. 活跃的或者已经在Nginx上(@listed)的、匹配通配限速配额或处于组、集群容量限速中的桶
+** TotalStatistic的限速配额是集群容量，以及只设置了权重、优先级的限速配额，不下发
+*/
+func desiredLimits(listed []string) (map[string]*BucketQuota) {
+    limits := make(map[string]*BucketQuota)
+    for key, value := range quotaRegistry.Snapshot() {
+        if value[1] != nil && !isPattern(key) && key != "TotalStatistic" {
+            limits[key] = effectiveQuota(key, 1)
         }
+    }
 
-        // LimitServer本地存储的桶限速配额
-        localLimits := make(map[string]*BucketQuota)
-        for key, value := range QuotaInfo {
-            if value[1] != nil {
-                localLimits[key] = value[1]
-            }
+    candidates := listed
+    for key, _ := range activeBuckets(300) {
+        candidates = append(candidates, key)
+    }
+    for _, key := range candidates {
+        if _, ok := limits[key]; ok {
+            continue
+        }
+        if l := effectiveQuota(key, 1); l != nil {
+            limits[key] = l
+        }
+    }
+    for key, l := range limits {
+        if splitLimitData(l, [3]float64{1, 1, 1}) == (LimitData{BucketName: key}) {
+            delete(limits, key)
         }
+    }
+    return limits
+}
 
-        /* 遍历所有收到的Bucket,对比其值与本地是否相同
-        ** 如果相同，从需要更新map中剔除
-        ** 如果对端有的，本地没有，那么需要从对端删除
-        ** 如果对端没有的，本地有，那么需要更新至对端
-        */
-        sngx := int64(len(Nginxs))
-        for _, v := range (blimits.BucketLimit) {
-            l, ok := localLimits[v.BucketName]
-            if ok {
-                if v.LimitRate == int64(l.RateQuota/sngx) && v.LimitConn == int64(l.ConnQuota/sngx) &&
-                   v.LimitQps  == int64(l.QpsQuota/sngx)  && v.LimitConnRate == l.RatePerConn {
-                    delete(localLimits, v.BucketName)
-                }
-            } else {
-                // 如果本地没有找到，就应该从Nginx上删除桶配额信息
-                GErrorLogger.Error("No bucket %s limit quota found", v.BucketName)
-                DelNginxLimit(server, v.BucketName)
+
+/* 等待配额变化通知，最长等待@timeout
+** 收到通知后合并已经积压的通知，一次同步即可覆盖所有变化
+** 返回值：是否收到了配额变化通知(否则为超时)，@stop被关闭时第二个返回值为false
+*/
+func waitQuotaChange(ch <-chan string, stop <-chan struct{}, timeout time.Duration) (bool, bool) {
+    select {
+    case <-ch:
+        for {
+            select {
+            case <-ch:
+            default:
+                return true, true
             }
         }
+    case <-stop:
+        return false, false
+    case <-time.After(timeout):
+    }
+    return false, true
+}
 
-        // 逐个更新Nginx上的桶配额信息
-        for _, value := range localLimits {
-            SetNginxLimit(server, value.BucketName, int64(value.RateQuota/sngx), int64(value.ConnQuota/sngx),
-                          int64(value.QpsQuota/sngx), int64(value.RatePerConn/sngx))
+
+/* 启动LimitServer，server形式为ip:port，@stop被关闭时退出
+** 每60秒用条件请求检查一次Nginx上的配额，配额变化时立即同步，同步协议见nginxsync.go
+** 投递队列中有待重试的操作时，到重试时间即再同步一次
+*/
+func limitServer(server string, stop <-chan struct{}) {
+    GLogger.Info("Start limitServer: %s", server)
+    contFailed := 0
+    changes := quotaRegistry.Subscribe()
+    defer quotaRegistry.Unsubscribe(changes)
+    st := newNodeSyncState(nodeEnforcer(server))
+    notified, running := false, true
+	for running {
+        if !syncNginx(server, st, notified) {
+            contFailed = contFailed + 1
+            if(LimitListWarnThreahold > 0 && contFailed >= LimitListWarnThreahold) {
+                warn := fmt.Sprintf("Get ListLimit failed %d times continuously from %s", contFailed, server)
+                SendWarn(warn)
+            }
+        } else {
+            contFailed = 0
         }
-		time.Sleep(60000 * time.Millisecond)
+		notified, running = waitQuotaChange(changes, stop, st.queue.nextRetry(60 * time.Second))
 	}
-	GLogger.Info("Limit Server exit")
-	time.Sleep(1000 * time.Millisecond)
+	GLogger.Info("Limit Server %s exit", server)
 }
 
 
 /* 启动LimitServer
-** 首先，读配置文件，解析所有前端Nginx地址
-** 然后，为每个前端Nginx启动一个go routine
+** 首先，加载前端Nginx节点列表
+** 然后，为每个前端Nginx启动一个go routine，运行时增删节点见fleet.go
 */
 func startLimitServer() {
-    for _, v := range Nginxs {
-        go limitServer(v)
+    loadFleet()
+    fleetLock.Lock()
+    for addr, _ := range nginxNodes {
+        startNodeSync(addr)
     }
+    fleetLock.Unlock()
 }
 
 
@@ -187,6 +303,9 @@ func main() {
         panic ("postgre init failed")
     }
 
+    // 先加载配额、模板、组和提额，再启动同步协程，避免首次同步按空配额删除Nginx上的全部限速
+    QuotaInit()
+
     startLimitServer()
 
 	go ringManager(UDPRingChan)
@@ -197,8 +316,6 @@ func main() {
 
 	go StaticServer()
 
-    QuotaInit()
-
 	for {
 		time.Sleep(10000 * time.Millisecond)
 	}
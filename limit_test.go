@@ -0,0 +1,92 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "testing"
+)
+
+import l4g "code.google.com/p/log4go"
+
+
+// 源码目录，部分测试需要从这里编译辅助程序
+var srcDir string
+
+
+/* 测试中日志不落盘，所有读写./conf的逻辑都在临时目录中进行
+** 默认管理员为alice和bob，密码均为pw
+*/
+func TestMain(m *testing.M) {
+    GLogger = make(l4g.Logger)
+    GErrorLogger = make(l4g.Logger)
+    GStatLogger = make(l4g.Logger)
+    GServerLog = make(map[string]l4g.Logger)
+
+    var err error
+    srcDir, err = os.Getwd()
+    if err != nil {
+        panic(err)
+    }
+    dir, err := ioutil.TempDir("", "limit-test")
+    if err != nil {
+        panic(err)
+    }
+    if err = os.Mkdir(dir + "/conf", 0755); err != nil {
+        panic(err)
+    }
+    if err = os.Chdir(dir); err != nil {
+        panic(err)
+    }
+
+    quotaTemplates = make(map[string]*QuotaTemplate)
+    quotaBoosts = make(map[string]*QuotaBoost)
+    pendingApprovals = make(map[int64]*PendingChange)
+    quotaStore = &fileQuotaStore{}
+    admins = map[string] string{"alice": "pw", "bob": "pw"}
+
+    code := m.Run()
+    os.Chdir(srcDir)
+    os.RemoveAll(dir)
+    os.Exit(code)
+}
+
+
+func testQuota(rate int64, conn int64, qps int64, ratePerConn int64) (*BucketQuota) {
+    return &BucketQuota{RateQuota: rate, ConnQuota: conn, QpsQuota: qps, RatePerConn: ratePerConn}
+}
+
+
+// 使@fname无法被创建，返回恢复函数，用于模拟持久化失败
+func breakFile(t *testing.T, fname string) (func()) {
+    if err := os.Mkdir(fname, 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := ioutil.WriteFile(fname + "/x", nil, 0644); err != nil {
+        t.Fatal(err)
+    }
+    return func() { os.RemoveAll(fname) }
+}
+
+
+// 删除桶@bucket的全部内存配额，不持久化，用于测试结束后清理
+func clearBucket(bucket string) {
+    quotaRegistry.Lock()
+    quotaRegistry.Set(bucket, 0, nil)
+    quotaRegistry.Set(bucket, 1, nil)
+    quotaRegistry.Unlock()
+}
+
+
+// 测试期间清空内存配额，测试结束后恢复
+func emptyQuotas(t *testing.T) {
+    quotas := make([]*BucketQuota, 0)
+    for _, value := range quotaRegistry.Snapshot() {
+        for _, v := range value {
+            if v != nil {
+                quotas = append(quotas, v)
+            }
+        }
+    }
+    quotaRegistry.Load(nil)
+    t.Cleanup(func() { quotaRegistry.Load(quotas) })
+}
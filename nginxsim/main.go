@@ -0,0 +1,119 @@
+/* Nginx限速模块及统计数据上报模拟器，用于在没有真实Nginx的环境中演示和集成测试limit_server:
+** 1. 模拟N个Nginx节点，第i个节点监听<ip+i>:<port>，实现限速模块的/?list、POST、DELETE和/?bulk接口，
+**    限速信息保存在内存中
+** 2. 每个节点每5秒从自己的IP向limit_server的NgxStatPort发送每个桶的BucketStatistic，
+**    流量按负载曲线产生，超过节点上的限速信息时按限速值上报
+** 3. 可以模拟时钟偏差、UDP丢包、HTTP失败和延迟，以及不支持批量下发的老版本模块
+** 4. 每个节点的/?sim接口可以在运行时查看和修改故障参数，便于自动化测试
+** 多个节点使用127.0.0.x等不同的回环地址，limit_server才能按来源IP区分节点
+**
+** 用法示例:
+**   nginxsim -nodes 3 -ip 127.0.0.11 -port 8080 -stat 127.0.0.1:7778 -buckets 20 -loss 0.05 -skew 2s
+**   nginxsim -profile ./profile.json
+** limit_server的./conf/nginxs中对应填写127.0.0.11:8080、127.0.0.12:8080、127.0.0.13:8080
+*/
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "net"
+    "flag"
+    "time"
+    "math/rand"
+    "encoding/json"
+    "io/ioutil"
+)
+
+
+type Options struct {
+    Nodes     int
+    IP        string
+    Port      int
+    Stat      string
+    Buckets   int
+    Profile   string
+    Skew      time.Duration
+    Loss      float64
+    Fail      float64
+    Latency   time.Duration
+    NoBulk    bool
+    Seed      int64
+}
+
+
+func main() {
+    opt := Options{}
+    flag.IntVar(&opt.Nodes, "nodes", 3, "模拟的Nginx节点数")
+    flag.StringVar(&opt.IP, "ip", "127.0.0.11", "第一个节点的IP，后续节点依次加1")
+    flag.IntVar(&opt.Port, "port", 8080, "每个节点限速模块接口的端口")
+    flag.StringVar(&opt.Stat, "stat", "127.0.0.1:7778", "limit_server接收统计数据的地址")
+    flag.IntVar(&opt.Buckets, "buckets", 10, "没有指定负载配置时生成的桶数量")
+    flag.StringVar(&opt.Profile, "profile", "", "负载配置文件(json)，见profile.go")
+    flag.DurationVar(&opt.Skew, "skew", 0, "每个节点的时钟偏差在[-skew, skew]内随机")
+    flag.Float64Var(&opt.Loss, "loss", 0, "统计数据的丢包率")
+    flag.Float64Var(&opt.Fail, "fail", 0, "限速接口返回500的概率")
+    flag.DurationVar(&opt.Latency, "latency", 0, "限速接口的额外延迟")
+    flag.BoolVar(&opt.NoBulk, "nobulk", false, "模拟不支持/?bulk和ETag的老版本模块")
+    flag.Int64Var(&opt.Seed, "seed", time.Now().UnixNano(), "随机数种子，便于复现")
+    flag.Parse()
+
+    rand.Seed(opt.Seed)
+    profiles, err := loadProfiles(opt.Profile, opt.Buckets)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "load profile failed: %s\n", err)
+        os.Exit(1)
+    }
+    for i := range profiles {
+        profiles[i].spread(opt.Nodes)
+    }
+    statAddr, err := net.ResolveUDPAddr("udp", opt.Stat)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "resolve stat addr %s failed: %s\n", opt.Stat, err)
+        os.Exit(1)
+    }
+    base := net.ParseIP(opt.IP).To4()
+    if base == nil {
+        fmt.Fprintf(os.Stderr, "invalid ip %s\n", opt.IP)
+        os.Exit(1)
+    }
+
+    for i := 0; i < opt.Nodes; i++ {
+        ip := make(net.IP, 4)
+        copy(ip, base)
+        ip[3] += byte(i)
+        skew := time.Duration(0)
+        if opt.Skew > 0 {
+            skew = time.Duration(rand.Int63n(int64(2 * opt.Skew))) - opt.Skew
+        }
+        n := newNode(i, ip, opt, skew)
+        if err := n.start(statAddr, profiles); err != nil {
+            fmt.Fprintf(os.Stderr, "start node %s failed: %s\n", n.addr, err)
+            os.Exit(1)
+        }
+        fmt.Printf("node %s started, clock skew %s\n", n.addr, skew)
+    }
+    fmt.Printf("%d nodes, %d buckets, stat to %s, seed %d\n", opt.Nodes, len(profiles), opt.Stat, opt.Seed)
+    select {}
+}
+
+
+// 从@path加载负载配置，为空时生成@num个桶的随机负载
+func loadProfiles(path string, num int) ([]Profile, error) {
+    if path == "" {
+        return randomProfiles(num), nil
+    }
+    buf, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    profiles := make([]Profile, 0)
+    if err = json.Unmarshal(buf, &profiles); err != nil {
+        return nil, err
+    }
+    for i := range profiles {
+        profiles[i].fill()
+    }
+    return profiles, nil
+}
@@ -0,0 +1,272 @@
+/* 一个模拟的Nginx节点:
+** 1. 限速模块接口，格式与limit_server的LimitData、LimitBulk一致:
+**    GET /?list               返回全部限速信息和ETag，If-None-Match与当前版本相同时返回304
+**    POST /                   设置一个桶的限速信息
+**    DELETE /?LimitBucketName 删除一个桶的限速信息
+**    POST /?bulk              批量下发，BaseETag(If-Match)与当前版本不同时返回412，-nobulk时返回404
+**    GET|POST /?sim           查看或修改故障参数(Faults)
+** 2. 统计数据上报，每5秒发送一次，格式与limit_server的BucketStatistic一致
+*/
+
+package main
+
+import (
+    "fmt"
+    "net"
+    "sort"
+    "sync"
+    "time"
+    "strconv"
+    "net/http"
+    "math/rand"
+    "encoding/json"
+)
+
+
+// 统计窗口长度(秒)，与limit_server一致
+const DURATION = 5
+
+
+type LimitData struct {
+    BucketName    string   `json:"LimitBucketName"`
+    LimitRate     int64    `json:"LimitBucketRate"`
+    LimitConnRate int64    `json:"LimitConnRate"`
+    LimitConn     int64    `json:"LimitBucketConn"`
+    LimitQps      int64    `json:"LimitBucketQPS"`
+    LimitGetQps    int64   `json:"LimitBucketGetQPS,omitempty"`
+    LimitPutQps    int64   `json:"LimitBucketPutQPS,omitempty"`
+    LimitDeleteQps int64   `json:"LimitBucketDeleteQPS,omitempty"`
+    LimitListQps   int64   `json:"LimitBucketListQPS,omitempty"`
+    LimitImageQps  int64   `json:"LimitBucketImageQPS,omitempty"`
+    LimitVideoQps  int64   `json:"LimitBucketVideoQPS,omitempty"`
+    LimitBurstRate      int64  `json:"LimitBucketBurstRate,omitempty"`
+    LimitBurstQps       int64  `json:"LimitBucketBurstQPS,omitempty"`
+    LimitRefillInterval int64  `json:"LimitRefillInterval,omitempty"`
+    LimitBlock          bool   `json:"LimitBucketBlock,omitempty"`
+}
+
+
+type LimitBulk struct {
+    BaseETag  string       `json:"BaseETag,omitempty"`
+    Full      bool         `json:"Full,omitempty"`
+    Set       []LimitData  `json:"Set,omitempty"`
+    Delete    []string     `json:"Delete,omitempty"`
+}
+
+
+type LimitBulkResult struct {
+    BucketName  string  `json:"LimitBucketName"`
+    Status      string
+}
+
+
+type LimitBulkResponse struct {
+    ETag     string
+    Results  []LimitBulkResult
+}
+
+
+// 故障参数，可以通过/?sim在运行时修改
+type Faults struct {
+    // 统计数据丢包率、限速接口返回500的概率
+    Loss       float64
+    Fail       float64
+    LatencyMs  int64
+    // 节点宕机：限速接口直接断开连接，不上报统计数据
+    Down       bool
+    NoBulk     bool
+}
+
+
+type node struct {
+    index   int
+    ip      net.IP
+    addr    string
+    skew    time.Duration
+    nodes   int
+
+    lock    sync.Mutex
+    limits  map[string]LimitData
+    version int64
+    faults  Faults
+}
+
+
+func newNode(index int, ip net.IP, opt Options, skew time.Duration) (*node) {
+    return &node{
+        index:  index,
+        ip:     ip,
+        addr:   net.JoinHostPort(ip.String(), strconv.Itoa(opt.Port)),
+        skew:   skew,
+        nodes:  opt.Nodes,
+        limits: make(map[string]LimitData),
+        faults: Faults{Loss: opt.Loss, Fail: opt.Fail, LatencyMs: int64(opt.Latency / time.Millisecond), NoBulk: opt.NoBulk},
+    }
+}
+
+
+// 启动限速接口和统计数据上报
+func (n *node) start(statAddr *net.UDPAddr, profiles []Profile) (error) {
+    l, err := net.Listen("tcp", n.addr)
+    if err != nil {
+        return err
+    }
+    conn, err := net.DialUDP("udp", &net.UDPAddr{IP: n.ip}, statAddr)
+    if err != nil {
+        l.Close()
+        return err
+    }
+    go http.Serve(l, n)
+    go n.report(conn, profiles)
+    return nil
+}
+
+
+// 当前版本，调用者必须持有锁
+func (n *node) etag() (string) {
+    return fmt.Sprintf("\"%d\"", n.version)
+}
+
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+    b, _ := json.Marshal(v)
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(b)
+}
+
+
+func (n *node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    n.lock.Lock()
+    faults := n.faults
+    n.lock.Unlock()
+
+    q := r.URL.Query()
+    if _, ok := q["sim"]; ok {
+        n.handleSim(w, r)
+        return
+    }
+    if faults.Down {
+        // 模拟宕机，直接断开连接
+        if hj, ok := w.(http.Hijacker); ok {
+            if conn, _, err := hj.Hijack(); err == nil {
+                conn.Close()
+                return
+            }
+        }
+        w.WriteHeader(http.StatusServiceUnavailable)
+        return
+    }
+    if faults.LatencyMs > 0 {
+        time.Sleep(time.Duration(faults.LatencyMs) * time.Millisecond)
+    }
+    if faults.Fail > 0 && rand.Float64() < faults.Fail {
+        http.Error(w, "simulated failure", http.StatusInternalServerError)
+        return
+    }
+
+    n.lock.Lock()
+    defer n.lock.Unlock()
+    _, list := q["list"]
+    _, bulk := q["bulk"]
+    switch {
+    case r.Method == "GET" && list:
+        tag := n.etag()
+        if !faults.NoBulk {
+            if r.Header.Get("If-None-Match") == tag {
+                w.WriteHeader(http.StatusNotModified)
+                return
+            }
+            w.Header().Set("ETag", tag)
+        }
+        limits := make([]LimitData, 0, len(n.limits))
+        for _, l := range n.limits {
+            limits = append(limits, l)
+        }
+        sort.Slice(limits, func(i, j int) bool { return limits[i].BucketName < limits[j].BucketName })
+        writeJson(w, http.StatusOK, limits)
+
+    case r.Method == "POST" && bulk:
+        if faults.NoBulk {
+            http.NotFound(w, r)
+            return
+        }
+        n.handleBulk(w, r)
+
+    case r.Method == "POST":
+        var l LimitData
+        if err := json.NewDecoder(r.Body).Decode(&l); err != nil || l.BucketName == "" {
+            http.Error(w, "bad limit data", http.StatusBadRequest)
+            return
+        }
+        n.limits[l.BucketName] = l
+        n.version++
+
+    case r.Method == "DELETE":
+        bucket := q.Get("LimitBucketName")
+        if bucket == "" {
+            http.Error(w, "no LimitBucketName", http.StatusBadRequest)
+            return
+        }
+        delete(n.limits, bucket)
+        n.version++
+
+    default:
+        http.Error(w, "unknown request", http.StatusBadRequest)
+    }
+}
+
+
+// 批量下发，调用者持有锁
+func (n *node) handleBulk(w http.ResponseWriter, r *http.Request) {
+    var bulk LimitBulk
+    if err := json.NewDecoder(r.Body).Decode(&bulk); err != nil {
+        http.Error(w, "bad bulk data", http.StatusBadRequest)
+        return
+    }
+    base := bulk.BaseETag
+    if m := r.Header.Get("If-Match"); m != "" {
+        base = m
+    }
+    if !bulk.Full && base != "" && base != n.etag() {
+        http.Error(w, "version changed", http.StatusPreconditionFailed)
+        return
+    }
+
+    if bulk.Full {
+        n.limits = make(map[string]LimitData)
+    }
+    resp := LimitBulkResponse{Results: make([]LimitBulkResult, 0, len(bulk.Set) + len(bulk.Delete))}
+    for _, l := range bulk.Set {
+        if l.BucketName == "" {
+            continue
+        }
+        n.limits[l.BucketName] = l
+        resp.Results = append(resp.Results, LimitBulkResult{BucketName: l.BucketName, Status: "ok"})
+    }
+    for _, key := range bulk.Delete {
+        delete(n.limits, key)
+        resp.Results = append(resp.Results, LimitBulkResult{BucketName: key, Status: "ok"})
+    }
+    n.version++
+    resp.ETag = n.etag()
+    w.Header().Set("ETag", resp.ETag)
+    writeJson(w, http.StatusOK, resp)
+}
+
+
+// GET返回当前故障参数，POST以请求体中的json覆盖
+func (n *node) handleSim(w http.ResponseWriter, r *http.Request) {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+    if r.Method == "POST" {
+        faults := n.faults
+        if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+            http.Error(w, "bad faults", http.StatusBadRequest)
+            return
+        }
+        n.faults = faults
+        fmt.Printf("node %s faults: %+v\n", n.addr, faults)
+    }
+    writeJson(w, http.StatusOK, n.faults)
+}
@@ -0,0 +1,107 @@
+/* 桶的负载配置，负载配置文件为Profile的json数组，例如:
+** [{"Bucket": "photo", "Rate": 10485760, "Conn": 200, "Qps": 800, "Shape": "sine", "Period": 600, "Skew": 0.5},
+**  {"Bucket": "backup", "Rate": 52428800, "Conn": 20, "Qps": 50, "Shape": "spike", "Period": 300}]
+** Rate、Conn、Qps为整个集群的平均负载，Skew为节点间负载的倾斜程度(0为均匀)
+*/
+
+package main
+
+import (
+    "fmt"
+    "math"
+    "math/rand"
+)
+
+
+const (
+    // 恒定负载
+    SHAPE_FLAT  = "flat"
+    // 周期为Period秒的正弦波动，峰值为平均值的2倍
+    SHAPE_SINE  = "sine"
+    // 每Period秒出现一次持续1/5周期的5倍突发
+    SHAPE_SPIKE = "spike"
+    // 在Period秒内从0线性增长到平均值的2倍，然后重复
+    SHAPE_RAMP  = "ramp"
+)
+
+
+type Profile struct {
+    Bucket  string
+    Rate    float64
+    Conn    float64
+    Qps     float64
+    Shape   string
+    Period  int64
+    Skew    float64
+    // 各节点分得负载的权重，由Skew生成
+    weights []float64
+}
+
+
+func (p *Profile) fill() {
+    if p.Shape == "" {
+        p.Shape = SHAPE_FLAT
+    }
+    if p.Period <= 0 {
+        p.Period = 600
+    }
+}
+
+
+// 随机生成@num个桶的负载
+func randomProfiles(num int) ([]Profile) {
+    shapes := []string{SHAPE_FLAT, SHAPE_SINE, SHAPE_SPIKE, SHAPE_RAMP}
+    profiles := make([]Profile, 0, num)
+    for i := 0; i < num; i++ {
+        qps := math.Exp(rand.Float64() * 7)
+        p := Profile{
+            Bucket: fmt.Sprintf("simbucket%02d", i),
+            Qps:    qps,
+            Rate:   qps * (4096 + rand.Float64() * 1048576),
+            Conn:   qps * (0.1 + rand.Float64()),
+            Shape:  shapes[rand.Intn(len(shapes))],
+            Period: 300 + rand.Int63n(1200),
+            Skew:   rand.Float64(),
+        }
+        profiles = append(profiles, p)
+    }
+    return profiles
+}
+
+
+// 时刻@t的负载倍数
+func (p *Profile) factor(t int64) (float64) {
+    phase := float64(t % p.Period) / float64(p.Period)
+    switch p.Shape {
+    case SHAPE_SINE:
+        return 1 + math.Sin(2 * math.Pi * phase)
+    case SHAPE_SPIKE:
+        if phase < 0.2 {
+            return 5
+        }
+        return 0
+    case SHAPE_RAMP:
+        return 2 * phase
+    }
+    return 1
+}
+
+
+// 按Skew生成@nodes个节点分得负载的权重，启动节点之前调用
+func (p *Profile) spread(nodes int) {
+    p.weights = make([]float64, nodes)
+    sum := 0.0
+    for i := range p.weights {
+        p.weights[i] = 1 + p.Skew * rand.Float64() * float64(nodes)
+        sum += p.weights[i]
+    }
+    for i := range p.weights {
+        p.weights[i] /= sum
+    }
+}
+
+
+// 节点@index分得的负载比例
+func (p *Profile) share(index int) (float64) {
+    return p.weights[index]
+}
@@ -0,0 +1,133 @@
+/* 模拟节点的统计数据上报:
+** 每个统计窗口结束时按负载曲线计算每个桶在本节点的需求，需求超过节点上的限速信息时实际值按限速值计算，
+** 被封禁的桶全部请求失败，时间戳按节点的时钟(包括偏差)对齐到窗口起点
+*/
+
+package main
+
+import (
+    "net"
+    "time"
+    "math/rand"
+    "encoding/json"
+)
+
+
+type BucketQPS struct {
+    QPSTotal        float64 `json:"qps_total"`
+    QPSTotalFailed  float64 `json:"qps_total_failed"`
+    QPSGet          float64 `json:"qps_get"`
+    QPSPut          float64 `json:"qps_put"`
+    QPSDelete       float64 `json:"qps_delete"`
+    QPSList         float64 `json:"qps_list"`
+    QPSVideo        float64 `json:"qps_video"`
+    QPSImage        float64 `json:"qps_image"`
+}
+
+
+type BucketStatistic struct {
+    BucketName          string    `json:"bucket_name"`
+    TimeStamp           int64     `json:"time_stamp"`
+
+    ExpectedBucketRate  float64   `json:"expected_bucket_rate"`
+    ExpectedBucketConn  float64   `json:"expected_bucket_conn"`
+    ExpectedBucketQps   float64   `json:"expected_bucket_qps"`
+    ExpectedConnRate    float64   `json:"expected_conn_rate"`
+
+    AssignedBucketRate  float64   `json:"assigned_bucket_rate"`
+    AssignedBucketConn  float64   `json:"assigned_bucket_conn"`
+    AssignedBucketQps   float64   `json:"assigned_bucket_qps"`
+
+    StatisticBucketRate float64   `json:"statistic_bucket_rate"`
+    StatisticBucketConn float64   `json:"statistic_bucket_conn"`
+    StatisticBucketConnMax float64  `json:"statistic_bucket_conn_max"`
+    StatisticBucketQps  BucketQPS `json:"statistic_bucket_qps"`
+}
+
+
+// 请求按操作的比例：GET、PUT、DELETE、LIST、IMAGE、VIDEO
+var opMix = [6]float64{0.6, 0.2, 0.05, 0.05, 0.07, 0.03}
+
+
+// 需求不超过限速@limit(0为不限)
+func capped(demand float64, limit int64) (float64) {
+    if limit > 0 && demand > float64(limit) {
+        return float64(limit)
+    }
+    return demand
+}
+
+
+// 桶@p在时刻@t、节点限速信息@l下的统计数据
+func (n *node) statistic(p *Profile, t int64, l LimitData) (*BucketStatistic) {
+    f := p.factor(t) * p.share(n.index) * (0.9 + 0.2 * rand.Float64())
+    if f == 0 {
+        return nil
+    }
+    bs := &BucketStatistic{BucketName: p.Bucket, TimeStamp: t}
+    bs.ExpectedBucketRate = p.Rate * f
+    bs.ExpectedBucketConn = p.Conn * f
+    bs.ExpectedBucketQps = p.Qps * f
+    if bs.ExpectedBucketConn > 0 {
+        bs.ExpectedConnRate = bs.ExpectedBucketRate / bs.ExpectedBucketConn
+    }
+    bs.AssignedBucketRate = float64(l.LimitRate)
+    bs.AssignedBucketConn = float64(l.LimitConn)
+    bs.AssignedBucketQps = float64(l.LimitQps)
+    if l.LimitBlock {
+        bs.StatisticBucketQps.QPSTotalFailed = bs.ExpectedBucketQps
+        return bs
+    }
+
+    bs.StatisticBucketRate = capped(bs.ExpectedBucketRate, l.LimitRate)
+    bs.StatisticBucketConn = capped(bs.ExpectedBucketConn, l.LimitConn)
+    bs.StatisticBucketConnMax = capped(bs.ExpectedBucketConn * 1.2, l.LimitConn)
+    qps := capped(bs.ExpectedBucketQps, l.LimitQps)
+    q := &bs.StatisticBucketQps
+    q.QPSGet = capped(qps * opMix[0], l.LimitGetQps)
+    q.QPSPut = capped(qps * opMix[1], l.LimitPutQps)
+    q.QPSDelete = capped(qps * opMix[2], l.LimitDeleteQps)
+    q.QPSList = capped(qps * opMix[3], l.LimitListQps)
+    q.QPSImage = capped(qps * opMix[4], l.LimitImageQps)
+    q.QPSVideo = capped(qps * opMix[5], l.LimitVideoQps)
+    q.QPSTotal = q.QPSGet + q.QPSPut + q.QPSDelete + q.QPSList + q.QPSImage + q.QPSVideo
+    q.QPSTotalFailed = bs.ExpectedBucketQps - q.QPSTotal
+    if q.QPSTotalFailed < 0 {
+        q.QPSTotalFailed = 0
+    }
+    return bs
+}
+
+
+// 每个统计窗口结束时上报一次，节点宕机时不上报，按丢包率丢弃
+func (n *node) report(conn *net.UDPConn, profiles []Profile) {
+    for {
+        now := time.Now().Add(n.skew)
+        next := now.Truncate(DURATION * time.Second).Add(DURATION * time.Second)
+        time.Sleep(next.Sub(now))
+        t := next.Unix() - DURATION
+
+        n.lock.Lock()
+        faults := n.faults
+        limits := make(map[string]LimitData, len(n.limits))
+        for key, l := range n.limits {
+            limits[key] = l
+        }
+        n.lock.Unlock()
+        if faults.Down {
+            continue
+        }
+
+        for i := range profiles {
+            bs := n.statistic(&profiles[i], t, limits[profiles[i].Bucket])
+            if bs == nil || (faults.Loss > 0 && rand.Float64() < faults.Loss) {
+                continue
+            }
+            buf, err := json.Marshal(bs)
+            if err != nil {
+                continue
+            }
+            conn.Write(buf)
+        }
+    }
+}
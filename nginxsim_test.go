@@ -0,0 +1,182 @@
+package main
+
+import (
+    "net"
+    "sync"
+    "time"
+    "os/exec"
+    "reflect"
+    "strconv"
+    "testing"
+    "path/filepath"
+)
+
+import l4g "code.google.com/p/log4go"
+
+
+var statServerOnce sync.Once
+
+
+/* 启动接收统计数据的UdpServer和ringManager，整个测试进程只启动一次
+** 返回值：统计数据的接收地址
+*/
+func startStatServer(t *testing.T) (string) {
+    statServerOnce.Do(func() {
+        NgxStatPort = strconv.Itoa(freePort(t, "udp"))
+        // UdpServer按来源IP记录日志，测试中日志不落盘
+        GServerLog["127.0.0.1"] = make(l4g.Logger)
+        ch := make(chan BucketStatistic)
+        go ringManager(ch)
+        go UdpServer(ch)
+    })
+    return net.JoinHostPort("127.0.0.1", NgxStatPort)
+}
+
+
+func freePort(t *testing.T, network string) (int) {
+    if network == "udp" {
+        conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatalf("listen udp: %s", err)
+        }
+        defer conn.Close()
+        return conn.LocalAddr().(*net.UDPAddr).Port
+    }
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("listen tcp: %s", err)
+    }
+    defer l.Close()
+    return l.Addr().(*net.TCPAddr).Port
+}
+
+
+// 编译nginxsim并启动一个模拟节点，统计数据发往@stat，返回节点地址
+func startNginxSim(t *testing.T, stat string, args ...string) (string) {
+    gobin, err := exec.LookPath("go")
+    if err != nil {
+        t.Fatalf("go command not found: %s", err)
+    }
+    bin := filepath.Join(t.TempDir(), "nginxsim")
+    build := exec.Command(gobin, "build", "-o", bin, "./nginxsim")
+    build.Dir = srcDir
+    if out, err := build.CombinedOutput(); err != nil {
+        t.Fatalf("build nginxsim failed: %s %s", err, out)
+    }
+
+    port := freePort(t, "tcp")
+    addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+    args = append([]string{"-nodes", "1", "-ip", "127.0.0.1", "-port", strconv.Itoa(port),
+                           "-stat", stat, "-buckets", "1", "-seed", "1"}, args...)
+    cmd := exec.Command(bin, args...)
+    if err = cmd.Start(); err != nil {
+        t.Fatalf("start nginxsim failed: %s", err)
+    }
+    t.Cleanup(func() {
+        cmd.Process.Kill()
+        cmd.Wait()
+    })
+
+    for i := 0; i < 50; i++ {
+        if conn, err := net.Dial("tcp", addr); err == nil {
+            conn.Close()
+            return addr
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    t.Fatalf("nginxsim %s not listening", addr)
+    return ""
+}
+
+
+// 使用nginxsim模拟的Nginx节点，分别测试批量下发和逐个桶下发
+func TestSyncNginxSim(t *testing.T) {
+    stat := startStatServer(t)
+    for _, mode := range []struct {
+        name  string
+        args  []string
+        bulk  bool
+    }{
+        {"bulk", nil, true},
+        {"nobulk", []string{"-nobulk"}, false},
+    } {
+        t.Run(mode.name, func(t *testing.T) {
+            addr := startNginxSim(t, stat, mode.args...)
+            setupSyncTest(t, addr, &BucketQuota{BucketName: "a", RateQuota: 100, ConnQuota: 10, QpsQuota: 50},
+                          &BucketQuota{BucketName: "b", RateQuota: 200, RateBurst: 400})
+            st := newNodeSyncState(nodeEnforcer(addr))
+
+            check := func(want map[string]LimitData) {
+                list, _, _, ok := st.enforcer.List("")
+                if !ok {
+                    t.Fatalf("list nginxsim %s failed", addr)
+                }
+                got := make(map[string]LimitData)
+                for _, l := range list {
+                    got[l.BucketName] = l
+                }
+                if !reflect.DeepEqual(got, want) {
+                    t.Fatalf("nginxsim limits %v, want %v", got, want)
+                }
+            }
+
+            if !syncNginx(addr, st, false) {
+                t.Fatal("sync to nginxsim failed")
+            }
+            check(map[string]LimitData{
+                "a": {BucketName: "a", LimitRate: 100, LimitConn: 10, LimitQps: 50},
+                "b": {BucketName: "b", LimitRate: 200, LimitBurstRate: 400},
+            })
+            if st.bulk != mode.bulk {
+                t.Errorf("bulk %v, want %v", st.bulk, mode.bulk)
+            }
+
+            // 修改a、删除b、新增c
+            quotaRegistry.Load([]*BucketQuota{
+                {BucketName: "a", QuotaType: 1, RateQuota: 300, ConnQuota: 10, QpsQuota: 50},
+                {BucketName: "c", QuotaType: 1, QpsQuota: 5},
+            })
+            if !syncNginx(addr, st, true) {
+                t.Fatal("sync to nginxsim failed")
+            }
+            check(map[string]LimitData{
+                "a": {BucketName: "a", LimitRate: 300, LimitConn: 10, LimitQps: 50},
+                "c": {BucketName: "c", LimitQps: 5},
+            })
+            if !st.queue.empty() {
+                t.Errorf("delivery queue not drained: %v", st.queue.ops)
+            }
+        })
+    }
+}
+
+
+/* nginxsim每5秒上报一次统计数据，经UdpServer和ringManager聚合后
+** 桶成为活跃桶，第二次上报后记录该节点上的需求
+*/
+func TestNginxSimStat(t *testing.T) {
+    if testing.Short() {
+        t.Skip("waits for nginxsim stat reports")
+    }
+    startNginxSim(t, startStatServer(t))
+
+    deadline := time.Now().Add(20 * time.Second)
+    for time.Now().Before(deadline) {
+        _, active := activeBuckets(300)["simbucket00"]
+        var d [3]float64
+        nodeLock.Lock()
+        n, demand := nodeDemands["simbucket00"]["127.0.0.1"]
+        if demand {
+            d = n.Demand
+        }
+        nodeLock.Unlock()
+        if active && demand {
+            if d[0] <= 0 || d[2] <= 0 {
+                t.Fatalf("demand of simbucket00 is %v", d)
+            }
+            return
+        }
+        time.Sleep(500 * time.Millisecond)
+    }
+    t.Fatalf("no stat from nginxsim: active %v", activeBuckets(300))
+}
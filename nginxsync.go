@@ -0,0 +1,321 @@
+/* LimitServer与前端Nginx的限速配额同步协议:
+** 1. GET /?list携带上次返回的ETag(If-None-Match)，Nginx上的配额没有变化时返回304，不必下载全部配额
+** 2. POST /?bulk一次下发全部差异，请求体为LimitBulk，BaseETag为差异所基于的Nginx版本；
+**    Nginx的当前版本与BaseETag不一致时返回412，此时改为携带全部期望配额(Full)重新下发
+** 3. 批量下发的响应为LimitBulkResponse，包含新的ETag和每个桶的结果，失败的桶进入投递队列重试
+** 4. Nginx不支持批量下发(404/405/501)时退回逐个桶POST/DELETE，由投递队列负责超时重试和核对，见delivery.go
+** 以上为nginx后端的协议，读取和下发均通过节点的Enforcer，其它后端见enforcer.go
+** 每次同步的结果记录在同步状态中，见syncstatus.go
+** 有差异时先生成同步计划并记录日志，dry-run的节点只记录计划；删除超过SyncMaxDeletes时需要管理员确认
+** 收到配额变化通知时，如果期望配额与Nginx上已知的配额一致，直接跳过本次同步
+*/
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "time"
+    "bytes"
+    "net/http"
+    "encoding/json"
+)
+
+
+// 批量下发请求，Full为true时Nginx用Set替换全部配额，忽略BaseETag和Delete
+type LimitBulk struct {
+    BaseETag  string       `json:"BaseETag,omitempty"`
+    Full      bool         `json:"Full,omitempty"`
+    Set       []LimitData  `json:"Set,omitempty"`
+    Delete    []string     `json:"Delete,omitempty"`
+}
+
+
+type LimitBulkResult struct {
+    BucketName  string  `json:"LimitBucketName"`
+    // "ok"表示成功，否则为失败原因
+    Status      string
+}
+
+
+type LimitBulkResponse struct {
+    ETag     string
+    Results  []LimitBulkResult
+}
+
+
+// 一个Nginx节点的同步状态，只由该节点的同步协程访问
+type nodeSyncState struct {
+    // Nginx返回的最近版本，为空表示未知
+    etag     string
+    // etag对应的Nginx上的限速信息，key为桶名
+    applied  map[string]LimitData
+    // Nginx是否支持批量下发
+    bulk     bool
+    // 逐个桶下发的投递队列，见delivery.go
+    queue    *deliveryQueue
+    // 节点的限速执行后端，见enforcer.go
+    enforcer Enforcer
+}
+
+
+func newNodeSyncState(enforcer Enforcer) (*nodeSyncState) {
+    return &nodeSyncState{applied: make(map[string]LimitData), bulk: true, queue: newDeliveryQueue(), enforcer: enforcer}
+}
+
+
+// 下发给Nginx @server的期望限速信息，@listed为Nginx上已有的桶
+func desiredNodeLimits(server string, listed map[string]LimitData) (map[string]LimitData) {
+    names := make([]string, 0, len(listed))
+    for key, _ := range listed {
+        names = append(names, key)
+    }
+    limits := make(map[string]LimitData)
+    for key, l := range desiredLimits(names) {
+        limits[key] = nginxLimitData(server, l)
+    }
+    return limits
+}
+
+
+func sameLimits(a map[string]LimitData, b map[string]LimitData) (bool) {
+    if len(a) != len(b) {
+        return false
+    }
+    for key, v := range a {
+        if w, ok := b[key]; !ok || w != v {
+            return false
+        }
+    }
+    return true
+}
+
+
+/* 同步Nginx @server上的限速配额，@notified表示由配额变化通知触发
+** 返回值：Nginx是否可以访问
+*/
+func syncNginx(server string, st *nodeSyncState, notified bool) (bool) {
+    // 本地配额变化但与Nginx上已知的配额一致，不需要访问Nginx
+    if notified && st.etag != "" {
+        if desired := desiredNodeLimits(server, st.applied); sameLimits(desired, st.applied) {
+            recordSyncDiff(server, st, desired)
+            return true
+        }
+    }
+
+    limitList, etag, notModified, ok := st.enforcer.List(st.etag)
+    recordListResult(server, ok)
+    if !ok {
+        return false
+    }
+    if !notModified {
+        st.applied = make(map[string]LimitData)
+        for _, v := range limitList {
+            st.applied[v.BucketName] = v
+        }
+        st.etag = etag
+    }
+
+    /* 对比期望配额与Nginx上的配额
+    ** 如果对端有的，本地没有，那么需要从对端删除
+    ** 如果对端没有的或者与本地不同，那么需要更新至对端
+    */
+    desired := desiredNodeLimits(server, st.applied)
+    set := make([]LimitData, 0)
+    del := make([]string, 0)
+    for key, v := range desired {
+        if a, ok := st.applied[key]; !ok || a != v {
+            set = append(set, v)
+        }
+    }
+    for key, _ := range st.applied {
+        if _, ok := desired[key]; !ok {
+            GErrorLogger.Error("No bucket %s limit quota found", key)
+            del = append(del, key)
+        }
+    }
+    if len(set) == 0 && len(del) == 0 {
+        recordSyncDiff(server, st, desired)
+        return true
+    }
+
+    // 计划并记录本次同步，dry-run时不下发，删除过多且未经确认时暂不删除
+    plan := newSyncPlan(st, set, del)
+    plan.DryRun = nodeDryRun(server)
+    push := desired
+    if !plan.DryRun && SyncMaxDeletes > 0 && len(del) > SyncMaxDeletes && !deletesConfirmed(server, del) {
+        plan.Blocked, plan.Delete = plan.Delete, make([]string, 0)
+        del = del[:0]
+        // 全量下发时保留被拦截删除的桶
+        push = make(map[string]LimitData)
+        for key, v := range desired {
+            push[key] = v
+        }
+        for _, key := range plan.Blocked {
+            push[key] = st.applied[key]
+        }
+    }
+    logSyncPlan(server, plan, set)
+    if !recordSyncPlan(server, plan) && len(plan.Blocked) > 0 {
+        SendWarn(fmt.Sprintf("Sync to %s wants to delete %d bucket limits (max %d), waiting for admin confirm", server, len(plan.Blocked), SyncMaxDeletes))
+    }
+    if plan.DryRun || (len(set) == 0 && len(del) == 0) {
+        recordSyncDiff(server, st, desired)
+        return true
+    }
+
+    start := time.Now()
+    defer func() {
+        recordPushLatency(server, time.Since(start))
+        recordSyncDiff(server, st, desired)
+    }()
+    // 投递队列中有待重试的操作时逐个桶下发，队列为空后恢复批量下发
+    if st.bulk && st.queue.empty() {
+        if bulkNginxLimit(server, st, push, set, del) {
+            return true
+        }
+        st.bulk = false
+        GLogger.Info("Nginx %s does not support bulk limit, fall back to per bucket sync", server)
+    }
+
+    // 逐个更新Nginx上的桶配额信息
+    st.queue.reconcile(set, del)
+    st.queue.flush(server, st)
+    return true
+}
+
+
+// 按需要下发的@set和删除的@del生成同步计划
+func newSyncPlan(st *nodeSyncState, set []LimitData, del []string) (*SyncPlan) {
+    plan := &SyncPlan{Time: time.Now().Unix(), Add: make([]string, 0), Update: make([]string, 0), Delete: make([]string, 0)}
+    for _, v := range set {
+        if _, ok := st.applied[v.BucketName]; ok {
+            plan.Update = append(plan.Update, v.BucketName)
+        } else {
+            plan.Add = append(plan.Add, v.BucketName)
+        }
+    }
+    plan.Delete = append(plan.Delete, del...)
+    sort.Strings(plan.Add)
+    sort.Strings(plan.Update)
+    sort.Strings(plan.Delete)
+    return plan
+}
+
+
+// 在日志中记录完整的同步计划
+func logSyncPlan(server string, plan *SyncPlan, set []LimitData) {
+    prefix := ""
+    if plan.DryRun {
+        prefix = "[dry-run] "
+    }
+    GLogger.Info("%sNginx %s sync plan: %d add, %d update, %d delete, %d blocked delete", prefix, server,
+                 len(plan.Add), len(plan.Update), len(plan.Delete), len(plan.Blocked))
+    for _, v := range set {
+        buf, _ := json.Marshal(v)
+        GLogger.Info("%sNginx %s set %s", prefix, server, buf)
+    }
+    for _, key := range plan.Delete {
+        GLogger.Info("%sNginx %s delete %s", prefix, server, key)
+    }
+    for _, key := range plan.Blocked {
+        GLogger.Info("%sNginx %s delete %s blocked, more than %d deletes need admin confirm", prefix, server, key, SyncMaxDeletes)
+    }
+}
+
+
+/* 向Nginx @server发送批量下发请求@bulk
+** 返回值：响应、HTTP状态码(请求失败时为0)、出错原因
+*/
+func postBulk(server string, bulk *LimitBulk) (*LimitBulkResponse, int, error) {
+    buf, err := json.Marshal(bulk)
+    if err != nil {
+        return nil, 0, err
+    }
+    GLogger.Info("Bulk set Nginx %s limit quota: full %v, %d set, %d delete", server, bulk.Full, len(bulk.Set), len(bulk.Delete))
+    res, err := nginxClient.Post("http://" + server + "/?bulk", "application/json", bytes.NewReader(buf))
+    if err != nil {
+        return nil, 0, err
+    }
+    defer res.Body.Close()
+    if res.StatusCode != http.StatusOK {
+        return nil, res.StatusCode, fmt.Errorf("status %d", res.StatusCode)
+    }
+    resp := new(LimitBulkResponse)
+    if err = json.NewDecoder(res.Body).Decode(resp); err != nil {
+        return nil, res.StatusCode, err
+    }
+    return resp, res.StatusCode, nil
+}
+
+
+/* 批量下发差异@set、@del，Nginx版本未知或者冲突时全量下发@desired
+** 按每个桶的结果更新同步状态，有失败的桶时报警并加入投递队列，下次同步重新获取Nginx上的配额
+** 返回值：Nginx是否支持批量下发
+*/
+func bulkNginxLimit(server string, st *nodeSyncState, desired map[string]LimitData, set []LimitData, del []string) (bool) {
+    full := &LimitBulk{Full: true, Set: make([]LimitData, 0, len(desired))}
+    for _, v := range desired {
+        full.Set = append(full.Set, v)
+    }
+
+    bulk := &LimitBulk{BaseETag: st.etag, Set: set, Delete: del}
+    if st.etag == "" {
+        bulk = full
+    }
+    resp, status, err := st.enforcer.Bulk(bulk)
+    if status == http.StatusPreconditionFailed && !bulk.Full {
+        // Nginx上的配额在获取之后被修改过，差异已不可靠
+        GLogger.Info("Nginx %s limit version changed since %s, send full limit set", server, st.etag)
+        bulk = full
+        resp, status, err = st.enforcer.Bulk(bulk)
+    }
+    if status == http.StatusNotFound || status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented {
+        return false
+    }
+    if err != nil {
+        GErrorLogger.Error("Bulk set limit to %s failed: %s", server, err)
+        recordSyncError(server, fmt.Sprintf("bulk set limit failed: %s", err))
+        SendWarn(fmt.Sprintf("Bulk set Limit Data to %s failed: %s", server, err))
+        st.etag = ""
+        return true
+    }
+
+    results := make(map[string]string)
+    for _, r := range resp.Results {
+        results[r.BucketName] = r.Status
+    }
+    if bulk.Full {
+        st.applied = make(map[string]LimitData)
+    }
+    // 失败的桶进入投递队列逐个重试
+    failed := 0
+    for _, v := range bulk.Set {
+        if results[v.BucketName] == "ok" {
+            st.applied[v.BucketName] = v
+        } else {
+            GErrorLogger.Error("Bulk set bucket %s limit to %s failed: [%s]", v.BucketName, server, results[v.BucketName])
+            op := st.queue.put(&deliveryOp{Bucket: v.BucketName, Data: v})
+            st.queue.failed(server, op, "bulk: " + results[v.BucketName])
+            failed++
+        }
+    }
+    for _, key := range bulk.Delete {
+        if results[key] == "ok" {
+            delete(st.applied, key)
+        } else {
+            GErrorLogger.Error("Bulk delete bucket %s limit from %s failed: [%s]", key, server, results[key])
+            op := st.queue.put(&deliveryOp{Bucket: key, Delete: true, Data: LimitData{BucketName: key}})
+            st.queue.failed(server, op, "bulk: " + results[key])
+            failed++
+        }
+    }
+
+    st.etag = resp.ETag
+    if failed > 0 {
+        recordSyncError(server, fmt.Sprintf("bulk set limit: %d of %d buckets failed", failed, len(bulk.Set) + len(bulk.Delete)))
+        SendWarn(fmt.Sprintf("Bulk set Limit Data to %s: %d of %d buckets failed", server, failed, len(bulk.Set) + len(bulk.Delete)))
+        st.etag = ""
+    }
+    return true
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+    "sort"
+    "sync"
+    "strconv"
+    "time"
+    "strings"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    "reflect"
+    "net/http"
+    "encoding/json"
+    "net/http/httptest"
+)
+
+
+// 实现同步协议的模拟Nginx，版本号即ETag
+type fakeNginx struct {
+    lock      sync.Mutex
+    limits    map[string]LimitData
+    version   int
+    // 为true时不支持批量下发
+    nobulk    bool
+    // 接下来这么多次差异下发返回412
+    conflicts int
+    // 逐个桶下发时返回500的桶，以及返回成功但不生效的桶
+    reject    string
+    drop      string
+    requests  int
+    bulks     int
+}
+
+
+// 启动模拟Nginx，Nginx上已有限速信息@limits，返回Nginx地址
+func startFakeNginx(t *testing.T, limits ...LimitData) (*fakeNginx, string) {
+    n := &fakeNginx{limits: make(map[string]LimitData)}
+    for _, l := range limits {
+        n.limits[l.BucketName] = l
+    }
+    s := httptest.NewServer(n)
+    t.Cleanup(s.Close)
+    return n, s.Listener.Addr().String()
+}
+
+
+func (n *fakeNginx) etag() (string) {
+    return strconv.Itoa(n.version)
+}
+
+
+func (n *fakeNginx) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+    n.requests++
+
+    switch {
+    case r.Method == "GET" && r.URL.RawQuery == "list":
+        if r.Header.Get("If-None-Match") == n.etag() {
+            w.WriteHeader(http.StatusNotModified)
+            return
+        }
+        list := make([]LimitData, 0, len(n.limits))
+        for _, l := range n.limits {
+            list = append(list, l)
+        }
+        w.Header().Set("ETag", n.etag())
+        json.NewEncoder(w).Encode(list)
+
+    case r.Method == "POST" && r.URL.RawQuery == "bulk":
+        if n.nobulk {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        var bulk LimitBulk
+        json.NewDecoder(r.Body).Decode(&bulk)
+        if !bulk.Full && (bulk.BaseETag != n.etag() || n.conflicts > 0) {
+            n.conflicts--
+            w.WriteHeader(http.StatusPreconditionFailed)
+            return
+        }
+        n.bulks++
+        if bulk.Full {
+            n.limits = make(map[string]LimitData)
+        }
+        resp := &LimitBulkResponse{}
+        for _, l := range bulk.Set {
+            n.limits[l.BucketName] = l
+            resp.Results = append(resp.Results, LimitBulkResult{BucketName: l.BucketName, Status: "ok"})
+        }
+        for _, key := range bulk.Delete {
+            delete(n.limits, key)
+            resp.Results = append(resp.Results, LimitBulkResult{BucketName: key, Status: "ok"})
+        }
+        n.version++
+        resp.ETag = n.etag()
+        json.NewEncoder(w).Encode(resp)
+
+    case r.Method == "POST":
+        var l LimitData
+        json.NewDecoder(r.Body).Decode(&l)
+        if l.BucketName == n.reject {
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        if l.BucketName == n.drop {
+            return
+        }
+        n.limits[l.BucketName] = l
+        n.version++
+
+    case r.Method == "DELETE":
+        delete(n.limits, r.URL.Query().Get("LimitBucketName"))
+        n.version++
+
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+    }
+}
+
+
+// 测试期间的限速配额为@quotas，节点列表只有@addr，并创建其同步状态
+func setupSyncTest(t *testing.T, addr string, quotas ...*BucketQuota) {
+    emptyQuotas(t)
+    for _, q := range quotas {
+        q.QuotaType = 1
+    }
+    quotaRegistry.Load(quotas)
+    setFleet(t, addr)
+    fleetLock.Lock()
+    initSyncStatus(addr)
+    fleetLock.Unlock()
+    t.Cleanup(func() {
+        fleetLock.Lock()
+        delSyncStatus(addr)
+        fleetLock.Unlock()
+    })
+}
+
+
+func testSyncStatus(t *testing.T, addr string) (NginxSyncStatus) {
+    for _, s := range syncStatusList() {
+        if s.Addr == addr {
+            return s
+        }
+    }
+    t.Fatalf("no sync status for %s", addr)
+    return NginxSyncStatus{}
+}
+
+
+func limitNames(limits map[string]LimitData) ([]string) {
+    names := make([]string, 0, len(limits))
+    for key, _ := range limits {
+        names = append(names, key)
+    }
+    sort.Strings(names)
+    return names
+}
+
+
+func TestNewSyncPlan(t *testing.T) {
+    st := newNodeSyncState(nodeEnforcer("127.0.0.1:1"))
+    st.applied["a"] = LimitData{BucketName: "a", LimitRate: 1}
+    st.applied["b"] = LimitData{BucketName: "b", LimitRate: 1}
+    plan := newSyncPlan(st, []LimitData{{BucketName: "d"}, {BucketName: "a", LimitRate: 2}, {BucketName: "c"}}, []string{"b"})
+    if !reflect.DeepEqual(plan.Add, []string{"c", "d"}) || !reflect.DeepEqual(plan.Update, []string{"a"}) ||
+       !reflect.DeepEqual(plan.Delete, []string{"b"}) || len(plan.Blocked) != 0 {
+        t.Fatalf("unexpected plan %+v", plan)
+    }
+}
+
+
+func TestSyncNginxBulk(t *testing.T) {
+    n, addr := startFakeNginx(t, LimitData{BucketName: "a", LimitRate: 1}, LimitData{BucketName: "stale", LimitRate: 1})
+    setupSyncTest(t, addr, &BucketQuota{BucketName: "a", RateQuota: 100, ConnQuota: 10, QpsQuota: 50},
+                  &BucketQuota{BucketName: "b", RateQuota: 200})
+    st := newNodeSyncState(nodeEnforcer(addr))
+
+    if !syncNginx(addr, st, false) {
+        t.Fatal("sync failed")
+    }
+    want := map[string]LimitData{
+        "a": {BucketName: "a", LimitRate: 100, LimitConn: 10, LimitQps: 50},
+        "b": {BucketName: "b", LimitRate: 200},
+    }
+    if !reflect.DeepEqual(n.limits, want) || n.bulks != 1 {
+        t.Fatalf("nginx limits %v after %d bulks, want %v", n.limits, n.bulks, want)
+    }
+    if !reflect.DeepEqual(st.applied, want) || st.etag != n.etag() {
+        t.Fatalf("sync state not updated: applied %v etag %s", st.applied, st.etag)
+    }
+    if s := testSyncStatus(t, addr); len(s.OutOfSync) != 0 || s.LastSync == 0 || s.LastList == 0 || s.ETag != n.etag() {
+        t.Fatalf("want in sync status, got %+v", s)
+    }
+
+    // 配额变化通知但期望配额没有变化时不访问Nginx
+    requests := n.requests
+    if !syncNginx(addr, st, true) || n.requests != requests {
+        t.Fatal("unchanged limits synced again")
+    }
+    // 定期检查时Nginx上的配额没有变化，条件请求返回304
+    if !syncNginx(addr, st, false) || n.requests != requests + 1 {
+        t.Fatalf("periodic check made %d requests", n.requests - requests)
+    }
+
+    // 差异下发冲突时全量下发
+    quotaRegistry.Load([]*BucketQuota{{BucketName: "a", QuotaType: 1, RateQuota: 300}})
+    n.conflicts = 1
+    if !syncNginx(addr, st, true) {
+        t.Fatal("sync failed")
+    }
+    want = map[string]LimitData{"a": {BucketName: "a", LimitRate: 300}}
+    if !reflect.DeepEqual(n.limits, want) || !reflect.DeepEqual(st.applied, want) || st.etag != n.etag() {
+        t.Fatalf("nginx limits %v applied %v after conflict", n.limits, st.applied)
+    }
+}
+
+
+// Nginx不支持批量下发时逐个桶下发
+func TestSyncNginxNoBulk(t *testing.T) {
+    n, addr := startFakeNginx(t, LimitData{BucketName: "stale", LimitRate: 1})
+    n.nobulk = true
+    setupSyncTest(t, addr, &BucketQuota{BucketName: "a", RateQuota: 100})
+    st := newNodeSyncState(nodeEnforcer(addr))
+
+    if !syncNginx(addr, st, false) {
+        t.Fatal("sync failed")
+    }
+    want := map[string]LimitData{"a": {BucketName: "a", LimitRate: 100}}
+    if !reflect.DeepEqual(n.limits, want) || st.bulk || !st.queue.empty() {
+        t.Fatalf("nginx limits %v bulk %v queue %v", n.limits, st.bulk, st.queue.ops)
+    }
+    // 投递后读取Nginx上的配额核对
+    if !reflect.DeepEqual(st.applied, want) || st.etag != n.etag() {
+        t.Fatalf("sync state not verified: applied %v etag %q", st.applied, st.etag)
+    }
+}
+
+
+// 逐个桶下发失败或者核对不一致的桶留在投递队列中退避重试
+func TestSyncNginxDeliveryRetry(t *testing.T) {
+    n, addr := startFakeNginx(t)
+    n.nobulk, n.reject, n.drop = true, "b", "c"
+    setupSyncTest(t, addr, &BucketQuota{BucketName: "a", RateQuota: 100}, &BucketQuota{BucketName: "b", RateQuota: 200},
+                  &BucketQuota{BucketName: "c", RateQuota: 300})
+    st := newNodeSyncState(nodeEnforcer(addr))
+
+    if !syncNginx(addr, st, false) {
+        t.Fatal("sync failed")
+    }
+    if got := limitNames(n.limits); !reflect.DeepEqual(got, []string{"a"}) {
+        t.Fatalf("nginx has %v", got)
+    }
+    if op := st.queue.ops["b"]; op == nil || op.Attempts != 1 || op.LastError == "" {
+        t.Fatalf("rejected op is %+v", op)
+    }
+    if op := st.queue.ops["c"]; op == nil || op.Attempts != 1 || op.LastError != "read back mismatch" {
+        t.Fatalf("dropped op is %+v", op)
+    }
+    if d := st.queue.nextRetry(time.Minute); d <= 0 || d > deliveryBackoff {
+        t.Fatalf("next retry in %s", d)
+    }
+
+    // 退避时间未到时不重试
+    syncNginx(addr, st, false)
+    if op := st.queue.ops["b"]; op == nil || op.Attempts != 1 {
+        t.Fatalf("op retried before backoff: %+v", op)
+    }
+
+    n.reject, n.drop = "", ""
+    for _, op := range st.queue.ops {
+        op.NextTry = time.Now()
+    }
+    if !syncNginx(addr, st, false) || !st.queue.empty() {
+        t.Fatalf("queue not drained: %v", st.queue.ops)
+    }
+    if got := limitNames(n.limits); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+        t.Fatalf("nginx has %v after retry", got)
+    }
+}
+
+
+// 同步状态接口返回Nginx上与期望不一致的桶
+func TestSyncStatusApi(t *testing.T) {
+    n, addr := startFakeNginx(t, LimitData{BucketName: "a", LimitRate: 100})
+    setupSyncTest(t, addr, &BucketQuota{BucketName: "a", RateQuota: 200})
+
+    if w := callApi(apiSync, "alice", "GET", "/api/v1/sync/" + addr, ""); w.Code != http.StatusOK {
+        t.Fatalf("get sync status: got %d", w.Code)
+    }
+    if w := callApi(apiSync, "alice", "GET", "/api/v1/sync/127.0.0.1:1", ""); w.Code != http.StatusNotFound {
+        t.Fatalf("get unknown nginx: got %d", w.Code)
+    }
+    st := newNodeSyncState(nodeEnforcer(addr))
+    st.applied = n.limits
+    recordSyncDiff(addr, st, desiredNodeLimits(addr, n.limits))
+    s := testSyncStatus(t, addr)
+    if len(s.OutOfSync) != 1 || s.OutOfSync[0].Nginx.LimitRate != 100 || s.OutOfSync[0].Desired.LimitRate != 200 {
+        t.Fatalf("out of sync buckets are %+v", s.OutOfSync)
+    }
+}
+
+
+func TestSyncNginxUnreachable(t *testing.T) {
+    s := httptest.NewServer(http.NotFoundHandler())
+    addr := s.Listener.Addr().String()
+    s.Close()
+    setupSyncTest(t, addr, &BucketQuota{BucketName: "a", RateQuota: 100})
+
+    st := newNodeSyncState(nodeEnforcer(addr))
+    if syncNginx(addr, st, false) || len(st.applied) != 0 {
+        t.Fatal("sync to unreachable nginx succeeded")
+    }
+    syncNginx(addr, st, false)
+    if s := testSyncStatus(t, addr); s.ContFailed != 2 || s.LastError == "" || s.LastSync != 0 {
+        t.Fatalf("unreachable nginx status is %+v", s)
+    }
+}
+
+
+func TestSyncNginxDryRun(t *testing.T) {
+    n, addr := startFakeNginx(t, LimitData{BucketName: "stale", LimitRate: 1})
+    setupSyncTest(t, addr, &BucketQuota{BucketName: "a", RateQuota: 100})
+    fleetLock.Lock()
+    nginxNodes[addr].DryRun = true
+    fleetLock.Unlock()
+    st := newNodeSyncState(nodeEnforcer(addr))
+
+    if !syncNginx(addr, st, false) {
+        t.Fatal("sync failed")
+    }
+    if n.bulks != 0 || !reflect.DeepEqual(limitNames(n.limits), []string{"stale"}) {
+        t.Fatalf("dry-run changed nginx: %v", n.limits)
+    }
+    s := testSyncStatus(t, addr)
+    if s.Plan == nil || !s.Plan.DryRun || !reflect.DeepEqual(s.Plan.Add, []string{"a"}) || !reflect.DeepEqual(s.Plan.Delete, []string{"stale"}) {
+        t.Fatalf("unexpected dry-run plan %+v", s.Plan)
+    }
+}
+
+
+func TestSyncNginxMaxDeletes(t *testing.T) {
+    saved := SyncMaxDeletes
+    SyncMaxDeletes = 2
+    defer func() { SyncMaxDeletes = saved }()
+
+    n, addr := startFakeNginx(t, LimitData{BucketName: "s1", LimitRate: 1}, LimitData{BucketName: "s2", LimitRate: 1},
+                              LimitData{BucketName: "s3", LimitRate: 1})
+    setupSyncTest(t, addr, &BucketQuota{BucketName: "keep", RateQuota: 100})
+    st := newNodeSyncState(nodeEnforcer(addr))
+
+    // 删除数超过上限，只下发新增，删除被拦截
+    if !syncNginx(addr, st, false) {
+        t.Fatal("sync failed")
+    }
+    if got := limitNames(n.limits); !reflect.DeepEqual(got, []string{"keep", "s1", "s2", "s3"}) {
+        t.Fatalf("deletes should be blocked, nginx has %v", got)
+    }
+    s := testSyncStatus(t, addr)
+    if s.Plan == nil || !reflect.DeepEqual(s.Plan.Blocked, []string{"s1", "s2", "s3"}) || len(s.Plan.Delete) != 0 {
+        t.Fatalf("unexpected plan %+v", s.Plan)
+    }
+
+    // 再次同步仍然拦截
+    syncNginx(addr, st, false)
+    if len(n.limits) != 4 {
+        t.Fatalf("deletes should stay blocked until confirmed, nginx has %v", limitNames(n.limits))
+    }
+
+    // 管理员确认后执行删除
+    if errMsg := confirmDeletes(addr, "alice"); errMsg != "" {
+        t.Fatalf("confirm failed: %s", errMsg)
+    }
+    syncNginx(addr, st, false)
+    if got := limitNames(n.limits); !reflect.DeepEqual(got, []string{"keep"}) {
+        t.Fatalf("confirmed deletes not applied, nginx has %v", got)
+    }
+    if errMsg := confirmDeletes(addr, "alice"); errMsg == "" {
+        t.Error("nothing left to confirm, want error")
+    }
+}
+
+
+// file后端渲染配置文件，重载失败时恢复之前的配置
+func TestSyncFileBackend(t *testing.T) {
+    addr := "127.0.0.1:4"
+    path := filepath.Join(t.TempDir(), "limits.conf")
+    setupSyncTest(t, addr, &BucketQuota{BucketName: "a", QpsQuota: 50, ConnQuota: 10, RatePerConn: 1024},
+                  &BucketQuota{BucketName: "bad;name", QpsQuota: 1})
+    fleetLock.Lock()
+    nginxNodes[addr].Backend, nginxNodes[addr].Endpoint, nginxNodes[addr].ReloadCmd = BACKEND_FILE, path, "true"
+    fleetLock.Unlock()
+    st := newNodeSyncState(nodeEnforcer(addr))
+    if st.enforcer.Kind() != BACKEND_FILE {
+        t.Fatalf("enforcer is %s", st.enforcer.Kind())
+    }
+
+    if !syncNginx(addr, st, false) {
+        t.Fatal("sync failed")
+    }
+    conf, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    zone := zoneName("a")
+    for _, want := range []string{`"a" 1024;`, "zone=" + zone + "_qps:1m rate=50r/s;", "limit_conn " + zone + "_conn 10;"} {
+        if !strings.Contains(string(conf), want) {
+            t.Errorf("config has no %q:\n%s", want, conf)
+        }
+    }
+    // 无法渲染的桶名不写入配置
+    if strings.Contains(string(conf), "bad;name") {
+        t.Errorf("unrenderable bucket rendered:\n%s", conf)
+    }
+    list, _, _, _ := st.enforcer.List("")
+    if len(list) != 1 || list[0].BucketName != "a" {
+        t.Fatalf("applied limits are %v", list)
+    }
+
+    // 重载失败时配置文件恢复原样，已生效的限速不变
+    st.enforcer = &fileEnforcer{node: addr, path: path, reloadCmd: "false"}
+    quotaRegistry.Load([]*BucketQuota{{BucketName: "a", QuotaType: 1, QpsQuota: 5}})
+    syncNginx(addr, st, true)
+    if after, _ := ioutil.ReadFile(path); string(after) != string(conf) {
+        t.Fatalf("config not restored after reload failure:\n%s", after)
+    }
+    if list, _, _, _ = st.enforcer.List(""); len(list) != 1 || list[0].LimitQps != 50 {
+        t.Fatalf("applied limits changed after reload failure: %v", list)
+    }
+    if s := testSyncStatus(t, addr); s.LastError == "" {
+        t.Error("reload failure not recorded")
+    }
+}
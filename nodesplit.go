@@ -0,0 +1,246 @@
+/* LimitServer按节点流量分配桶配额:
+** 1. 根据每个Nginx上报的BucketStatistic记录桶在各节点最近的需求(流量、连接数、QPS)
+** 2. 下发限速配额时按需求比例为每个节点分配份额，每个节点至少分得均分份额的NodeShareFloor%，
+**    需求比例取整到1%，需求的微小波动不改变下发的限速
+** 3. 桶详情页展示各节点的需求和分得的配额
+** 节点没有上报数据或所有节点都没有需求时按节点均分，节点列表见fleet.go
+** 超过nodeDemandExpire没有上报的需求定期清理，删除节点时清理该节点的需求
+*/
+
+package main
+
+import (
+    "fmt"
+    "html"
+    "math"
+    "net"
+    "sync"
+    "time"
+)
+
+
+// 节点需求的平滑系数，每收到一个统计数据更新一次
+const nodeDemandAlpha = 0.2
+
+// 超过该时间(秒)没有上报的节点需求按0计算
+const nodeDemandExpire = 60
+
+/* 按需求分配的比例取整到该粒度(1%)，需求每次上报都有微小变化，
+** 不取整时下发的限速几乎每次同步都不同，无法跳过没有变化的同步
+*/
+const nodeShareStep = 0.01
+
+
+// 桶在一个节点上最近的需求，顺序同shareDims
+type nodeDemand struct {
+    Demand      [3]float64
+    LastUpdate  int64
+}
+
+
+var nodeLock sync.Mutex
+// key为桶名，第二层key为节点IP
+var nodeDemands = make(map[string]map[string]*nodeDemand)
+
+
+// Nginx地址@server(ip:port)中的IP，与统计数据中的ServerAddr对应
+func nodeHost(server string) (string) {
+    host, _, err := net.SplitHostPort(server)
+    if err != nil {
+        return server
+    }
+    return host
+}
+
+
+func maxFloat(a float64, b float64) (float64) {
+    if a > b {
+        return a
+    }
+    return b
+}
+
+
+/* 记录节点上报的统计数据@bs中桶的需求
+** 需求取期望值与实际统计值中的较大者，被限速的节点期望值高于实际值
+*/
+func recordNodeDemand(bs *BucketStatistic) {
+    cur := [3]float64{maxFloat(bs.ExpectedBucketRate, bs.StatisticBucketRate),
+                      maxFloat(bs.ExpectedBucketConn, bs.StatisticBucketConn),
+                      maxFloat(bs.ExpectedBucketQps, bs.StatisticBucketQps.QPSTotal)}
+
+    nodeLock.Lock()
+    defer nodeLock.Unlock()
+    nodes, ok := nodeDemands[bs.BucketName]
+    if !ok {
+        nodes = make(map[string]*nodeDemand)
+        nodeDemands[bs.BucketName] = nodes
+    }
+    n, ok := nodes[bs.ServerAddr]
+    if !ok || time.Now().Unix() - n.LastUpdate > nodeDemandExpire {
+        n = &nodeDemand{Demand: cur}
+        nodes[bs.ServerAddr] = n
+    } else {
+        for i := range n.Demand {
+            n.Demand[i] = n.Demand[i] * (1 - nodeDemandAlpha) + cur[i] * nodeDemandAlpha
+        }
+    }
+    n.LastUpdate = time.Now().Unix()
+
+    for key, value := range nodes {
+        if n.LastUpdate - value.LastUpdate > nodeDemandExpire {
+            delete(nodes, key)
+        }
+    }
+}
+
+
+// 清理超过nodeDemandExpire没有上报的需求，以及没有需求的桶
+func pruneNodeDemands() {
+    now := time.Now().Unix()
+    nodeLock.Lock()
+    defer nodeLock.Unlock()
+    for bucket, nodes := range nodeDemands {
+        for key, value := range nodes {
+            if now - value.LastUpdate > nodeDemandExpire {
+                delete(nodes, key)
+            }
+        }
+        if len(nodes) == 0 {
+            delete(nodeDemands, bucket)
+        }
+    }
+}
+
+
+// 每分钟清理一次过期的节点需求
+func nodeDemandWatcher() {
+    GLogger.Info("Start nginx demand watcher")
+    for {
+        time.Sleep(60 * time.Second)
+        pruneNodeDemands()
+    }
+}
+
+
+/* 删除Nginx @server后清理该节点的需求
+** 需求按IP记录，同一IP上还有其他节点时保留
+*/
+func delNodeDemands(server string) {
+    host := nodeHost(server)
+    for _, n := range fleetNodes() {
+        if nodeHost(n.Addr) == host {
+            return
+        }
+    }
+    nodeLock.Lock()
+    defer nodeLock.Unlock()
+    for bucket, nodes := range nodeDemands {
+        delete(nodes, host)
+        if len(nodes) == 0 {
+            delete(nodeDemands, bucket)
+        }
+    }
+}
+
+
+/* 桶@bucket在各Nginx上分得的配额比例，key为Nginx地址，顺序同shareDims
+** 每个节点先分得均分份额的NodeShareFloor%，剩余部分按需求比例分配给active节点，
+** draining节点只分得保底份额；所有active节点都没有需求时剩余部分在active节点间均分
+*/
+func nodeRatios(bucket string) (map[string][3]float64, map[string][3]float64) {
+    ratios := make(map[string][3]float64)
+    demands := make(map[string][3]float64)
+    nodes := fleetNodes()
+    num := float64(len(nodes))
+    if num == 0 {
+        return ratios, demands
+    }
+    floor := float64(NodeShareFloor) / 100 / num
+    if floor > 1 / num {
+        floor = 1 / num
+    }
+
+    var total [3]float64
+    active := 0.0
+    now := time.Now().Unix()
+    nodeLock.Lock()
+    for _, n := range nodes {
+        var d [3]float64
+        if v, ok := nodeDemands[bucket][nodeHost(n.Addr)]; ok && now - v.LastUpdate <= nodeDemandExpire {
+            d = v.Demand
+        }
+        demands[n.Addr] = d
+        if n.State == NODE_DRAINING {
+            continue
+        }
+        active++
+        for i := range total {
+            total[i] += d[i]
+        }
+    }
+    nodeLock.Unlock()
+
+    for _, n := range nodes {
+        var r [3]float64
+        for i := range r {
+            switch {
+            case active == 0:
+                r[i] = 1 / num
+            case n.State == NODE_DRAINING:
+                r[i] = floor
+            case total[i] > 0:
+                r[i] = floor + (1 - floor * num) * roundShare(demands[n.Addr][i] / total[i])
+            default:
+                r[i] = floor + (1 - floor * num) / active
+            }
+        }
+        ratios[n.Addr] = r
+    }
+    return ratios, demands
+}
+
+
+// 将需求比例@r取整到nodeShareStep，各节点取整后的比例之和与1相差不超过节点数个nodeShareStep的一半
+func roundShare(r float64) (float64) {
+    return math.Floor(r / nodeShareStep + 0.5) * nodeShareStep
+}
+
+
+// 桶@bucket在Nginx @server上分得的配额比例，节点已被删除时返回0
+func nodeRatio(server string, bucket string) ([3]float64) {
+    ratios, _ := nodeRatios(bucket)
+    return ratios[server]
+}
+
+
+// 按比例@ratio分配配额@v，配额不为0时至少分得1，避免下发0变成不限速
+func splitQuota(v int64, ratio float64) (int64) {
+    s := int64(float64(v) * ratio)
+    if v > 0 && s < 1 {
+        s = 1
+    }
+    return s
+}
+
+
+// 桶详情页中各节点的需求和分得的限速配额
+func nodeSplitTable(bucket string) (string) {
+    q := effectiveQuota(bucket, 1)
+    ratios, demands := nodeRatios(bucket)
+    lines := ""
+    for _, n := range fleetNodes() {
+        r, d := ratios[n.Addr], demands[n.Addr]
+        limit := "-"
+        if q != nil {
+            l := nginxLimitData(n.Addr, q)
+            limit = fmt.Sprintf("%d/%d/%d", l.LimitRate, l.LimitConn, l.LimitQps)
+        }
+        lines += fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%.1f/%.1f/%.1f</td><td>%.1f%%/%.1f%%/%.1f%%</td><td>%s</td></tr>`,
+                             html.EscapeString(n.Addr), n.State, d[0], d[1], d[2], r[0] * 100, r[1] * 100, r[2] * 100, limit)
+    }
+    return fmt.Sprintf(`<p><b>Nginx Split</b></p><table border=1>
+        <tr><td>Nginx</td><td>State</td><td>Demand Rate/Conn/QPS</td><td>Share Rate/Conn/QPS</td><td>Limit Rate/Conn/QPS</td></tr>
+        %s
+        </table>`, lines)
+}
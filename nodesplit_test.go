@@ -0,0 +1,145 @@
+package main
+
+import (
+    "math"
+    "testing"
+    "time"
+)
+
+
+// 测试期间使用active的Nginx节点@servers，不持久化，测试结束后恢复节点并清空需求
+func setFleet(t *testing.T, servers ...string) {
+    fleetLock.Lock()
+    old := nginxNodes
+    nginxNodes = make(map[string]*NginxNode)
+    for _, addr := range servers {
+        nginxNodes[addr] = &NginxNode{Addr: addr, State: NODE_ACTIVE}
+    }
+    fleetLock.Unlock()
+    t.Cleanup(func() {
+        fleetLock.Lock()
+        nginxNodes = old
+        fleetLock.Unlock()
+        nodeLock.Lock()
+        nodeDemands = make(map[string]map[string]*nodeDemand)
+        nodeLock.Unlock()
+    })
+}
+
+
+// 直接设置桶@bucket在节点IP @host上的需求
+func setNodeDemand(bucket string, host string, demand [3]float64, lastUpdate int64) {
+    nodeLock.Lock()
+    defer nodeLock.Unlock()
+    if _, ok := nodeDemands[bucket]; !ok {
+        nodeDemands[bucket] = make(map[string]*nodeDemand)
+    }
+    nodeDemands[bucket][host] = &nodeDemand{Demand: demand, LastUpdate: lastUpdate}
+}
+
+
+func TestRecordNodeDemand(t *testing.T) {
+    setFleet(t, "127.0.0.1:80")
+    bs := &BucketStatistic{BucketName: "split", ServerAddr: "127.0.0.1",
+                           ExpectedBucketRate: 100, StatisticBucketRate: 50, StatisticBucketConn: 10}
+    recordNodeDemand(bs)
+    // 被限速的节点期望值高于实际值，取较大者
+    if d := nodeDemands["split"]["127.0.0.1"].Demand; d != [3]float64{100, 10, 0} {
+        t.Fatalf("first demand is %v", d)
+    }
+
+    bs.ExpectedBucketRate = 200
+    recordNodeDemand(bs)
+    if d := nodeDemands["split"]["127.0.0.1"].Demand; math.Abs(d[0] - 120) > 1e-9 {
+        t.Fatalf("smoothed demand is %v", d)
+    }
+
+    setNodeDemand("stale", "127.0.0.1", [3]float64{1, 1, 1}, time.Now().Unix() - nodeDemandExpire - 1)
+    pruneNodeDemands()
+    if _, ok := nodeDemands["stale"]; ok {
+        t.Fatal("stale demand not pruned")
+    }
+    if _, ok := nodeDemands["split"]; !ok {
+        t.Fatal("fresh demand pruned")
+    }
+}
+
+
+func TestNodeRatios(t *testing.T) {
+    setFleet(t, "127.0.0.1:80", "127.0.0.2:80", "127.0.0.3:80")
+    old := NodeShareFloor
+    defer func() { NodeShareFloor = old }()
+    NodeShareFloor = 20
+    now := time.Now().Unix()
+    setNodeDemand("split", "127.0.0.1", [3]float64{600, 0, 0}, now)
+    setNodeDemand("split", "127.0.0.2", [3]float64{300, 0, 0}, now)
+    // 过期的需求按0计算
+    setNodeDemand("split", "127.0.0.3", [3]float64{900, 0, 0}, now - nodeDemandExpire - 1)
+
+    // 每个节点保底20%/3，剩余80%按取整后的需求比例67%、33%、0%分配
+    floor := 0.2 / 3
+    want := map[string]float64{"127.0.0.1:80": floor + 0.8 * 0.67, "127.0.0.2:80": floor + 0.8 * 0.33, "127.0.0.3:80": floor}
+    ratios, _ := nodeRatios("split")
+    for server, r := range want {
+        if math.Abs(ratios[server][0] - r) > 1e-9 {
+            t.Errorf("%s rate ratio is %v, want %v", server, ratios[server][0], r)
+        }
+        // 没有需求的维度按节点均分
+        if math.Abs(ratios[server][1] - 1.0 / 3) > 1e-9 {
+            t.Errorf("%s conn ratio is %v", server, ratios[server][1])
+        }
+    }
+
+    q := testQuota(900, 3, 0, 50)
+    q.BucketName = "split"
+    l := nginxLimitData("127.0.0.1:80", q)
+    if l.LimitRate != 542 || l.LimitConn != 1 || l.LimitQps != 0 || l.LimitConnRate != 50 {
+        t.Fatalf("limit data is %+v", l)
+    }
+    if l = nginxLimitData("127.0.0.3:80", q); l.LimitRate != 60 {
+        t.Fatalf("floor limit data is %+v", l)
+    }
+
+    // 需求的微小波动不改变下发的限速
+    setNodeDemand("split", "127.0.0.1", [3]float64{601, 0, 0}, now)
+    if l = nginxLimitData("127.0.0.1:80", q); l.LimitRate != 542 {
+        t.Fatalf("limit changed with tiny demand change: %+v", l)
+    }
+
+    // draining节点只分得保底份额，剩余部分全部分给active节点
+    fleetLock.Lock()
+    nginxNodes["127.0.0.1:80"].State = NODE_DRAINING
+    fleetLock.Unlock()
+    ratios, _ = nodeRatios("split")
+    if math.Abs(ratios["127.0.0.1:80"][0] - floor) > 1e-9 || math.Abs(ratios["127.0.0.2:80"][0] - (floor + 0.8)) > 1e-9 {
+        t.Fatalf("ratios with draining node are %v", ratios)
+    }
+    // 删除的节点不再分得配额
+    if r := nodeRatio("127.0.0.9:80", "split"); r != [3]float64{} {
+        t.Fatalf("removed node ratio is %v", r)
+    }
+}
+
+
+func TestSplitQuota(t *testing.T) {
+    cases := []struct {
+        v      int64
+        ratio  float64
+        want   int64
+    }{
+        {100, 0.5, 50},
+        {0, 0.5, 0},
+        // 配额不为0时至少分得1，避免变成不限速
+        {1, 0.1, 1},
+    }
+    for _, c := range cases {
+        if got := splitQuota(c.v, c.ratio); got != c.want {
+            t.Errorf("splitQuota(%d, %v) = %d, want %d", c.v, c.ratio, got, c.want)
+        }
+    }
+    for r, want := range map[float64]float64{0.6666: 0.67, 0.333: 0.33, 0.004: 0, 0.995: 1} {
+        if got := roundShare(r); math.Abs(got - want) > 1e-9 {
+            t.Errorf("roundShare(%v) = %v, want %v", r, got, want)
+        }
+    }
+}
@@ -0,0 +1,106 @@
+/* LimitServer通配配额模块
+** 桶名以"*"结尾的配额为通配配额，如"log-*"匹配所有以"log-"开头的桶，"*"匹配所有桶
+** 没有精确配额的桶使用最长匹配的通配配额，报警配额和限速配额都适用
+** 每个配额快照生成时按长度排好通配配额，查找只需要遍历通配配额，见registry.go
+*/
+
+package main
+
+import (
+    "sort"
+    "strings"
+)
+
+
+// 判断@name是否为通配配额名
+func isPattern(name string) (bool) {
+    return strings.HasSuffix(name, "*")
+}
+
+
+/* 检查配额名是否合法，通配符只能出现在末尾
+** 返回值：""代表合法，否则为出错原因
+*/
+func checkBucketName(name string) (string) {
+    if strings.Contains(strings.TrimSuffix(name, "*"), "*") {
+        return "通配符*只能出现在桶名末尾"
+    }
+    if name == "TotalStatistic*" {
+        return "TotalStatistic不支持通配"
+    }
+    return ""
+}
+
+
+// 桶@bucket是否匹配通配配额@pattern
+func matchPattern(pattern string, bucket string) (bool) {
+    return strings.HasPrefix(bucket, strings.TrimSuffix(pattern, "*"))
+}
+
+
+// @quotas中有@qt类型配额的通配配额名，按长度从长到短排列，第一个匹配的即为最长匹配
+func sortedPatterns(quotas QuotaMap, qt int) ([]string) {
+    patterns := make([]string, 0)
+    for key, value := range quotas {
+        if value[qt] != nil && isPattern(key) {
+            patterns = append(patterns, key)
+        }
+    }
+    sort.Slice(patterns, func(i, j int) bool {
+        if len(patterns[i]) != len(patterns[j]) {
+            return len(patterns[i]) > len(patterns[j])
+        }
+        return patterns[i] < patterns[j]
+    })
+    return patterns
+}
+
+
+/* 在快照@s中查找桶@bucket最长匹配的@qt类型通配配额
+** 返回值：通配配额名，没有匹配时为""
+*/
+func snapshotPattern(s *quotaSnapshot, bucket string, qt int) (string) {
+    if bucket == "TotalStatistic" || isPattern(bucket) {
+        return ""
+    }
+    for _, key := range s.patterns[qt] {
+        if matchPattern(key, bucket) {
+            return key
+        }
+    }
+    return ""
+}
+
+
+/* 查找桶@bucket最长匹配的@qt类型通配配额
+** 返回值：通配配额名，没有匹配时为""
+*/
+func longestPattern(bucket string, qt int) (string) {
+    return snapshotPattern(quotaRegistry.snapshot(), bucket, qt)
+}
+
+
+/* 获取桶@bucket的@qt类型配额，没有精确配额时使用最长匹配的通配配额
+** 返回内存中的配额，调用者不能修改，没有配额时返回nil
+*/
+func resolveQuota(bucket string, qt int) (*BucketQuota) {
+    s := quotaRegistry.snapshot()
+    if value, ok := s.quotas[bucket]; ok && value[qt] != nil {
+        return value[qt]
+    }
+    pattern := snapshotPattern(s, bucket, qt)
+    if pattern == "" {
+        return nil
+    }
+    return s.quotas[pattern][qt]
+}
+
+
+// 桶@bucket是否有精确配额或匹配的通配配额
+func hasQuota(bucket string) (bool) {
+    s := quotaRegistry.snapshot()
+    if _, ok := s.quotas[bucket]; ok {
+        return true
+    }
+    return snapshotPattern(s, bucket, 0) != "" || snapshotPattern(s, bucket, 1) != ""
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+)
+
+
+func TestCheckBucketName(t *testing.T) {
+    for _, name := range []string{"a", "log-*", "*"} {
+        if errMsg := checkBucketName(name); errMsg != "" {
+            t.Errorf("%s: %s", name, errMsg)
+        }
+    }
+    for _, name := range []string{"a*b", "**", "TotalStatistic*"} {
+        if checkBucketName(name) == "" {
+            t.Errorf("%s should be invalid", name)
+        }
+    }
+
+    w := callApi(apiBucketQuota, "alice", "PUT", "/api/v1/buckets/a*b/quota/limit", `{"Rate": 1, "Connection": 0, "QPS": 0, "RatePerConn": 0}`)
+    if w.Code != http.StatusBadRequest {
+        t.Fatalf("PUT invalid name: got %d", w.Code)
+    }
+}
+
+
+// 精确配额优先，其次是最长匹配的通配配额，报警和限速配额分别匹配
+func TestResolveQuota(t *testing.T) {
+    emptyQuotas(t)
+
+    setQuota("*", 1, testQuota(1, 0, 0, 0), "alice", "")
+    setQuota("log-*", 1, testQuota(2, 0, 0, 0), "alice", "")
+    setQuota("log-app-*", 1, testQuota(3, 0, 0, 0), "alice", "")
+    setQuota("log-app-*", 0, testQuota(30, 0, 0, 0), "alice", "")
+    setQuota("log-app-x", 0, testQuota(40, 0, 0, 0), "alice", "")
+    setQuota("TotalStatistic", 0, testQuota(50, 0, 0, 0), "alice", "")
+
+    cases := []struct {
+        bucket  string
+        qt      int
+        pattern string
+        rate    int64
+    }{
+        {"data", 1, "*", 1},
+        {"log-web", 1, "log-*", 2},
+        {"log-app-y", 1, "log-app-*", 3},
+        {"log-app-y", 0, "log-app-*", 30},
+        // 只有报警精确配额的桶，限速配额仍然使用通配配额
+        {"log-app-x", 1, "log-app-*", 3},
+        {"log-app-x", 0, "log-app-*", 40},
+        {"data", 0, "", 0},
+        // 通配配额本身和整体流量不参与匹配
+        {"log-*", 1, "", 2},
+    }
+    for _, c := range cases {
+        if p := longestPattern(c.bucket, c.qt); p != c.pattern {
+            t.Errorf("longestPattern(%s, %d) = %q, want %q", c.bucket, c.qt, p, c.pattern)
+        }
+        q := resolveQuota(c.bucket, c.qt)
+        var rate int64
+        if q != nil {
+            rate = q.RateQuota
+        }
+        if rate != c.rate {
+            t.Errorf("resolveQuota(%s, %d) rate = %d, want %d", c.bucket, c.qt, rate, c.rate)
+        }
+    }
+    if longestPattern("TotalStatistic", 1) != "" || resolveQuota("TotalStatistic", 0).RateQuota != 50 {
+        t.Error("TotalStatistic should only use its own quota")
+    }
+
+    // 生效配额使用桶自己的名字
+    if e := effectiveQuota("log-web", 1); e == nil || e.BucketName != "log-web" || e.RateQuota != 2 {
+        t.Errorf("effectiveQuota is %+v", e)
+    }
+    if !hasQuota("anything") {
+        t.Error("bucket matching * should have quota")
+    }
+    delQuota("*", 1, "alice", "")
+    if hasQuota("anything") {
+        t.Error("bucket without any match should have no quota")
+    }
+}
+
+
+// 已经在Nginx上的桶即使不活跃也继续按通配配额下发
+func TestDesiredLimits(t *testing.T) {
+    emptyQuotas(t)
+    old := Nginxs
+    defer func() { Nginxs = old }()
+    Nginxs = []string{"127.0.0.1:8080"}
+
+    setQuota("img-*", 1, testQuota(100, 0, 0, 0), "alice", "")
+    setQuota("exact", 1, testQuota(200, 0, 0, 0), "alice", "")
+
+    limits := desiredLimits([]string{"img-a", "other"})
+    if len(limits) != 2 {
+        t.Fatalf("desired limits are %v", limits)
+    }
+    if limits["img-a"].RateQuota != 100 || limits["img-a"].BucketName != "img-a" || limits["exact"].RateQuota != 200 {
+        t.Fatalf("desired limits are wrong: %+v %+v", limits["img-a"], limits["exact"])
+    }
+    if _, ok := limits["img-*"]; ok {
+        t.Fatal("pattern itself should not be pushed to Nginx")
+    }
+}
@@ -0,0 +1,252 @@
+/* LimitServer配额文件持久化，保证进程崩溃或磁盘写满时不丢失配额:
+** 1. 先完整写入quota.new并fsync，成功后再原子重命名为quota
+** 2. 文件首行为版本和校验头: #LimitServerQuota v1 <配额数> <sha256>，校验内容为首行之后的全部数据
+** 3. 每次覆盖前将原quota文件备份为quota.bak.1，保留最近QuotaBackupNum份(quota.bak.1最新)
+** 4. 加载时校验失败则拒绝启动，并给出最近一份校验通过的备份
+*/
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "bytes"
+    "strings"
+    "strconv"
+    "io/ioutil"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+)
+
+
+const (
+    quotaFile        = "./conf/quota"
+    quotaFileMagic   = "#LimitServerQuota"
+    quotaFileVersion = "v1"
+)
+
+
+// 第@i份备份文件名，1为最新
+func quotaBackupName(i int) (string) {
+    return quotaFile + ".bak." + strconv.Itoa(i)
+}
+
+
+// 将内存配额序列化为带校验头的文件内容，任意配额序列化失败则整体失败
+func marshalQuota() ([]byte, error) {
+    var body bytes.Buffer
+    count := 0
+    for key, value := range quotaRegistry.Snapshot() {
+        for _, v := range value {
+            if v == nil {
+                continue
+            }
+            b, err := json.Marshal(v)
+            if err != nil {
+                return nil, fmt.Errorf("json Marshal[%s]failed: %s", key, err)
+            }
+            body.Write(b)
+            body.WriteByte('\n')
+            count++
+        }
+    }
+
+    sum := sha256.Sum256(body.Bytes())
+    header := fmt.Sprintf("%s %s %d %s\n", quotaFileMagic, quotaFileVersion, count, hex.EncodeToString(sum[:]))
+    return append([]byte(header), body.Bytes()...), nil
+}
+
+
+/* 解析并校验配额文件内容@data
+** 没有校验头的旧格式文件逐行解析，跳过无法解析的行
+** 返回值：解析出的配额和出错原因，""代表文件完好
+*/
+func parseQuotaFile(data []byte) ([]*BucketQuota, string) {
+    quotas := make([]*BucketQuota, 0)
+    body := data
+    count := -1
+
+    if bytes.HasPrefix(data, []byte(quotaFileMagic)) {
+        index := bytes.IndexByte(data, '\n')
+        if index == -1 {
+            return nil, "校验头不完整"
+        }
+        fields := strings.Fields(string(data[:index]))
+        if len(fields) != 4 || fields[1] != quotaFileVersion {
+            return nil, fmt.Sprintf("无法识别的校验头[%s]", data[:index])
+        }
+        n, err := strconv.Atoi(fields[2])
+        if err != nil {
+            return nil, fmt.Sprintf("校验头中的配额数[%s]错误", fields[2])
+        }
+        count = n
+        body = data[index + 1:]
+        sum := sha256.Sum256(body)
+        if hex.EncodeToString(sum[:]) != fields[3] {
+            return nil, "sha256校验失败，文件内容不完整或已损坏"
+        }
+    } else if len(data) > 0 {
+        GLogger.Info("quota file has no checksum header, treat as legacy format")
+    }
+
+    for _, line := range bytes.Split(body, []byte("\n")) {
+        if len(trimLine(line)) == 0 {
+            continue
+        }
+        quota := new(BucketQuota)
+        err := json.Unmarshal(line, quota)
+        if err == nil && quota.QuotaType != 0 && quota.QuotaType != 1 {
+            err = fmt.Errorf("unknown quota type %d", quota.QuotaType)
+        }
+        if err != nil {
+            if count >= 0 {
+                return nil, fmt.Sprintf("配额[%s]解析失败: %s", line, err)
+            }
+            GErrorLogger.Error("Unmarshal [%s] failed: [%s]", line, err)
+            continue
+        }
+        quotas = append(quotas, quota)
+    }
+
+    if count >= 0 && count != len(quotas) {
+        return nil, fmt.Sprintf("校验头中的配额数%d与实际配额数%d不一致", count, len(quotas))
+    }
+    return quotas, ""
+}
+
+
+// 最近一份校验通过的备份文件名，没有时返回""
+func latestValidBackup() (string) {
+    for i := 1; i <= QuotaBackupNum; i++ {
+        data, err := ioutil.ReadFile(quotaBackupName(i))
+        if err != nil {
+            continue
+        }
+        if _, errMsg := parseQuotaFile(data); errMsg == "" {
+            return quotaBackupName(i)
+        }
+    }
+    return ""
+}
+
+
+/* 读取并校验./conf/quota，文件不存在时返回空配额
+** 返回值：配额和出错原因，""代表成功
+*/
+func readQuotaFile() ([]*BucketQuota, string) {
+    data, err := ioutil.ReadFile(quotaFile)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return make([]*BucketQuota, 0), ""
+        }
+        return nil, fmt.Sprintf("read quota file [%s] failed: %s", quotaFile, err)
+    }
+
+    quotas, errMsg := parseQuotaFile(data)
+    if errMsg == "" {
+        return quotas, ""
+    }
+
+    errMsg = fmt.Sprintf("quota file [%s] is corrupted: %s.", quotaFile, errMsg)
+    if backup := latestValidBackup(); backup != "" {
+        errMsg += fmt.Sprintf(" Latest valid backup is [%s], copy it to [%s] and restart.", backup, quotaFile)
+    } else {
+        errMsg += " No valid backup found."
+    }
+    return nil, errMsg
+}
+
+
+// 将@data写入@fname并fsync
+func writeFileSync(fname string, data []byte) (error) {
+    f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+    if err != nil {
+        return err
+    }
+    _, err = f.Write(data)
+    if err == nil {
+        err = f.Sync()
+    }
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+
+// 将当前配额文件备份为quota.bak.1，更早的备份依次后移，超出QuotaBackupNum的删除
+func rotateQuotaBackups() (error) {
+    if QuotaBackupNum <= 0 {
+        return nil
+    }
+    data, err := ioutil.ReadFile(quotaFile)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return err
+    }
+    // 已损坏的文件不作为备份，避免挤掉完好的旧备份
+    if _, errMsg := parseQuotaFile(data); errMsg != "" {
+        GErrorLogger.Error("skip backup of corrupted quota file: %s", errMsg)
+        return nil
+    }
+
+    os.Remove(quotaBackupName(QuotaBackupNum))
+    for i := QuotaBackupNum - 1; i >= 1; i-- {
+        err = os.Rename(quotaBackupName(i), quotaBackupName(i + 1))
+        if err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    return writeFileSync(quotaBackupName(1), data)
+}
+
+
+// fsync配置目录，保证重命名操作落盘
+func syncConfDir() {
+    d, err := os.Open("./conf")
+    if err != nil {
+        return
+    }
+    d.Sync()
+    d.Close()
+}
+
+
+/* 将内存配额写入配额文件，步骤：
+** 1.将内存配额数据和校验头写入quota.new并fsync
+** 2.备份原始配额文件quota
+** 3.将quota.new原子重命名为quota
+** 任意一步失败时原quota文件保持不变
+*/
+func writeQuotaFile() (error) {
+    newfile := quotaFile + ".new"
+
+    data, err := marshalQuota()
+    if err != nil {
+        return err
+    }
+
+    // 创建新配额文件quota.new
+    err = writeFileSync(newfile, data)
+    if err != nil {
+        os.Remove(newfile)
+        return fmt.Errorf("write %s failed: %s", newfile, err)
+    }
+
+    err = rotateQuotaBackups()
+    if err != nil {
+        os.Remove(newfile)
+        return fmt.Errorf("backup %s failed: %s", quotaFile, err)
+    }
+
+    err = os.Rename(newfile, quotaFile)
+    if err != nil {
+        os.Remove(newfile)
+        return fmt.Errorf("rename %s to %s failed: %s", newfile, quotaFile, err)
+    }
+    syncConfDir()
+    return nil
+}
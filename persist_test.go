@@ -0,0 +1,84 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+
+// 带校验头的配额文件内容，@count为校验头中的配额数
+func quotaFileData(body string, count int) ([]byte) {
+    sum := sha256.Sum256([]byte(body))
+    return []byte(fmt.Sprintf("%s %s %d %s\n%s", quotaFileMagic, quotaFileVersion, count, hex.EncodeToString(sum[:]), body))
+}
+
+
+const testQuotaBody = `{"BucketName":"a","QuotaType":1,"RateQuota":100,"ConnQuota":10,"QpsQuota":50,"RatePerConn":0}
+{"BucketName":"b","QuotaType":0,"RateQuota":200,"ConnQuota":20,"QpsQuota":60,"RatePerConn":0}
+`
+
+
+func TestParseQuotaFileChecksum(t *testing.T) {
+    quotas, errMsg := parseQuotaFile(quotaFileData(testQuotaBody, 2))
+    if errMsg != "" {
+        t.Fatalf("valid file rejected: %s", errMsg)
+    }
+    if len(quotas) != 2 || quotas[0].BucketName != "a" || quotas[0].RateQuota != 100 || quotas[1].QuotaType != 0 {
+        t.Fatalf("unexpected quotas %+v", quotas)
+    }
+}
+
+
+func TestParseQuotaFileCorrupted(t *testing.T) {
+    data := quotaFileData(testQuotaBody, 2)
+    // 篡改内容后校验失败
+    tampered := []byte(strings.Replace(string(data), `"RateQuota":100`, `"RateQuota":900`, 1))
+    if _, errMsg := parseQuotaFile(tampered); errMsg == "" {
+        t.Errorf("tampered file accepted")
+    }
+    // 写入中断，内容被截断
+    if _, errMsg := parseQuotaFile(data[:len(data) - 20]); errMsg == "" {
+        t.Errorf("truncated file accepted")
+    }
+    // 校验头不完整
+    if _, errMsg := parseQuotaFile([]byte(quotaFileMagic + " v1 2")); errMsg == "" {
+        t.Errorf("incomplete header accepted")
+    }
+    // 校验头中的配额数不一致
+    if _, errMsg := parseQuotaFile(quotaFileData(testQuotaBody, 3)); errMsg == "" {
+        t.Errorf("count mismatch accepted")
+    }
+    // 未知版本
+    v2 := []byte(strings.Replace(string(data), quotaFileVersion, "v2", 1))
+    if _, errMsg := parseQuotaFile(v2); errMsg == "" {
+        t.Errorf("unknown version accepted")
+    }
+}
+
+
+func TestParseQuotaFileBadLineWithChecksum(t *testing.T) {
+    body := testQuotaBody + "not json\n"
+    if _, errMsg := parseQuotaFile(quotaFileData(body, 3)); errMsg == "" {
+        t.Errorf("unparsable line in checksummed file accepted")
+    }
+}
+
+
+func TestParseQuotaFileLegacy(t *testing.T) {
+    // 没有校验头的旧格式跳过无法解析的行
+    quotas, errMsg := parseQuotaFile([]byte(testQuotaBody + "not json\n"))
+    if errMsg != "" {
+        t.Fatalf("legacy file rejected: %s", errMsg)
+    }
+    if len(quotas) != 2 {
+        t.Fatalf("want 2 quotas, got %d", len(quotas))
+    }
+
+    quotas, errMsg = parseQuotaFile(nil)
+    if errMsg != "" || len(quotas) != 0 {
+        t.Errorf("empty file: quotas %v, err %s", quotas, errMsg)
+    }
+}
@@ -6,13 +6,14 @@
 package main
 
 import (
-    "io"
     "os"
     "fmt"
-    "bufio"
+    "html"
+    "time"
+    "strings"
     "strconv"
+    "net/url"
     "net/http"
-    "encoding/json"
 )
 
 
@@ -32,6 +33,100 @@ type BucketQuota struct {
     QpsQuota    int64
     // 单个连接上的流量配额
     RatePerConn int64
+    // 分操作QPS配额，与BucketQPS中的分类对应，0表示不单独限制
+    QpsGetQuota    int64  `json:",omitempty"`
+    QpsPutQuota    int64  `json:",omitempty"`
+    QpsDeleteQuota int64  `json:",omitempty"`
+    QpsListQuota   int64  `json:",omitempty"`
+    QpsImageQuota  int64  `json:",omitempty"`
+    QpsVideoQuota  int64  `json:",omitempty"`
+    /* 令牌桶参数，只对限速配额有效，0表示不允许突发
+    ** RateQuota/QpsQuota为令牌补充速率，RateBurst/QpsBurst为令牌桶容量，
+    ** 即允许的突发流量(B)和突发请求数，RefillInterval为补充令牌的间隔(ms)，0表示由Nginx连续补充
+    */
+    RateBurst      int64  `json:",omitempty"`
+    QpsBurst       int64  `json:",omitempty"`
+    RefillInterval int64  `json:",omitempty"`
+    /* 集群容量限速时的公平份额参数，只对限速配额有效
+    ** Weight为权重，0按1计算；Priority为优先级，优先级高的桶先分配容量
+    */
+    Weight         int64  `json:",omitempty"`
+    Priority       int64  `json:",omitempty"`
+    // 时间段配额，时间段内替代上述配额值
+    Schedules   []QuotaSchedule  `json:",omitempty"`
+    // 引用的配额模板，不为空时上述配额值由模板决定
+    Template    string           `json:",omitempty"`
+    // 引用模板时对模板中个别配额项的覆盖，key为BucketQuota中的配额字段名，如QpsQuota、QpsListQuota
+    Overrides   map[string]int64 `json:",omitempty"`
+    // 封禁，只对限速配额有效，封禁时前端Nginx拒绝该桶的全部请求，见block.go
+    Blocked     bool             `json:",omitempty"`
+}
+
+
+// 配额项：表单和API中的参数名、出错信息中的名称、BucketQuota中的字段名、是否可以不填、是否只用于限速配额
+type quotaField struct {
+    Key       string
+    Name      string
+    Field     string
+    Optional  bool
+    LimitOnly bool
+}
+
+
+var quotaFields = []quotaField{
+    {"Rate",           "流量",             "RateQuota",      false, false},
+    {"Connection",     "连接数",           "ConnQuota",      false, false},
+    {"QPS",            "QPS",              "QpsQuota",       false, false},
+    {"RatePerConn",    "RatePerConn",      "RatePerConn",    false, true},
+    {"QPSGet",         "GET QPS",          "QpsGetQuota",    true,  false},
+    {"QPSPut",         "PUT QPS",          "QpsPutQuota",    true,  false},
+    {"QPSDelete",      "DELETE QPS",       "QpsDeleteQuota", true,  false},
+    {"QPSList",        "LIST QPS",         "QpsListQuota",   true,  false},
+    {"QPSImage",       "IMAGE QPS",        "QpsImageQuota",  true,  false},
+    {"QPSVideo",       "VIDEO QPS",        "QpsVideoQuota",  true,  false},
+    {"BurstRate",      "BurstRate(B)",     "RateBurst",      true,  true},
+    {"BurstQPS",       "BurstQPS",         "QpsBurst",       true,  true},
+    {"RefillInterval", "RefillInterval(ms)", "RefillInterval", true, true},
+    {"Weight",         "Weight",           "Weight",         true,  true},
+    {"Priority",       "Priority",         "Priority",       true,  true},
+}
+
+
+// 配额@q中字段名为@field的配额项，字段名未知时返回nil
+func quotaFieldPtr(q *BucketQuota, field string) (*int64) {
+    switch field {
+    case "RateQuota":
+        return &q.RateQuota
+    case "ConnQuota":
+        return &q.ConnQuota
+    case "QpsQuota":
+        return &q.QpsQuota
+    case "RatePerConn":
+        return &q.RatePerConn
+    case "QpsGetQuota":
+        return &q.QpsGetQuota
+    case "QpsPutQuota":
+        return &q.QpsPutQuota
+    case "QpsDeleteQuota":
+        return &q.QpsDeleteQuota
+    case "QpsListQuota":
+        return &q.QpsListQuota
+    case "QpsImageQuota":
+        return &q.QpsImageQuota
+    case "QpsVideoQuota":
+        return &q.QpsVideoQuota
+    case "Weight":
+        return &q.Weight
+    case "Priority":
+        return &q.Priority
+    case "RateBurst":
+        return &q.RateBurst
+    case "QpsBurst":
+        return &q.QpsBurst
+    case "RefillInterval":
+        return &q.RefillInterval
+    }
+    return nil
 }
 
 
@@ -41,121 +136,89 @@ type Admin struct {
 }
 
 
-// 每个桶目前存在两种配额，第一用于报警，第二用于限速
-var QuotaInfo map[string] []*BucketQuota
 var admins    map[string] string
 
 
-/* 更新磁盘配额，步骤：
-** 1.创建新的配额文件quota.new并将内存配额数据写入其中
-** 2.删除原始配额文件quota
-** 3.将quota.new重命名为quota
+/*
+** 从form中获取流量、连接数、QPS及时间段配额信息
+** 返回值：errMsg保存错误信息,""代表正确
+**         "xxxx"代表出错原因
 */
-func updateDiskQuota() {
-    fname := "./conf/quota"
-    newfile := fname + ".new"
-    var b []byte
+func getParFromReq(r *http.Request) (*BucketQuota, string) {
+    return getParFromForm(r.Form)
+}
 
-    // 创建新配额文件quota.new
-    f, err := os.OpenFile(newfile, os.O_RDWR|os.O_CREATE, 0666)
-    if err != nil {
-        GErrorLogger.Error("open quota.new for writing failed: [%s]", err)
-        goto RET;
-    }
 
-    // 配额信息json格式化并写入quota.new,每个桶的配额信息写入一行
-    for key, value := range QuotaInfo {
-        for _, v := range value {
-            if v == nil {
-                continue
-            }
-            b, err = json.Marshal(v)
-            if err != nil {
-                GErrorLogger.Error("json Marshal[%s]failed: [%s]", key, err)
-                continue
-            }
-            _, err = f.Write(b)
-            if err != nil {
-                GErrorLogger.Error("write [%s] failed: [%s]", key, err)
-            }
-            _,err = f.WriteString("\n")
-        }
+/* 从@form中解析配额项@key，@name用于出错信息
+** @optional为true时允许不填写
+** 返回值：配额值，是否填写，errMsg保存错误信息,""代表正确
+*/
+func getQuotaField(form url.Values, key string, name string, optional bool) (int64, bool, string) {
+    raw := form.Get(key)
+    if raw == "" && optional {
+        return 0, false, ""
     }
-
-    // 删除原始quota文件
-    err = os.Remove(fname)
-    if err != nil && os.IsNotExist(err){
-        GErrorLogger.Error("delete file quota: [%s]", err)
+    v, err := strconv.Atoi(raw)
+    if err != nil {
+        return 0, false, "请检查" + name + "设置，确保输入的是数字"
     }
-
-    os.Rename(newfile, fname)
-RET:
-    return
+    if v < 0 {
+        return 0, false, name + "范围为[0, 无穷大)"
+    }
+    return int64(v), true, ""
 }
 
 
-/*
-** 从form中获取桶名、流量、连接数、QPS信息
-** 返回值：errMsg保存错误信息,""代表正确
-**         "xxxx"代表出错原因
+/* 从@form中解析并检查配额参数，WEB表单和API共用
+** 引用配额模板时，填写的配额项作为对模板的覆盖，未填写的沿用模板
 */
-func getParFromReq(r *http.Request) (int, int, int, int, string) {
-    var rate     int
-    var conn     int
-    var qps      int
-    var rateConn int
-    var err      error
+func getParFromForm(form url.Values) (*BucketQuota, string) {
+    var quota    *BucketQuota
 
     errMsg := ""
     warn := false
 
-    if r.Form.Get("Warn") == "true" {
+    if form.Get("Warn") == "true" {
         warn = true
     }
 
-    rate, err = strconv.Atoi(r.Form.Get("Rate"))
-    if err != nil {
-        errMsg = "请检查流量设置，确保输入的是数字"
-        goto RET
-    }
-    if rate < 0 {
-        errMsg = "流量范围为[0, 无穷大)"
-        goto RET
-    }
-
-    conn, err = strconv.Atoi(r.Form.Get("Connection"))
-    if err != nil {
-        errMsg = "请检查连接数设置，确保输入的是数字"
-        goto RET
-    }
-    if conn < 0 {
-        errMsg = "连接数范围为[0, 无穷大)"
-        goto RET
-    }
-
-    qps, err = strconv.Atoi(r.Form.Get("QPS"))
-    if err != nil {
-        errMsg = "请检查QPS设置，确保输入的是数字"
-        goto RET
-    }
-    if qps < 0 {
-        errMsg = "QPS范围为[0, 无穷大)"
-        goto RET
+    template := strings.TrimSpace(form.Get("Template"))
+    if template != "" {
+        if _, ok := getTemplate(template); !ok {
+            errMsg = "配额模板" + template + "不存在"
+            goto RET
+        }
     }
 
-    if warn == false {
-        rateConn, err = strconv.Atoi(r.Form.Get("RatePerConn"))
-        if err != nil {
-            errMsg = "请检查RatePerConn设置，确保输入的是数字"
-            goto RET
+    quota = new(BucketQuota)
+    quota.Template = template
+    for _, f := range quotaFields {
+        // 报警配额没有单连接流量配额和令牌桶参数
+        if f.LimitOnly && warn {
+            continue
         }
-        if rateConn < 0 {
-            errMsg = "RatePerConn范围为[0, 无穷大)"
+        v, has, err := getQuotaField(form, f.Key, f.Name, f.Optional || template != "")
+        if err != "" {
+            errMsg = err
             goto RET
         }
+        if template == "" {
+            *quotaFieldPtr(quota, f.Field) = v
+        } else if has {
+            if quota.Overrides == nil {
+                quota.Overrides = make(map[string]int64)
+            }
+            quota.Overrides[f.Field] = v
+        }
     }
+
+    // 时间段配额以json数组形式提交，为空表示不分时段
+    quota.Schedules, errMsg = parseSchedules(form.Get("Schedules"))
 RET:
-    return rate, conn, qps, rateConn, errMsg
+    if errMsg != "" {
+        quota = nil
+    }
+    return quota, errMsg
 }
 
 
@@ -191,7 +254,7 @@ func checkLogin(w http.ResponseWriter, r *http.Request) {
     }
 
     // 验证通过，方可进行配额设置
-    errMsg, ok = UpdateQuota2(w, r, RESET)
+    errMsg, ok = UpdateQuota2(w, r, getQuotaOp(r.FormValue("Op")))
 
 RET:
     // 如果设置成功，跳转至主页面
@@ -206,7 +269,7 @@ RET:
             jump = fmt.Sprintf(`<html><head><meta http-equiv="refresh" content="1; url=http://%s:%s/quota?limit=true&name=%s&rate=%s&qps=%s&conn=%s&connrate=%s" /></head><body>%s</body></html>`, Host, HttpPort, bucket, rate, qps, conn, connrate, errMsg)
         }
     } else {
-        jump = fmt.Sprintf(`<html><head><meta http-equiv="refresh" content="2; url=http://%s:%s/all" /></head><body>OK!</body></html>`, Host, HttpPort)
+        jump = fmt.Sprintf(`<html><head><meta charset=utf-8><meta http-equiv="refresh" content="2; url=http://%s:%s/all" /></head><body>%s</body></html>`, Host, HttpPort, errMsg)
     }
     fmt.Fprintf(w, jump)
 }
@@ -222,26 +285,35 @@ func QuotaSet(w http.ResponseWriter, r *http.Request) {
     connrate  := r.FormValue("connrate")
 
     if r.Method == "GET" {
+        schedules := html.EscapeString(formatSchedules(name, getQuotaType(warn)))
+        template := html.EscapeString(bucketTemplate(name, getQuotaType(warn)))
+        optional := optionalInputs(name, getQuotaType(warn))
         if name == "TotalStatistic" {
+            // 整体流量的限速配额即集群容量
+            title := "Total Warn Quota Set"
+            if warn != "true" {
+                title = "Cluster Capacity Set"
+            }
             fmt.Fprintf(w, `<html>
                 <head><meta charset=utf-8></head>
                 <body>
                 <form action="/checkLogin" method="post">
                 <table border="0">
                 <thead valign="middle">
-                <tr><td><strong><font size="4">Total Warn Quota Set</font></strong></td></tr>
+                <tr><td><strong><font size="4">%s</font></strong></td></tr>
                 </thead>
                 <tr><td>Rate(B/s)</td><td><input type="text" name="Rate" value=%s></input></td></tr>
                 <tr><td>QPS</td><td><input type="text" name="QPS" value=%s></input></td></tr>
                 <tr><td>Connection</td><td><input type="text" name="Connection" value=%s></input></td></tr>
                 <tr><td>Admin</td><td><input type="text" name="Admin"></input></td></tr>
-                <tr><td><input type="hidden" name="Warn" value=%s></input></td></tr>
+                <tr><td><input type="hidden" name="Warn" value=%s></input><input type="hidden" name="RatePerConn" value=0></input></td></tr>
                 <tr><td>Password</td><td><input type="password" name="Password"></input></td></tr>
+                <tr><td>Reason</td><td><input type="text" name="Reason"></input></td></tr>
                 <tr><td><input type="submit" name="设置"></input></td></tr>
                 </table>
                 </form>
                 </body>
-                </html>`, rate, qps, conn, warn)
+                </html>`, title, rate, qps, conn, warn)
           } else if warn == "true" {
               fmt.Fprintf(w, `<html>
                 <head><meta charset=utf-8></head>
@@ -255,14 +327,19 @@ func QuotaSet(w http.ResponseWriter, r *http.Request) {
                 <tr><td>Rate(B/s)</td><td><input type="text" name="Rate" value=%s></input></td></tr>
                 <tr><td>QPS</td><td><input type="text" name="QPS" value=%s></input></td></tr>
                 <tr><td>Connection</td><td><input type="text" name="Connection" value=%s></input></td></tr>
+                %s
+                <tr><td>Template</td><td><input type="text" name="Template" value="%s"></input></td></tr>
+                <tr><td>Schedules(json)</td><td><textarea name="Schedules" rows="4" cols="60">%s</textarea></td></tr>
                 <tr><td>Admin</td><td><input type="text" name="Admin"></input></td></tr>
                 <tr><td><input type="hidden" name="Warn" value=%s></input></td></tr>
                 <tr><td>Password</td><td><input type="password" name="Password"></input></td></tr>
+                <tr><td>Reason</td><td><input type="text" name="Reason"></input></td></tr>
                 <tr><td><input type="submit" name="设置"></input></td></tr>
+                <tr><td><input type="submit" name="Op" value="Add"></input></td><td><input type="submit" name="Op" value="Delete"></input></td></tr>
                 </table>
                 </form>
                 </body>
-                </html>`, name, rate, qps, conn, warn)
+                </html>`, name, rate, qps, conn, optional, template, schedules, warn)
             } else {
               fmt.Fprintf(w, `<html>
                 <head><meta charset=utf-8></head>
@@ -277,14 +354,19 @@ func QuotaSet(w http.ResponseWriter, r *http.Request) {
                 <tr><td>QPS</td><td><input type="text" name="QPS" value=%s></input></td></tr>
                 <tr><td>Connection</td><td><input type="text" name="Connection" value=%s></input></td></tr>
                 <tr><td>RatePerConn(B/s)</td><td><input type="text" name="RatePerConn" value=%s></input></td></tr>
+                %s
+                <tr><td>Template</td><td><input type="text" name="Template" value="%s"></input></td></tr>
+                <tr><td>Schedules(json)</td><td><textarea name="Schedules" rows="4" cols="60">%s</textarea></td></tr>
                 <tr><td>Admin</td><td><input type="text" name="Admin"></input></td></tr>
                 <tr><td><input type="hidden" name="Warn" value=%s></input></td></tr>
                 <tr><td>Password</td><td><input type="password" name="Password"></input></td></tr>
+                <tr><td>Reason</td><td><input type="text" name="Reason"></input></td></tr>
                 <tr><td><input type="submit" name="设置"></input></td></tr>
+                <tr><td><input type="submit" name="Op" value="Add"></input></td><td><input type="submit" name="Op" value="Delete"></input></td></tr>
                 </table>
                 </form>
                 </body>
-                </html>`, name, rate, qps, conn, connrate, warn)
+                </html>`, name, rate, qps, conn, connrate, optional, template, schedules, warn)
             }
     } else {
         checkLogin(w, r)
@@ -292,22 +374,58 @@ func QuotaSet(w http.ResponseWriter, r *http.Request) {
 }
 
 
-// 获取桶@bucketName的配额
-func GetQuota(bucketName string, qt int)(int64, int64, int64, int64) {
+/* 获取桶@bucketName当前生效的配额
+** 返回值最后一项为当前生效的时间段配额名，""表示没有
+*/
+func GetQuota(bucketName string, qt int)(int64, int64, int64, int64, string) {
     rateQuota, connQuota, qpsQuota, connRateQuota := int64(0), int64(0), int64(0), int64(0)
+    schedule := ""
     if qt == 0 {
        rateQuota, connQuota, qpsQuota = int64(RateAlarmThreshold), int64(ConnAlarmThreshold), int64(QpsAlarmThreshold)
     }
 
-    value, ok := QuotaInfo[bucketName]
-    if ok && value[qt] != nil {
-        rateQuota = value[qt].RateQuota
-        connQuota = value[qt].ConnQuota
-        qpsQuota  = value[qt].QpsQuota
-        qpsQuota  = value[qt].QpsQuota
-        connRateQuota  = value[qt].RatePerConn
+    value := effectiveQuota(bucketName, qt)
+    if value != nil {
+        rateQuota = value.RateQuota
+        connQuota = value.ConnQuota
+        qpsQuota  = value.QpsQuota
+        connRateQuota  = value.RatePerConn
+        if s := activeSchedule(resolveQuota(bucketName, qt), time.Now()); s != nil {
+            schedule = s.Name
+        }
+    }
+    return rateQuota, connQuota, qpsQuota, connRateQuota, schedule
+}
+
+
+// 可选配额项(分操作QPS、令牌桶参数)的表单输入项，回显桶@bucket已有的@qt类型配额，0显示为空
+func optionalInputs(bucket string, qt int) (string) {
+    q := quotaRegistry.Get(bucket, qt)
+    inputs := ""
+    for _, f := range quotaFields {
+        if !f.Optional || (f.LimitOnly && qt == 0) {
+            continue
+        }
+        v := ""
+        if q != nil && *quotaFieldPtr(q, f.Field) > 0 {
+            v = strconv.FormatInt(*quotaFieldPtr(q, f.Field), 10)
+        }
+        inputs += fmt.Sprintf(`<tr><td>%s</td><td><input type="text" name="%s" value="%s"></input></td></tr>`,
+                              f.Name, f.Key, v)
+    }
+    return inputs
+}
+
+
+// 表单中的操作类型，默认为修改配额
+func getQuotaOp(op string) (int) {
+    switch op {
+    case "Add":
+        return ADD
+    case "Delete":
+        return DEL
     }
-    return rateQuota, connQuota, qpsQuota, connRateQuota
+    return RESET
 }
 
 
@@ -323,17 +441,145 @@ func getQuotaType(warn string) (int) {
 }
 
 
+/* 将桶@bucket的@quotaType类型配额替换为@quota，@quota为nil表示删除
+** 调用者必须持有注册表写锁，并负责持久化，持久化成功后记录一次配额修改历史
+*/
+func replaceQuota(bucket string, quotaType int, quota *BucketQuota, admin string, reason string) {
+    old := quotaRegistry.Get(bucket, quotaType)
+    quotaRegistry.Set(bucket, quotaType, quota)
+    addPendingChange(bucket, quotaType, old, quota, admin, reason)
+}
+
+
+// 限速配额全0且没有时间段配额、模板和封禁，相当于不限速
+func isUnlimited(q *BucketQuota) (bool) {
+    if q.QuotaType != 1 || len(q.Schedules) != 0 || q.Template != "" || q.Blocked {
+        return false
+    }
+    for _, f := range quotaFields {
+        if *quotaFieldPtr(q, f.Field) != 0 {
+            return false
+        }
+    }
+    return true
+}
+
+
+/* 将桶@bucket的@quotaType类型配额替换为@quota并持久化，调用者必须持有注册表写锁
+** 不限速的限速配额从内存限速信息中删除
+** 解锁后注册表通知前端Nginx同步协程，将限速配额同步至所有前端Nginx
+** 返回值：持久化失败的原因，此时内存配额已回滚
+*/
+func putQuotaLocked(bucket string, quotaType int, quota *BucketQuota, admin string, reason string) (error) {
+    if quota != nil && isUnlimited(quota) {
+        quota = nil
+    }
+    replaceQuota(bucket, quotaType, quota, admin, reason)
+
+    // 持久化配额信息
+    return updateDiskQuota()
+}
+
+
+// 将桶@bucket的@quotaType类型配额替换为@quota，持久化后同步至所有前端Nginx
+func putQuota(bucket string, quotaType int, quota *BucketQuota, admin string, reason string) (error) {
+    quotaRegistry.Lock()
+    defer quotaRegistry.Unlock()
+    return putQuotaLocked(bucket, quotaType, quota, admin, reason)
+}
+
+
+/* 设置桶@bucket的@quotaType类型配额，持久化后同步至所有前端Nginx
+** 封禁中的桶修改限速配额时保持封禁，只能通过unblockBucket解除
+** 返回值：持久化失败的原因
+*/
+func setQuota(bucket string, quotaType int, quota *BucketQuota, admin string, reason string) (error) {
+    quotaRegistry.Lock()
+    defer quotaRegistry.Unlock()
+    return setQuotaLocked(bucket, quotaType, quota, admin, reason)
+}
+
+
+// 同setQuota，调用者必须持有注册表写锁
+func setQuotaLocked(bucket string, quotaType int, quota *BucketQuota, admin string, reason string) (error) {
+    quota.BucketName = bucket
+    quota.QuotaType  = int64(quotaType)
+    if quotaType == 1 {
+        quota = keepBlocked(bucket, quota)
+    }
+    return putQuotaLocked(bucket, quotaType, quota, admin, reason)
+}
+
+
+/* 新建桶@bucket的@quotaType类型配额，如果该配额已经存在则失败
+** 新建的精确限速配额大幅低于桶当前继承的通配配额时，提交待审批变更而不立即生效
+** 审批检查在注册表写锁内进行，避免检查之后配额被并发修改
+** 返回值：""代表成功，否则为出错原因；待审批变更，nil表示已生效；持久化失败的原因
+*/
+func addQuota(bucket string, quotaType int, quota *BucketQuota, admin string, reason string) (string, *PendingChange, error) {
+    quotaRegistry.Lock()
+    defer quotaRegistry.Unlock()
+    if quotaRegistry.Get(bucket, quotaType) != nil {
+        return "桶配额已经存在，请使用修改", nil, nil
+    }
+    quota.BucketName = bucket
+    quota.QuotaType  = int64(quotaType)
+    if why := needApproval(bucket, quotaType, quota); why != "" {
+        p, err := submitApproval(ADD, bucket, quotaType, quota, admin, reason, why)
+        return "", p, err
+    }
+    return "", nil, putQuotaLocked(bucket, quotaType, quota, admin, reason)
+}
+
+
+/* 删除桶@bucket的@quotaType类型配额，持久化后同步至所有前端Nginx
+** 封禁中的桶删除限速配额后仍保持封禁
+** 返回值：false表示该配额不存在；持久化失败的原因
+*/
+func delQuota(bucket string, quotaType int, admin string, reason string) (bool, error) {
+    quotaRegistry.Lock()
+    defer quotaRegistry.Unlock()
+    if quotaRegistry.Get(bucket, quotaType) == nil {
+        return false, nil
+    }
+
+    var quota *BucketQuota
+    if quotaType == 1 {
+        quota = keepBlocked(bucket, nil)
+    }
+    return true, putQuotaLocked(bucket, quotaType, quota, admin, reason)
+}
+
+
+/* 删除桶@bucket的全部配额(报警和限速)，并从所有前端Nginx上删除限速
+** 封禁中的桶保留封禁标记
+** 返回值：false表示该桶没有任何配额；持久化失败的原因
+*/
+func delBucket(bucket string, admin string, reason string) (bool, error) {
+    quotaRegistry.Lock()
+    defer quotaRegistry.Unlock()
+    value, ok := quotaRegistry.Snapshot()[bucket]
+    if !ok {
+        return false, nil
+    }
+
+    if value[0] != nil {
+        replaceQuota(bucket, 0, nil, admin, reason)
+    }
+    if value[1] != nil {
+        replaceQuota(bucket, 1, keepBlocked(bucket, nil), admin, reason)
+    }
+    return true, updateDiskQuota()
+}
+
+
 func UpdateQuota2(w http.ResponseWriter, r *http.Request, op int ) (errMsg string, ok bool){
-    var rate int
-    var conn int
-    var qps  int
-    var ratePerConn int
+    var quota *BucketQuota
     var err  string
+    var serr error
+    var found bool
     var quotaType int
-    var quota *BucketQuota
-    var quotarray []*BucketQuota
     ok = true
-    needDel := false
     errMsg = "恭喜，设置成功！"
 
     r.ParseForm()
@@ -341,8 +587,7 @@ func UpdateQuota2(w http.ResponseWriter, r *http.Request, op int ) (errMsg strin
     // 获取配额类型,0:报警配额,1:限速配额
     quotaType = getQuotaType(r.Form.Get("Warn"))
 
-    // 如果bucketName为空，意味着是整体流量报警信息设置
-    // 需要作一些特殊处理
+    // 如果bucketName为空，意味着是整体流量的报警配额或集群容量设置
     bucket := r.Form.Get("Bucket")
     if bucket == "" {
         /*
@@ -351,110 +596,160 @@ func UpdateQuota2(w http.ResponseWriter, r *http.Request, op int ) (errMsg strin
         goto RET
         */
         bucket = "TotalStatistic"
-        quotaType = getQuotaType("true")
     }
 
-    quotarray, ok = QuotaInfo[bucket]
+    admin := r.Form.Get("Admin")
+    reason := r.Form.Get("Reason")
+
+    err = checkBucketName(bucket)
+    if err != "" {
+        errMsg = err
+        ok = false
+        goto RET
+    }
+
     switch op {
-    case RESET:
-        if !ok {
-            quotarray = make([]*BucketQuota, 2)
-            QuotaInfo[bucket] = quotarray
-            ok = true
+    case ADD:
+        quota, err = getParFromReq(r)
+        if err != "" {
+            errMsg = err
+            ok = false
+            goto RET
+        }
+        var p *PendingChange
+        err, p, serr = addQuota(bucket, quotaType, quota, admin, reason)
+        if err != "" {
+            errMsg = err
+            ok = false
+            goto RET
+        }
+        if p != nil {
+            // 新建的限速配额大幅低于继承的通配配额，需要另一位管理员审批
+            errMsg = pendingMsg(p, serr)
+            goto RET
         }
-        if quotarray[quotaType] == nil {
-            quota = new(BucketQuota)
-            quota.BucketName = bucket
-            quota.QuotaType = int64(quotaType)
-            quotarray[quotaType] = quota
+        if serr != nil {
+            errMsg = saveErrMsg(serr)
+            ok = false
+            goto RET
         }
 
-        rate, conn, qps, ratePerConn, err = getParFromReq(r)
+    case DEL:
+        // 删除限速配额需要另一位管理员审批
+        if why := needBucketApproval(bucket); why != "" {
+            errMsg = pendingMsg(submitApproval(DEL, bucket, -1, nil, admin, reason, why))
+            goto RET
+        }
+        if found, serr = delBucket(bucket, admin, reason); !found {
+            errMsg = "桶配额不存在"
+            ok = false
+            goto RET
+        }
+        if serr != nil {
+            errMsg = saveErrMsg(serr)
+            ok = false
+            goto RET
+        }
+        errMsg = "删除成功！"
+
+    case RESET:
+        quota, err = getParFromReq(r)
         if err != "" {
             errMsg = err
             ok = false
             goto RET
         }
-        quota = quotarray[quotaType]
-        quota.RateQuota   = int64(rate)
-        quota.ConnQuota   = int64(conn)
-        quota.QpsQuota    = int64(qps)
-        quota.RatePerConn = int64(ratePerConn)
-
-        // 如果设置为全0，相当于不限速，从内存限速信息中删除
-        if quotaType == 1 && rate == 0 && conn == 0 && qps == 0 && ratePerConn == 0 {
-            needDel = true
-            quotarray[1] = nil
+        // 大幅降低限速配额需要另一位管理员审批
+        if why := needApproval(bucket, quotaType, quota); why != "" {
+            errMsg = pendingMsg(submitApproval(RESET, bucket, quotaType, quota, admin, reason, why))
+            goto RET
+        }
+        if serr = setQuota(bucket, quotaType, quota, admin, reason); serr != nil {
+            errMsg = saveErrMsg(serr)
+            ok = false
+            goto RET
         }
 
     default:
         GErrorLogger.Error("Unknown operation, it should be ADD, DEL or RESET")
     }
-    // 持久化配额信息
-    updateDiskQuota()
-
-    // 如果是设置限速配额，需要更新至所有前端Nginx服务器
-    if quotaType == 1 {
-        sngx := len(Nginxs)
-        for _, v := range Nginxs {
-            // 全0就删除Nginx的限速信息
-            if needDel {
-                DelNginxLimit(v, bucket)
-            } else {
-                SetNginxLimit(v, bucket, int64(rate / sngx), int64(conn / sngx), int64(qps / sngx), int64(ratePerConn))
-            }
-        }
-    }
 
 RET:
     return;
 }
 
 
-/* 检查桶当前统计值是否超过配额，超过返回true，并返回报警信息 */
-func CheckQuota(bucket string, static_rate float64, static_conn float64, static_qps float64, qt int)(string, bool) {
-    var value *BucketQuota
-    va, ok := QuotaInfo[bucket]
+/* 检查桶当前统计值是否超过配额，超过返回true，并返回报警信息
+** 分操作QPS只在配置了对应配额时检查
+*/
+func CheckQuota(bucket string, static_rate float64, static_conn float64, bucket_qps BucketQPS, qt int)(string, bool) {
+    if !hasQuota(bucket) {
+        return "", false
+    }
+    return quotaExceeded(effectiveQuota(bucket, qt), static_rate, static_conn, bucket_qps)
+}
+
+
+/* 检查统计数据是否超过配额@value，@value为nil时使用配置文件中的报警阈值
+** 桶配额和组配额共用
+*/
+func quotaExceeded(value *BucketQuota, static_rate float64, static_conn float64, bucket_qps BucketQPS)(string, bool) {
+    static_qps := bucket_qps.QPSTotal
     compareRate, compareConn, compareQps := float64(RateAlarmThreshold), float64(ConnAlarmThreshold), float64(QpsAlarmThreshold)
-    if ok {
-        value = va[qt]
-        if value != nil {
-            compareRate = float64(value.RateQuota)
-            compareConn = float64(value.ConnQuota)
-            compareQps = float64(value.QpsQuota)
-        }
+    if value != nil {
+        compareRate = float64(value.RateQuota)
+        compareConn = float64(value.ConnQuota)
+        compareQps = float64(value.QpsQuota)
     }
 
     //fmt.Printf("Bucket: %s, Conn Quota is %d, statistic conn is %.1f\n", bucket, value.ConnQuota, static_conn)
     errMsg := ""
     over := false
-    if ok {
-        // errMsg += "Bucket"
-        // errMsg += fmt.Sprintf("<%s>", bucket)
-
-        // if value != nil && value.RateQuota > 0 && static_rate > float64(value.RateQuota) {
-        if  compareRate > 0 && static_rate > compareRate {
-            errMsg += " Rate exceeds Quota, Current"
-            errMsg += fmt.Sprintf("<%.1f>", static_rate)
-            errMsg += ",Quota:"
-            errMsg += fmt.Sprintf("<%d>", int64(compareRate))
-            over = true
-        }
-        // if value != nil && value.ConnQuota > 0 && static_conn > float64(value.ConnQuota) {
-        if compareConn > 0 && static_conn > compareConn {
-            errMsg += " Connection exceeds Quota,Current"
-            errMsg += fmt.Sprintf("<%.1f>", static_conn)
-            errMsg += ",Quota"
-            errMsg += fmt.Sprintf("<%d>", int64(compareConn))
-            over = true
+    // errMsg += "Bucket"
+    // errMsg += fmt.Sprintf("<%s>", bucket)
+
+    // if value != nil && value.RateQuota > 0 && static_rate > float64(value.RateQuota) {
+    if  compareRate > 0 && static_rate > compareRate {
+        errMsg += " Rate exceeds Quota, Current"
+        errMsg += fmt.Sprintf("<%.1f>", static_rate)
+        errMsg += ",Quota:"
+        errMsg += fmt.Sprintf("<%d>", int64(compareRate))
+        over = true
+    }
+    // if value != nil && value.ConnQuota > 0 && static_conn > float64(value.ConnQuota) {
+    if compareConn > 0 && static_conn > compareConn {
+        errMsg += " Connection exceeds Quota,Current"
+        errMsg += fmt.Sprintf("<%.1f>", static_conn)
+        errMsg += ",Quota"
+        errMsg += fmt.Sprintf("<%d>", int64(compareConn))
+        over = true
+    }
+    // if value != nil && value.QpsQuota > 0 && static_qps > float64(value.QpsQuota) {
+    if compareQps > 0 && static_qps > compareQps {
+        errMsg += " QPS exceeds Quota,Current"
+        errMsg += fmt.Sprintf("<%.1f>", static_qps)
+        errMsg += ",Quota"
+        errMsg += fmt.Sprintf("<%d>", int64(compareQps))
+        over = true
+    }
+    if value != nil {
+        opQps := []struct {
+            name    string
+            current float64
+            quota   int64
+        }{
+            {"GET",    bucket_qps.QPSGet,    value.QpsGetQuota},
+            {"PUT",    bucket_qps.QPSPut,    value.QpsPutQuota},
+            {"DELETE", bucket_qps.QPSDelete, value.QpsDeleteQuota},
+            {"LIST",   bucket_qps.QPSList,   value.QpsListQuota},
+            {"IMAGE",  bucket_qps.QPSImage,  value.QpsImageQuota},
+            {"VIDEO",  bucket_qps.QPSVideo,  value.QpsVideoQuota},
         }
-        // if value != nil && value.QpsQuota > 0 && static_qps > float64(value.QpsQuota) {
-        if compareQps > 0 && static_qps > compareQps {
-            errMsg += " QPS exceeds Quota,Current"
-            errMsg += fmt.Sprintf("<%.1f>", static_qps)
-            errMsg += ",Quota"
-            errMsg += fmt.Sprintf("<%d>", int64(compareQps))
-            over = true
+        for _, op := range opQps {
+            if op.quota > 0 && op.current > float64(op.quota) {
+                errMsg += fmt.Sprintf(" %s QPS exceeds Quota,Current<%.1f>,Quota<%d>", op.name, op.current, op.quota)
+                over = true
+            }
         }
     }
     return errMsg, over
@@ -463,83 +758,56 @@ func CheckQuota(bucket string, static_rate float64, static_conn float64, static_
 
 // 加载磁盘桶配额信息
 func loadQuota() (bool) {
-    // 按行读取桶配额
-    f, err := os.Open("./conf/quota")
-    if err != nil && !os.IsNotExist(err){
-        GErrorLogger.Error("open quota file[%s] failed: [%s]", "./conf/quota", err)
-        return true
+    var err error
+    quotaStore, err = newQuotaStore()
+    if err != nil {
+        GErrorLogger.Error("open quota store failed: [%s]", err)
+        fmt.Fprintln(os.Stderr, err)
+        return false
     }
 
-    r := bufio.NewReader(f)
-    for {
-        buf, _, err := r.ReadLine()
-        if(err == io.EOF) {
-            GLogger.Info("read quota file [%s] done", "./conf/quota")
-            break
-        }
-        if (err != nil) {
-            GErrorLogger.Error("read quota file [%s] failed: [%s]", "./conf/quota", err)
-            break
-        }
-
-        quota := new(BucketQuota)
-        err = json.Unmarshal(buf, quota)
-        if err != nil {
-            GErrorLogger.Error("Unmarshal [%s] failed: [%s]", buf, err)
-        } else {
-            qt := quota.QuotaType
-            if(qt != 0 && qt != 1) {
-                GErrorLogger.Error("Unknown Quota type: %d, Content: %s", qt, buf)
-                continue
-            }
-            qa, ok := QuotaInfo[quota.BucketName]
-            if !ok {
-                qa = make([]*BucketQuota, 2)
-                QuotaInfo[quota.BucketName] = qa
-            }
-            qa[qt] = quota
-        }
+    // 读取并校验桶配额，存储损坏时拒绝启动
+    quotas, err := quotaStore.LoadQuotas()
+    if err != nil {
+        GErrorLogger.Error("load quota failed: [%s]", err)
+        fmt.Fprintln(os.Stderr, err)
+        return false
     }
+    quotaRegistry.Load(quotas)
+    GLogger.Info("load quota from %s store done, %d quotas", QuotaStoreType, len(quotas))
 
     // 加载管理员信息
-    f, err = os.Open("./conf/admins")
+    users, err := quotaStore.LoadAdmins()
     if err != nil {
-        GErrorLogger.Error("open admin file[%s] failed: [%s]", "./conf/admins", err)
+        GErrorLogger.Error("load admins failed: [%s]", err)
         return true
     }
-
-    r = bufio.NewReader(f)
-    for {
-        buf, _, err := r.ReadLine()
-        if(err == io.EOF) {
-            GLogger.Info("read admin file [%s] done", "./conf/admins")
-            break
-        }
-        if (err != nil) {
-            GErrorLogger.Error("read admin file [%s] failed: [%s]", "./conf/admins", err)
-            break
-        }
-
-        a := new(Admin)
-        err = json.Unmarshal(buf, a)
-        if err != nil {
-            GErrorLogger.Error("Unmarshal [%s] failed: [%s]", buf, err)
-        } else {
-            admins[a.User] = a.Password
-        }
+    for user, passwd := range users {
+        admins[user] = passwd
     }
     return true
 }
 
 
 func QuotaInit() {
-    QuotaInfo = make(map[string] []*BucketQuota)
     admins    = make(map[string] string)
 
     ret := loadQuota()
     if !ret {
        panic("load quota file failed")
     }
+    loadTemplates()
+    loadHistory()
+    loadGroups()
+    loadBoosts()
+    loadApprovals()
+
+    go quotaScheduler()
+    go groupWatcher()
+    go capacityWatcher()
+    go boostWatcher()
+    go approvalWatcher()
+    go nodeDemandWatcher()
 
     http.HandleFunc("/checkLogin", checkLogin)
 }
@@ -0,0 +1,181 @@
+/* LimitServer配额注册表，替代原来没有加锁的QuotaInfo map:
+** 1. 读者通过Snapshot获取一致的只读快照，不加锁，快照内容不会被修改
+** 2. 写者通过Lock/Unlock串行化，每次修改复制一份新的map(copy-on-write)后整体替换
+** 3. 配额修改后通知订阅者，前端Nginx同步协程收到通知后立即同步，不必等待下一个周期
+** 4. 每个快照生成时建立通配配额索引，查找最长匹配的通配配额不需要遍历全部配额，见pattern.go
+** 快照中的BucketQuota只读，修改配额时必须放入新的BucketQuota
+*/
+
+package main
+
+import (
+    "sync"
+    "sync/atomic"
+)
+
+
+// 每个桶目前存在两种配额，第一用于报警，第二用于限速
+type QuotaMap map[string][]*BucketQuota
+
+
+// 不可变的配额快照
+type quotaSnapshot struct {
+    quotas    QuotaMap
+    // 每种配额类型的通配配额名，按长度从长到短排列
+    patterns  [2][]string
+}
+
+
+func newQuotaSnapshot(quotas QuotaMap) (*quotaSnapshot) {
+    s := &quotaSnapshot{quotas: quotas}
+    for qt := range s.patterns {
+        s.patterns[qt] = sortedPatterns(quotas, qt)
+    }
+    return s
+}
+
+
+type QuotaRegistry struct {
+    // 串行化写者
+    writer   sync.Mutex
+    // 当前快照，类型为*quotaSnapshot
+    current  atomic.Value
+    // 持有写锁期间发生变化的桶，解锁时统一通知订阅者
+    dirty    []string
+    subLock  sync.Mutex
+    subs     []chan string
+}
+
+
+var quotaRegistry = newQuotaRegistry()
+
+
+func newQuotaRegistry() (*QuotaRegistry) {
+    r := &QuotaRegistry{}
+    r.current.Store(newQuotaSnapshot(make(QuotaMap)))
+    return r
+}
+
+
+// 获取当前配额快照，调用者不能修改
+func (r *QuotaRegistry) Snapshot() (QuotaMap) {
+    return r.snapshot().quotas
+}
+
+
+// 获取当前配额快照及其通配配额索引
+func (r *QuotaRegistry) snapshot() (*quotaSnapshot) {
+    return r.current.Load().(*quotaSnapshot)
+}
+
+
+// 获取桶@bucket的@qt类型配额，没有时返回nil
+func (r *QuotaRegistry) Get(bucket string, qt int) (*BucketQuota) {
+    value, ok := r.Snapshot()[bucket]
+    if !ok {
+        return nil
+    }
+    return value[qt]
+}
+
+
+// 写者加锁，一次完整的配额修改(内存、持久化)必须在锁内完成
+func (r *QuotaRegistry) Lock() {
+    r.writer.Lock()
+}
+
+
+/* 写者解锁，并通知订阅者锁内发生变化的桶
+** 修改在锁内可能因持久化失败被回滚，因此不在Set时立即通知
+*/
+func (r *QuotaRegistry) Unlock() {
+    dirty := r.dirty
+    r.dirty = nil
+    r.writer.Unlock()
+    for _, bucket := range dirty {
+        r.Notify(bucket)
+    }
+}
+
+
+/* 将桶@bucket的@qt类型配额替换为@quota，nil表示删除，调用者必须持有写锁
+** 复制一份新的map修改后替换当前快照，并重建通配配额索引，解锁时通知订阅者
+*/
+func (r *QuotaRegistry) Set(bucket string, qt int, quota *BucketQuota) {
+    old := r.Snapshot()
+    next := make(QuotaMap, len(old) + 1)
+    for key, value := range old {
+        next[key] = value
+    }
+
+    quotarray := make([]*BucketQuota, 2)
+    if value, ok := old[bucket]; ok {
+        copy(quotarray, value)
+    }
+    quotarray[qt] = quota
+    if quotarray[0] == nil && quotarray[1] == nil {
+        delete(next, bucket)
+    } else {
+        next[bucket] = quotarray
+    }
+    r.current.Store(newQuotaSnapshot(next))
+    r.dirty = append(r.dirty, bucket)
+}
+
+
+// 启动时用@quotas替换全部配额，不通知订阅者
+func (r *QuotaRegistry) Load(quotas []*BucketQuota) {
+    next := make(QuotaMap)
+    for _, quota := range quotas {
+        quotarray, ok := next[quota.BucketName]
+        if !ok {
+            quotarray = make([]*BucketQuota, 2)
+            next[quota.BucketName] = quotarray
+        }
+        quotarray[quota.QuotaType] = quota
+    }
+    s := newQuotaSnapshot(next)
+    r.writer.Lock()
+    r.current.Store(s)
+    r.writer.Unlock()
+}
+
+
+/* 订阅配额变化，返回的管道中为发生变化的桶名
+** 管道满时丢弃通知，订阅者收到任意通知后应以最新快照为准
+*/
+func (r *QuotaRegistry) Subscribe() (<-chan string) {
+    ch := make(chan string, 64)
+    r.subLock.Lock()
+    r.subs = append(r.subs, ch)
+    r.subLock.Unlock()
+    return ch
+}
+
+
+// 取消订阅@ch
+func (r *QuotaRegistry) Unsubscribe(ch <-chan string) {
+    r.subLock.Lock()
+    defer r.subLock.Unlock()
+    for i, c := range r.subs {
+        if c == ch {
+            r.subs = append(r.subs[:i], r.subs[i + 1:]...)
+            return
+        }
+    }
+}
+
+
+/* 通知订阅者桶@bucket的实际生效配额发生了变化
+** 除Set外，模板修改、时间段切换等不修改注册表的变化也通过它通知
+*/
+func (r *QuotaRegistry) Notify(bucket string) {
+    r.subLock.Lock()
+    defer r.subLock.Unlock()
+    for _, ch := range r.subs {
+        select {
+        case ch <- bucket:
+        default:
+        }
+    }
+}
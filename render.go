@@ -0,0 +1,270 @@
+/* file限速后端，将限速信息渲染为Nginx配置文件并执行重载命令:
+** 1. 配置文件在http{}中include，请求的桶名需事先放在变量$limit_bucket中，例如 map $host $limit_bucket {...}
+** 2. 桶的QPS配额渲染为limit_req_zone/limit_req，连接数配额渲染为limit_conn_zone/limit_conn，
+**    单连接流量配额渲染为$limit_bucket_rate供limit_rate使用；桶流量和分操作QPS配额无法用原生指令表达，不渲染
+**    封禁的桶渲染为$limit_bucket_blocked，需在server{}中配置 if ($limit_bucket_blocked) { return 403; }
+** 3. 已生效的限速信息以json保存在配置文件同目录的<文件名>.json，读取限速信息时以此为准，
+**    重载失败时不更新，下次同步重新渲染
+** 重载命令在./conf/nginxs中配置，为空时只生成配置文件
+*/
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "sort"
+    "time"
+    "bytes"
+    "context"
+    "os/exec"
+    "hash/fnv"
+    "net/http"
+    "io/ioutil"
+    "crypto/sha1"
+    "encoding/hex"
+    "encoding/json"
+    "strings"
+)
+
+
+// 重载命令的超时时间
+const reloadTimeout = 30 * time.Second
+
+
+type fileEnforcer struct {
+    // 对应的节点地址，用于记录同步状态
+    node       string
+    path       string
+    reloadCmd  string
+}
+
+
+func (e *fileEnforcer) Kind() (string) {
+    return BACKEND_FILE
+}
+
+
+// 已生效的限速信息及其版本，文件不存在时为空
+func (e *fileEnforcer) load() (map[string]LimitData, string, error) {
+    limits := make(map[string]LimitData)
+    buf, err := ioutil.ReadFile(e.path + ".json")
+    if err != nil {
+        if os.IsNotExist(err) {
+            return limits, "", nil
+        }
+        return nil, "", err
+    }
+    list := make([]LimitData, 0)
+    if err = json.Unmarshal(buf, &list); err != nil {
+        return nil, "", err
+    }
+    for _, l := range list {
+        limits[l.BucketName] = l
+    }
+    sum := sha1.Sum(buf)
+    return limits, hex.EncodeToString(sum[:]), nil
+}
+
+
+// 先写入.new并fsync，再重命名
+func writeFileAtomic(path string, buf []byte) (error) {
+    newfile := path + ".new"
+    if err := writeFileSync(newfile, buf); err != nil {
+        return err
+    }
+    return os.Rename(newfile, path)
+}
+
+
+// nginx配置中桶@bucket使用的变量和zone名
+func zoneName(bucket string) (string) {
+    h := fnv.New64a()
+    h.Write([]byte(bucket))
+    return fmt.Sprintf("limit_bucket_%x", h.Sum64())
+}
+
+
+// 将限速信息@limits渲染为nginx配置
+func renderLimits(limits []LimitData) ([]byte) {
+    var b bytes.Buffer
+    fmt.Fprintf(&b, "# generated by LimitServer at %s, do not edit\n\n", time.Now().Format("2006-01-02 15:04:05"))
+
+    b.WriteString("map $limit_bucket $limit_bucket_rate {\n    default 0;\n")
+    for _, l := range limits {
+        if l.LimitConnRate > 0 {
+            fmt.Fprintf(&b, "    \"%s\" %d;\n", l.BucketName, l.LimitConnRate)
+        }
+    }
+    b.WriteString("}\n")
+
+    b.WriteString("map $limit_bucket $limit_bucket_blocked {\n    default 0;\n")
+    for _, l := range limits {
+        if l.LimitBlock {
+            fmt.Fprintf(&b, "    \"%s\" 1;\n", l.BucketName)
+        }
+    }
+    b.WriteString("}\n")
+
+    for _, l := range limits {
+        if l.LimitBlock || (l.LimitQps <= 0 && l.LimitConn <= 0) {
+            continue
+        }
+        zone := zoneName(l.BucketName)
+        fmt.Fprintf(&b, "\n# bucket %s\n", l.BucketName)
+        fmt.Fprintf(&b, "map $limit_bucket $%s {\n    default \"\";\n    \"%s\" $limit_bucket;\n}\n", zone, l.BucketName)
+        if l.LimitQps > 0 {
+            fmt.Fprintf(&b, "limit_req_zone $%s zone=%s_qps:1m rate=%dr/s;\n", zone, zone, l.LimitQps)
+            if l.LimitBurstQps > 0 {
+                fmt.Fprintf(&b, "limit_req zone=%s_qps burst=%d nodelay;\n", zone, l.LimitBurstQps)
+            } else {
+                fmt.Fprintf(&b, "limit_req zone=%s_qps;\n", zone)
+            }
+        }
+        if l.LimitConn > 0 {
+            fmt.Fprintf(&b, "limit_conn_zone $%s zone=%s_conn:1m;\n", zone, zone)
+            fmt.Fprintf(&b, "limit_conn %s_conn %d;\n", zone, l.LimitConn)
+        }
+    }
+    return b.Bytes()
+}
+
+
+// 桶名会出现在nginx配置的引号中，不能包含引号、空白等字符
+func renderable(bucket string) (bool) {
+    return !strings.ContainsAny(bucket, "\"\\;{} \t\n")
+}
+
+
+/* 渲染限速信息@limits、执行重载命令，成功后保存已生效的限速信息
+** 重载失败时恢复之前的配置文件，使磁盘上的配置与nginx实际生效的一致
+** 返回值：新的版本、出错原因
+*/
+func (e *fileEnforcer) apply(limits map[string]LimitData) (string, error) {
+    list := make([]LimitData, 0, len(limits))
+    for key, l := range limits {
+        if !renderable(key) {
+            GErrorLogger.Error("bucket name %s can not be rendered to nginx config", key)
+            continue
+        }
+        list = append(list, l)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].BucketName < list[j].BucketName })
+
+    prev, perr := ioutil.ReadFile(e.path)
+    if perr != nil && !os.IsNotExist(perr) {
+        return "", perr
+    }
+    if err := writeFileAtomic(e.path, renderLimits(list)); err != nil {
+        return "", err
+    }
+    if e.reloadCmd != "" {
+        ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+        defer cancel()
+        out, err := exec.CommandContext(ctx, "sh", "-c", e.reloadCmd).CombinedOutput()
+        if err != nil {
+            var rerr error
+            if perr == nil {
+                rerr = writeFileAtomic(e.path, prev)
+            } else {
+                rerr = os.Remove(e.path)
+            }
+            if rerr != nil {
+                GErrorLogger.Error("Restore nginx config %s failed: %s", e.path, rerr)
+            }
+            return "", fmt.Errorf("reload [%s] failed: %s, output: %s", e.reloadCmd, err, bytes.TrimSpace(out))
+        }
+        GLogger.Info("Nginx %s reload [%s] done", e.node, e.reloadCmd)
+    }
+
+    buf, err := json.Marshal(list)
+    if err != nil {
+        return "", err
+    }
+    if err = writeFileAtomic(e.path + ".json", buf); err != nil {
+        return "", err
+    }
+    sum := sha1.Sum(buf)
+    return hex.EncodeToString(sum[:]), nil
+}
+
+
+func (e *fileEnforcer) List(etag string) ([]LimitData, string, bool, bool) {
+    limits, cur, err := e.load()
+    if err != nil {
+        GErrorLogger.Error("Load limit file %s.json failed: %s", e.path, err)
+        recordSyncError(e.node, fmt.Sprintf("load limit file failed: %s", err))
+        return nil, "", false, false
+    }
+    if etag != "" && etag == cur {
+        return nil, cur, true, true
+    }
+    list := make([]LimitData, 0, len(limits))
+    for _, l := range limits {
+        list = append(list, l)
+    }
+    return list, cur, false, true
+}
+
+
+// 修改一个桶的限速信息后重新渲染，@l为nil时删除
+func (e *fileEnforcer) update(bucket string, l *LimitData) (int, error) {
+    limits, _, err := e.load()
+    if err == nil {
+        if l == nil {
+            delete(limits, bucket)
+        } else {
+            limits[bucket] = *l
+        }
+        _, err = e.apply(limits)
+    }
+    if err != nil {
+        GErrorLogger.Error("Render bucket %s limit to %s failed: %s", bucket, e.path, err)
+        recordSyncError(e.node, fmt.Sprintf("render bucket %s limit failed: %s", bucket, err))
+        return http.StatusInternalServerError, err
+    }
+    return http.StatusOK, nil
+}
+
+
+func (e *fileEnforcer) Set(l LimitData) (int, error) {
+    return e.update(l.BucketName, &l)
+}
+
+
+func (e *fileEnforcer) Delete(bucket string) (int, error) {
+    return e.update(bucket, nil)
+}
+
+
+// 所有修改渲染一次、重载一次
+func (e *fileEnforcer) Bulk(bulk *LimitBulk) (*LimitBulkResponse, int, error) {
+    limits, cur, err := e.load()
+    if err != nil {
+        return nil, http.StatusInternalServerError, err
+    }
+    if !bulk.Full && bulk.BaseETag != "" && bulk.BaseETag != cur {
+        return nil, http.StatusPreconditionFailed, fmt.Errorf("version %s changed to %s", bulk.BaseETag, cur)
+    }
+    if bulk.Full {
+        limits = make(map[string]LimitData)
+    }
+    resp := &LimitBulkResponse{Results: make([]LimitBulkResult, 0, len(bulk.Set) + len(bulk.Delete))}
+    for _, l := range bulk.Set {
+        if !renderable(l.BucketName) {
+            resp.Results = append(resp.Results, LimitBulkResult{BucketName: l.BucketName, Status: "bucket name can not be rendered"})
+            continue
+        }
+        limits[l.BucketName] = l
+        resp.Results = append(resp.Results, LimitBulkResult{BucketName: l.BucketName, Status: "ok"})
+    }
+    for _, key := range bulk.Delete {
+        delete(limits, key)
+        resp.Results = append(resp.Results, LimitBulkResult{BucketName: key, Status: "ok"})
+    }
+    if resp.ETag, err = e.apply(limits); err != nil {
+        recordSyncError(e.node, fmt.Sprintf("render limit file failed: %s", err))
+        return nil, http.StatusInternalServerError, err
+    }
+    return resp, http.StatusOK, nil
+}
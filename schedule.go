@@ -0,0 +1,234 @@
+/* LimitServer分时段配额模块，提供以下功能:
+** 1. 桶配额可以附加多个按星期和时刻生效的时间段配额
+** 2. 计算桶当前实际生效的配额
+** 3. 定时检查时间段切换，切换时将新的限速配额同步至所有前端Nginx
+*/
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "encoding/json"
+)
+
+
+/* 时间段配额，在时间段内替代桶的基础配额
+** 只替代设置了的配额项，为0的配额项沿用基础配额
+** 例如夜间批处理时放宽带宽: {"Name":"night","Start":"00:00","End":"06:00","RateQuota":104857600}
+*/
+type QuotaSchedule struct {
+    Name        string
+    // 生效的星期，0为周日，为空表示每天生效
+    Weekdays    []int  `json:",omitempty"`
+    // 每天生效的起止时刻，格式HH:MM，End不大于Start表示跨越午夜
+    Start       string
+    End         string
+    RateQuota   int64
+    ConnQuota   int64
+    QpsQuota    int64
+    RatePerConn int64
+}
+
+
+// 每个桶当前生效的限速时间段名，用于判断是否发生了切换
+var activeSchedules map[string]string
+
+
+// 将HH:MM转换为当天的分钟数
+func parseClock(clock string) (int, bool) {
+    t, err := time.Parse("15:04", clock)
+    if err != nil {
+        return 0, false
+    }
+    return t.Hour() * 60 + t.Minute(), true
+}
+
+
+/* 解析并检查json格式的时间段配额
+** 返回值：errMsg保存错误信息,""代表正确
+*/
+func parseSchedules(raw string) ([]QuotaSchedule, string) {
+    raw = strings.TrimSpace(raw)
+    if raw == "" {
+        return nil, ""
+    }
+
+    var schedules []QuotaSchedule
+    err := json.Unmarshal([]byte(raw), &schedules)
+    if err != nil {
+        return nil, fmt.Sprintf("时间段配额不是合法的json数组: %s", err)
+    }
+
+    for i, s := range schedules {
+        if s.Name == "" {
+            return nil, fmt.Sprintf("第%d个时间段配额缺少Name", i + 1)
+        }
+        if _, ok := parseClock(s.Start); !ok {
+            return nil, fmt.Sprintf("时间段配额%s的Start应为HH:MM格式", s.Name)
+        }
+        if _, ok := parseClock(s.End); !ok {
+            return nil, fmt.Sprintf("时间段配额%s的End应为HH:MM格式", s.Name)
+        }
+        for _, d := range s.Weekdays {
+            if d < 0 || d > 6 {
+                return nil, fmt.Sprintf("时间段配额%s的Weekdays范围为[0, 6]", s.Name)
+            }
+        }
+        if s.RateQuota < 0 || s.ConnQuota < 0 || s.QpsQuota < 0 || s.RatePerConn < 0 {
+            return nil, fmt.Sprintf("时间段配额%s的配额范围为[0, 无穷大)", s.Name)
+        }
+        if s.RateQuota == 0 && s.ConnQuota == 0 && s.QpsQuota == 0 && s.RatePerConn == 0 {
+            return nil, fmt.Sprintf("时间段配额%s至少需要设置一项配额", s.Name)
+        }
+    }
+    return schedules, ""
+}
+
+
+// 桶@bucket的时间段配额，json格式，用于WEB表单回显
+func formatSchedules(bucket string, qt int) (string) {
+    value, ok := quotaRegistry.Snapshot()[bucket]
+    if !ok || value[qt] == nil || len(value[qt].Schedules) == 0 {
+        return ""
+    }
+    b, err := json.Marshal(value[qt].Schedules)
+    if err != nil {
+        return ""
+    }
+    return string(b)
+}
+
+
+func weekdayMatch(days []int, d time.Weekday) (bool) {
+    if len(days) == 0 {
+        return true
+    }
+    for _, v := range days {
+        if time.Weekday(v) == d {
+            return true
+        }
+    }
+    return false
+}
+
+
+/* 判断时间段@s在@t时刻是否生效
+** 跨越午夜的时间段，午夜之后的部分按前一天的星期计算
+*/
+func (s *QuotaSchedule) activeAt(t time.Time) (bool) {
+    start, ok1 := parseClock(s.Start)
+    end, ok2 := parseClock(s.End)
+    if !ok1 || !ok2 {
+        return false
+    }
+    now := t.Hour() * 60 + t.Minute()
+
+    if start < end {
+        return now >= start && now < end && weekdayMatch(s.Weekdays, t.Weekday())
+    }
+    if now >= start {
+        return weekdayMatch(s.Weekdays, t.Weekday())
+    }
+    if now < end {
+        return weekdayMatch(s.Weekdays, t.AddDate(0, 0, -1).Weekday())
+    }
+    return false
+}
+
+
+// 用时间段配额@s中设置了的配额项替代@q的配额值
+func (s *QuotaSchedule) applyTo(q *BucketQuota) {
+    if s.RateQuota > 0 {
+        q.RateQuota = s.RateQuota
+    }
+    if s.ConnQuota > 0 {
+        q.ConnQuota = s.ConnQuota
+    }
+    if s.QpsQuota > 0 {
+        q.QpsQuota = s.QpsQuota
+    }
+    if s.RatePerConn > 0 {
+        q.RatePerConn = s.RatePerConn
+    }
+}
+
+
+// 配额@q在@t时刻生效的时间段，按顺序取第一个匹配的，没有返回nil
+func activeSchedule(q *BucketQuota, t time.Time) (*QuotaSchedule) {
+    if q == nil {
+        return nil
+    }
+    for i := range q.Schedules {
+        if q.Schedules[i].activeAt(t) {
+            return &q.Schedules[i]
+        }
+    }
+    return nil
+}
+
+
+/* 获取桶@bucket当前实际生效的@qt类型配额
+** 返回内存配额(或匹配的通配配额)的副本，引用模板时展开模板，
+** 处于某个时间段内时使用该时间段的配额值
+** 没有配额时返回nil
+*/
+func effectiveQuota(bucket string, qt int) (*BucketQuota) {
+    value := resolveQuota(bucket, qt)
+    if value == nil {
+        // 没有限速配额的桶在组或集群容量限速中时使用分得的配额
+        if qt == 1 {
+            return sharedLimit(bucket)
+        }
+        return nil
+    }
+
+    q := *value
+    q.BucketName = bucket
+    applyTemplate(&q)
+    if s := activeSchedule(value, time.Now()); s != nil {
+        s.applyTo(&q)
+    }
+    if qt == 1 {
+        if s := sharedLimit(bucket); s != nil {
+            mergeShare(&q, s)
+        }
+    }
+    return &q
+}
+
+
+/* 每分钟检查一次限速时间段是否切换
+** 如果切换了，通知前端Nginx同步协程同步新的限速配额
+*/
+func quotaScheduler() {
+    GLogger.Info("Start quota scheduler")
+    activeSchedules = make(map[string]string)
+    for {
+        now := time.Now()
+        info := quotaRegistry.Snapshot()
+        for key, value := range info {
+            if value[1] == nil || len(value[1].Schedules) == 0 {
+                delete(activeSchedules, key)
+                continue
+            }
+            name := ""
+            if s := activeSchedule(value[1], now); s != nil {
+                name = s.Name
+            }
+            if last, ok := activeSchedules[key]; !ok || last != name {
+                GLogger.Info("Bucket %s limit schedule switch from [%s] to [%s]", key, last, name)
+                activeSchedules[key] = name
+                quotaRegistry.Notify(key)
+            }
+        }
+        for key, _ := range activeSchedules {
+            if _, ok := info[key]; !ok {
+                delete(activeSchedules, key)
+            }
+        }
+        // 对齐到下一分钟开始
+        time.Sleep(time.Duration(60 - time.Now().Second()) * time.Second)
+    }
+}
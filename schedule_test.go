@@ -0,0 +1,156 @@
+package main
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+    "time"
+)
+
+
+func TestParseSchedules(t *testing.T) {
+    s, errMsg := parseSchedules(` [{"Name":"night","Weekdays":[1,2],"Start":"00:00","End":"06:00","RateQuota":10}] `)
+    if errMsg != "" || len(s) != 1 || s[0].Name != "night" || len(s[0].Weekdays) != 2 || s[0].RateQuota != 10 {
+        t.Fatalf("parsed %+v %s", s, errMsg)
+    }
+    if s, errMsg = parseSchedules("  "); errMsg != "" || s != nil {
+        t.Fatalf("empty input parsed %+v %s", s, errMsg)
+    }
+
+    bad := []string{
+        `{"Name":"x"}`,
+        `[{"Start":"00:00","End":"01:00","RateQuota":1}]`,
+        `[{"Name":"x","Start":"24:00","End":"01:00","RateQuota":1}]`,
+        `[{"Name":"x","Start":"00:00","End":"1am","RateQuota":1}]`,
+        `[{"Name":"x","Weekdays":[7],"Start":"00:00","End":"01:00","RateQuota":1}]`,
+        `[{"Name":"x","Start":"00:00","End":"01:00","QpsQuota":-1}]`,
+        `[{"Name":"x","Start":"00:00","End":"01:00"}]`,
+    }
+    for _, raw := range bad {
+        if _, errMsg := parseSchedules(raw); errMsg == "" {
+            t.Errorf("%s should fail", raw)
+        }
+    }
+}
+
+
+func TestScheduleActiveAt(t *testing.T) {
+    // 2026-10-19为周一
+    at := func(day int, clock string) (time.Time) {
+        tm, _ := time.Parse("2006-01-02 15:04", "2026-10-19 " + clock)
+        return tm.AddDate(0, 0, day)
+    }
+
+    day := QuotaSchedule{Name: "day", Start: "09:00", End: "18:00", Weekdays: []int{1, 2, 3, 4, 5}}
+    night := QuotaSchedule{Name: "night", Start: "22:00", End: "06:00", Weekdays: []int{5}}
+    cases := []struct {
+        s      QuotaSchedule
+        t      time.Time
+        active bool
+    }{
+        {day, at(0, "09:00"), true},
+        {day, at(0, "17:59"), true},
+        {day, at(0, "18:00"), false},
+        {day, at(0, "08:59"), false},
+        {day, at(5, "12:00"), false},
+        // 周五22点开始，跨越午夜的部分按周五计算
+        {night, at(4, "21:59"), false},
+        {night, at(4, "22:00"), true},
+        {night, at(5, "05:59"), true},
+        {night, at(5, "06:00"), false},
+        {night, at(5, "23:00"), false},
+        {night, at(4, "03:00"), false},
+    }
+    for i, c := range cases {
+        if got := c.s.activeAt(c.t); got != c.active {
+            t.Errorf("case %d: %s at %s = %v, want %v", i, c.s.Name, c.t.Format("Mon 15:04"), got, c.active)
+        }
+    }
+
+    // 没有Weekdays表示每天生效
+    always := QuotaSchedule{Name: "always", Start: "00:00", End: "00:00"}
+    for d := 0; d < 7; d++ {
+        if !always.activeAt(at(d, "12:34")) {
+            t.Errorf("all-day schedule inactive on day %d", d)
+        }
+    }
+}
+
+
+// 时间段只替代设置了的配额项，按顺序取第一个匹配的时间段
+func TestActiveScheduleApply(t *testing.T) {
+    q := &BucketQuota{RateQuota: 100, ConnQuota: 10, QpsQuota: 5, Schedules: []QuotaSchedule{
+        {Name: "first", Start: "00:00", End: "00:00", RateQuota: 1000},
+        {Name: "second", Start: "00:00", End: "00:00", QpsQuota: 50},
+    }}
+    s := activeSchedule(q, time.Now())
+    if s == nil || s.Name != "first" {
+        t.Fatalf("active schedule is %+v", s)
+    }
+
+    quotaRegistry.Lock()
+    quotaRegistry.Set("sched", 1, q)
+    quotaRegistry.Unlock()
+    defer clearBucket("sched")
+    e := effectiveQuota("sched", 1)
+    if e.RateQuota != 1000 || e.ConnQuota != 10 || e.QpsQuota != 5 {
+        t.Fatalf("effective quota is %+v", e)
+    }
+    if q.RateQuota != 100 {
+        t.Fatal("effectiveQuota modified the stored quota")
+    }
+    rate, _, _, _, name := GetQuota("sched", 1)
+    if rate != 1000 || name != "first" {
+        t.Fatalf("GetQuota returned %d %s", rate, name)
+    }
+    if effectiveQuota("sched", 0) != nil || activeSchedule(nil, time.Now()) != nil {
+        t.Fatal("missing quota should have no effective value")
+    }
+}
+
+
+// 只有时间段配额的限速配额不能被当作不限速删除
+func TestScheduleOnlyLimit(t *testing.T) {
+    defer clearBucket("sched-only")
+    body := `{"Rate": 0, "Connection": 0, "QPS": 0, "RatePerConn": 0,
+              "Schedules": [{"Name": "burst", "Start": "00:00", "End": "00:00", "RateQuota": 4096}]}`
+    w := callApi(apiBucketQuota, "alice", "PUT", "/api/v1/buckets/sched-only/quota/limit", body)
+    if w.Code != 200 || !strings.Contains(w.Body.String(), `"Name":"burst"`) {
+        t.Fatalf("PUT: got %d %s", w.Code, w.Body.String())
+    }
+    if e := effectiveQuota("sched-only", 1); e == nil || e.RateQuota != 4096 {
+        t.Fatalf("effective quota is %+v", e)
+    }
+
+    w = callApi(apiBucketQuota, "alice", "PUT", "/api/v1/buckets/sched-only/quota/limit",
+                `{"Rate": 0, "Connection": 0, "QPS": 0, "RatePerConn": 0, "Schedules": [{"Name": "bad"}]}`)
+    if w.Code != 400 || quotaRegistry.Get("sched-only", 1).Schedules[0].Name != "burst" {
+        t.Fatalf("bad schedule: got %d %s", w.Code, w.Body.String())
+    }
+}
+
+
+func TestScheduleBulkRoundTrip(t *testing.T) {
+    emptyQuotas(t)
+
+    q := testQuota(100, 0, 0, 0)
+    q.Schedules = []QuotaSchedule{{Name: "n", Weekdays: []int{0, 6}, Start: "23:00", End: "01:00", ConnQuota: 9}}
+    setQuota("bulk-sched", 1, q, "alice", "")
+
+    var buf bytes.Buffer
+    exportQuota(&buf, "csv")
+    quotas, errMsg := parseImportQuota(&buf, "csv")
+    if errMsg != "" || len(quotas) != 1 {
+        t.Fatalf("parsed %v %s", quotas, errMsg)
+    }
+    s := quotas[0].Schedules
+    if len(s) != 1 || s[0].Name != "n" || s[0].ConnQuota != 9 || len(s[0].Weekdays) != 2 {
+        t.Fatalf("schedules lost in csv: %+v", s)
+    }
+
+    // 没有Schedules列的旧格式仍然可以导入
+    quotas, errMsg = parseImportQuota(strings.NewReader("a,1,1,0,0,0\n"), "csv")
+    if errMsg != "" || len(quotas) != 1 || quotas[0].Schedules != nil {
+        t.Fatalf("old csv parsed %v %s", quotas, errMsg)
+    }
+}
@@ -0,0 +1,362 @@
+/* LimitServer限速配额模拟，收紧桶的限速之前评估会影响多少流量:
+** 1. 将拟设置的限速配额在桶的历史统计数据上回放，历史数据来自内存中的ringmap，
+**    或者开启PushStatDB时来自PostgreSQL的stat_buckets表
+** 2. 统计流量、连接数、QPS(包括分操作QPS)各有多少个统计窗口超过配额，以及超出的幅度
+** 3. 在plotinum图上叠加拟设置的配额曲线
+** WEB页面为/simulate，API为POST /api/v1/buckets/{name}/simulate
+*/
+
+package main
+
+import (
+    "fmt"
+    "html"
+    "time"
+    "strings"
+    "strconv"
+    "net/url"
+    "net/http"
+    "code.google.com/p/plotinum/plot"
+    "code.google.com/p/plotinum/plotter"
+    "code.google.com/p/plotinum/plotutil"
+)
+
+
+// 一个统计窗口的历史数据
+type simSample struct {
+    TimeStamp  int64
+    Rate       float64
+    Conn       float64
+    Qps        BucketQPS
+}
+
+
+// 单项配额的模拟结果
+type SimItem struct {
+    Name        string
+    // 有配额限制的窗口数和超过配额的窗口数
+    Limited     int
+    Exceeded    int
+    // 超出配额部分的最大值和平均值(按超过配额的窗口平均)
+    MaxExcess   float64
+    AvgExcess   float64
+    // 超出配额部分占总量的比例，即会被限速的比例
+    ExcessRatio float64
+}
+
+
+type SimResult struct {
+    BucketName  string
+    Source      string
+    Windows     int
+    Start       int64
+    End         int64
+    Items       []SimItem
+}
+
+
+// 模拟的各项配额：名称、是否为可选配额、统计值、@q中对应的配额值
+var simFields = []struct {
+    Name      string
+    optional  bool
+    stat      func(s *simSample) float64
+    quota     func(q *BucketQuota) int64
+}{
+    {"Rate",       false, func(s *simSample) float64 { return s.Rate },         func(q *BucketQuota) int64 { return q.RateQuota }},
+    {"Connection", false, func(s *simSample) float64 { return s.Conn },         func(q *BucketQuota) int64 { return q.ConnQuota }},
+    {"QPS",        false, func(s *simSample) float64 { return s.Qps.QPSTotal }, func(q *BucketQuota) int64 { return q.QpsQuota }},
+    {"GET QPS",    true,  func(s *simSample) float64 { return s.Qps.QPSGet },   func(q *BucketQuota) int64 { return q.QpsGetQuota }},
+    {"PUT QPS",    true,  func(s *simSample) float64 { return s.Qps.QPSPut },   func(q *BucketQuota) int64 { return q.QpsPutQuota }},
+    {"DELETE QPS", true,  func(s *simSample) float64 { return s.Qps.QPSDelete },func(q *BucketQuota) int64 { return q.QpsDeleteQuota }},
+    {"LIST QPS",   true,  func(s *simSample) float64 { return s.Qps.QPSList },  func(q *BucketQuota) int64 { return q.QpsListQuota }},
+    {"IMAGE QPS",  true,  func(s *simSample) float64 { return s.Qps.QPSImage }, func(q *BucketQuota) int64 { return q.QpsImageQuota }},
+    {"VIDEO QPS",  true,  func(s *simSample) float64 { return s.Qps.QPSVideo }, func(q *BucketQuota) int64 { return q.QpsVideoQuota }},
+}
+
+
+// 从ringmap中取出桶@bucket的历史数据，按时间先后排列
+func ringSamples(bucket string) ([]simSample) {
+    samples := make([]simSample, 0)
+    rwLocker.RLock()
+    defer rwLocker.RUnlock()
+
+    ringBuffer, ok := ringmap[bucket]
+    if !ok {
+        return samples
+    }
+    ringBuffer.Do(func(p interface{}) {
+        if p != nil {
+            bs := p.(*BucketStatistic)
+            samples = append(samples, simSample{TimeStamp: bs.TimeStamp, Rate: bs.StatisticBucketRate,
+                                                Conn: bs.StatisticBucketConnMax, Qps: bs.StatisticBucketQps})
+        }
+    })
+    return samples
+}
+
+
+/* 从stat_buckets表中取出桶@bucket最近@hours小时的历史数据
+** items数组的顺序与PgInsert写入时一致
+*/
+func dbSamples(bucket string, hours int) ([]simSample, string) {
+    if !Needpush || !DBInit || dbins == nil {
+        return nil, "PushStatDB未开启，没有数据库中的历史数据"
+    }
+    since := time.Now().Add(-time.Duration(hours) * time.Hour).Unix()
+    rows, err := dbins.Query("SELECT stat_time, items::text FROM stat_buckets WHERE bucket_name = $1 AND stat_time >= $2 ORDER BY stat_time", bucket, since)
+    if err != nil {
+        return nil, fmt.Sprintf("query stat_buckets failed: %s", err)
+    }
+    defer rows.Close()
+
+    samples := make([]simSample, 0)
+    for rows.Next() {
+        var stime int64
+        var raw string
+        if err = rows.Scan(&stime, &raw); err != nil {
+            return nil, fmt.Sprintf("scan stat_buckets failed: %s", err)
+        }
+        fields := strings.Split(strings.Trim(raw, "{}"), ",")
+        if len(fields) < 11 {
+            continue
+        }
+        var items [11]float64
+        for i := 0; i < 11; i++ {
+            items[i], _ = strconv.ParseFloat(fields[i], 64)
+        }
+        samples = append(samples, simSample{TimeStamp: stime, Rate: items[0], Conn: items[2],
+                                            Qps: BucketQPS{QPSTotal: items[3], QPSTotalFailed: items[4],
+                                                           QPSGet: items[5], QPSPut: items[6], QPSDelete: items[7],
+                                                           QPSList: items[8], QPSVideo: items[9], QPSImage: items[10]}})
+    }
+    return samples, ""
+}
+
+
+// 配额@quota在@ts时刻生效的配额值，考虑模板和时间段配额
+func quotaAt(quota *BucketQuota, ts int64) (*BucketQuota) {
+    q := *quota
+    applyTemplate(&q)
+    if s := activeSchedule(quota, time.Unix(ts, 0)); s != nil {
+        s.applyTo(&q)
+    }
+    return &q
+}
+
+
+// 将限速配额@quota在历史数据@samples上回放
+func simulateQuota(bucket string, source string, quota *BucketQuota, samples []simSample) (*SimResult) {
+    res := &SimResult{BucketName: bucket, Source: source, Windows: len(samples), Items: make([]SimItem, 0)}
+    if len(samples) > 0 {
+        res.Start = samples[0].TimeStamp
+        res.End   = samples[len(samples) - 1].TimeStamp
+    }
+
+    quotas := make([]*BucketQuota, len(samples))
+    for i := range samples {
+        quotas[i] = quotaAt(quota, samples[i].TimeStamp)
+    }
+
+    for _, f := range simFields {
+        item := SimItem{Name: f.Name}
+        total, excess := 0.0, 0.0
+        for i := range samples {
+            limit := f.quota(quotas[i])
+            if limit <= 0 {
+                continue
+            }
+            item.Limited++
+            v := f.stat(&samples[i])
+            total += v
+            if v > float64(limit) {
+                e := v - float64(limit)
+                item.Exceeded++
+                excess += e
+                if e > item.MaxExcess {
+                    item.MaxExcess = e
+                }
+            }
+        }
+        // 没有设置的分操作配额不展示
+        if item.Limited == 0 && f.optional {
+            continue
+        }
+        if item.Exceeded > 0 {
+            item.AvgExcess = excess / float64(item.Exceeded)
+        }
+        if total > 0 {
+            item.ExcessRatio = excess / total
+        }
+        res.Items = append(res.Items, item)
+    }
+    return res
+}
+
+
+// 在统计曲线上叠加拟设置的配额曲线，保存为@save_as
+func drawSimulate(bucket string, name string, quota *BucketQuota, samples []simSample, save_as string) {
+    var field int
+    for i, f := range simFields {
+        if f.Name == name {
+            field = i
+        }
+    }
+    f := simFields[field]
+
+    p, _ := plot.New()
+    p.Title.Text = bucket + " " + name + " Simulate"
+    p.X.Label.Text = "time line"
+    p.Y.Label.Text = name
+
+    ptsStatistic := make(plotter.XYs, len(samples))
+    ptsProposed  := make(plotter.XYs, len(samples))
+    for i := range samples {
+        ptsStatistic[i].X = float64(i)
+        ptsProposed[i].X  = float64(i)
+        ptsStatistic[i].Y = f.stat(&samples[i])
+        ptsProposed[i].Y  = float64(f.quota(quotaAt(quota, samples[i].TimeStamp)))
+    }
+
+    // 桶已有限速配额时同时画出当前配额，便于对比
+    if current := resolveQuota(bucket, 1); current != nil {
+        ptsCurrent := make(plotter.XYs, len(samples))
+        for i := range samples {
+            ptsCurrent[i].X = float64(i)
+            ptsCurrent[i].Y = float64(f.quota(quotaAt(current, samples[i].TimeStamp)))
+        }
+        plotutil.AddLinePoints(p,
+            "Statistic", ptsStatistic,
+            "Current", ptsCurrent,
+            "Proposed", ptsProposed)
+    } else {
+        plotutil.AddLinePoints(p,
+            "Statistic", ptsStatistic,
+            "Proposed", ptsProposed)
+    }
+    p.Add(plotter.NewGrid())
+    if err := p.Save(6, 4, save_as); err != nil {
+        GErrorLogger.Error("Save %s fail: %s", save_as, err)
+    }
+}
+
+
+/* 从@form中解析模拟参数并执行模拟
+** Source为ring(默认)或db，Hours为从数据库回放的小时数，默认24
+*/
+func runSimulate(bucket string, form url.Values) (*SimResult, *BucketQuota, []simSample, string) {
+    if bucket == "" || bucket == "TotalStatistic" || isPattern(bucket) {
+        return nil, nil, nil, "需要指定一个具体的桶"
+    }
+    form.Del("Warn")
+    quota, errMsg := getParFromForm(form)
+    if errMsg != "" {
+        return nil, nil, nil, errMsg
+    }
+    quota.BucketName = bucket
+    quota.QuotaType  = 1
+
+    source := form.Get("Source")
+    var samples []simSample
+    switch source {
+    case "", "ring":
+        source = "ring"
+        samples = ringSamples(bucket)
+    case "db":
+        hours, err := strconv.Atoi(form.Get("Hours"))
+        if err != nil || hours <= 0 {
+            hours = 24
+        }
+        samples, errMsg = dbSamples(bucket, hours)
+        if errMsg != "" {
+            return nil, nil, nil, errMsg
+        }
+    default:
+        return nil, nil, nil, "Source应为ring或db"
+    }
+    if len(samples) == 0 {
+        return nil, nil, nil, "桶" + bucket + "没有历史统计数据"
+    }
+    return simulateQuota(bucket, source, quota, samples), quota, samples, ""
+}
+
+
+// 限速配额模拟WEB页面，GET展示表单，POST展示模拟结果和叠加图
+func handlerSimulate(w http.ResponseWriter, r *http.Request) {
+    r.ParseForm()
+    name := strings.TrimSpace(r.Form.Get("Bucket"))
+    if name == "" {
+        name = r.Form.Get("name")
+    }
+
+    result := ""
+    if r.Method == "POST" {
+        res, quota, samples, errMsg := runSimulate(name, r.Form)
+        if errMsg != "" {
+            result = "<p>" + html.EscapeString(errMsg) + "</p>"
+        } else {
+            lines := ""
+            for _, item := range res.Items {
+                lines += fmt.Sprintf(`<tr><td>%s</td><td>%d</td><td>%d</td><td>%.1f</td><td>%.1f</td><td>%.2f%%</td></tr>`,
+                                     item.Name, item.Limited, item.Exceeded, item.MaxExcess, item.AvgExcess, item.ExcessRatio * 100)
+            }
+            drawSimulate(name, "Rate", quota, samples, "sim_rate.png")
+            drawSimulate(name, "Connection", quota, samples, "sim_conn.png")
+            drawSimulate(name, "QPS", quota, samples, "sim_qps.png")
+            url := "http://" + Host + ":" + FileListenPort
+            result = fmt.Sprintf(`<p>Source: %s, Windows: %d, %s ~ %s</p>
+                <table border=1>
+                <tr><td>Item</td><td>Limited</td><td>Exceeded</td><td>MaxExcess</td><td>AvgExcess</td><td>ExcessRatio</td></tr>
+                %s
+                </table>
+                <table border=0><tr>
+                <td><img src="%s/sim_rate.png"></td><td><img src="%s/sim_conn.png"></td>
+                </tr><tr><td><img src="%s/sim_qps.png"></td></tr></table>`,
+                res.Source, res.Windows, time.Unix(res.Start, 0).Format("2006-01-02 15:04:05"),
+                time.Unix(res.End, 0).Format("2006-01-02 15:04:05"), lines, url, url, url)
+        }
+    }
+
+    fmt.Fprintf(w, `<html><head><meta charset=utf-8></head><body>
+        <p><b>限速配额模拟</b></p>
+        <form action="/simulate" method="post">
+        <table border=0>
+        <tr><td>Bucket</td><td><input type="text" name="Bucket" value="%s"></input></td></tr>
+        <tr><td>Rate(B/s)</td><td><input type="text" name="Rate"></input></td></tr>
+        <tr><td>QPS</td><td><input type="text" name="QPS"></input></td></tr>
+        <tr><td>Connection</td><td><input type="text" name="Connection"></input></td></tr>
+        <tr><td>RatePerConn(B/s)</td><td><input type="text" name="RatePerConn"></input></td></tr>
+        %s
+        <tr><td>Template</td><td><input type="text" name="Template"></input></td></tr>
+        <tr><td>Schedules(json)</td><td><textarea name="Schedules" rows="4" cols="60"></textarea></td></tr>
+        <tr><td>Source</td><td><select name="Source"><option value="ring">ring</option><option value="db">db</option></select></td></tr>
+        <tr><td>Hours(db)</td><td><input type="text" name="Hours" value="24"></input></td></tr>
+        <tr><td><input type="submit" value="Simulate"></input></td></tr>
+        </table>
+        </form>
+        %s
+        </body></html>`, html.EscapeString(name), optionalInputs("", 1), result)
+}
+
+
+// POST /api/v1/buckets/{name}/simulate
+func apiBucketSimulate(w http.ResponseWriter, r *http.Request, bucket string) {
+    if r.Method != "POST" {
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only POST is allowed")
+        return
+    }
+    if _, ok := apiAuth(w, r); !ok {
+        return
+    }
+
+    form, errMsg := getFormFromBody(r)
+    if errMsg != "" {
+        writeApiError(w, http.StatusBadRequest, "MalformedJson", errMsg)
+        return
+    }
+    res, _, _, errMsg := runSimulate(bucket, form)
+    if errMsg != "" {
+        writeApiError(w, http.StatusBadRequest, "InvalidArgument", errMsg)
+        return
+    }
+    writeJson(w, http.StatusOK, res)
+}
@@ -8,11 +8,13 @@ package main
 import (
 	"fmt"
     "net"
+    "html"
 	"time"
     "sort"
     "sync"
     "syscall"
     "strconv"
+	"net/url"
 	"net/http"
 	"encoding/json"
 	"container/ring"
@@ -328,7 +330,7 @@ func init_stat_windows(bucketStatistic *BucketStatistic) {
 
             // 检查流量是否超过报警阈值，如果是，根据配置发送报警
             errMsg, over := CheckQuota(key, value.StatisticBucketRate, value.StatisticBucketConnMax,
-                                             value.StatisticBucketQps.QPSTotal, 0)
+                                             value.StatisticBucketQps, 0)
             if over {
                 SendWarn("Bucket: " + key + errMsg)
             }
@@ -384,6 +386,8 @@ func window_go_forward() (bool) {
     stime := time.Unix(ts, 0).Format("2006-01-02 15:04:05")
     LastUpdate = time.Now()
 
+    // 同时累加组内成员桶的数据，用于组配额报警和限速
+    groups := newGroupWindow()
     for key, value := range windows[gPrev].windowData {
         if value.reportServerNum == 0 {
             continue
@@ -434,11 +438,12 @@ func window_go_forward() (bool) {
 
         // 检查流量是否超过报警阈值，如果是，根据配置发送报警
         errMsg, over := CheckQuota(key, value.StatisticBucketRate, value.StatisticBucketConnMax,
-                                         value.StatisticBucketQps.QPSTotal, 0)
+                                         value.StatisticBucketQps, 0)
         if over {
             SendWarn("Bucket: " + key + errMsg)
             // SendWarn(errMsg)
         }
+        groups.add(key, value)
 
         value.TimeStamp  = 0
         value.StatisticBucketRate = 0
@@ -457,6 +462,7 @@ func window_go_forward() (bool) {
         value.reportServerNum = 0
         value.reportDone = false
     }
+    groups.finish()
 
     // 时间窗口向前滑动
     oldCurrts := windows[gCurr].TimeStamp
@@ -522,7 +528,7 @@ func updateTotalStatistic(bucketStatistic BucketStatistic) {
     }
 
     // 更新完成后应该要检查是否超过报警阈值，如果是，则需要报警
-    errMsg, over := CheckQuota("TotalStatistic", curRate, curConn, curQps, 0)
+    errMsg, over := CheckQuota("TotalStatistic", curRate, curConn, BucketQPS{QPSTotal: curQps}, 0)
     if over {
         SendWarn("NOS Total" + errMsg)
     }
@@ -610,7 +616,9 @@ func ringManager(UDPRingChan chan BucketStatistic) {
     var bucketStat       *BucketState = nil
 
 	GLogger.Info("Start ringManager")
+    rwLocker.Lock()
 	ringmap = make(map[string]*ring.Ring)
+    rwLocker.Unlock()
 
     // 使用第一个统计数据作为时间窗口的初始值
     bucketStatistic = <-UDPRingChan
@@ -658,6 +666,8 @@ func ringManager(UDPRingChan chan BucketStatistic) {
         if res == false {
             continue
         }
+        // 记录桶在该节点上的需求，用于按节点分配限速配额
+        recordNodeDemand(&bucketStatistic)
 MEM_UP:
         // 更新内存统计数据之前需要加写锁
         // 更新完成后再释放
@@ -970,6 +980,7 @@ func handlerBucket(w http.ResponseWriter, r *http.Request) {
     rwLocker.RUnlock()
     url := "http://" + Host + ":" + FileListenPort
     if name != "TotalStatistic" {
+        fmt.Fprintf(w, "%s", blockNotice(name))
         fmt.Fprintf(w, `<table border=0><tr>
             <td><a href="bucket rate" target=_blank><img src="%s/bucket_rate.png"></td>
             <td><a href="bucket conn" target=_blank><img src="%s/bucket_conn.png"></td>
@@ -987,6 +998,7 @@ func handlerBucket(w http.ResponseWriter, r *http.Request) {
             <td><a href="bucket qps_video" target=_blank><img src="%s/bucket_qps_video.png"></td>
             </tr>
             </table>`, url, url, url, url, url, url, url, url, url, url)
+        fmt.Fprintf(w, "%s", nodeSplitTable(name))
         } else {
           fmt.Fprintf(w, `<table border=0><tr>
             <td><a href="bucket rate" target=_blank><img src="%s/bucket_rate.png"></td>
@@ -1055,19 +1067,42 @@ func sortByRate(b []string) (sorted []string) {
 }
 
 
+/* 最近@seconds秒内有统计数据的活跃桶
+** 返回值：桶名到最后一次统计时间的映射
+*/
+func activeBuckets(seconds float64) (map[string]time.Time) {
+    active := make(map[string]time.Time)
+    rwLocker.RLock()
+    for key, value := range ringmap {
+        ringBuffer := value.Prev()
+        if ringBuffer.Value == nil {
+            continue
+        }
+        ts := (ringBuffer.Value).(*BucketStatistic).GetTimeStamp()
+        lastUpdate := time.Unix(ts, 0)
+        if time.Since(lastUpdate).Seconds() < seconds {
+            active[key] = lastUpdate
+        }
+    }
+    rwLocker.RUnlock()
+    return active
+}
+
+
+// 桶名作为链接参数时转义，handlerAll中url为局部变量
+func queryEscape(s string) (string) {
+    return url.QueryEscape(s)
+}
+
+
 func handlerAll(w http.ResponseWriter, r *http.Request) {
 	var line, lines, out string
 
     outer := make(map[string]string)
 
     // 只展示5分钟内活跃的桶
-    for key, value := range ringmap {
-        ringBuffer := value.Prev()
-        ts := (ringBuffer.Value).(*BucketStatistic).GetTimeStamp()
-        lastUpdate := time.Unix(ts, 0)
-        if time.Since(lastUpdate).Seconds() < 300 {
-            outer[key] = lastUpdate.Format("15:04")
-        }
+    for key, lastUpdate := range activeBuckets(300) {
+        outer[key] = lastUpdate.Format("15:04")
     }
 
     bucketName := make([]string, 0)
@@ -1095,36 +1130,62 @@ func handlerAll(w http.ResponseWriter, r *http.Request) {
 
     lastUpdate := time.Unix(t, 0).Format("15:04")
 
-    tRateQ, tConnQ, tQpsQ , _:= GetQuota("TotalStatistic", 0)
+    tRateQ, tConnQ, tQpsQ , _, _:= GetQuota("TotalStatistic", 0)
     stRateQ := strconv.FormatInt(tRateQ, 10)
     stConnQ := strconv.FormatInt(tConnQ, 10)
     stQpsQ := strconv.FormatInt(tQpsQ, 10)
-    lines = fmt.Sprintf(`<p><a href=%s/bucket?name=%s>%s</a> Update %s <a href=%s/quota?warn=true&name=%s&rate=%s&conn=%s&qps=%s>%s </p>`, url, key, key, lastUpdate, url, key, stRateQ, stConnQ, stQpsQ, "WarnQuota")
+    cRateQ, cConnQ, cQpsQ , _, _:= GetQuota("TotalStatistic", 1)
+    lines = fmt.Sprintf(`<p><a href=%s/bucket?name=%s>%s</a> Update %s <a href=%s/quota?warn=true&name=%s&rate=%s&conn=%s&qps=%s>%s </a><a href=%s/quota?limit=true&name=%s&rate=%d&conn=%d&qps=%d>%s </a><a href=%s/history?name=%s>%s</a></p>`, url, key, key, lastUpdate, url, key, stRateQ, stConnQ, stQpsQ, "WarnQuota", url, key, cRateQ, cConnQ, cQpsQ, "Capacity", url, key, "History")
 
 
     // 展示每个桶的流量等统计信息
     for _, key := range bucketName {
         value, _ := outer[key]
-        rateQuota, connQuota, qpsQuota, connRate := GetQuota(key, 0)
+        rateQuota, connQuota, qpsQuota, connRate, wSchedule := GetQuota(key, 0)
         swRate := strconv.FormatInt(rateQuota, 10)
         swConn := strconv.FormatInt(connQuota, 10)
         swQps  := strconv.FormatInt(qpsQuota,  10)
         swconnRate  := strconv.FormatInt(connRate,  10)
 
-        rateQuota, connQuota, qpsQuota, connRate = GetQuota(key, 1)
+        rateQuota, connQuota, qpsQuota, connRate, lSchedule := GetQuota(key, 1)
         slRate := strconv.FormatInt(rateQuota, 10)
         slConn := strconv.FormatInt(connQuota, 10)
         slQps  := strconv.FormatInt(qpsQuota,  10)
         slconnRate  := strconv.FormatInt(connRate,  10)
 
+        // 当前处于时间段配额内时，展示时间段名
+        warnText, limitText := "WarnQuota", "LimitQuota"
+        if wSchedule != "" {
+            warnText += "(" + html.EscapeString(wSchedule) + ")"
+        }
+        if lSchedule != "" {
+            limitText += "(" + html.EscapeString(lSchedule) + ")"
+        }
+
+        // 有限速配额时展示当前限速值和令牌桶参数
+        limitInfo := ""
+        if l := effectiveQuota(key, 1); l != nil {
+            limitInfo = fmt.Sprintf("<a>  Limit Rate:%d Conn:%d QPS:%d", l.RateQuota, l.ConnQuota, l.QpsQuota)
+            if l.RateBurst > 0 || l.QpsBurst > 0 {
+                limitInfo += fmt.Sprintf(" Burst Rate:%d QPS:%d Refill:%dms", l.RateBurst, l.QpsBurst, l.RefillInterval)
+            }
+            limitInfo += "</a>"
+            if l.Blocked {
+                limitInfo = `<b style="color:red">  BLOCKED</b>`
+            }
+        }
+
+        // 桶名来自API，输出前转义
+        qkey, hkey := queryEscape(key), html.EscapeString(key)
         url := "http://" + Host + ":" + HttpPort
 
-        line = fmt.Sprintf(`<p><a href=%s/bucket?name=%s>%s</a><a>  Update %s</a>  <a href=%s/quota?warn=true&name=%s&rate=%s&conn=%s&qps=%s&connrate=%s>%s  </a><a href=%s/quota?limit=true&name=%s&rate=%s&conn=%s&qps=%s&connrate=%s>%s</a></p>`, url, key, key, value, url, key, swRate, swConn, swQps, swconnRate, "WarnQuota", url, key, slRate, slConn, slQps, slconnRate, "LimitQuota")
+        line = fmt.Sprintf(`<p><a href=%s/bucket?name=%s>%s</a><a>  Update %s</a>  <a href=%s/quota?warn=true&name=%s&rate=%s&conn=%s&qps=%s&connrate=%s>%s  </a><a href=%s/quota?limit=true&name=%s&rate=%s&conn=%s&qps=%s&connrate=%s>%s  </a><a href=%s/history?name=%s>%s</a>%s</p>`, url, qkey, hkey, value, url, qkey, swRate, swConn, swQps, swconnRate, warnText, url, qkey, slRate, slConn, slQps, slconnRate, limitText, url, qkey, "History", limitInfo)
 		lines += line
     }
 
 	active := fmt.Sprintf("<p><b>当前(5分钟)活跃桶数量 %d</b></p>", len(bucketName))
-	out = "<html><body>" + active + "<p><b>点击查看详情<b></p>" + lines + "</body></html>"
+	manage := fmt.Sprintf(`<p><a href=%s/templates>Templates</a> <a href=%s/groups>Groups</a> <a href=%s/nginxs>Nginxs</a> <a href=%s/sync>Sync</a> <a href=%s/boosts>Boosts</a> <a href=%s/blocks>Blocks</a> <a href=%s/simulate>Simulate</a> <a href=%s/approvals>Approvals(%d)</a></p>`, url, url, url, url, url, url, url, url, approvalCount())
+	out = "<html><body>" + active + manage + blockSummary() + capacitySummary() + boostSummary() + "<p><b>点击查看详情<b></p>" + lines + "</body></html>"
 	fmt.Fprintf(w, out)
 }
 
@@ -1147,6 +1208,28 @@ func HttpServer() {
 	http.HandleFunc("/all", handlerAll)
 	http.HandleFunc("/bucket", handlerBucket)
 	http.HandleFunc("/quota", QuotaSet)
+	http.HandleFunc("/api/v1/buckets", apiListQuota)
+	http.HandleFunc("/api/v1/buckets/", apiBucketQuota)
+	http.HandleFunc("/history", handlerHistory)
+	http.HandleFunc("/templates", handlerTemplates)
+	http.HandleFunc("/api/v1/templates", apiTemplates)
+	http.HandleFunc("/api/v1/templates/", apiTemplates)
+	http.HandleFunc("/api/v1/quotas", apiBulkQuota)
+	http.HandleFunc("/groups", handlerGroups)
+	http.HandleFunc("/api/v1/groups", apiGroups)
+	http.HandleFunc("/api/v1/groups/", apiGroups)
+	http.HandleFunc("/nginxs", handlerNginxs)
+	http.HandleFunc("/api/v1/nginxs", apiNginxs)
+	http.HandleFunc("/api/v1/nginxs/", apiNginxs)
+	http.HandleFunc("/sync", handlerSync)
+	http.HandleFunc("/api/v1/sync", apiSync)
+	http.HandleFunc("/api/v1/sync/", apiSync)
+	http.HandleFunc("/boosts", handlerBoosts)
+	http.HandleFunc("/blocks", handlerBlocks)
+	http.HandleFunc("/simulate", handlerSimulate)
+	http.HandleFunc("/approvals", handlerApprovals)
+	http.HandleFunc("/api/v1/approvals", apiApprovals)
+	http.HandleFunc("/api/v1/approvals/", apiApprovals)
     port := ":" + HttpPort
     err := http.ListenAndServe(port, nil)
     if err != nil {
@@ -0,0 +1,257 @@
+/* LimitServer配额存储，配额和管理员信息可以保存在以下两种存储中，由limit.conf中的QuotaStore选择:
+** 1. file: ./conf/quota和./conf/admins文件(默认)
+** 2. postgres: PostgreSQL的limit_quotas和limit_admins表，连接串由QuotaStoreDSN指定，没有默认值
+** 每次配额修改产生的变更在一个事务中写入存储，写入失败时内存配额回滚至修改前
+** 注意：存储只在启动时加载，运行中不会读取其它LimitServer写入的变更；修改历史、待审批变更、
+** 模板、组和临时提额仍保存在本地./conf下。多个LimitServer共用同一个数据库时只能有一个接受修改，
+** 其它实例需要重启才能看到修改，不能作为多活的共享配额后端
+*/
+
+package main
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "time"
+    "bufio"
+    "database/sql"
+    "encoding/json"
+)
+
+
+// 一次配额变更，Old/New为nil表示变更前/后没有该配额，Admin/Reason用于写入成功后记录修改历史
+type QuotaChange struct {
+    BucketName  string
+    QuotaType   int
+    Old         *BucketQuota
+    New         *BucketQuota
+    Admin       string
+    Reason      string
+}
+
+
+type QuotaStore interface {
+    // 加载全部配额
+    LoadQuotas() ([]*BucketQuota, error)
+    // 加载管理员，key为用户名，value为密码
+    LoadAdmins() (map[string]string, error)
+    // 在一个事务中写入配额变更，失败时存储保持不变
+    SaveQuotas(changes []QuotaChange) (error)
+}
+
+
+var quotaStore QuotaStore
+
+// 尚未写入存储的配额变更，由updateDiskQuota统一提交，受注册表写锁保护
+var pendingChanges []QuotaChange
+
+
+// 根据配置创建配额存储
+func newQuotaStore() (QuotaStore, error) {
+    switch QuotaStoreType {
+    case "", "file":
+        return &fileQuotaStore{}, nil
+    case "postgres":
+        return newPgQuotaStore(QuotaStoreDSN)
+    }
+    return nil, fmt.Errorf("unknown QuotaStore %s, it should be file or postgres", QuotaStoreType)
+}
+
+
+// 记录一次内存配额变更，等待提交
+func addPendingChange(bucket string, quotaType int, old *BucketQuota, new *BucketQuota, admin string, reason string) {
+    pendingChanges = append(pendingChanges, QuotaChange{BucketName: bucket, QuotaType: quotaType, Old: old, New: new,
+                                                        Admin: admin, Reason: reason})
+}
+
+
+/* 将尚未提交的配额变更写入配额存储，调用者必须持有注册表写锁
+** 写入成功后为每个变更记录修改历史，写入失败时将内存配额回滚至变更前并报警
+** 返回值：写入失败的原因，nil代表成功
+*/
+func updateDiskQuota() (error) {
+    changes := pendingChanges
+    pendingChanges = nil
+
+    err := quotaStore.SaveQuotas(changes)
+    if err == nil {
+        for _, c := range changes {
+            recordRevision(c.BucketName, c.QuotaType, c.Old, c.New, c.Admin, c.Reason)
+        }
+        return nil
+    }
+
+    for i := len(changes) - 1; i >= 0; i-- {
+        quotaRegistry.Set(changes[i].BucketName, changes[i].QuotaType, changes[i].Old)
+    }
+    GErrorLogger.Error("save %d quota changes failed, rolled back: [%s]", len(changes), err)
+    SendWarn(fmt.Sprintf("LimitServer save quota failed, %d changes rolled back: %s", len(changes), err))
+    return err
+}
+
+
+// 配额写入存储失败时展示给管理员的出错信息
+func saveErrMsg(err error) (string) {
+    return fmt.Sprintf("保存配额失败，修改已撤销: %s", err)
+}
+
+
+// 文件配额存储，每次提交重写整个配额文件
+type fileQuotaStore struct {
+}
+
+
+func (s *fileQuotaStore) LoadQuotas() ([]*BucketQuota, error) {
+    quotas, errMsg := readQuotaFile()
+    if errMsg != "" {
+        return nil, fmt.Errorf("%s", errMsg)
+    }
+    return quotas, nil
+}
+
+
+func (s *fileQuotaStore) LoadAdmins() (map[string]string, error) {
+    users := make(map[string]string)
+    f, err := os.Open("./conf/admins")
+    if err != nil {
+        GErrorLogger.Error("open admin file[%s] failed: [%s]", "./conf/admins", err)
+        return users, nil
+    }
+    defer f.Close()
+
+    r := bufio.NewReader(f)
+    for {
+        buf, _, err := r.ReadLine()
+        if(err == io.EOF) {
+            GLogger.Info("read admin file [%s] done", "./conf/admins")
+            break
+        }
+        if (err != nil) {
+            GErrorLogger.Error("read admin file [%s] failed: [%s]", "./conf/admins", err)
+            break
+        }
+
+        a := new(Admin)
+        err = json.Unmarshal(buf, a)
+        if err != nil {
+            GErrorLogger.Error("Unmarshal [%s] failed: [%s]", buf, err)
+        } else {
+            users[a.User] = a.Password
+        }
+    }
+    return users, nil
+}
+
+
+// 文件写入本身是原子的，内存配额已包含全部变更
+func (s *fileQuotaStore) SaveQuotas(changes []QuotaChange) (error) {
+    return writeQuotaFile()
+}
+
+
+// PostgreSQL配额存储
+type pgQuotaStore struct {
+    db  *sql.DB
+}
+
+
+func newPgQuotaStore(dsn string) (*pgQuotaStore, error) {
+    if dsn == "" {
+        return nil, fmt.Errorf("QuotaStoreDSN must be configured for postgres quota store")
+    }
+    db, err := sql.Open("postgres", dsn)
+    if err != nil {
+        return nil, err
+    }
+    _, err = db.Exec(`CREATE TABLE IF NOT EXISTS limit_quotas(bucket_name text NOT NULL, quota_type int NOT NULL,
+                      quota text NOT NULL, update_time bigint NOT NULL, PRIMARY KEY(bucket_name, quota_type))`)
+    if err == nil {
+        _, err = db.Exec(`CREATE TABLE IF NOT EXISTS limit_admins(name text PRIMARY KEY, password text NOT NULL)`)
+    }
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return &pgQuotaStore{db: db}, nil
+}
+
+
+func (s *pgQuotaStore) LoadQuotas() ([]*BucketQuota, error) {
+    rows, err := s.db.Query("SELECT bucket_name, quota_type, quota FROM limit_quotas")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    quotas := make([]*BucketQuota, 0)
+    for rows.Next() {
+        var name, raw string
+        var qt int64
+        if err = rows.Scan(&name, &qt, &raw); err != nil {
+            return nil, err
+        }
+        quota := new(BucketQuota)
+        if err = json.Unmarshal([]byte(raw), quota); err != nil {
+            return nil, fmt.Errorf("unmarshal quota of bucket %s type %d failed: %s", name, qt, err)
+        }
+        if qt != 0 && qt != 1 {
+            return nil, fmt.Errorf("unknown quota type %d of bucket %s", qt, name)
+        }
+        quota.BucketName = name
+        quota.QuotaType  = qt
+        quotas = append(quotas, quota)
+    }
+    return quotas, rows.Err()
+}
+
+
+func (s *pgQuotaStore) LoadAdmins() (map[string]string, error) {
+    rows, err := s.db.Query("SELECT name, password FROM limit_admins")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    users := make(map[string]string)
+    for rows.Next() {
+        var name, passwd string
+        if err = rows.Scan(&name, &passwd); err != nil {
+            return nil, err
+        }
+        users[name] = passwd
+    }
+    return users, rows.Err()
+}
+
+
+func (s *pgQuotaStore) SaveQuotas(changes []QuotaChange) (error) {
+    if len(changes) == 0 {
+        return nil
+    }
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+
+    now := time.Now().Unix()
+    for _, c := range changes {
+        if c.New == nil {
+            _, err = tx.Exec("DELETE FROM limit_quotas WHERE bucket_name = $1 AND quota_type = $2",
+                             c.BucketName, c.QuotaType)
+        } else {
+            var b []byte
+            b, err = json.Marshal(c.New)
+            if err == nil {
+                _, err = tx.Exec(`INSERT INTO limit_quotas(bucket_name, quota_type, quota, update_time) VALUES($1, $2, $3, $4)
+                                  ON CONFLICT (bucket_name, quota_type) DO UPDATE SET quota = EXCLUDED.quota, update_time = EXCLUDED.update_time`,
+                                 c.BucketName, c.QuotaType, string(b), now)
+            }
+        }
+        if err != nil {
+            tx.Rollback()
+            return fmt.Errorf("bucket %s type %d: %s", c.BucketName, c.QuotaType, err)
+        }
+    }
+    return tx.Commit()
+}
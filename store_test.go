@@ -0,0 +1,51 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+)
+
+
+func TestNewQuotaStore(t *testing.T) {
+    oldType, oldDSN := QuotaStoreType, QuotaStoreDSN
+    defer func() { QuotaStoreType, QuotaStoreDSN = oldType, oldDSN }()
+
+    QuotaStoreType, QuotaStoreDSN = "postgres", ""
+    if _, err := newQuotaStore(); err == nil {
+        t.Error("postgres store without DSN should fail")
+    }
+    QuotaStoreType = "mysql"
+    if _, err := newQuotaStore(); err == nil {
+        t.Error("unknown store type should fail")
+    }
+    QuotaStoreType = ""
+    if s, err := newQuotaStore(); err != nil || s == nil {
+        t.Errorf("default store: %v", err)
+    }
+}
+
+
+// 写入存储失败时内存配额回滚，且不记录修改历史
+func TestSaveFailureRollback(t *testing.T) {
+    defer clearBucket("store-fail")
+    setQuota("store-fail", 1, testQuota(100, 0, 0, 0), "alice", "")
+    revs := len(getBucketHistory("store-fail"))
+
+    restore := breakFile(t, quotaFile + ".new")
+    err := setQuota("store-fail", 1, testQuota(200, 0, 0, 0), "alice", "")
+    if err == nil {
+        t.Fatal("setQuota should fail")
+    }
+    w := callApi(apiBucketQuota, "alice", "PUT", "/api/v1/buckets/store-fail/quota/warn", `{"Rate": 1, "Connection": 0, "QPS": 0}`)
+    if w.Code != http.StatusInternalServerError {
+        t.Fatalf("PUT: got %d %s", w.Code, w.Body.String())
+    }
+    restore()
+
+    if quotaRegistry.Get("store-fail", 1).RateQuota != 100 || quotaRegistry.Get("store-fail", 0) != nil {
+        t.Fatalf("quota not rolled back: %+v", quotaRegistry.Snapshot()["store-fail"])
+    }
+    if len(getBucketHistory("store-fail")) != revs {
+        t.Fatal("failed change was recorded in history")
+    }
+}
@@ -0,0 +1,374 @@
+/* LimitServer前端Nginx同步状态:
+** 1. 内存中记录每个Nginx最近一次成功获取配额列表的时间、最近的错误、连续失败次数、
+**    最近一次下发的耗时，以及与期望配额不一致的桶和差异
+** 2. 通过/api/v1/sync接口和/sync页面查看，便于定位哪个Nginx上的配额与QuotaInfo不一致及原因
+** 3. 记录最近一次的同步计划；删除数量超过SyncMaxDeletes的计划需要管理员在页面或接口上确认后才会执行删除
+** 节点被删除时清除其同步状态
+*/
+
+package main
+
+import (
+    "fmt"
+    "html"
+    "sort"
+    "sync"
+    "time"
+    "strings"
+    "net/http"
+    "encoding/json"
+)
+
+
+// 一个桶在Nginx上的限速信息与期望值的差异，为nil表示不存在
+type LimitDiff struct {
+    BucketName  string
+    Nginx       *LimitData
+    Desired     *LimitData
+}
+
+
+// 一次同步的计划，均为桶名
+type SyncPlan struct {
+    Time     int64
+    DryRun   bool
+    // Nginx上没有的桶、与期望不同的桶、需要删除的桶
+    Add      []string
+    Update   []string
+    Delete   []string
+    // 超过SyncMaxDeletes且未经确认而暂不执行的删除
+    Blocked  []string
+}
+
+
+type NginxSyncStatus struct {
+    Addr           string
+    Backend        string
+    // 最近一次成功获取配额列表(包括304)的时间
+    LastList       int64
+    // 最近一次Nginx上的配额与期望完全一致的时间
+    LastSync       int64
+    LastError      string
+    LastErrorTime  int64
+    // 连续获取配额列表失败的次数
+    ContFailed     int
+    // 最近一次下发的耗时(毫秒)及下发时间
+    PushLatencyMs  int64
+    LastPush       int64
+    Bulk           bool
+    ETag           string
+    // 投递队列中等待重试的操作数
+    Pending        int
+    OutOfSync      []LimitDiff
+    // 最近一次与期望不一致时的同步计划，一致时为nil
+    Plan           *SyncPlan
+    // 管理员确认可以删除的桶
+    confirmed      map[string]bool
+}
+
+
+var syncStatusLock sync.Mutex
+var syncStatus = make(map[string]*NginxSyncStatus)
+
+
+// 启动同步协程时创建节点@server的同步状态，调用者必须持有fleetLock
+func initSyncStatus(server string) {
+    syncStatusLock.Lock()
+    defer syncStatusLock.Unlock()
+    syncStatus[server] = &NginxSyncStatus{Addr: server, Bulk: true, OutOfSync: make([]LimitDiff, 0)}
+}
+
+
+// 节点被删除时清除同步状态，调用者必须持有fleetLock
+func delSyncStatus(server string) {
+    syncStatusLock.Lock()
+    defer syncStatusLock.Unlock()
+    delete(syncStatus, server)
+}
+
+
+// 在持有锁的情况下修改节点@server的同步状态，节点已被删除时不做修改
+func updateSyncStatus(server string, f func(s *NginxSyncStatus)) {
+    syncStatusLock.Lock()
+    defer syncStatusLock.Unlock()
+    if s, ok := syncStatus[server]; ok {
+        f(s)
+    }
+}
+
+
+// 记录与Nginx @server交互时的错误
+func recordSyncError(server string, msg string) {
+    updateSyncStatus(server, func(s *NginxSyncStatus) {
+        s.LastError = msg
+        s.LastErrorTime = time.Now().Unix()
+    })
+}
+
+
+/* 记录获取配额列表的结果
+** 返回值：连续失败次数
+*/
+func recordListResult(server string, ok bool) (int) {
+    failed := 0
+    updateSyncStatus(server, func(s *NginxSyncStatus) {
+        if ok {
+            s.LastList = time.Now().Unix()
+            s.ContFailed = 0
+        } else {
+            s.ContFailed++
+        }
+        failed = s.ContFailed
+    })
+    return failed
+}
+
+
+// 记录一次下发的耗时
+func recordPushLatency(server string, d time.Duration) {
+    updateSyncStatus(server, func(s *NginxSyncStatus) {
+        s.PushLatencyMs = int64(d / time.Millisecond)
+        s.LastPush = time.Now().Unix()
+    })
+}
+
+
+// 按期望配额@desired与Nginx上已知的配额记录不一致的桶
+func recordSyncDiff(server string, st *nodeSyncState, desired map[string]LimitData) {
+    diffs := make([]LimitDiff, 0)
+    for key, v := range desired {
+        if a, ok := st.applied[key]; !ok || a != v {
+            d := LimitDiff{BucketName: key, Desired: new(LimitData)}
+            *d.Desired = v
+            if ok {
+                d.Nginx = new(LimitData)
+                *d.Nginx = a
+            }
+            diffs = append(diffs, d)
+        }
+    }
+    for key, a := range st.applied {
+        if _, ok := desired[key]; !ok {
+            d := LimitDiff{BucketName: key, Nginx: new(LimitData)}
+            *d.Nginx = a
+            diffs = append(diffs, d)
+        }
+    }
+    sort.Slice(diffs, func(i, j int) bool { return diffs[i].BucketName < diffs[j].BucketName })
+
+    updateSyncStatus(server, func(s *NginxSyncStatus) {
+        s.OutOfSync = diffs
+        s.Backend = st.enforcer.Kind()
+        s.Bulk = st.bulk
+        s.ETag = st.etag
+        s.Pending = len(st.queue.ops)
+        if len(diffs) == 0 {
+            s.LastSync = time.Now().Unix()
+            s.Plan = nil
+        }
+    })
+}
+
+
+/* 记录同步计划@plan
+** 返回值：上一次的计划中是否已经有被拦截的删除
+*/
+func recordSyncPlan(server string, plan *SyncPlan) (bool) {
+    blocked := false
+    updateSyncStatus(server, func(s *NginxSyncStatus) {
+        blocked = s.Plan != nil && len(s.Plan.Blocked) > 0
+        s.Plan = plan
+    })
+    return blocked
+}
+
+
+/* 管理员确认执行节点@server当前计划中被拦截的删除
+** 返回值：""代表成功，否则为出错原因
+*/
+func confirmDeletes(server string, admin string) (string) {
+    errMsg := "Nginx " + server + "没有待确认的删除"
+    updateSyncStatus(server, func(s *NginxSyncStatus) {
+        if s.Plan == nil || len(s.Plan.Blocked) == 0 {
+            return
+        }
+        s.confirmed = make(map[string]bool)
+        for _, key := range s.Plan.Blocked {
+            s.confirmed[key] = true
+        }
+        errMsg = ""
+    })
+    if errMsg != "" {
+        return errMsg
+    }
+    GLogger.Info("Admin %s confirm deleting limits from nginx %s", admin, server)
+    quotaRegistry.Notify("")
+    return ""
+}
+
+
+// 需要删除的桶@del是否都经过管理员确认，确认只生效一次
+func deletesConfirmed(server string, del []string) (bool) {
+    ok := false
+    updateSyncStatus(server, func(s *NginxSyncStatus) {
+        if s.confirmed == nil {
+            return
+        }
+        ok = true
+        for _, key := range del {
+            if !s.confirmed[key] {
+                ok = false
+            }
+        }
+        s.confirmed = nil
+    })
+    return ok
+}
+
+
+// 按地址排序的所有节点同步状态副本
+func syncStatusList() ([]NginxSyncStatus) {
+    syncStatusLock.Lock()
+    defer syncStatusLock.Unlock()
+    list := make([]NginxSyncStatus, 0, len(syncStatus))
+    for _, s := range syncStatus {
+        list = append(list, *s)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+    return list
+}
+
+
+func formatUnix(t int64) (string) {
+    if t == 0 {
+        return "-"
+    }
+    return time.Unix(t, 0).Format("2006-01-02 15:04:05")
+}
+
+
+func limitJson(l *LimitData) (string) {
+    if l == nil {
+        return "-"
+    }
+    b, _ := json.Marshal(l)
+    return string(b)
+}
+
+
+// Nginx同步状态页面，展示每个节点的同步情况和不一致的桶，POST确认被拦截的删除
+func handlerSync(w http.ResponseWriter, r *http.Request) {
+    if r.Method == "POST" {
+        r.ParseForm()
+        user := r.Form.Get("Admin")
+        passwd := r.Form.Get("Password")
+        value, find := admins[user]
+        errMsg := ""
+        if user == "" || passwd == "" {
+            errMsg = "用户名或密码不能为空"
+        } else if !find || value != passwd {
+            errMsg = "非管理员登陆"
+        } else {
+            errMsg = confirmDeletes(strings.TrimSpace(r.Form.Get("Addr")), user)
+        }
+        if errMsg == "" {
+            errMsg = "OK!"
+        }
+        fmt.Fprintf(w, `<html><head><meta charset=utf-8><meta http-equiv="refresh" content="2; url=http://%s:%s/sync" /></head><body>%s</body></html>`, Host, HttpPort, html.EscapeString(errMsg))
+        return
+    }
+
+    lines := ""
+    diffs := ""
+    plans := ""
+    for _, s := range syncStatusList() {
+        if p := s.Plan; p != nil {
+            plans += fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%v</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>`, html.EscapeString(s.Addr), formatUnix(p.Time), p.DryRun,
+                                 html.EscapeString(strings.Join(p.Add, " ")), html.EscapeString(strings.Join(p.Update, " ")),
+                                 html.EscapeString(strings.Join(p.Delete, " ")), html.EscapeString(strings.Join(p.Blocked, " ")))
+        }
+        lines += fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%d</td><td>%s</td><td>%s %s</td><td>%v</td><td>%s</td><td>%d</td></tr>`,
+                             html.EscapeString(s.Addr), html.EscapeString(s.Backend), formatUnix(s.LastList), formatUnix(s.LastSync), s.ContFailed, len(s.OutOfSync),
+                             formatUnix(s.LastPush) + fmt.Sprintf(" %dms", s.PushLatencyMs), formatUnix(s.LastErrorTime),
+                             html.EscapeString(s.LastError), s.Bulk, html.EscapeString(s.ETag), s.Pending)
+        for _, d := range s.OutOfSync {
+            diffs += fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>`, html.EscapeString(s.Addr), html.EscapeString(d.BucketName),
+                                 html.EscapeString(limitJson(d.Nginx)), html.EscapeString(limitJson(d.Desired)))
+        }
+    }
+    fmt.Fprintf(w, `<html><head><meta charset=utf-8></head><body>
+        <p><b>Nginx同步状态</b></p>
+        <table border=1>
+        <tr><td>Nginx</td><td>Backend</td><td>Last List</td><td>Last In Sync</td><td>Failed</td><td>Out Of Sync</td><td>Last Push</td><td>Last Error</td><td>Bulk</td><td>ETag</td><td>Pending</td></tr>
+        %s
+        </table>
+        <p><b>同步计划</b></p>
+        <table border=1>
+        <tr><td>Nginx</td><td>Time</td><td>DryRun</td><td>Add</td><td>Update</td><td>Delete</td><td>Blocked Delete</td></tr>
+        %s
+        </table>
+        <form action="/sync" method="post">
+        <table border=0>
+        <tr><td>确认删除(超过%d个)</td><td>Nginx</td><td><input type="text" name="Addr"></input></td></tr>
+        <tr><td></td><td>Admin</td><td><input type="text" name="Admin"></input></td></tr>
+        <tr><td></td><td>Password</td><td><input type="password" name="Password"></input></td></tr>
+        <tr><td></td><td><input type="submit" value="Confirm"></input></td></tr>
+        </table>
+        </form>
+        <p><b>不一致的桶</b></p>
+        <table border=1>
+        <tr><td>Nginx</td><td>Bucket</td><td>On Nginx</td><td>Desired</td></tr>
+        %s
+        </table></body></html>`, lines, plans, SyncMaxDeletes, diffs)
+}
+
+
+/* Nginx同步状态API:
+** GET  /api/v1/sync                 所有节点的同步状态
+** GET  /api/v1/sync/{addr}          某个节点的同步状态
+** POST /api/v1/sync/{addr}/confirm  确认执行该节点计划中被拦截的删除
+*/
+func apiSync(w http.ResponseWriter, r *http.Request) {
+    addr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/sync"), "/")
+    if strings.HasSuffix(addr, "/confirm") {
+        addr = strings.TrimSuffix(addr, "/confirm")
+        if r.Method != "POST" {
+            writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only POST is allowed")
+            return
+        }
+        admin, ok := apiAuth(w, r)
+        if !ok {
+            return
+        }
+        if errMsg := confirmDeletes(addr, admin); errMsg != "" {
+            writeApiError(w, http.StatusConflict, "NothingToConfirm", errMsg)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    if strings.Contains(addr, "/") {
+        writeApiError(w, http.StatusNotFound, "NotFound", "unknown api path " + r.URL.Path)
+        return
+    }
+    if r.Method != "GET" {
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET is allowed")
+        return
+    }
+    if _, ok := apiAuth(w, r); !ok {
+        return
+    }
+
+    list := syncStatusList()
+    if addr == "" {
+        writeJson(w, http.StatusOK, list)
+        return
+    }
+    for _, s := range list {
+        if s.Addr == addr {
+            writeJson(w, http.StatusOK, s)
+            return
+        }
+    }
+    writeApiError(w, http.StatusNotFound, "NoSuchNginx", "no nginx " + addr)
+}
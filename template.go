@@ -0,0 +1,456 @@
+/* LimitServer配额模板模块，提供以下功能:
+** 1. 定义命名的配额模板(如standard、premium)，桶配额可以引用模板
+** 2. 修改模板后，所有引用该模板的桶在一次同步中更新至所有前端Nginx
+** 3. 通过WEB页面和API管理模板，修改和删除模板记录在配额修改历史中
+** 模板以json格式保存在./conf/templates，每个模板一行
+*/
+
+package main
+
+import (
+    "io"
+    "bytes"
+    "os"
+    "fmt"
+    "html"
+    "sort"
+    "bufio"
+    "sync"
+    "strings"
+    "net/url"
+    "net/http"
+    "encoding/json"
+)
+
+
+const templateFile = "./conf/templates"
+
+
+type QuotaTemplate struct {
+    Name        string
+    RateQuota   int64
+    ConnQuota   int64
+    QpsQuota    int64
+    RatePerConn int64
+    QpsGetQuota    int64  `json:",omitempty"`
+    QpsPutQuota    int64  `json:",omitempty"`
+    QpsDeleteQuota int64  `json:",omitempty"`
+    QpsListQuota   int64  `json:",omitempty"`
+    QpsImageQuota  int64  `json:",omitempty"`
+    QpsVideoQuota  int64  `json:",omitempty"`
+    RateBurst      int64  `json:",omitempty"`
+    QpsBurst       int64  `json:",omitempty"`
+    RefillInterval int64  `json:",omitempty"`
+    Weight         int64  `json:",omitempty"`
+    Priority       int64  `json:",omitempty"`
+}
+
+
+/* 全部配额模板，key为模板名，由templateLock保护
+** 修改模板时整体替换为新的QuotaTemplate，通过getTemplate取出的模板只读
+*/
+var quotaTemplates map[string]*QuotaTemplate
+var templateLock sync.RWMutex
+
+
+// 获取模板@name
+func getTemplate(name string) (*QuotaTemplate, bool) {
+    templateLock.RLock()
+    defer templateLock.RUnlock()
+    t, ok := quotaTemplates[name]
+    return t, ok
+}
+
+
+// 按模板名排序的全部模板
+func sortedTemplates() ([]*QuotaTemplate) {
+    templateLock.RLock()
+    list := make([]*QuotaTemplate, 0, len(quotaTemplates))
+    for _, t := range quotaTemplates {
+        list = append(list, t)
+    }
+    templateLock.RUnlock()
+    sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    return list
+}
+
+
+// 加载磁盘配额模板
+func loadTemplates() {
+    templateLock.Lock()
+    defer templateLock.Unlock()
+    quotaTemplates = make(map[string]*QuotaTemplate)
+
+    f, err := os.Open(templateFile)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            GErrorLogger.Error("open template file[%s] failed: [%s]", templateFile, err)
+        }
+        return
+    }
+    defer f.Close()
+
+    r := bufio.NewReader(f)
+    for {
+        buf, _, err := r.ReadLine()
+        if(err == io.EOF) {
+            GLogger.Info("read template file [%s] done", templateFile)
+            break
+        }
+        if (err != nil) {
+            GErrorLogger.Error("read template file [%s] failed: [%s]", templateFile, err)
+            break
+        }
+
+        t := new(QuotaTemplate)
+        err = json.Unmarshal(buf, t)
+        if err != nil {
+            GErrorLogger.Error("Unmarshal [%s] failed: [%s]", buf, err)
+        } else {
+            quotaTemplates[t.Name] = t
+        }
+    }
+}
+
+
+/* 持久化配额模板，先写入templates.new并fsync再重命名，调用者必须持有templateLock写锁
+** 返回值：持久化失败的原因
+*/
+func updateDiskTemplates() (error) {
+    var data bytes.Buffer
+    for key, t := range quotaTemplates {
+        b, err := json.Marshal(t)
+        if err != nil {
+            GErrorLogger.Error("json Marshal template[%s]failed: [%s]", key, err)
+            return err
+        }
+        data.Write(append(b, '\n'))
+    }
+
+    newfile := templateFile + ".new"
+    err := writeFileSync(newfile, data.Bytes())
+    if err == nil {
+        err = os.Rename(newfile, templateFile)
+    }
+    if err != nil {
+        GErrorLogger.Error("save template file [%s] failed: [%s]", templateFile, err)
+    }
+    return err
+}
+
+
+/* 将配额@q引用的模板和覆盖项展开到配额值中
+** 模板不存在时保留@q自身的配额值
+*/
+func applyTemplate(q *BucketQuota) {
+    if q.Template == "" {
+        return
+    }
+    t, ok := getTemplate(q.Template)
+    if !ok {
+        GErrorLogger.Error("Bucket %s references unknown template %s", q.BucketName, q.Template)
+        return
+    }
+    t.applyTo(q)
+}
+
+
+// 将模板@t和@q的覆盖项展开到配额@q中
+func (t *QuotaTemplate) applyTo(q *BucketQuota) {
+    q.RateQuota   = t.RateQuota
+    q.ConnQuota   = t.ConnQuota
+    q.QpsQuota    = t.QpsQuota
+    q.RatePerConn = t.RatePerConn
+    q.QpsGetQuota    = t.QpsGetQuota
+    q.QpsPutQuota    = t.QpsPutQuota
+    q.QpsDeleteQuota = t.QpsDeleteQuota
+    q.QpsListQuota   = t.QpsListQuota
+    q.QpsImageQuota  = t.QpsImageQuota
+    q.QpsVideoQuota  = t.QpsVideoQuota
+    q.RateBurst      = t.RateBurst
+    q.QpsBurst       = t.QpsBurst
+    q.RefillInterval = t.RefillInterval
+    q.Weight         = t.Weight
+    q.Priority       = t.Priority
+    for key, v := range q.Overrides {
+        if p := quotaFieldPtr(q, key); p != nil {
+            *p = v
+        }
+    }
+}
+
+
+// 桶@bucket的@qt类型配额引用的模板名，用于WEB表单回显
+func bucketTemplate(bucket string, qt int) (string) {
+    value, ok := quotaRegistry.Snapshot()[bucket]
+    if !ok || value[qt] == nil {
+        return ""
+    }
+    return value[qt].Template
+}
+
+
+// 引用模板@name的桶，@qt为-1时不区分配额类型
+func templateBuckets(name string, qt int) ([]string) {
+    buckets := make([]string, 0)
+    for key, value := range quotaRegistry.Snapshot() {
+        for i, v := range value {
+            if v != nil && v.Template == name && (qt == -1 || qt == i) {
+                buckets = append(buckets, key)
+                break
+            }
+        }
+    }
+    sort.Strings(buckets)
+    return buckets
+}
+
+
+/* 新建或修改模板@t，大幅降低被限速桶引用的模板配额时提交待审批变更，否则立即生效
+** 返回值：待审批变更，nil表示已生效；受影响的限速桶数量；持久化失败的原因
+*/
+func setTemplate(t *QuotaTemplate, admin string, reason string) (*PendingChange, int, error) {
+    if why := needTemplateApproval(t); why != "" {
+        p, err := submitTemplateApproval(t, admin, reason, why)
+        return p, 0, err
+    }
+    n, err := putTemplate(t, admin, reason)
+    return nil, n, err
+}
+
+
+/* 保存模板@t，记录修改历史，并将引用该模板的桶限速同步至所有前端Nginx
+** 返回值：受影响的限速桶数量；持久化失败的原因，此时内存中的模板已回滚
+*/
+func putTemplate(t *QuotaTemplate, admin string, reason string) (int, error) {
+    templateLock.Lock()
+    old, ok := quotaTemplates[t.Name]
+    quotaTemplates[t.Name] = t
+    if err := updateDiskTemplates(); err != nil {
+        if ok {
+            quotaTemplates[t.Name] = old
+        } else {
+            delete(quotaTemplates, t.Name)
+        }
+        templateLock.Unlock()
+        return 0, err
+    }
+    templateLock.Unlock()
+    GLogger.Info("Admin %s set template %s: Rate:%d Conn:%d QPS:%d RatePerConn:%d", admin, t.Name,
+                 t.RateQuota, t.ConnQuota, t.QpsQuota, t.RatePerConn)
+    recordTemplateRevision(t.Name, old, t, admin, reason)
+
+    // 通知同步所有引用该模板的限速桶
+    buckets := templateBuckets(t.Name, 1)
+    for _, b := range buckets {
+        quotaRegistry.Notify(b)
+    }
+    return len(buckets), nil
+}
+
+
+/* 删除模板@name，仍被桶引用时失败
+** 返回值：""代表成功，否则为出错原因；持久化失败的原因，此时模板未删除
+*/
+func delTemplate(name string, admin string, reason string) (string, error) {
+    templateLock.Lock()
+    defer templateLock.Unlock()
+    old, ok := quotaTemplates[name]
+    if !ok {
+        return "配额模板" + name + "不存在", nil
+    }
+    if buckets := templateBuckets(name, -1); len(buckets) > 0 {
+        return fmt.Sprintf("配额模板%s仍被%d个桶引用: %s", name, len(buckets), strings.Join(buckets, ",")), nil
+    }
+    delete(quotaTemplates, name)
+    if err := updateDiskTemplates(); err != nil {
+        quotaTemplates[name] = old
+        return "", err
+    }
+    GLogger.Info("Admin %s delete template %s", admin, name)
+    recordTemplateRevision(name, old, nil, admin, reason)
+    return "", nil
+}
+
+
+// 从@form中解析模板配额，检查逻辑与桶配额相同
+func getTemplateFromForm(name string, form url.Values) (*QuotaTemplate, string) {
+    if name == "" {
+        return nil, "模板名不能为空"
+    }
+    form.Del("Template")
+    form.Del("Warn")
+    quota, errMsg := getParFromForm(form)
+    if errMsg != "" {
+        return nil, errMsg
+    }
+    return &QuotaTemplate{Name: name, RateQuota: quota.RateQuota, ConnQuota: quota.ConnQuota,
+                          QpsQuota: quota.QpsQuota, RatePerConn: quota.RatePerConn,
+                          QpsGetQuota: quota.QpsGetQuota, QpsPutQuota: quota.QpsPutQuota,
+                          QpsDeleteQuota: quota.QpsDeleteQuota, QpsListQuota: quota.QpsListQuota,
+                          QpsImageQuota: quota.QpsImageQuota, QpsVideoQuota: quota.QpsVideoQuota,
+                          RateBurst: quota.RateBurst, QpsBurst: quota.QpsBurst, RefillInterval: quota.RefillInterval,
+                          Weight: quota.Weight, Priority: quota.Priority}, ""
+}
+
+
+// 配额模板WEB页面，GET展示所有模板，POST新建或修改模板
+func handlerTemplates(w http.ResponseWriter, r *http.Request) {
+    if r.Method == "POST" {
+        r.ParseForm()
+        user := r.Form.Get("Admin")
+        passwd := r.Form.Get("Password")
+        value, find := admins[user]
+        errMsg := ""
+        if user == "" || passwd == "" {
+            errMsg = "用户名或密码不能为空"
+        } else if !find || value != passwd {
+            errMsg = "非管理员登陆"
+        } else if r.Form.Get("Op") == "Delete" {
+            var serr error
+            if errMsg, serr = delTemplate(r.Form.Get("Name"), user, r.Form.Get("Reason")); serr != nil {
+                errMsg = saveErrMsg(serr)
+            }
+        } else {
+            t, err := getTemplateFromForm(r.Form.Get("Name"), r.Form)
+            if err != "" {
+                errMsg = err
+            } else if p, n, serr := setTemplate(t, user, r.Form.Get("Reason")); serr != nil {
+                errMsg = saveErrMsg(serr)
+            } else if p != nil {
+                // 大幅降低被引用模板的配额需要另一位管理员审批
+                errMsg = pendingMsg(p, nil)
+            } else {
+                errMsg = fmt.Sprintf("OK! %d个限速桶已同步", n)
+            }
+        }
+        if errMsg == "" {
+            errMsg = "OK!"
+        }
+        fmt.Fprintf(w, `<html><head><meta charset=utf-8><meta http-equiv="refresh" content="2; url=http://%s:%s/templates" /></head><body>%s</body></html>`, Host, HttpPort, html.EscapeString(errMsg))
+        return
+    }
+
+    lines := ""
+    for _, t := range sortedTemplates() {
+        lines += fmt.Sprintf(`<tr><td>%s</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td><td>%d/%d/%d/%d/%d/%d</td><td>%d/%d/%d</td><td>%d/%d</td><td>%s</td></tr>`,
+                             html.EscapeString(t.Name), t.RateQuota, t.ConnQuota, t.QpsQuota, t.RatePerConn,
+                             t.QpsGetQuota, t.QpsPutQuota, t.QpsDeleteQuota, t.QpsListQuota, t.QpsImageQuota, t.QpsVideoQuota,
+                             t.RateBurst, t.QpsBurst, t.RefillInterval, t.Weight, t.Priority,
+                             html.EscapeString(strings.Join(templateBuckets(t.Name, -1), " ")))
+    }
+    fmt.Fprintf(w, `<html><head><meta charset=utf-8></head><body>
+        <p><b>配额模板</b></p>
+        <table border=1>
+        <tr><td>Name</td><td>Rate(B/s)</td><td>Connection</td><td>QPS</td><td>RatePerConn(B/s)</td><td>GET/PUT/DELETE/LIST/IMAGE/VIDEO QPS</td><td>BurstRate/BurstQPS/RefillInterval</td><td>Weight/Priority</td><td>Buckets</td></tr>
+        %s
+        </table>
+        <form action="/templates" method="post">
+        <table border=0>
+        <tr><td>Name</td><td><input type="text" name="Name"></input></td></tr>
+        <tr><td>Rate(B/s)</td><td><input type="text" name="Rate"></input></td></tr>
+        <tr><td>QPS</td><td><input type="text" name="QPS"></input></td></tr>
+        <tr><td>Connection</td><td><input type="text" name="Connection"></input></td></tr>
+        <tr><td>RatePerConn(B/s)</td><td><input type="text" name="RatePerConn"></input></td></tr>
+        %s
+        <tr><td>Reason</td><td><input type="text" name="Reason"></input></td></tr>
+        <tr><td>Admin</td><td><input type="text" name="Admin"></input></td></tr>
+        <tr><td>Password</td><td><input type="password" name="Password"></input></td></tr>
+        <tr><td><input type="submit" value="Set"></input></td><td><input type="submit" name="Op" value="Delete"></input></td></tr>
+        </table>
+        </form></body></html>`, lines, optionalInputs("", 1))
+}
+
+
+/* 配额模板API:
+** GET    /api/v1/templates         列出所有模板
+** GET    /api/v1/templates/{name}  获取模板
+** PUT    /api/v1/templates/{name}  新建或修改模板，并同步引用该模板的桶；大幅降低被引用模板的配额时返回202和待审批变更
+** GET    /api/v1/templates/{name}/history  获取模板的修改历史，最新的在前
+** DELETE /api/v1/templates/{name}  删除模板，仍被引用时失败，可以携带?reason=
+*/
+func apiTemplates(w http.ResponseWriter, r *http.Request) {
+    name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/templates"), "/")
+    history := strings.HasSuffix(name, "/history")
+    if history {
+        name = strings.TrimSuffix(name, "/history")
+    }
+    if strings.Contains(name, "/") || (history && name == "") {
+        writeApiError(w, http.StatusNotFound, "NotFound", "unknown api path " + r.URL.Path)
+        return
+    }
+
+    admin, ok := apiAuth(w, r)
+    if !ok {
+        return
+    }
+
+    if name == "" {
+        if r.Method != "GET" {
+            writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET is allowed")
+            return
+        }
+        writeJson(w, http.StatusOK, sortedTemplates())
+        return
+    }
+
+    if history {
+        if r.Method != "GET" {
+            writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET is allowed")
+            return
+        }
+        writeJson(w, http.StatusOK, getTemplateHistory(name))
+        return
+    }
+
+    switch r.Method {
+    case "GET":
+        t, ok := getTemplate(name)
+        if !ok {
+            writeApiError(w, http.StatusNotFound, "NoSuchTemplate", "no template " + name)
+            return
+        }
+        writeJson(w, http.StatusOK, t)
+
+    case "PUT":
+        form, errMsg := getFormFromBody(r)
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "MalformedJson", errMsg)
+            return
+        }
+        t, errMsg := getTemplateFromForm(name, form)
+        if errMsg != "" {
+            writeApiError(w, http.StatusBadRequest, "InvalidArgument", errMsg)
+            return
+        }
+        p, _, err := setTemplate(t, admin, form.Get("Reason"))
+        if err != nil {
+            writeSaveError(w, err)
+            return
+        }
+        if p != nil {
+            writeJson(w, http.StatusAccepted, p)
+            return
+        }
+        writeJson(w, http.StatusOK, t)
+
+    case "DELETE":
+        if _, ok := getTemplate(name); !ok {
+            writeApiError(w, http.StatusNotFound, "NoSuchTemplate", "no template " + name)
+            return
+        }
+        errMsg, err := delTemplate(name, admin, r.URL.Query().Get("reason"))
+        if errMsg != "" {
+            writeApiError(w, http.StatusConflict, "TemplateInUse", errMsg)
+            return
+        }
+        if err != nil {
+            writeSaveError(w, err)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        writeApiError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET, PUT and DELETE are allowed")
+    }
+}
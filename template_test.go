@@ -0,0 +1,163 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+
+func TestTemplateApplyAndSync(t *testing.T) {
+    defer func() {
+        clearBucket("tpl-a")
+        clearBucket("tpl-b")
+        delTemplate("std", "alice", "")
+    }()
+
+    if _, _, err := setTemplate(&QuotaTemplate{Name: "std", RateQuota: 1000, ConnQuota: 10, QpsQuota: 100}, "alice", "init"); err != nil {
+        t.Fatal(err)
+    }
+    w := callApi(apiBucketQuota, "alice", "PUT", "/api/v1/buckets/tpl-a/quota/limit", `{"Template": "std", "QPS": 5}`)
+    if w.Code != http.StatusOK {
+        t.Fatalf("PUT with template: got %d %s", w.Code, w.Body.String())
+    }
+    setQuota("tpl-b", 1, &BucketQuota{Template: "std"}, "alice", "")
+
+    e := effectiveQuota("tpl-a", 1)
+    if e.RateQuota != 1000 || e.ConnQuota != 10 || e.QpsQuota != 5 {
+        t.Fatalf("effective quota with override is %+v", e)
+    }
+
+    _, n, err := setTemplate(&QuotaTemplate{Name: "std", RateQuota: 2000, ConnQuota: 10, QpsQuota: 100}, "bob", "raise")
+    if err != nil || n != 2 {
+        t.Fatalf("setTemplate synced %d buckets, err %v", n, err)
+    }
+    if e = effectiveQuota("tpl-b", 1); e.RateQuota != 2000 {
+        t.Fatalf("bucket did not follow template: %+v", e)
+    }
+    if quotaRegistry.Get("tpl-b", 1).RateQuota != 0 {
+        t.Fatal("template values were written into the stored quota")
+    }
+
+    // 模板不存在时不能引用
+    w = callApi(apiBucketQuota, "alice", "PUT", "/api/v1/buckets/tpl-a/quota/limit", `{"Template": "nope"}`)
+    if w.Code != http.StatusBadRequest {
+        t.Fatalf("unknown template: got %d", w.Code)
+    }
+
+    errMsg, err := delTemplate("std", "alice", "")
+    if errMsg == "" || err != nil || !strings.Contains(errMsg, "tpl-a,tpl-b") {
+        t.Fatalf("delete of referenced template: %q %v", errMsg, err)
+    }
+    delQuota("tpl-a", 1, "alice", "")
+    delQuota("tpl-b", 1, "alice", "")
+    if errMsg, err = delTemplate("std", "alice", "cleanup"); errMsg != "" || err != nil {
+        t.Fatalf("delete template: %q %v", errMsg, err)
+    }
+    if _, ok := getTemplate("std"); ok {
+        t.Fatal("template still exists")
+    }
+}
+
+
+// 模板的修改和删除记录在修改历史中，且不出现在桶的历史中，也不能作为桶回滚的目标
+func TestTemplateHistory(t *testing.T) {
+    setTemplate(&QuotaTemplate{Name: "hist-tpl", RateQuota: 1}, "alice", "v1")
+    setTemplate(&QuotaTemplate{Name: "hist-tpl", RateQuota: 2}, "bob", "v2")
+    delTemplate("hist-tpl", "alice", "gone")
+
+    revs := getTemplateHistory("hist-tpl")
+    if len(revs) != 3 {
+        t.Fatalf("got %d template revisions, want 3", len(revs))
+    }
+    if revs[0].Reason != "gone" || revs[0].NewTemplate != nil || revs[0].OldTemplate.RateQuota != 2 {
+        t.Fatalf("delete revision is %+v", revs[0])
+    }
+    if revs[1].Admin != "bob" || revs[1].OldTemplate.RateQuota != 1 || revs[1].NewTemplate.RateQuota != 2 {
+        t.Fatalf("update revision is %+v", revs[1])
+    }
+    if revs[2].OldTemplate != nil {
+        t.Fatalf("create revision is %+v", revs[2])
+    }
+    if len(getBucketHistory("")) != 0 {
+        t.Fatal("template revisions leaked into bucket history")
+    }
+    if _, errMsg, _ := rollbackQuota("", revs[1].Revision, "alice", ""); errMsg == "" {
+        t.Fatal("rollback to a template revision should fail")
+    }
+
+    w := callApi(apiTemplates, "alice", "GET", "/api/v1/templates/hist-tpl/history", "")
+    var list []*QuotaRevision
+    if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 3 {
+        t.Fatalf("history api: %d %s", w.Code, w.Body.String())
+    }
+}
+
+
+// 持久化失败时模板回滚，并向管理员报告错误
+func TestTemplateSaveFailure(t *testing.T) {
+    setTemplate(&QuotaTemplate{Name: "fail-tpl", RateQuota: 1}, "alice", "")
+    defer delTemplate("fail-tpl", "alice", "")
+    revs := len(getTemplateHistory("fail-tpl"))
+
+    restore := breakFile(t, templateFile + ".new")
+    if _, _, err := setTemplate(&QuotaTemplate{Name: "fail-tpl", RateQuota: 2}, "alice", ""); err == nil {
+        t.Fatal("setTemplate should fail")
+    }
+    if _, _, err := setTemplate(&QuotaTemplate{Name: "fail-new", RateQuota: 2}, "alice", ""); err == nil {
+        t.Fatal("setTemplate should fail")
+    }
+    if errMsg, err := delTemplate("fail-tpl", "alice", ""); errMsg != "" || err == nil {
+        t.Fatal("delTemplate should fail")
+    }
+    w := callApi(apiTemplates, "alice", "PUT", "/api/v1/templates/fail-tpl", `{"Rate": 3, "Connection": 0, "QPS": 0, "RatePerConn": 0}`)
+    if w.Code != http.StatusInternalServerError {
+        t.Fatalf("PUT: got %d %s", w.Code, w.Body.String())
+    }
+    restore()
+
+    if tpl, ok := getTemplate("fail-tpl"); !ok || tpl.RateQuota != 1 {
+        t.Fatalf("template not rolled back: %+v", tpl)
+    }
+    if _, ok := getTemplate("fail-new"); ok {
+        t.Fatal("failed new template is still in memory")
+    }
+    if len(getTemplateHistory("fail-tpl")) != revs {
+        t.Fatal("failed change was recorded in history")
+    }
+
+    // 磁盘上的模板与内存一致
+    loadTemplates()
+    if tpl, ok := getTemplate("fail-tpl"); !ok || tpl.RateQuota != 1 {
+        t.Fatalf("reloaded template is %+v", tpl)
+    }
+}
+
+
+func TestApiTemplates(t *testing.T) {
+    body := `{"Rate": 100, "Connection": 1, "QPS": 2, "RatePerConn": 3, "Reason": "new"}`
+    w := callApi(apiTemplates, "alice", "PUT", "/api/v1/templates/api-tpl", body)
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"RatePerConn":3`) {
+        t.Fatalf("PUT: got %d %s", w.Code, w.Body.String())
+    }
+    w = callApi(apiTemplates, "bob", "GET", "/api/v1/templates", "")
+    if !strings.Contains(w.Body.String(), `"Name":"api-tpl"`) {
+        t.Fatalf("list: %s", w.Body.String())
+    }
+    w = callApi(apiTemplates, "bob", "DELETE", "/api/v1/templates/api-tpl?reason=unused", "")
+    if w.Code != http.StatusNoContent {
+        t.Fatalf("DELETE: got %d %s", w.Code, w.Body.String())
+    }
+    if revs := getTemplateHistory("api-tpl"); len(revs) != 2 || revs[0].Reason != "unused" || revs[1].Reason != "new" {
+        t.Fatalf("template history is wrong: %+v", revs)
+    }
+    w = callApi(apiTemplates, "bob", "GET", "/api/v1/templates/api-tpl", "")
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("GET deleted: got %d", w.Code)
+    }
+    w = callApi(apiTemplates, "bob", "GET", "/api/v1/templates//history", "")
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("empty name history: got %d", w.Code)
+    }
+}
@@ -0,0 +1,125 @@
+/* webhook限速后端，供自研Nginx模块之外的代理接入:
+** 1. GET Endpoint返回限速信息列表(格式同Nginx的/?list)和ETag，携带If-None-Match时没有变化返回304
+** 2. POST Endpoint下发限速信息，请求体为LimitBulk，响应为LimitBulkResponse，协议同Nginx的/?bulk
+** 3. 单个桶的设置、删除也通过POST下发，Set或Delete中只有一个桶，BaseETag为空表示不检查版本
+** 所有请求携带X-Limit-Node头，值为节点地址，便于一个webhook服务多个节点
+*/
+
+package main
+
+import (
+    "fmt"
+    "bytes"
+    "net/http"
+    "encoding/json"
+)
+
+
+type webhookEnforcer struct {
+    node  string
+    url   string
+}
+
+
+func (e *webhookEnforcer) Kind() (string) {
+    return BACKEND_WEBHOOK
+}
+
+
+func (e *webhookEnforcer) List(etag string) ([]LimitData, string, bool, bool) {
+    req, err := http.NewRequest("GET", e.url, nil)
+    if err != nil {
+        GErrorLogger.Error("Get webhook %s limit list failed: %s", e.url, err)
+        return nil, "", false, false
+    }
+    req.Header.Set("X-Limit-Node", e.node)
+    if etag != "" {
+        req.Header.Set("If-None-Match", etag)
+    }
+    res, err := nginxClient.Do(req)
+    if err != nil {
+        GErrorLogger.Error("Get webhook %s limit list failed: %s", e.url, err)
+        recordSyncError(e.node, fmt.Sprintf("get webhook limit list failed: %s", err))
+        return nil, "", false, false
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode == http.StatusNotModified {
+        return nil, etag, true, true
+    }
+    if res.StatusCode != http.StatusOK {
+        GErrorLogger.Error("Get webhook %s limit list failed, status %d", e.url, res.StatusCode)
+        recordSyncError(e.node, fmt.Sprintf("get webhook limit list failed: status %d", res.StatusCode))
+        return nil, "", false, false
+    }
+    list := make([]LimitData, 0)
+    if err = json.NewDecoder(res.Body).Decode(&list); err != nil {
+        GErrorLogger.Error("Json decode webhook %s limit list failed: %s", e.url, err)
+        recordSyncError(e.node, fmt.Sprintf("decode webhook limit list failed: %s", err))
+        return nil, "", false, false
+    }
+    return list, res.Header.Get("ETag"), false, true
+}
+
+
+func (e *webhookEnforcer) Bulk(bulk *LimitBulk) (*LimitBulkResponse, int, error) {
+    buf, err := json.Marshal(bulk)
+    if err != nil {
+        return nil, 0, err
+    }
+    req, err := http.NewRequest("POST", e.url, bytes.NewReader(buf))
+    if err != nil {
+        return nil, 0, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Limit-Node", e.node)
+    if bulk.BaseETag != "" {
+        req.Header.Set("If-Match", bulk.BaseETag)
+    }
+    GLogger.Info("Post webhook %s for %s: full %v, %d set, %d delete", e.url, e.node, bulk.Full, len(bulk.Set), len(bulk.Delete))
+    res, err := nginxClient.Do(req)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer res.Body.Close()
+    if res.StatusCode != http.StatusOK {
+        return nil, res.StatusCode, checkNginxResponse(res)
+    }
+    resp := new(LimitBulkResponse)
+    if err = json.NewDecoder(res.Body).Decode(resp); err != nil {
+        return nil, res.StatusCode, err
+    }
+    return resp, res.StatusCode, nil
+}
+
+
+// 下发只包含一个桶的请求@bulk，检查该桶的结果
+func (e *webhookEnforcer) one(bucket string, bulk *LimitBulk) (int, error) {
+    resp, status, err := e.Bulk(bulk)
+    if err == nil {
+        err = fmt.Errorf("no result")
+        for _, r := range resp.Results {
+            if r.BucketName == bucket {
+                err = nil
+                if r.Status != "ok" {
+                    err = fmt.Errorf("%s", r.Status)
+                }
+            }
+        }
+    }
+    if err != nil {
+        GErrorLogger.Error("Webhook %s update bucket %s for %s failed: %s", e.url, bucket, e.node, err)
+        recordSyncError(e.node, fmt.Sprintf("webhook update bucket %s failed: %s", bucket, err))
+    }
+    return status, err
+}
+
+
+func (e *webhookEnforcer) Set(l LimitData) (int, error) {
+    return e.one(l.BucketName, &LimitBulk{Set: []LimitData{l}})
+}
+
+
+func (e *webhookEnforcer) Delete(bucket string) (int, error) {
+    return e.one(bucket, &LimitBulk{Delete: []string{bucket}})
+}